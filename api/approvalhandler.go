@@ -0,0 +1,486 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/approvalapp"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// 需要审批的 role 的授权流程
+// 给用户赋予需要审批的 role 或者用户自己申请 role 时，生成待审批的授权申请
+// 拥有 role 上配置的审批 role 的用户审批，通过后才赋予，审批人不能是申请人或被授权的用户
+
+// 设置 role 是否需要审批以及审批人
+type RoleApprovalForm struct {
+	RequireApproval bool     `json:"requireApproval"`
+	ApproverRoleIds []string `json:"approverRoleIds"` // 为空时只有管理员可以审批
+}
+
+func SetRoleApprovalHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form RoleApprovalForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	id := c.Param("id")
+	if roleapp.CanNotModifyThis(roleapp.IdTypeRole, id) || id == roleapp.DefaultRoleId() {
+		returnfun.Return403Json(c, "无权做此修改")
+		return
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeRole, id) {
+		return
+	}
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeRole, form.ApproverRoleIds) {
+		return
+	}
+
+	dbrole, err := roleapp.GetRoleById(db, id, false)
+	middleware.StopExec(err)
+	if dbrole == nil || dbrole.Deleted {
+		returnfun.ReturnErrJson(c, "无指定id的role或role被删除")
+		return
+	}
+
+	if form.ApproverRoleIds == nil {
+		form.ApproverRoleIds = []string{}
+	}
+	form.ApproverRoleIds = util.UniqueStringArray(form.ApproverRoleIds)
+
+	curUser, _ := GetCurUserAndRole(c)
+	after := *dbrole
+	after.RequireApproval, after.ApproverRoleIds = form.RequireApproval, form.ApproverRoleIds
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name":            dbrole.Name,
+		"requireApproval": form.RequireApproval,
+		"approverRoleIds": form.ApproverRoleIds,
+	}).SetDiff(dbrole, &after)
+
+	update := bson.M{
+		"$set": bson.M{
+			"requireApproval": form.RequireApproval,
+			"approverRoleIds": form.ApproverRoleIds,
+			"updateT":         util.GetCurTime(),
+		},
+	}
+	err = db.C(roleapp.CollectionNameRole).UpdateId(id, update)
+	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleApproval, ophistory.TargetRole, id)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 给用户赋予 roles，需要审批的 role 生成授权申请，其余直接赋予
+// 只有需要审批的 role 时，返回的 uwr 为 nil
+func grantRolesToUser(c *gin.Context, db *dbandmq.Ds, curUser *userapp.User, userId string, roleIds []string, expireT int64, reason string) (*userandrole.UserWithRole, []*approvalapp.GrantRequest, error) {
+	roles, err := roleapp.GetRolesByRoleIds(db, roleIds, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	approvalRoles := make(map[string]*roleapp.Role)
+	for _, role := range roles {
+		if role.RequireApproval {
+			approvalRoles[role.Id] = role
+		}
+	}
+
+	var directIds []string
+	for _, rid := range roleIds {
+		if approvalRoles[rid] == nil {
+			directIds = append(directIds, rid)
+		}
+	}
+
+	var uwr *userandrole.UserWithRole
+	if len(directIds) > 0 || len(approvalRoles) == 0 {
+		uwr, err = addRoleToUser(c, db, curUser, userId, directIds, expireT)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(approvalRoles) == 0 {
+		return uwr, nil, nil
+	}
+
+	user, err := userapp.GetUserById(db, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	userName := ""
+	if user != nil {
+		userName = user.Name
+	}
+
+	var reqs []*approvalapp.GrantRequest
+	for _, role := range approvalRoles {
+		req := &approvalapp.GrantRequest{
+			TenantId:        tenantapp.NormalizeId(curUser.TenantId),
+			UserId:          userId,
+			UserName:        userName,
+			RoleId:          role.Id,
+			RoleName:        role.Name,
+			ApproverRoleIds: role.ApproverRoleIds,
+			Source:          approvalapp.SourceGrant,
+			RequesterId:     curUser.Id,
+			RequesterName:   curUser.Name,
+			Reason:          reason,
+			ExpireT:         expireT,
+		}
+		opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+			"userId":   userId,
+			"userName": userName,
+			"roleId":   role.Id,
+			"roleName": role.Name,
+		})
+		req, err = approvalapp.CreateGrantRequest(db, req, opHis)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ophistory.Record(db, opHis, ophistory.CodeGrantRequestCreate, ophistory.TargetUser, userId)
+		if err != nil {
+			return nil, nil, err
+		}
+		reqs = append(reqs, req)
+	}
+
+	return uwr, reqs, nil
+}
+
+// 需要审批的 role 只能通过授权申请赋予给用户，不能赋予部门或用户组
+func checkNoApprovalRoles(c *gin.Context, db *dbandmq.Ds, roleIds []string) bool {
+	roles, err := roleapp.GetRolesByRoleIds(db, roleIds, false)
+	middleware.StopExec(err)
+	for _, role := range roles {
+		if role.RequireApproval {
+			returnfun.Return403Json(c, fmt.Sprintf("role[%s]需要审批，只能通过授权申请赋予用户", role.Name))
+			return false
+		}
+	}
+	return true
+}
+
+// 用户自己申请 role
+type AccessRequestForm struct {
+	RoleId  string `json:"roleId" binding:"required"`
+	Reason  string `json:"reason" binding:"required"`
+	ExpireT int64  `json:"expireT"` // 希望的到期时间，unix 秒，非必输
+}
+
+func CreateAccessRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form AccessRequestForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	err = approvalapp.CheckExpireT(form.ExpireT, time.Now().Unix())
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	role, err := roleapp.GetRoleById(db, form.RoleId, false)
+	middleware.StopExec(err)
+	if role == nil || role.Deleted || !roleDataVisible(c, role.TenantId, role.DataFrom) {
+		returnfun.ReturnErrJson(c, "无指定id的role或role被删除")
+		return
+	}
+
+	curUser, curRoles := GetCurUserAndRole(c)
+	for _, cr := range curRoles {
+		if cr.Id == role.Id {
+			returnfun.ReturnErrJson(c, "已拥有该role")
+			return
+		}
+	}
+
+	req := &approvalapp.GrantRequest{
+		TenantId:        GetCurTenantId(c),
+		UserId:          curUser.Id,
+		UserName:        curUser.Name,
+		RoleId:          role.Id,
+		RoleName:        role.Name,
+		ApproverRoleIds: role.ApproverRoleIds,
+		Source:          approvalapp.SourceApply,
+		RequesterId:     curUser.Id,
+		RequesterName:   curUser.Name,
+		Reason:          form.Reason,
+		ExpireT:         form.ExpireT,
+	}
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"userId":   curUser.Id,
+		"userName": curUser.Name,
+		"roleId":   role.Id,
+		"roleName": role.Name,
+	})
+	req, err = approvalapp.CreateGrantRequest(db, req, opHis)
+	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeGrantRequestCreate, ophistory.TargetUser, curUser.Id)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, req)
+	return
+}
+
+// 读取自己的授权申请，包含别人给自己发起的
+func QueryMyAccessRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	curUser, _ := GetCurUserAndRole(c)
+	query := bson.M{
+		"userId": curUser.Id,
+	}
+	status := c.Query("status")
+	if status != "" {
+		query["status"] = status
+	}
+
+	queryGrantRequests(c, ds, query)
+}
+
+// 审批授权申请
+type ReviewGrantRequestForm struct {
+	Comment string `json:"comment"`
+}
+
+func ApproveGrantRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	reviewGrantRequest(c, ds, true)
+}
+
+func RejectGrantRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	reviewGrantRequest(c, ds, false)
+}
+
+func reviewGrantRequest(c *gin.Context, ds *dbandmq.Ds, approve bool) {
+	var form ReviewGrantRequestForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	req := getTenantGrantRequest(c, db, c.Param("id"))
+	if req == nil {
+		return
+	}
+
+	curUser, curRoles := GetCurUserAndRole(c)
+	if !req.CanReview(curUser.Id, getRoleIds(curRoles), isAdminUser(curUser, curRoles)) {
+		returnfun.Return403Json(c, "无权审批该申请")
+		return
+	}
+
+	status := approvalapp.StatusRejected
+	if approve {
+		// 申请期间到期时间可能已经过了，只能拒绝
+		err = approvalapp.CheckExpireT(req.ExpireT, time.Now().Unix())
+		if err != nil {
+			returnfun.ReturnErrJson(c, err.Error())
+			return
+		}
+		status = approvalapp.StatusApproved
+	}
+
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"requestId": req.Id,
+		"userId":    req.UserId,
+		"userName":  req.UserName,
+		"roleName":  req.RoleName,
+		"comment":   form.Comment,
+	})
+	// 申请已经处理，审计日志写入失败时仍然赋予 role，最后返回错误
+	err = approvalapp.CloseGrantRequest(db, req, status, curUser.Id, curUser.Name, form.Comment, opHis)
+	if err != nil && !errors.Is(err, ophistory.ErrRecordFailed) {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+	recordErr := err
+	err = ophistory.Record(db, opHis, approvalapp.StatusCode(status), ophistory.TargetUser, req.UserId)
+	if recordErr == nil {
+		recordErr = err
+	}
+
+	if approve {
+		_, err = addRoleToUser(c, db, curUser, req.UserId, []string{req.RoleId}, req.ExpireT)
+		if err != nil && !errors.Is(err, ophistory.ErrRecordFailed) {
+			// 没有赋予 role，申请恢复为待审批，可以重新审批
+			if rErr := approvalapp.ReopenGrantRequest(db, req); rErr != nil {
+				err = fmt.Errorf("%s; %s", err.Error(), rErr.Error())
+			}
+			failHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+				"requestId": req.Id,
+				"roleName":  req.RoleName,
+				"error":     err.Error(),
+			})
+			if rErr := ophistory.Record(db, failHis, ophistory.CodeGrantRequestGrantError, ophistory.TargetGrantRequest, req.Id); rErr != nil {
+				err = fmt.Errorf("%s; %w", err.Error(), rErr)
+			}
+			middleware.StopExec(err)
+		}
+		if recordErr == nil {
+			recordErr = err
+		}
+	}
+	middleware.StopExec(recordErr)
+
+	returnfun.ReturnOKJson(c, req)
+	return
+}
+
+// 申请人撤回授权申请
+func CancelGrantRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	req := getTenantGrantRequest(c, db, c.Param("id"))
+	if req == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	if curUser.Id != req.RequesterId {
+		returnfun.Return403Json(c, "只有申请人可以撤回申请")
+		return
+	}
+
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"requestId": req.Id, "roleName": req.RoleName})
+	err := approvalapp.CloseGrantRequest(db, req, approvalapp.StatusCanceled, "", "", "", opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+	err = ophistory.Record(db, opHis, ophistory.CodeGrantRequestCanceled, ophistory.TargetUser, req.UserId)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, req)
+	return
+}
+
+// 读取授权申请明细
+// 申请人、被授权的用户、审批人以及管理范围包含被授权用户的人可以读取
+func GetGrantRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	req := getTenantGrantRequest(c, db, c.Param("id"))
+	if req == nil {
+		return
+	}
+
+	curUser, curRoles := GetCurUserAndRole(c)
+	if curUser.Id != req.UserId && curUser.Id != req.RequesterId &&
+		!req.CanReview(curUser.Id, getRoleIds(curRoles), isAdminUser(curUser, curRoles)) {
+		if !checkUserScope(c, db, req.UserId) {
+			return
+		}
+	}
+
+	returnfun.ReturnOKJson(c, req)
+	return
+}
+
+// 待当前用户审批的申请
+func QueryTodoGrantRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	curUser, curRoles := GetCurUserAndRole(c)
+	query := bson.M{
+		"tenantId":    GetCurTenantId(c),
+		"status":      approvalapp.StatusPending,
+		"userId":      bson.M{"$ne": curUser.Id},
+		"requesterId": bson.M{"$ne": curUser.Id},
+	}
+	if !isAdminUser(curUser, curRoles) {
+		query["approverRoleIds"] = bson.M{"$in": getRoleIds(curRoles)}
+	}
+
+	queryGrantRequests(c, ds, query)
+}
+
+// 搜索授权申请，只能看到自己管理范围内用户的申请
+// 支持 status / userId / roleId / requesterId 过滤
+func QueryGrantRequestHandler(c *gin.Context, ds *dbandmq.Ds) {
+	query := bson.M{
+		"tenantId": GetCurTenantId(c),
+	}
+	for _, key := range []string{"status", "userId", "roleId", "requesterId"} {
+		val := c.Query(key)
+		if val != "" {
+			query[key] = val
+		}
+	}
+
+	db := ds.CopyDs()
+	scopeUserIds, err := getManageScope(c, db).UserIds(db)
+	db.Close()
+	middleware.StopExec(err)
+	if scopeUserIds != nil {
+		if userId, ok := query["userId"]; ok {
+			query["userId"] = bson.M{"$in": scopeUserIds, "$eq": userId}
+		} else {
+			query["userId"] = bson.M{"$in": scopeUserIds}
+		}
+	}
+
+	queryGrantRequests(c, ds, query)
+}
+
+func queryGrantRequests(c *gin.Context, ds *dbandmq.Ds, query bson.M) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	Q := db.C(approvalapp.CollectionNameGrantRequest).Find(query)
+	total, err := Q.Count()
+	middleware.StopExec(err)
+
+	var reqs []*approvalapp.GrantRequest
+	page, size, skip := util.GetPageAndSize(c)
+	err = Q.Sort("-_id").Skip(skip).Limit(size).All(&reqs)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"data":  reqs,
+	}
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 读取当前租户的授权申请，不存在时返回 nil
+func getTenantGrantRequest(c *gin.Context, db *dbandmq.Ds, id string) *approvalapp.GrantRequest {
+	req, err := approvalapp.GetGrantRequestById(db, id)
+	middleware.StopExec(err)
+	if req == nil || tenantapp.NormalizeId(req.TenantId) != GetCurTenantId(c) {
+		returnfun.ReturnErrJson(c, approvalapp.ErrRequestNotFound.Error())
+		return nil
+	}
+	return req
+}
+
+func getRoleIds(roles []*roleapp.Role) []string {
+	var roleIds []string
+	for _, role := range roles {
+		roleIds = append(roleIds, role.Id)
+	}
+	return roleIds
+}
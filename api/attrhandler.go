@@ -0,0 +1,225 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// 管理员新建用户自定义属性
+type CreateAttrDefForm struct {
+	Key        string `json:"key" binding:"required"`
+	Name       string `json:"name" binding:"required"`
+	Type       string `json:"type" binding:"required"` // STRING / NUMBER / BOOL / DATE
+	Required   bool   `json:"required"`
+	Unique     bool   `json:"unique"`
+	Visibility string `json:"visibility"` // PUBLIC / PRIVATE，默认 PRIVATE
+}
+
+func CreateAttrDefHandler(c *gin.Context, uo *UserOption) {
+	// 自定义属性对所有租户生效，只有超级管理员可以维护
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	var form CreateAttrDefForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	def := &userapp.AttrDef{
+		Id:         util.GenerateDataId(),
+		Key:        strings.TrimSpace(form.Key),
+		Name:       strings.TrimSpace(form.Name),
+		Type:       strings.ToUpper(form.Type),
+		Required:   form.Required,
+		Unique:     form.Unique,
+		Visibility: strings.ToUpper(form.Visibility),
+		CreateT:    util.GetCurTime(),
+	}
+	def.UpdateT = def.CreateT
+	if def.Visibility == "" {
+		def.Visibility = userapp.AttrVisibilityPrivate
+	}
+	if err = def.Check(); err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	err = userapp.CreateAttrDef(db, def)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, def)
+	return
+}
+
+// 修改属性定义，key 和 type 不可修改
+type UpdateAttrDefForm struct {
+	Name       string `json:"name" binding:"required"`
+	Required   bool   `json:"required"`
+	Unique     bool   `json:"unique"`
+	Visibility string `json:"visibility" binding:"required"`
+}
+
+func UpdateAttrDefHandler(c *gin.Context, uo *UserOption) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	var form UpdateAttrDefForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	old, err := userapp.GetAttrDefById(db, c.Param("id"))
+	middleware.StopExec(err)
+	if old == nil {
+		returnfun.ReturnErrJson(c, "无指定id的属性")
+		return
+	}
+
+	def := *old
+	def.Name = strings.TrimSpace(form.Name)
+	def.Required = form.Required
+	def.Unique = form.Unique
+	def.Visibility = strings.ToUpper(form.Visibility)
+	if err = def.Check(); err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	// 改为必填时，已有用户可能没有该属性，只影响之后的修改
+	err = userapp.UpdateAttrDef(db, old, &def)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, &def)
+	return
+}
+
+// 删除属性定义，所有用户的该属性值同时被删除
+func DeleteAttrDefHandler(c *gin.Context, uo *UserOption) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	def, err := userapp.GetAttrDefById(db, c.Param("id"))
+	middleware.StopExec(err)
+	if def == nil {
+		returnfun.ReturnErrJson(c, "无指定id的属性")
+		return
+	}
+
+	err = userapp.DeleteAttrDef(db, def)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 读取所有属性定义
+func GetAttrDefsHandler(c *gin.Context, uo *UserOption) {
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	defs, err := userapp.GetAllAttrDefs(db)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, defs)
+	return
+}
+
+// 新建用户时校验传递的属性，包括必填和唯一
+func checkCreateAttributes(db *dbandmq.Ds, tenantId string, attrs map[string]interface{}) (map[string]interface{}, error) {
+	defs, err := userapp.GetAllAttrDefs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	vals, err := userapp.ValidateAttributes(defs, nil, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = userapp.CheckUniqueAttributes(db, defs, tenantId, "", vals)
+	if err != nil {
+		return nil, err
+	}
+
+	return vals, nil
+}
+
+// 搜索用户时，查询参数 attr.<key>=value 按属性值精确匹配
+func attrQuery(c *gin.Context, db *dbandmq.Ds) (bson.M, error) {
+	const prefix = "attr."
+
+	q := bson.M{}
+	var defs []*userapp.AttrDef
+	for param, vals := range c.Request.URL.Query() {
+		if !strings.HasPrefix(param, prefix) || len(vals) == 0 {
+			continue
+		}
+
+		if defs == nil {
+			var err error
+			defs, err = userapp.GetAllAttrDefs(db)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		key := strings.TrimPrefix(param, prefix)
+		var def *userapp.AttrDef
+		for _, d := range defs {
+			if d.Key == key {
+				def = d
+				break
+			}
+		}
+		if def == nil {
+			return nil, fmt.Errorf("未定义的属性[%s]", key)
+		}
+
+		val, err := def.ParseQuery(vals[0])
+		if err != nil {
+			return nil, err
+		}
+		q[userapp.AttrProfileField(key)] = val
+	}
+
+	return q, nil
+}
+
+// 返回给下游服务的用户信息，只保留公开的属性
+func publicUserView(db *dbandmq.Ds, user *userapp.User) (*userapp.User, error) {
+	if user == nil || len(user.Attributes) == 0 {
+		return user, nil
+	}
+
+	defs, err := userapp.GetAllAttrDefs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *user
+	u.Attributes = userapp.FilterAttributes(defs, user.Attributes, userapp.AttrVisibilityPublic)
+	return &u, nil
+}
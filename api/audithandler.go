@@ -0,0 +1,118 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+)
+
+// 审计日志接口的配置
+type AuditOption struct {
+	Ds         *dbandmq.Ds
+	Checkpoint *ophistory.CheckpointOption // 检查点导出配置，未配置时为 nil
+}
+
+// 搜索审计日志，只能读取当前租户的记录
+// 可以按操作人、被操作的数据、操作类型、请求 id、ip 和时间范围过滤
+// 返回的 text 是按语言渲染的操作描述
+func QueryAuditLogHandler(c *gin.Context, ds *dbandmq.Ds) {
+	query := bson.M{
+		"tenantId": GetCurTenantId(c),
+	}
+
+	// actorId 是操作人的 userId
+	keys := map[string]string{
+		"actorId":    "userId",
+		"targetType": "targetType",
+		"targetId":   "targetId",
+		"code":       "code",
+		"reqId":      "reqId",
+		"ip":         "ip",
+	}
+	for key, field := range keys {
+		val := c.Query(key)
+		if val != "" {
+			query[field] = val
+		}
+	}
+
+	// 时间范围，unix 秒
+	tRange := bson.M{}
+	for key, op := range map[string]string{"startT": "$gte", "endT": "$lte"} {
+		val := c.Query(key)
+		if val == "" {
+			continue
+		}
+		t, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			returnfun.ReturnErrJson(c, key+"必须是unix时间戳")
+			return
+		}
+		tRange[op] = t
+	}
+	if len(tRange) > 0 {
+		query["t.seconds"] = tRange
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	Q := db.C(ophistory.CollectionNameAuditLog).Find(query)
+	total, err := Q.Count()
+	middleware.StopExec(err)
+
+	var logs []*ophistory.OperationHistory
+	page, size, skip := util.GetPageAndSize(c)
+	err = Q.Sort("-t.seconds").Skip(skip).Limit(size).All(&logs)
+	middleware.StopExec(err)
+
+	// 按语言渲染操作描述，lang 参数优先，其次是 Accept-Language，默认中文
+	lang := ophistory.ParseLang(c.DefaultQuery("lang", c.GetHeader("Accept-Language")))
+	for _, log := range logs {
+		log.Text = ophistory.Render(log, lang)
+	}
+
+	retData := gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"data":  logs,
+	}
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 校验审计日志的哈希链，哈希链包含所有租户的记录，仅超级管理员可以操作
+// 配置了检查点导出时，同时校验检查点文件
+func VerifyAuditLogHandler(c *gin.Context, ao *AuditOption) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	db := ao.Ds.CopyDs()
+	defer db.Close()
+
+	ret, err := ophistory.VerifyChain(db)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"chain": ret,
+	}
+	if ao.Checkpoint != nil {
+		breaks, err := ophistory.VerifyCheckpoints(db, ao.Checkpoint)
+		middleware.StopExec(err)
+		if len(breaks) > 0 {
+			ret.OK = false
+		}
+		retData["checkpointBreaks"] = breaks
+	}
+
+	retData["ok"] = ret.OK
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
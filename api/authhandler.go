@@ -26,6 +26,12 @@ func AuthHandler(c *gin.Context, uo *UserOption) {
 
 	result := auth.AuthLoginAndRole(option, form.Token, form.Method, form.Path, "")
 
+	// 只返回公开的自定义属性
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+	result.User, err = publicUserView(db, result.User)
+	middleware.StopExec(err)
+
 	returnfun.ReturnOKJson(c, result)
 	return
 }
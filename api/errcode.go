@@ -7,4 +7,7 @@ var NameExistErr = errors.New("数据已存在")
 const (
 	ErrCodeNameExist = 4000 // 名字比如 item role loginid 已经存在
 	ErrCodeXiaoChengXuNeedProfile = 2000 // 小程序登录时，需要进一步的 profile 信息
+	ErrCodeTooManyRequest = 4290 // 请求过于频繁，被限流
+	ErrCodeAuthConflict = 4090 // 绑定的登录方式已属于其他账户
+	ErrCodeImportConflict = 4091 // 导入的数据与现有数据冲突
 )
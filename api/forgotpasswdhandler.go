@@ -0,0 +1,228 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/userapp"
+	"strings"
+	"time"
+)
+
+// 找回密码时，同一个手机号或邮箱在窗口期内最多可以尝试验证的次数
+const (
+	ForgotPasswdVerifyLimit  = 5
+	ForgotPasswdVerifyWindow = 10 * time.Minute
+)
+
+// 找回密码配置
+type ForgotPasswdOption struct {
+	// 同一个 ip 在 RateWindow 内最多请求 RateLimit 次
+	RateLimit  int
+	RateWindow time.Duration
+}
+
+// 新密码使用的密码策略，开放注册时与注册的策略一致
+func passwdPolicy(uo *UserOption) *userapp.PasswdPolicy {
+	if uo.RegOpt != nil && uo.RegOpt.Passwd != nil {
+		return uo.RegOpt.Passwd
+	}
+	return userapp.DefaultPasswdPolicy
+}
+
+// 找回密码，给用户绑定的手机号或邮箱发送验证码
+// 无论账户是否存在，都返回相同的结果，避免被用来探测账户
+type ForgotPasswdForm struct {
+	Phone string `json:"phone"`
+	Email string `json:"email"`
+}
+
+func ForgotPasswdHandler(c *gin.Context, uo *UserOption) {
+	fo := uo.ForgotOpt
+	if fo == nil {
+		returnfun.ReturnErrJson(c, "未开放找回密码")
+		return
+	}
+
+	var form ForgotPasswdForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	form.Phone = strings.TrimSpace(form.Phone)
+	form.Email = strings.ToLower(strings.TrimSpace(form.Email))
+	if form.Phone == "" && form.Email == "" {
+		returnfun.ReturnErrJson(c, "缺少手机号或邮箱")
+		return
+	}
+	if form.Email != "" && uo.EmailOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置邮件发送")
+		return
+	}
+	if form.Phone != "" && uo.PhoneOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置短信发送")
+		return
+	}
+
+	if rateLimited(c, uo, "FORGOT:"+c.ClientIP(), fo.RateLimit, fo.RateWindow) {
+		return
+	}
+
+	target := form.Phone
+	if target == "" {
+		target = form.Email
+	}
+	if rateLimited(c, uo, "FORGOT:"+target, 1, EmailCodeInterval) {
+		return
+	}
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	user, err := forgotPasswdUser(db, GetCurTenantId(c), form.Phone, form.Email)
+	middleware.StopExec(err)
+
+	reqId := middleware.GetReqId(c)
+	if user == nil {
+		Logger.Infof(reqId, "找回密码时，[%s]无对应的可用账户，不发送验证码", target)
+	} else if form.Phone != "" {
+		err = uo.PhoneOpt.SendSms(form.Phone, "", "")
+		if err != nil {
+			Logger.Errorf(reqId, "找回密码时，给phone[%s]发送验证码失败, %s", form.Phone, err.Error())
+		}
+	} else {
+		err = uo.EmailOpt.SendCode(form.Email, "找回密码")
+		if err != nil {
+			Logger.Errorf(reqId, "找回密码时，给email[%s]发送验证码失败, %s", form.Email, err.Error())
+		}
+	}
+
+	returnfun.ReturnOKJson(c, "如果账户存在，验证码已发送")
+	return
+}
+
+// 读取可以找回密码的账户，必须有账户密码登录方式且未被封禁
+func forgotPasswdUser(db *dbandmq.Ds, tenantId, phone, email string) (*userapp.User, error) {
+	var user *userapp.User
+	var err error
+	if phone != "" {
+		user, err = userapp.GetUserByPhone(db, tenantId, phone)
+	} else {
+		user, err = userapp.GetUserByEmail(db, tenantId, email)
+	}
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	if user.IsBanned() {
+		return nil, nil
+	}
+
+	fullUser, err := userapp.GetUserFullInfoById(db, user.Id)
+	if err != nil || fullUser == nil {
+		return nil, err
+	}
+	if fullUser.IdPasswd == nil {
+		return nil, nil
+	}
+	if email != "" && (fullUser.EmailAuth == nil || !fullUser.EmailAuth.Verified) {
+		return nil, nil
+	}
+
+	return fullUser, nil
+}
+
+// 使用验证码设置新密码，成功后用户所有的登录 token 都失效
+type ResetPasswdByCodeForm struct {
+	Phone  string `json:"phone"`
+	Email  string `json:"email"`
+	Code   string `json:"code" binding:"required"`
+	Passwd string `json:"passwd" binding:"required"`
+}
+
+func ResetPasswdByCodeHandler(c *gin.Context, uo *UserOption) {
+	fo := uo.ForgotOpt
+	if fo == nil {
+		returnfun.ReturnErrJson(c, "未开放找回密码")
+		return
+	}
+
+	var form ResetPasswdByCodeForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	form.Phone = strings.TrimSpace(form.Phone)
+	form.Email = strings.ToLower(strings.TrimSpace(form.Email))
+	if form.Phone == "" && form.Email == "" {
+		returnfun.ReturnErrJson(c, "缺少手机号或邮箱")
+		return
+	}
+	if form.Email != "" && uo.EmailOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置邮件发送")
+		return
+	}
+	if form.Phone != "" && uo.PhoneOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置短信发送")
+		return
+	}
+
+	err = passwdPolicy(uo).Check(form.Passwd)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	if rateLimited(c, uo, "FORGOTRESET:"+c.ClientIP(), fo.RateLimit, fo.RateWindow) {
+		return
+	}
+
+	target := form.Phone
+	if target == "" {
+		target = form.Email
+	}
+	// 限制同一个手机号或邮箱的尝试次数，防止暴力猜测验证码
+	if rateLimited(c, uo, "FORGOTRESET:"+target, ForgotPasswdVerifyLimit, ForgotPasswdVerifyWindow) {
+		return
+	}
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	// 验证码错误和账户不存在返回相同的提示
+	const errMsg = "验证码错误或已失效"
+
+	user, err := forgotPasswdUser(db, GetCurTenantId(c), form.Phone, form.Email)
+	middleware.StopExec(err)
+	if user == nil {
+		returnfun.ReturnErrJson(c, errMsg)
+		return
+	}
+
+	var ok bool
+	if form.Phone != "" {
+		ok, err = uo.PhoneOpt.CheckSms(form.Phone, form.Code)
+	} else {
+		ok, err = uo.EmailOpt.CheckCode(form.Email, form.Code)
+	}
+	if err != nil || !ok {
+		returnfun.ReturnErrJson(c, errMsg)
+		return
+	}
+
+	ulpa, err := userapp.GetIdPasswdAuthByUserId(db, user.Id)
+	middleware.StopExec(err)
+	if ulpa == nil {
+		returnfun.ReturnErrJson(c, errMsg)
+		return
+	}
+
+	// 所有登录方式的 token 都失效
+	opHis := newOpHistory(c, user, "").SetParams(ophistory.Params{"target": target})
+	_, err = userapp.ResetIdPasswd(db, uo.R, passwdPolicy(uo), ulpa.TenantId, ulpa.LoginId, form.Passwd, false, ophistory.CodeUserForgotPasswd, opHis)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
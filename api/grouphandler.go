@@ -0,0 +1,297 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/groupapp"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 用户组管理
+// 给用户组赋予 roles 后，组成员自动拥有这些 roles，移出组后立即失去
+
+// 新建用户组
+type CreateGroupForm struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+func CreateGroupHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form CreateGroupForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": form.Name})
+	g, err := groupapp.CreateGroup(db, GetCurTenantId(c), form.Name, form.Description, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, g)
+	return
+}
+
+// 修改用户组名字和描述
+func UpdateGroupHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form CreateGroupForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	g := getTenantGroup(c, db, c.Param("id"))
+	if g == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": form.Name, "description": form.Description})
+	err = groupapp.UpdateGroupInfo(db, g, form.Name, form.Description, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, g)
+	return
+}
+
+// 删除用户组，成员通过本组获得的 roles 同时失效
+func DeleteGroupHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	g := getTenantGroup(c, db, c.Param("id"))
+	if g == nil {
+		return
+	}
+
+	userIds, err := groupapp.GetGroupMemberUserIds(db, g.Id)
+	middleware.StopExec(err)
+
+	err = groupapp.DeleteGroup(db, g)
+	middleware.StopExec(err)
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"groupId": g.Id, "name": g.Name})
+	err = ophistory.Record(db, opHis, ophistory.CodeGroupDelete, ophistory.TargetGroup, g.Id)
+	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeGroupDelete, ophistory.TargetUser, userIds...)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 读取用户组明细，包含 roles 和成员 userIds
+func GetGroupHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	g := getTenantGroup(c, db, c.Param("id"))
+	if g == nil {
+		return
+	}
+
+	roles, err := roleapp.GetRolesByRoleIds(db, g.RoleIds, false)
+	middleware.StopExec(err)
+
+	userIds, err := groupapp.GetGroupMemberUserIds(db, g.Id)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"group":   g,
+		"roles":   roles,
+		"members": userIds,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 搜索用户组，支持 name 部分匹配
+func QueryGroupHandler(c *gin.Context, ds *dbandmq.Ds) {
+	query := bson.M{
+		"tenantId": GetCurTenantId(c),
+	}
+
+	name := c.Query("name")
+	if name != "" {
+		query["name"] = bson.M{"$regex": name}
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	Q := db.C(groupapp.CollectionNameGroup).Find(query)
+	total, err := Q.Count()
+	middleware.StopExec(err)
+
+	var gs []*groupapp.Group
+	page, size, skip := util.GetPageAndSize(c)
+	err = Q.Sort("name").Skip(skip).Limit(size).All(&gs)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"data":  gs,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 添加、移除组成员
+// 加入用户组相当于给用户赋予组的 roles，与给用户赋予 role 的规则相同
+type GroupMembersForm struct {
+	UserIds []string `json:"userIds" binding:"required"`
+}
+
+func AddGroupMembersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateGroupMembers(c, ds, true)
+}
+
+func RemoveGroupMembersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateGroupMembers(c, ds, false)
+}
+
+func updateGroupMembers(c *gin.Context, ds *dbandmq.Ds, add bool) {
+	var form GroupMembersForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	g := getTenantGroup(c, db, c.Param("id"))
+	if g == nil {
+		return
+	}
+
+	curUser, curRoles := GetCurUserAndRole(c)
+	if !shareRoleIsValid(curUser, curRoles, g.RoleIds) {
+		returnfun.Return403Json(c, "当前用户无权操作某些权限")
+		return
+	}
+
+	for _, userId := range form.UserIds {
+		if !checkUserScope(c, db, userId) {
+			return
+		}
+	}
+
+	code := ophistory.CodeGroupAddMembers
+	if add {
+		err = groupapp.AddGroupMembers(db, g.Id, form.UserIds)
+	} else {
+		code = ophistory.CodeGroupDelMembers
+		err = groupapp.RemoveGroupMembers(db, g.Id, form.UserIds)
+	}
+	middleware.StopExec(err)
+
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"groupId": g.Id, "name": g.Name})
+	err = ophistory.Record(db, opHis, code, ophistory.TargetUser, form.UserIds...)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 给用户组添加、移除 roles
+type GroupRolesForm struct {
+	RoleIds []string `json:"roleIds" binding:"required"`
+}
+
+func AddRolesToGroupHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateGroupRoles(c, ds, true)
+}
+
+func RemoveRolesFromGroupHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateGroupRoles(c, ds, false)
+}
+
+func updateGroupRoles(c *gin.Context, ds *dbandmq.Ds, add bool) {
+	var form GroupRolesForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	g := getTenantGroup(c, db, c.Param("id"))
+	if g == nil {
+		return
+	}
+
+	// 与给用户赋予 role 的规则相同
+	curUser, curRoles := GetCurUserAndRole(c)
+	if !shareRoleIsValid(curUser, curRoles, form.RoleIds) {
+		returnfun.Return403Json(c, "当前用户无权操作某些权限")
+		return
+	}
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeRole, form.RoleIds) {
+		return
+	}
+	if add && !checkNoApprovalRoles(c, db, form.RoleIds) {
+		return
+	}
+
+	opHis := newOpHistory(c, curUser, "").SetParams(roleChangeParams(g.Name, form.RoleIds, add))
+	err = groupapp.UpdateGroupRoles(db, g, form.RoleIds, add, opHis)
+	middleware.StopExec(err)
+
+	g, err = groupapp.GetGroupById(db, g.Id)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, g)
+	return
+}
+
+// 读取用户所属的用户组
+func GetUserGroupsHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	userId := c.Param("id")
+	if !checkUserScope(c, db, userId) {
+		return
+	}
+
+	gs, err := groupapp.GetUserGroups(db, userId)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, gs)
+	return
+}
+
+// 读取当前租户的用户组，不存在时返回 nil
+func getTenantGroup(c *gin.Context, db *dbandmq.Ds, id string) *groupapp.Group {
+	g, err := groupapp.GetGroupById(db, id)
+	middleware.StopExec(err)
+	if g == nil || tenantapp.NormalizeId(g.TenantId) != GetCurTenantId(c) {
+		returnfun.ReturnErrJson(c, groupapp.ErrGroupNotFound.Error())
+		return nil
+	}
+	return g
+}
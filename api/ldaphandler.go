@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ldapapp"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+)
+
+// ldap / active directory 账户密码登录
+type LoginLdapForm struct {
+	LoginId  string `json:"loginId" binding:"required"`
+	Passwd   string `json:"passwd" binding:"required"`
+	Platform string `json:"platform" binding:"required"`
+}
+
+func LoginByLdapHandler(c *gin.Context, uo *UserOption) {
+	if uo.LdapOpt == nil {
+		returnfun.ReturnErrJson(c, "未启用 ldap 登录")
+		return
+	}
+
+	var form LoginLdapForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	if !userapp.IsValidPlatform(form.Platform) {
+		returnfun.ReturnErrJson(c, "错误的 platform 值")
+		return
+	}
+
+	// 到目录中验证账户密码
+	lu, err := uo.LdapOpt.Authenticate(form.LoginId, form.Passwd)
+	if err == ldapapp.ErrInvalidCredentials {
+		returnfun.Return401Json(c, "账户或密码错误")
+		return
+	}
+	middleware.StopExec(err)
+
+	// 首次登录时新建账户，否则同步目录中的信息
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+	user, token, err := userapp.SaveLdapLogin(db, uo.R, GetCurTenantId(c), lu)
+	middleware.StopExec(err)
+
+	if user.IsBanned() {
+		_ = userapp.DeleteToken(uo.R, user.Id, userapp.LoginTypeLdap)
+		returnfun.Return401Json(c, "banned")
+		return
+	}
+	user.Platform = form.Platform
+	user.LoginType = userapp.LoginTypeLdap
+
+	// 按照目录分组同步用户的角色，映射中不存在的 role name 会被忽略
+	roleNames := uo.LdapOpt.MapGroupsToRoleNames(lu.Groups)
+	_, err = userandrole.SyncLdapRoles(db, GetCurTenantId(c), user.Id, user.Name, roleNames)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		// 角色已经修改，审计日志写入失败时不能继续登录
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		// 同步失败不影响登录，使用已有的角色
+		Logger.Errorf(middleware.GetReqId(c), "同步ldap用户[%s]的角色失败, %s", user.Id, err.Error())
+	}
+
+	// 读取用户角色信息
+	uwr, err := userandrole.GetUserRoles(db, user.Id)
+	middleware.StopExec(err)
+
+	// 保存登录信息
+	lh := &ophistory.LoginHistory{
+		Id:        util.GenerateDataId(),
+		TenantId:  GetCurTenantId(c),
+		UserId:    user.Id,
+		UserName:  user.Name,
+		LoginType: userapp.LoginTypeLdap,
+		Platform:  form.Platform,
+		Ip:        c.Request.RemoteAddr,
+		UserAgent: c.Request.UserAgent(),
+		LoginT:    util.GetCurTime(),
+	}
+	_ = ophistory.SaveLoginHistory(db, lh)
+
+	retData := gin.H{
+		"token":        token,
+		"user":         user,
+		"roles":        roleapp.RemoveDefaultRole(uwr.Roles),
+		"childrenRole": uwr.ChildrenRole,
+		"menus":        uwr.Menus,
+		"buttons":      uwr.Buttons,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
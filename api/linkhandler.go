@@ -0,0 +1,319 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/userapp"
+	"github.com/silenceper/wechat"
+	"github.com/silenceper/wechat/oauth"
+	"regexp"
+	"strings"
+)
+
+// 用户读取自己已绑定的登录方式
+func GetMyLinkedAuthsHandler(c *gin.Context, uo *UserOption) {
+	curUser, _ := GetCurUserAndRole(c)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	auths, err := userapp.GetUserLinkedAuths(db, curUser.Id)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, auths)
+	return
+}
+
+// 已登录用户证明自己拥有另一个登录凭证后，把它绑定到当前账户上
+// 凭证已属于其他账户时，不做任何修改，返回冲突，需要管理员合并账户
+type LinkAuthForm struct {
+	LoginType string `json:"loginType" binding:"required"` // IDPASSWD / PHONE / WECHAT / EMAIL
+
+	LoginId string `json:"loginId"` // IDPASSWD
+	Passwd  string `json:"passwd"`  // IDPASSWD
+
+	Phone string `json:"phone"` // PHONE
+	Email string `json:"email"` // EMAIL
+	Code  string `json:"code"`  // PHONE / EMAIL 的验证码，或者微信授权 code
+
+	Platform string `json:"platform"` // WECHAT，H5 / APP
+}
+
+func LinkAuthHandler(c *gin.Context, uo *UserOption) {
+	var form LinkAuthForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	form.LoginType = strings.ToUpper(form.LoginType)
+
+	curUser, _ := GetCurUserAndRole(c)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	auths, err := userapp.GetUserLinkedAuths(db, curUser.Id)
+	middleware.StopExec(err)
+
+	// 账户密码、手机号、邮箱每个账户只能绑定一个，微信不同平台的 openId 不同，可以绑定多个
+	if form.LoginType != userapp.LoginTypeWeChat {
+		for _, a := range auths {
+			if a.LoginType == form.LoginType {
+				returnfun.ReturnErrJson(c, userapp.ErrAuthExist.Error())
+				return
+			}
+		}
+	}
+
+	var value string
+	var owner *userapp.User
+	var link func() error
+
+	switch form.LoginType {
+	case userapp.LoginTypePhone:
+		if uo.PhoneOpt == nil {
+			returnfun.ReturnErrJson(c, "未配置短信发送")
+			return
+		}
+		if form.Phone == "" || form.Code == "" {
+			returnfun.ReturnErrJson(c, "缺少手机号或验证码")
+			return
+		}
+		ok, err := uo.PhoneOpt.CheckSms(form.Phone, form.Code)
+		middleware.StopExec(err)
+		if !ok {
+			returnfun.ReturnErrJson(c, "验证码错误")
+			return
+		}
+		value = form.Phone
+		owner, err = userapp.GetUserByPhone(db, GetCurTenantId(c), form.Phone)
+		middleware.StopExec(err)
+		link = func() error {
+			_, err := userapp.AddPhoneAuth(db, GetCurTenantId(c), curUser.Id, form.Phone, true)
+			return err
+		}
+
+	case userapp.LoginTypeEmail:
+		if uo.EmailOpt == nil {
+			returnfun.ReturnErrJson(c, "未配置邮件发送")
+			return
+		}
+		if form.Email == "" || form.Code == "" {
+			returnfun.ReturnErrJson(c, "缺少邮箱或验证码")
+			return
+		}
+		ok, err := uo.EmailOpt.CheckCode(form.Email, form.Code)
+		middleware.StopExec(err)
+		if !ok {
+			returnfun.ReturnErrJson(c, "验证码错误")
+			return
+		}
+		value = strings.ToLower(strings.TrimSpace(form.Email))
+		owner, err = userapp.GetUserByEmail(db, GetCurTenantId(c), value)
+		middleware.StopExec(err)
+		link = func() error {
+			_, err := userapp.AddEmailAuth(db, GetCurTenantId(c), curUser.Id, value, true)
+			return err
+		}
+
+	case userapp.LoginTypeIdPasswd:
+		form.LoginId = strings.TrimSpace(form.LoginId)
+		if form.LoginId == "" || form.Passwd == "" {
+			returnfun.ReturnErrJson(c, "缺少账户或密码")
+			return
+		}
+		value = form.LoginId
+		owner, err = userapp.GetUserByLoginId(db, GetCurTenantId(c), form.LoginId)
+		middleware.StopExec(err)
+		if owner != nil {
+			// 已存在的账户，必须密码正确才能证明所有权
+			if !userapp.CheckIdPasswd(owner.IdPasswd, form.Passwd) {
+				returnfun.Return401Json(c, "账户或密码错误")
+				return
+			}
+		} else {
+			// 不存在的账户，相当于给当前用户新建一个账户密码登录方式
+			var pattern *regexp.Regexp
+			if uo.RegOpt != nil {
+				pattern = uo.RegOpt.LoginIdPattern
+			}
+			if err = userapp.CheckLoginId(pattern, form.LoginId); err != nil {
+				returnfun.ReturnErrJson(c, err.Error())
+				return
+			}
+			if err = passwdPolicy(uo).Check(form.Passwd); err != nil {
+				returnfun.ReturnErrJson(c, err.Error())
+				return
+			}
+		}
+		link = func() error {
+			_, err := userapp.AddIdPasswdAuth(db, GetCurTenantId(c), curUser.Id, form.LoginId, form.Passwd, curUser.Avatar, true, false)
+			return err
+		}
+
+	case userapp.LoginTypeWeChat:
+		if form.Code == "" {
+			returnfun.ReturnErrJson(c, "缺少微信授权 code")
+			return
+		}
+		platform := strings.ToUpper(form.Platform)
+		wxInfo, err := getWeChatUserInfo(uo, platform, form.Code)
+		if err != nil {
+			Logger.Errorf(middleware.GetReqId(c), "绑定微信时，读取微信用户信息失败, %s", err.Error())
+			returnfun.ReturnErrJson(c, err.Error())
+			return
+		}
+		value = wxInfo.OpenID
+		owner, err = userapp.GetUserByOpenId(db, GetCurTenantId(c), wxInfo.OpenID)
+		middleware.StopExec(err)
+		link = func() error {
+			_, err := userapp.AddWeChatAuth(db, GetCurTenantId(c), curUser.Id, platform, wxInfo)
+			return err
+		}
+
+	default:
+		returnfun.ReturnErrJson(c, "不支持绑定该类型的登录方式")
+		return
+	}
+
+	// 锁定凭证，避免并发绑定到不同账户
+	lockKey := "LINK:" + form.LoginType + ":" + value
+	lockVal, ok := dbandmq.AcquireLock(uo.R, lockKey, dbandmq.DEFAULT_LOCK_ACQUIRE_TIMEOUT, dbandmq.DEFAULT_LOCK_KEY_TIMEOUT)
+	if !ok {
+		returnfun.ReturnErrJson(c, "锁定数据失败")
+		return
+	}
+	defer dbandmq.ReleaseLock(uo.R, lockKey, lockVal)
+
+	if owner != nil {
+		if owner.Id == curUser.Id {
+			returnfun.ReturnErrJson(c, "当前账户已绑定该登录方式")
+			return
+		}
+
+		opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+			"loginType": form.LoginType,
+			"value":     value,
+			"ownerId":   owner.Id,
+		})
+		err = ophistory.Record(db, opHis, ophistory.CodeUserLinkConflict, ophistory.TargetUser, curUser.Id)
+		middleware.StopExec(err)
+
+		returnfun.ReturnJson(c, 409, ErrCodeAuthConflict, userapp.ErrAuthConflict.Error(), gin.H{"loginType": form.LoginType})
+		return
+	}
+
+	err = link()
+	if err != nil {
+		// 唯一索引冲突，说明并发时被其他账户绑定了
+		Logger.Errorf(middleware.GetReqId(c), "用户[%s]绑定登录方式[%s][%s]失败, %s", curUser.Id, form.LoginType, value, err.Error())
+		returnfun.ReturnJson(c, 409, ErrCodeAuthConflict, userapp.ErrAuthConflict.Error(), gin.H{"loginType": form.LoginType})
+		return
+	}
+
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"loginType": form.LoginType, "value": value})
+	err = ophistory.Record(db, opHis, ophistory.CodeUserLink, ophistory.TargetUser, curUser.Id)
+	middleware.StopExec(err)
+
+	auths, err = userapp.GetUserLinkedAuths(db, curUser.Id)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, auths)
+	return
+}
+
+// 解绑自己的某个登录方式，至少要保留一种可以登录的方式
+type UnlinkAuthForm struct {
+	LoginType string `json:"loginType" binding:"required"`
+	Id        string `json:"id" binding:"required"` // 已绑定登录方式的 id，从读取已绑定列表接口获取
+}
+
+func UnlinkAuthHandler(c *gin.Context, uo *UserOption) {
+	var form UnlinkAuthForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	form.LoginType = strings.ToUpper(form.LoginType)
+
+	curUser, _ := GetCurUserAndRole(c)
+
+	lockKey := "LINK:USER:" + curUser.Id
+	lockVal, ok := dbandmq.AcquireLock(uo.R, lockKey, dbandmq.DEFAULT_LOCK_ACQUIRE_TIMEOUT, dbandmq.DEFAULT_LOCK_KEY_TIMEOUT)
+	if !ok {
+		returnfun.ReturnErrJson(c, "锁定数据失败")
+		return
+	}
+	defer dbandmq.ReleaseLock(uo.R, lockKey, lockVal)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	auths, err := userapp.GetUserLinkedAuths(db, curUser.Id)
+	middleware.StopExec(err)
+
+	var target *userapp.LinkedAuth
+	for _, a := range auths {
+		if a.Id == form.Id && a.LoginType == form.LoginType {
+			target = a
+			break
+		}
+	}
+	if target == nil {
+		returnfun.ReturnErrJson(c, userapp.ErrAuthNotFound.Error())
+		return
+	}
+
+	if target.LoginType != userapp.LoginTypeEmail && userapp.CountLoginAuths(auths) <= 1 {
+		returnfun.ReturnErrJson(c, userapp.ErrAuthLastOne.Error())
+		return
+	}
+
+	err = userapp.RemoveAuth(db, curUser.Id, target.LoginType, target.Id)
+	middleware.StopExec(err)
+
+	// 使用被解绑方式登录的 token 失效
+	if target.LoginType != userapp.LoginTypeEmail {
+		_ = userapp.DeleteToken(uo.R, curUser.Id, target.LoginType)
+	}
+
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"loginType": target.LoginType, "value": target.Value})
+	err = ophistory.Record(db, opHis, ophistory.CodeUserUnlink, ophistory.TargetUser, curUser.Id)
+	middleware.StopExec(err)
+
+	auths, err = userapp.GetUserLinkedAuths(db, curUser.Id)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, auths)
+	return
+}
+
+// 使用网页或 app 授权 code 读取微信用户信息
+func getWeChatUserInfo(uo *UserOption, platform, code string) (*oauth.UserInfo, error) {
+	if platform != userapp.WeChatOptPlatformWeb && platform != userapp.WeChatOptPlatformApp {
+		return nil, fmt.Errorf("错误的 platform 值[%s]", platform)
+	}
+
+	wxOpt, ok := uo.WeChatOpt[platform]
+	if !ok {
+		return nil, fmt.Errorf("微信登录未配置相关信息")
+	}
+
+	cf := userapp.GetWeChatConfig(uo.R, platform, wxOpt)
+	wxOauth := wechat.NewWechat(cf).GetOauth()
+
+	resToken, err := wxOauth.GetUserAccessToken(code)
+	if err != nil {
+		return nil, err
+	}
+
+	wxInfo, err := wxOauth.GetUserInfo(resToken.AccessToken, resToken.OpenID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wxInfo, nil
+}
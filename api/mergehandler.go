@@ -0,0 +1,198 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+)
+
+// 管理员合并账户，把 source 账户的登录方式、roles、历史记录迁移到 target 账户，source 账户被禁用
+type MergeUserForm struct {
+	SourceId string `json:"sourceId" binding:"required"`
+	TargetId string `json:"targetId" binding:"required"`
+}
+
+// 预览合并结果，不修改数据
+func PreviewMergeUserHandler(c *gin.Context, uo *UserOption) {
+	var form MergeUserForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	mj, err := userandrole.PlanMerge(db, form.SourceId, form.TargetId)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+	if !mergeJournalInCurTenant(c, mj) {
+		returnfun.Return403Json(c, "无权管理该用户")
+		return
+	}
+
+	returnfun.ReturnOKJson(c, mj)
+	return
+}
+
+func MergeUserHandler(c *gin.Context, uo *UserOption) {
+	var form MergeUserForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	unlock, ok := lockMergeUsers(uo, form.SourceId, form.TargetId)
+	if !ok {
+		returnfun.ReturnErrJson(c, "锁定数据失败")
+		return
+	}
+	defer unlock()
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	mj, err := userandrole.PlanMerge(db, form.SourceId, form.TargetId)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+	if !mergeJournalInCurTenant(c, mj) {
+		returnfun.Return403Json(c, "无权管理该用户")
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	err = userandrole.ExecMerge(db, mj, newOpHistory(c, curUser, ""))
+	if err != nil && !errors.Is(err, ophistory.ErrRecordFailed) {
+		Logger.Errorf(middleware.GetReqId(c), "合并账户[%s]->[%s]失败，合并记录[%s], %s", form.SourceId, form.TargetId, mj.Id, err.Error())
+		returnfun.ReturnJson(c, 400, 400, "合并账户失败，可以根据合并记录撤销", gin.H{"id": mj.Id})
+		return
+	}
+
+	recordErr := err
+
+	// source 账户所有 token 失效
+	_ = userapp.DeleteUserTokens(uo.R, form.SourceId)
+	middleware.StopExec(recordErr)
+
+	Logger.Infof(middleware.GetReqId(c), "[%s]合并账户[%s]->[%s]成功，合并记录[%s]", curUser.Name, form.SourceId, form.TargetId, mj.Id)
+
+	returnfun.ReturnOKJson(c, mj)
+	return
+}
+
+// 撤销合并
+func UndoMergeUserHandler(c *gin.Context, uo *UserOption) {
+	id := c.Param("id")
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	mj, err := userandrole.GetMergeJournalById(db, id)
+	middleware.StopExec(err)
+	if mj == nil || !mergeJournalInCurTenant(c, mj) {
+		returnfun.ReturnErrJson(c, "无指定id的合并记录")
+		return
+	}
+
+	unlock, ok := lockMergeUsers(uo, mj.SourceId, mj.TargetId)
+	if !ok {
+		returnfun.ReturnErrJson(c, "锁定数据失败")
+		return
+	}
+	defer unlock()
+
+	// 加锁后重新读取，避免重复撤销
+	mj, err = userandrole.GetMergeJournalById(db, id)
+	middleware.StopExec(err)
+
+	curUser, _ := GetCurUserAndRole(c)
+	err = userandrole.UndoMerge(db, mj, newOpHistory(c, curUser, ""))
+	if err != nil && !errors.Is(err, ophistory.ErrRecordFailed) {
+		Logger.Errorf(middleware.GetReqId(c), "撤销合并记录[%s]失败, %s", id, err.Error())
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	// 移回 source 的登录方式，在 target 上对应的 token 失效
+	for _, a := range mj.MovedAuths {
+		_ = userapp.DeleteToken(uo.R, mj.TargetId, a.LoginType)
+	}
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, mj)
+	return
+}
+
+// 读取合并记录明细
+func GetMergeJournalHandler(c *gin.Context, uo *UserOption) {
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	mj, err := userandrole.GetMergeJournalById(db, c.Param("id"))
+	middleware.StopExec(err)
+	if mj != nil && !mergeJournalInCurTenant(c, mj) {
+		mj = nil
+	}
+
+	returnfun.ReturnOKJson(c, mj)
+	return
+}
+
+// 搜索合并记录，userid 参数可选，source 或 target 为该用户的记录
+func QueryMergeJournalHandler(c *gin.Context, uo *UserOption) {
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	page, size, _ := util.GetPageAndSize(c)
+	mjs, total, err := userandrole.QueryMergeJournal(db, GetCurTenantId(c), c.Query("userid"), page, size)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"data":  mjs,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 合并时同时锁定两个账户，按 id 排序加锁，避免死锁
+func lockMergeUsers(uo *UserOption, sourceId, targetId string) (func(), bool) {
+	ids := []string{sourceId, targetId}
+	if sourceId > targetId {
+		ids = []string{targetId, sourceId}
+	}
+
+	var vals []string
+	unlock := func() {
+		for i, val := range vals {
+			dbandmq.ReleaseLock(uo.R, "MERGE:"+ids[i], val)
+		}
+	}
+
+	for _, id := range ids {
+		val, ok := dbandmq.AcquireLock(uo.R, "MERGE:"+id, dbandmq.DEFAULT_LOCK_ACQUIRE_TIMEOUT, dbandmq.DEFAULT_LOCK_KEY_TIMEOUT)
+		if !ok {
+			unlock()
+			return nil, false
+		}
+		vals = append(vals, val)
+	}
+
+	return unlock, true
+}
+
+// 合并只能在同一个租户内进行，其他租户的合并记录视为不存在
+func mergeJournalInCurTenant(c *gin.Context, mj *userandrole.MergeJournal) bool {
+	return tenantapp.NormalizeId(mj.TenantId) == GetCurTenantId(c)
+}
@@ -0,0 +1,534 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/orgapp"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+)
+
+// 组织架构（部门）管理
+// 部门负责人只能管理自己负责的部门及其下级部门
+
+// 新建部门，parentId 为空时为顶级部门，只有不限制管理范围的管理员可以新建顶级部门
+type CreateOrgUnitForm struct {
+	Name     string `json:"name" binding:"required"`
+	ParentId string `json:"parentId"`
+}
+
+func CreateOrgUnitHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form CreateOrgUnitForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	scope := getManageScope(c, db)
+	if !scope.CanManageOrg(form.ParentId) {
+		returnfun.Return403Json(c, "无权在该部门下新建部门")
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": form.Name})
+	ou, err := orgapp.CreateOrgUnit(db, GetCurTenantId(c), form.Name, form.ParentId, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, ou)
+	return
+}
+
+// 部门改名
+type RenameOrgUnitForm struct {
+	Name string `json:"name" binding:"required"`
+}
+
+func RenameOrgUnitHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form RenameOrgUnitForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"oldName": ou.Name, "name": form.Name})
+	err = orgapp.RenameOrgUnit(db, ou, form.Name, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, ou)
+	return
+}
+
+// 移动部门，下级部门一起移动，parentId 为空时移动为顶级部门
+type MoveOrgUnitForm struct {
+	ParentId string `json:"parentId"`
+}
+
+func MoveOrgUnitHandler(c *gin.Context, ds *dbandmq.Ds, r *redis.Client) {
+	var form MoveOrgUnitForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	scope := getManageScope(c, db)
+	if !scope.CanManageOrg(form.ParentId) {
+		returnfun.Return403Json(c, "无权移动到该部门下")
+		return
+	}
+
+	// 同一个租户内的移动串行执行，避免并发移动时都通过循环检查后形成环
+	lockKey := "ORG:MOVE:" + ou.TenantId
+	lockVal, ok := dbandmq.AcquireLock(r, lockKey, dbandmq.DEFAULT_LOCK_ACQUIRE_TIMEOUT, dbandmq.DEFAULT_LOCK_KEY_TIMEOUT)
+	if !ok {
+		returnfun.ReturnErrJson(c, "锁定数据失败")
+		return
+	}
+	defer dbandmq.ReleaseLock(r, lockKey, lockVal)
+
+	// 加锁后重新读取，path 可能已经被其他移动修改
+	ou, err = orgapp.GetOrgUnitById(db, ou.Id)
+	middleware.StopExec(err)
+	if ou == nil {
+		returnfun.ReturnErrJson(c, orgapp.ErrOrgNotFound.Error())
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name":        ou.Name,
+		"oldParentId": ou.ParentId,
+		"parentId":    form.ParentId,
+	})
+	err = orgapp.MoveOrgUnit(db, ou, form.ParentId, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, ou)
+	return
+}
+
+// 删除部门及所有下级部门，成员关系同时删除
+func DeleteOrgUnitHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	ids, err := orgapp.DeleteOrgUnit(db, ou)
+	middleware.StopExec(err)
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"orgId": ou.Id, "name": ou.Name, "ids": ids})
+	recordErr := ophistory.Record(db, opHis, ophistory.CodeOrgDelete, ophistory.TargetOrg, ids...)
+	err = userandrole.RemoveManageOrgIds(db, ids, opHis)
+	middleware.StopExec(err)
+	middleware.StopExec(recordErr)
+
+	returnfun.ReturnOKJson(c, ids)
+	return
+}
+
+// 读取部门明细，包含直接下级部门
+func GetOrgUnitHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou, err := orgapp.GetOrgUnitById(db, c.Param("id"))
+	middleware.StopExec(err)
+	if ou == nil || !orgInCurTenant(c, ou) {
+		returnfun.ReturnErrJson(c, orgapp.ErrOrgNotFound.Error())
+		return
+	}
+
+	children, err := orgapp.GetChildOrgUnits(db, GetCurTenantId(c), ou.Id)
+	middleware.StopExec(err)
+
+	roles, err := roleapp.GetRolesByRoleIds(db, ou.RoleIds, false)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"unit":     ou,
+		"children": children,
+		"roles":    roles,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 读取下级部门列表，parentid 参数为空时读取顶级部门
+func GetChildOrgUnitsHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ous, err := orgapp.GetChildOrgUnits(db, GetCurTenantId(c), c.Query("parentid"))
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, ous)
+	return
+}
+
+// 添加、移除部门成员
+type OrgMembersForm struct {
+	UserIds []string `json:"userIds" binding:"required"`
+	Primary bool     `json:"primary"` // 添加时使用，为 true 时本部门成为这些用户的主部门
+}
+
+func AddOrgMembersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form OrgMembersForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	// 部门负责人只能添加管理范围内的用户，否则可以通过加入部门扩大自己的管理范围
+	scope := getManageScope(c, db)
+	for _, userId := range form.UserIds {
+		user, err := userapp.GetUserById(db, userId)
+		middleware.StopExec(err)
+		if user == nil || tenantapp.NormalizeId(user.TenantId) != GetCurTenantId(c) {
+			returnfun.ReturnErrJson(c, fmt.Sprintf("无指定id[%s]用户", userId))
+			return
+		}
+
+		ok, err := scope.CanManageUser(db, userId)
+		middleware.StopExec(err)
+		if !ok {
+			returnfun.Return403Json(c, fmt.Sprintf("无权管理用户[%s]", userId))
+			return
+		}
+	}
+
+	err = orgapp.AddOrgMembers(db, ou.Id, form.UserIds, form.Primary)
+	middleware.StopExec(err)
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"orgId": ou.Id, "name": ou.Name})
+	err = ophistory.Record(db, opHis, ophistory.CodeOrgAddMembers, ophistory.TargetUser, form.UserIds...)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+func RemoveOrgMembersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form OrgMembersForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	err = orgapp.RemoveOrgMembers(db, ou.Id, form.UserIds)
+	middleware.StopExec(err)
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"orgId": ou.Id, "name": ou.Name})
+	err = ophistory.Record(db, opHis, ophistory.CodeOrgDelMembers, ophistory.TargetUser, form.UserIds...)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 设置用户的主部门，用户必须已经是该部门成员
+type SetPrimaryOrgForm struct {
+	UserId string `json:"userId" binding:"required"`
+}
+
+func SetPrimaryOrgHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form SetPrimaryOrgForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	err = orgapp.SetPrimaryOrg(db, form.UserId, ou.Id)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"orgId": ou.Id, "name": ou.Name})
+	err = ophistory.Record(db, opHis, ophistory.CodeOrgPrimary, ophistory.TargetUser, form.UserId)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 读取部门成员，descendant=true 时包含所有下级部门的成员
+func GetOrgMembersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou, err := orgapp.GetOrgUnitById(db, c.Param("id"))
+	middleware.StopExec(err)
+	if ou == nil || !orgInCurTenant(c, ou) {
+		returnfun.ReturnErrJson(c, orgapp.ErrOrgNotFound.Error())
+		return
+	}
+
+	orgIds := []string{ou.Id}
+	if c.Query("descendant") == "true" {
+		orgIds, err = orgapp.SubtreeIds(db, orgIds)
+		middleware.StopExec(err)
+	}
+
+	userIds, err := orgapp.GetOrgMemberUserIds(db, orgIds)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, userIds)
+	return
+}
+
+// 读取用户所属的部门
+func GetUserOrgsHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ms, err := orgapp.GetUserOrgMembers(db, c.Param("id"))
+	middleware.StopExec(err)
+
+	var orgIds []string
+	for _, m := range ms {
+		orgIds = append(orgIds, m.OrgId)
+	}
+	ous, err := orgapp.GetOrgUnitsByIds(db, orgIds)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"members": ms,
+		"units":   ous,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 给部门添加、移除 roles，部门成员自动拥有这些 roles
+type OrgRolesForm struct {
+	RoleIds []string `json:"roleIds" binding:"required"`
+}
+
+func AddRolesToOrgHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateOrgRoles(c, ds, true)
+}
+
+func RemoveRolesFromOrgHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateOrgRoles(c, ds, false)
+}
+
+func updateOrgRoles(c *gin.Context, ds *dbandmq.Ds, add bool) {
+	var form OrgRolesForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	// 与给用户赋予 role 的规则相同
+	curUser, curRoles := GetCurUserAndRole(c)
+	if !shareRoleIsValid(curUser, curRoles, form.RoleIds) {
+		returnfun.Return403Json(c, "当前用户无权操作某些权限")
+		return
+	}
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeRole, form.RoleIds) {
+		return
+	}
+	if add && !checkNoApprovalRoles(c, db, form.RoleIds) {
+		return
+	}
+
+	opHis := newOpHistory(c, curUser, "").SetParams(roleChangeParams(ou.Name, form.RoleIds, add))
+	err = orgapp.UpdateOrgRoles(db, ou, form.RoleIds, add, opHis)
+	middleware.StopExec(err)
+
+	ou, err = orgapp.GetOrgUnitById(db, ou.Id)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, ou)
+	return
+}
+
+// 部门和用户组修改 roles 的操作参数，添加和移除使用同一个操作类型
+func roleChangeParams(name string, roleIds []string, add bool) ophistory.Params {
+	params := ophistory.Params{
+		"name":       name,
+		"addRoleIds": []string{},
+		"delRoleIds": []string{},
+	}
+	if add {
+		params["addRoleIds"] = roleIds
+	} else {
+		params["delRoleIds"] = roleIds
+	}
+	return params
+}
+
+// 设置、取消部门负责人，负责人可以管理本部门及下级部门的用户
+type OrgManagersForm struct {
+	UserIds []string `json:"userIds" binding:"required"`
+}
+
+func AddOrgManagersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateOrgManagers(c, ds, true)
+}
+
+func RemoveOrgManagersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateOrgManagers(c, ds, false)
+}
+
+func updateOrgManagers(c *gin.Context, ds *dbandmq.Ds, add bool) {
+	var form OrgManagersForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	ou := getScopedOrgUnit(c, db, c.Param("id"))
+	if ou == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "")
+	for _, userId := range form.UserIds {
+		if !checkUserTenant(c, db, userId) {
+			return
+		}
+	}
+	for _, userId := range form.UserIds {
+		err = userandrole.UpdateManageOrgs(db, GetCurTenantId(c), userId, []string{ou.Id}, add, opHis)
+		middleware.StopExec(err)
+	}
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 当前用户是否是系统管理员
+func isAdminUser(curUser *userapp.User, curRoles []*roleapp.Role) bool {
+	if curUser.Id == userapp.AdminUserId() {
+		return true
+	}
+	for _, role := range curRoles {
+		if role.Name == roleapp.AdminRoleName {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取当前用户的管理范围
+func getManageScope(c *gin.Context, db *dbandmq.Ds) *userandrole.ManageScope {
+	curUser, curRoles := GetCurUserAndRole(c)
+	scope, err := userandrole.GetManageScope(db, curUser.Id, isAdminUser(curUser, curRoles))
+	middleware.StopExec(err)
+	return scope
+}
+
+// 检查当前用户是否可以管理指定用户，不可以时返回 403
+func checkUserScope(c *gin.Context, db *dbandmq.Ds, userId string) bool {
+	if !checkUserTenant(c, db, userId) {
+		return false
+	}
+
+	scope := getManageScope(c, db)
+	ok, err := scope.CanManageUser(db, userId)
+	middleware.StopExec(err)
+	if !ok {
+		returnfun.Return403Json(c, "无权管理该用户")
+		return false
+	}
+	return true
+}
+
+// 读取当前用户管理范围内的部门，不存在或无权管理时返回 nil
+func getScopedOrgUnit(c *gin.Context, db *dbandmq.Ds, id string) *orgapp.OrgUnit {
+	ou, err := orgapp.GetOrgUnitById(db, id)
+	middleware.StopExec(err)
+	if ou == nil || !orgInCurTenant(c, ou) {
+		returnfun.ReturnErrJson(c, orgapp.ErrOrgNotFound.Error())
+		return nil
+	}
+
+	if !getManageScope(c, db).CanManageOrg(ou.Id) {
+		returnfun.Return403Json(c, "无权管理该部门")
+		return nil
+	}
+
+	return ou
+}
+
+// 其他租户的部门视为不存在
+func orgInCurTenant(c *gin.Context, ou *orgapp.OrgUnit) bool {
+	return tenantapp.NormalizeId(ou.TenantId) == GetCurTenantId(c)
+}
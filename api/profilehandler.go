@@ -0,0 +1,247 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/userapp"
+	"sort"
+	"strings"
+)
+
+// 用户资料修改配置
+// 用户拥有的角色在 Roles 中有配置时，可修改字段为匹配到的角色配置的并集
+// 否则使用 SelfFields / AdminFields
+// admin 角色可以修改所有字段
+type ProfileOption struct {
+	SelfFields  []string // 用户可以修改自己的字段
+	AdminFields []string // 管理员可以修改其他用户的字段
+	Roles       []*ProfileRoleOption
+}
+
+type ProfileRoleOption struct {
+	Role        string // role name
+	SelfFields  []string
+	AdminFields []string
+}
+
+// 未配置时，用户可以修改自己的 name 和 avatar，管理员可以修改所有字段
+var DefaultProfileOption = &ProfileOption{
+	SelfFields:  []string{userapp.ProfileFieldName, userapp.ProfileFieldAvatar},
+	AdminFields: userapp.AllProfileFields,
+}
+
+// 根据当前用户的角色，计算可以修改的字段
+func (po *ProfileOption) EditableFields(roles []*roleapp.Role, self bool) []string {
+	var fields []string
+	matched := false
+	for _, role := range roles {
+		if role.Name == roleapp.AdminRoleName {
+			return userapp.AllProfileFields
+		}
+		for _, pr := range po.Roles {
+			if pr.Role != role.Name {
+				continue
+			}
+			matched = true
+			if self {
+				fields = append(fields, pr.SelfFields...)
+			} else {
+				fields = append(fields, pr.AdminFields...)
+			}
+		}
+	}
+
+	if !matched {
+		if self {
+			fields = po.SelfFields
+		} else {
+			fields = po.AdminFields
+		}
+	}
+
+	if len(fields) > 1 {
+		fields = util.UniqueStringArray(fields)
+	}
+
+	return fields
+}
+
+func profileOption(uo *UserOption) *ProfileOption {
+	if uo.ProfileOpt != nil {
+		return uo.ProfileOpt
+	}
+	return DefaultProfileOption
+}
+
+// 修改用户资料，只修改传递了的字段
+type UpdateProfileForm struct {
+	Name   *string `json:"name"`
+	Avatar *string `json:"avatar"`
+
+	// 自定义属性，只修改传递了的属性，值为 null 或空字符串时删除该属性
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func (f *UpdateProfileForm) values() map[string]*string {
+	return map[string]*string{
+		userapp.ProfileFieldName:   f.Name,
+		userapp.ProfileFieldAvatar: f.Avatar,
+	}
+}
+
+// 用户修改自己的资料
+func UpdateMyProfileHandler(c *gin.Context, uo *UserOption) {
+	var form UpdateProfileForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	curUser, roles := GetCurUserAndRole(c)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	fields := profileOption(uo).EditableFields(roles, true)
+	updateProfile(c, db, curUser.Id, &form, fields, curUser)
+}
+
+// 管理员修改指定用户的资料
+func UpdateUserProfileHandler(c *gin.Context, uo *UserOption) {
+	var form UpdateProfileForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	curUser, roles := GetCurUserAndRole(c)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	userId := c.Param("id")
+	if !checkUserScope(c, db, userId) {
+		return
+	}
+
+	fields := profileOption(uo).EditableFields(roles, false)
+	updateProfile(c, db, userId, &form, fields, curUser)
+}
+
+func updateProfile(c *gin.Context, db *dbandmq.Ds, userId string, form *UpdateProfileForm, fields []string, curUser *userapp.User) {
+	user, err := userapp.GetUserById(db, userId)
+	middleware.StopExec(err)
+	if user == nil {
+		returnfun.ReturnErrJson(c, "无指定id用户")
+		return
+	}
+
+	var changes []*userapp.ProfileChange
+	for _, field := range userapp.AllProfileFields {
+		val := form.values()[field]
+		if val == nil {
+			continue
+		}
+		if !fieldEditable(fields, field) {
+			returnfun.Return403Json(c, fmt.Sprintf("无权修改字段[%s]", field))
+			return
+		}
+
+		newVal, err := userapp.CheckProfileField(field, *val)
+		if err != nil {
+			returnfun.ReturnErrJson(c, err.Error())
+			return
+		}
+
+		oldVal := user.ProfileValue(field)
+		if newVal == oldVal {
+			continue
+		}
+		changes = append(changes, &userapp.ProfileChange{
+			Field: field,
+			Old:   oldVal,
+			New:   newVal,
+		})
+	}
+
+	// 自定义属性
+	if len(form.Attributes) > 0 {
+		var keys []string
+		for key := range form.Attributes {
+			field := userapp.AttrProfileField(key)
+			if !fieldEditable(fields, field) {
+				returnfun.Return403Json(c, fmt.Sprintf("无权修改字段[%s]", field))
+				return
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		defs, err := userapp.GetAllAttrDefs(db)
+		middleware.StopExec(err)
+		attrs, err := userapp.ValidateAttributes(defs, user.Attributes, form.Attributes)
+		if err != nil {
+			returnfun.ReturnErrJson(c, err.Error())
+			return
+		}
+		err = userapp.CheckUniqueAttributes(db, defs, user.TenantId, userId, attrs)
+		if err != nil {
+			returnfun.ReturnErrJson(c, err.Error())
+			return
+		}
+
+		for _, key := range keys {
+			oldVal := user.Attributes[key]
+			newVal := attrs[key]
+			if oldVal == newVal {
+				continue
+			}
+			changes = append(changes, &userapp.ProfileChange{
+				Field: userapp.AttrProfileField(key),
+				Old:   oldVal,
+				New:   newVal,
+			})
+		}
+	}
+
+	err = userapp.UpdateUserProfile(db, userId, changes, newOpHistory(c, curUser, ""))
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	if len(changes) > 0 {
+		Logger.Infof(middleware.GetReqId(c), "[%s][%s]修改了用户[%s]的资料，修改字段数量[%d]", curUser.Id, curUser.Name, userId, len(changes))
+	}
+
+	user, err = userapp.GetUserFullInfoById(db, userId)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"user":    user,
+		"changes": changes,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 字段是否可以修改，配置了 attributes 时可以修改所有自定义属性
+func fieldEditable(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+		if f == userapp.ProfileFieldAttributes && strings.HasPrefix(field, userapp.ProfileFieldAttributes+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/userandrole/emailapp"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/mgo.v2"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 自助注册时的验证方式
+const (
+	RegisterVerifyNone  = "NONE"
+	RegisterVerifyPhone = "PHONE"
+	RegisterVerifyEmail = "EMAIL"
+)
+
+// 同一个邮箱发送验证码的最小间隔
+const EmailCodeInterval = time.Minute
+
+type RegisterOption struct {
+	LoginIdPattern *regexp.Regexp
+	Passwd         *userapp.PasswdPolicy
+	Verify         string
+	Captcha        *userapp.CaptchaOption // 为 nil 时不需要人机验证
+
+	// 同一个 ip 在 RateWindow 内最多请求 RateLimit 次
+	RateLimit  int
+	RateWindow time.Duration
+}
+
+// 检查请求频率，超过限制时直接返回
+func rateLimited(c *gin.Context, uo *UserOption, key string, limit int, window time.Duration) bool {
+	ok, err := userapp.AllowRequest(uo.R, key, limit, window)
+	middleware.StopExec(err)
+	if !ok {
+		returnfun.ReturnJson(c, 429, ErrCodeTooManyRequest, "请求过于频繁，请稍后再试", "")
+		return true
+	}
+	return false
+}
+
+// 用户自助注册账户密码登录方式的账户
+type RegisterForm struct {
+	LoginId string `json:"loginId" binding:"required"`
+	Passwd  string `json:"passwd" binding:"required"`
+	Avatar  string `json:"avatar"`
+	Captcha string `json:"captcha"` // 人机验证 token，启用人机验证时必输
+	Phone   string `json:"phone"`   // verify 为 PHONE 时必输
+	Email   string `json:"email"`   // verify 为 EMAIL 时必输
+	Code    string `json:"code"`    // 短信或邮件验证码
+}
+
+func RegisterHandler(c *gin.Context, uo *UserOption) {
+	ro := uo.RegOpt
+	if ro == nil {
+		returnfun.ReturnErrJson(c, "未开放注册")
+		return
+	}
+
+	var form RegisterForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	if rateLimited(c, uo, "REGISTER:"+c.ClientIP(), ro.RateLimit, ro.RateWindow) {
+		return
+	}
+
+	// 人机验证
+	if ro.Captcha != nil {
+		ok, err := ro.Captcha.Verify(form.Captcha, c.ClientIP())
+		middleware.StopExec(err)
+		if !ok {
+			returnfun.ReturnErrJson(c, "人机验证失败")
+			return
+		}
+	}
+
+	form.LoginId = strings.TrimSpace(form.LoginId)
+	err = userapp.CheckLoginId(ro.LoginIdPattern, form.LoginId)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	err = ro.Passwd.Check(form.Passwd)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	// 悲观锁
+	lockVal, ok := dbandmq.AcquireLock(uo.R, form.LoginId, dbandmq.DEFAULT_LOCK_ACQUIRE_TIMEOUT, dbandmq.DEFAULT_LOCK_KEY_TIMEOUT)
+	if !ok {
+		returnfun.ReturnErrJson(c, "锁定数据失败")
+		return
+	}
+	defer dbandmq.ReleaseLock(uo.R, form.LoginId, lockVal)
+
+	db := uo.Ds.CopyDs()
+	defer db.Close()
+
+	dbuser, err := userapp.GetUserByLoginId(db, GetCurTenantId(c), form.LoginId)
+	middleware.StopExec(err)
+	if dbuser != nil {
+		returnfun.ReturnJson(c, 400, ErrCodeNameExist, "账户已存在", "")
+		return
+	}
+
+	// 手机号或邮箱验证，验证码正确后才会创建账户
+	switch ro.Verify {
+	case RegisterVerifyPhone:
+		if form.Phone == "" || form.Code == "" {
+			returnfun.ReturnErrJson(c, "缺少手机号或验证码")
+			return
+		}
+		pu, err := userapp.GetUserByPhone(db, GetCurTenantId(c), form.Phone)
+		middleware.StopExec(err)
+		if pu != nil {
+			returnfun.ReturnJson(c, 400, ErrCodeNameExist, "手机号已被使用", "")
+			return
+		}
+		ok, err := uo.PhoneOpt.CheckSms(form.Phone, form.Code)
+		middleware.StopExec(err)
+		if !ok {
+			returnfun.ReturnErrJson(c, "验证码错误")
+			return
+		}
+	case RegisterVerifyEmail:
+		if uo.EmailOpt == nil {
+			returnfun.ReturnErrJson(c, "未配置邮件发送")
+			return
+		}
+		if form.Email == "" || form.Code == "" {
+			returnfun.ReturnErrJson(c, "缺少邮箱或验证码")
+			return
+		}
+		eu, err := userapp.GetUserByEmail(db, GetCurTenantId(c), form.Email)
+		middleware.StopExec(err)
+		if eu != nil {
+			returnfun.ReturnJson(c, 400, ErrCodeNameExist, "邮箱已被使用", "")
+			return
+		}
+		ok, err := uo.EmailOpt.CheckCode(form.Email, form.Code)
+		middleware.StopExec(err)
+		if !ok {
+			returnfun.ReturnErrJson(c, "验证码错误")
+			return
+		}
+	}
+
+	user, err := userapp.NewIdPasswdAccount(db, GetCurTenantId(c), form.LoginId, form.Passwd, form.Avatar, true, "")
+	if err != nil {
+		Logger.Errorf(middleware.GetReqId(c), "自助注册账户[%s]失败, %s", form.LoginId, err.Error())
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	// 锁只针对 loginId，并发注册同一个手机号或邮箱时由唯一索引拒绝
+	// 保存失败时删除刚创建的账户，不能留下没有验证的账户
+	dupMsg := ""
+	switch ro.Verify {
+	case RegisterVerifyPhone:
+		user.PhoneAuth, err = userapp.AddPhoneAuth(db, GetCurTenantId(c), user.Id, form.Phone, true)
+		dupMsg = "手机号已被使用"
+	case RegisterVerifyEmail:
+		user.EmailAuth, err = userapp.AddEmailAuth(db, GetCurTenantId(c), user.Id, form.Email, true)
+		dupMsg = "邮箱已被使用"
+	}
+	if err != nil {
+		_ = userapp.RemoveIdPasswdAccount(db, user.Id)
+		if mgo.IsDup(err) {
+			returnfun.ReturnJson(c, 400, ErrCodeNameExist, dupMsg, "")
+			return
+		}
+		middleware.StopExec(err)
+	}
+
+	opHis := newOpHistory(c, user, "").SetParams(ophistory.Params{"loginId": form.LoginId}).SetDiff(nil, user)
+	recordErr := ophistory.Record(db, opHis, ophistory.CodeUserRegister, ophistory.TargetUser, user.Id)
+
+	// 新注册用户赋予默认角色，审计日志写入失败时账户已经创建，仍然赋予
+	_, err = addRoleToUser(c, db, user, user.Id, []string{roleapp.DefaultRoleId()}, 0)
+	middleware.StopExec(err)
+	middleware.StopExec(recordErr)
+
+	Logger.Infof(middleware.GetReqId(c), "用户自助注册账户[%s]成功, ip[%s]", form.LoginId, c.ClientIP())
+
+	returnfun.ReturnOKJson(c, user)
+	return
+}
+
+// 发送邮箱验证码
+type SendEmailCodeForm struct {
+	Email string `json:"email" binding:"required"`
+}
+
+func SendEmailCodeHandler(c *gin.Context, uo *UserOption) {
+	if uo.EmailOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置邮件发送")
+		return
+	}
+
+	var form SendEmailCodeForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	email := strings.ToLower(strings.TrimSpace(form.Email))
+	if !emailapp.IsValidEmail(email) {
+		returnfun.ReturnErrJson(c, "错误的邮箱地址")
+		return
+	}
+
+	if rateLimited(c, uo, "EMAILCODE:"+email, 1, EmailCodeInterval) {
+		return
+	}
+	if uo.RegOpt != nil && rateLimited(c, uo, "EMAILCODE:"+c.ClientIP(), uo.RegOpt.RateLimit, uo.RegOpt.RateWindow) {
+		return
+	}
+
+	err = uo.EmailOpt.SendCode(email, "验证码")
+	middleware.StopExec(err)
+
+	if uo.EmailOpt.Debug {
+		code, _ := uo.R.Get(emailapp.EmailRedisPrefix + email).Result()
+		returnfun.ReturnOKJson(c, gin.H{"code": code})
+		return
+	}
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
@@ -2,9 +2,7 @@ package api
 
 import (
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
-	jsoniter "github.com/json-iterator/go"
 	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/middleware"
@@ -37,7 +35,7 @@ func CreateItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	name := form.Name
 	// 检查 name 是否重复，不用加锁，假设不冲突
-	dbitem, err := roleapp.GetItemByName(db, name)
+	dbitem, err := roleapp.GetItemByName(db, GetCurTenantId(c), name)
 	middleware.StopExec(err)
 	if dbitem != nil {
 		Logger.Errorf(middleware.GetReqId(c), "新建role item时，已存在同名[%s]数据", name)
@@ -57,6 +55,7 @@ func CreateItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 		Resource: form.Resource,
 		Menu:     form.Menu,
 		Button:   form.Button,
+		TenantId: GetCurTenantId(c),
 		DataFrom: roleapp.DataFromUser,
 		Deleted:  false,
 		CreateT:  util.GetCurTime(),
@@ -64,18 +63,20 @@ func CreateItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 	item.UpdateT = item.CreateT
 
 	// 记录 history 操作
-	hisAction := fmt.Sprintf("新建 role item, item id[%s], item name[%s]", item.Id, item.Name)
 	curUser, _ := GetCurUserAndRole(c)
 	if curUser == nil {
 		middleware.StopExec(errors.New("获取当前用户信息失败"))
 	}
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, hisAction)
-	if opHis != nil {
-		item.History = append(item.History, opHis)
-	}
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name":   item.Name,
+		"method": item.Method,
+		"path":   item.Path,
+	}).SetDiff(nil, item)
 
 	err = roleapp.SaveItem(db, item)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeItemCreate, ophistory.TargetItem, item.Id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, item)
 	return
@@ -106,6 +107,10 @@ func UpdateItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeItem, id) {
+		return
+	}
+
 	dbitem, err := roleapp.GetItemById(db, id)
 	middleware.StopExec(err)
 
@@ -118,6 +123,7 @@ func UpdateItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 		form.Path = strings.ReplaceAll(form.Path, ":id", "*")
 	}
 
+	before := ophistory.Snapshot(dbitem)
 	dbitem.Name = form.Name
 	dbitem.Method = form.Method
 	dbitem.Path = form.Path
@@ -128,19 +134,16 @@ func UpdateItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 	dbitem.UpdateT = util.GetCurTime()
 
 	// 记录 history 操作
-	hdata, _ := jsoniter.MarshalToString(form)
-	hisAction := fmt.Sprintf("修改 item，传递的数据是, %s", hdata)
 	curUser, _ := GetCurUserAndRole(c)
 	if curUser == nil {
 		middleware.StopExec(errors.New("获取当前用户信息失败"))
 	}
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, hisAction)
-	if opHis != nil {
-		dbitem.History = append(dbitem.History, opHis)
-	}
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": dbitem.Name}).SetDiff(before, dbitem)
 
 	err = roleapp.UpdateItem(db, dbitem)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeItemUpdate, ophistory.TargetItem, dbitem.Id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, dbitem)
 	return
@@ -162,7 +165,21 @@ func DeleteItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
-	err := roleapp.DeleteItemById(db, curUser.Id, curUser.Name, id)
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeItem, id) {
+		return
+	}
+
+	dbitem, err := roleapp.GetItemById(db, id)
+	middleware.StopExec(err)
+	if dbitem == nil {
+		returnfun.ReturnErrJson(c, "无指定id的数据")
+		return
+	}
+
+	after := *dbitem
+	after.Deleted = true
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": dbitem.Name}).SetDiff(dbitem, &after)
+	err = roleapp.DeleteItemById(db, id, opHis)
 	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, "")
@@ -177,6 +194,10 @@ func GetItemInfoHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	item, err := roleapp.GetItemById(db, id)
 	middleware.StopExec(err)
+	if item != nil && !roleDataVisible(c, item.TenantId, item.DataFrom) {
+		returnfun.ReturnErrJson(c, "无指定id的数据")
+		return
+	}
 	returnfun.ReturnOKJson(c, item)
 	return
 }
@@ -188,6 +209,9 @@ func QueryItemHandler(c *gin.Context, ds *dbandmq.Ds) {
 	// 过滤掉 admin
 	andCondition = append(andCondition, bson.M{"name": bson.M{"$not": bson.M{"$in": roleapp.AdminItemNames}}})
 
+	// 只能看到当前租户的数据和系统内置的数据
+	andCondition = append(andCondition, roleapp.TenantVisibleFilter(GetCurTenantId(c)))
+
 	name := c.Query("name")
 	if name != "" {
 		andCondition = append(andCondition, bson.M{"name": bson.M{"$regex": name}})
@@ -2,7 +2,6 @@ package api
 
 import (
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/middleware"
@@ -30,8 +29,12 @@ func CreateRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataVisible(c, db, roleapp.IdTypePermission, form.Pids) {
+		return
+	}
+
 	// 检查 name 是否存在
-	dbrole, err := roleapp.GetRoleByName(db, form.Name, false)
+	dbrole, err := roleapp.GetRoleByName(db, GetCurTenantId(c), form.Name, false)
 	middleware.StopExec(err)
 	if dbrole != nil {
 		returnfun.ReturnJson(c, 400, ErrCodeNameExist, "role已存在", gin.H{"id": dbrole.Id})
@@ -46,6 +49,7 @@ func CreateRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 		PermissionIds: form.Pids,
 		Menu:          form.Menu,
 		Button:        form.Button,
+		TenantId:      GetCurTenantId(c),
 		DataFrom:      roleapp.DataFromUser,
 		Deleted:       false,
 		CreateT:       util.GetCurTime(),
@@ -57,13 +61,12 @@ func CreateRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	if curUser == nil {
 		middleware.StopExec(errors.New("读取当前用户信息失败"))
 	}
-	hisAction := fmt.Sprintf("新建 role, role name[%s], pids[%s], menu[%s], button[%s]", form.Name, form.Pids, form.Menu, form.Button)
-
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, hisAction)
-	role.History = append(role.History, opHis)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": role.Name}).SetDiff(nil, role)
 
 	err = roleapp.SaveRole(db, role)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleCreate, ophistory.TargetRole, role.Id)
+	middleware.StopExec(err)
 	returnfun.ReturnOKJson(c, role)
 	return
 }
@@ -87,6 +90,13 @@ func AddPermissionsToRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeRole, id) {
+		return
+	}
+	if !checkRoleDataVisible(c, db, roleapp.IdTypePermission, form.Pids) {
+		return
+	}
+
 	dbrole, err := roleapp.GetRoleById(db, id, false)
 	middleware.StopExec(err)
 	if dbrole == nil || dbrole.Deleted {
@@ -96,18 +106,22 @@ func AddPermissionsToRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	// 检查 pids 的合法性 todo
 
+	before := ophistory.Snapshot(dbrole)
 	dbrole.PermissionIds = append(dbrole.PermissionIds, form.Pids...)
 	dbrole.PermissionIds = util.UniqueStringArray(dbrole.PermissionIds)
 	dbrole.UpdateT = util.GetCurTime()
 
 	// op history
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("添加 permissiondIds %s", form.Pids)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	dbrole.History = append(dbrole.History, opHis)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name": dbrole.Name,
+		"pids": form.Pids,
+	}).SetDiff(before, dbrole)
 
 	err = roleapp.UpdateRole(db, dbrole)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleAddPs, ophistory.TargetRole, dbrole.Id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, dbrole)
 	return
@@ -132,6 +146,10 @@ func RemovePermissionsFromRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeRole, id) {
+		return
+	}
+
 	dbrole, err := roleapp.GetRoleById(db, id, false)
 	middleware.StopExec(err)
 
@@ -156,17 +174,21 @@ func RemovePermissionsFromRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 		}
 	}
 
+	before := ophistory.Snapshot(dbrole)
 	dbrole.PermissionIds = remainPids
 	dbrole.UpdateT = util.GetCurTime()
 
 	// op history
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("移除 pids %s", form.Pids)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	dbrole.History = append(dbrole.History, opHis)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name": dbrole.Name,
+		"pids": form.Pids,
+	}).SetDiff(before, dbrole)
 
 	err = roleapp.UpdateRole(db, dbrole)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleDelPs, ophistory.TargetRole, dbrole.Id)
+	middleware.StopExec(err)
 	returnfun.ReturnOKJson(c, dbrole)
 	return
 }
@@ -192,9 +214,21 @@ func UpdateRoleInfoHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeRole, id) {
+		return
+	}
+
+	dbrole, err := roleapp.GetRoleById(db, id, false)
+	middleware.StopExec(err)
+	if dbrole == nil {
+		returnfun.ReturnErrJson(c, "无指定id的role信息")
+		return
+	}
+
+	after := *dbrole
+	after.Name, after.Menu, after.Button, after.Deleted = form.Name, form.Menu, form.Button, false
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("更新role信息, name[%s], menu[%s], button[%s]", form.Name, form.Menu, form.Button)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": form.Name}).SetDiff(dbrole, &after)
 
 	update := bson.M{
 		"$set": bson.M{
@@ -204,13 +238,12 @@ func UpdateRoleInfoHandler(c *gin.Context, ds *dbandmq.Ds) {
 			"deleted": false, // 重新上线
 			"updateT": util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
-		},
 	}
 
 	err = db.C(roleapp.CollectionNameRole).UpdateId(id, update)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleUpdate, ophistory.TargetRole, id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, "")
 	return
@@ -225,30 +258,41 @@ func DeleteRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 		return
 	}
 
-	if id == roleapp.DefaultRoleId {
+	if id == roleapp.DefaultRoleId() {
 		returnfun.Return403Json(c, "无权做此修改")
 		return
 	}
 
-	// op history
-	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("删除role")
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-
 	update := bson.M{
 		"$set": bson.M{
 			"deleted": true,
 			"updateT": util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
-		},
 	}
 
 	db := ds.CopyDs()
 	defer db.Close()
 
-	err := db.C(roleapp.CollectionNameRole).UpdateId(id, update)
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeRole, id) {
+		return
+	}
+
+	dbrole, err := roleapp.GetRoleById(db, id, false)
+	middleware.StopExec(err)
+	if dbrole == nil {
+		returnfun.ReturnErrJson(c, "无指定id的role信息")
+		return
+	}
+
+	// op history
+	after := *dbrole
+	after.Deleted = true
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": dbrole.Name}).SetDiff(dbrole, &after)
+
+	err = db.C(roleapp.CollectionNameRole).UpdateId(id, update)
+	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleDelete, ophistory.TargetRole, id)
 	middleware.StopExec(err)
 	returnfun.ReturnOKJson(c, "")
 	return
@@ -268,6 +312,10 @@ func AddChildRoleToRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeRole, roleId) {
+		return
+	}
+
 	dbRole, err := roleapp.GetRoleById(db, roleId, false)
 	middleware.StopExec(err)
 	if dbRole == nil {
@@ -286,6 +334,10 @@ func AddChildRoleToRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	}
 	roleIds = util.UniqueStringArray(roleIds)
 
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeRole, roleIds) {
+		return
+	}
+
 	addRoles, err := roleapp.GetRolesByRoleIds(db, roleIds, false)
 	middleware.StopExec(err)
 	findR := func(rid string) *roleapp.Role {
@@ -330,21 +382,28 @@ func AddChildRoleToRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	// op history
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("添加 childrole, %s", validRoles)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+	var childRoleIds []string
+	for _, vr := range validRoles {
+		childRoleIds = append(childRoleIds, vr.Id)
+	}
+	after := *dbRole
+	after.ChildrenRoles = allRoles
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name":         dbRole.Name,
+		"childRoleIds": childRoleIds,
+	}).SetDiff(dbRole, &after)
 
 	update := bson.M{
 		"$set": bson.M{
 			"childrenRole": allRoles,
 			"updateT":      util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
-		},
 	}
 
 	err = db.C(roleapp.CollectionNameRole).UpdateId(dbRole.Id, update)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleAddChildRole, ophistory.TargetRole, dbRole.Id)
+	middleware.StopExec(err)
 
 	retData := gin.H{
 		"validRoles":   validRoles,
@@ -365,6 +424,10 @@ func DelChildRoleFromRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypeRole, roleId) {
+		return
+	}
+
 	dbRole, err := roleapp.GetRoleById(db, roleId, false)
 	middleware.StopExec(err)
 	if dbRole == nil {
@@ -401,21 +464,28 @@ func DelChildRoleFromRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	// op history
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("删除 childrole %s", form.Roles)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+	var childRoleIds []string
+	for _, fr := range form.Roles {
+		childRoleIds = append(childRoleIds, fr.Id)
+	}
+	after := *dbRole
+	after.ChildrenRoles = remainRoles
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name":         dbRole.Name,
+		"childRoleIds": childRoleIds,
+	}).SetDiff(dbRole, &after)
 
 	update := bson.M{
 		"$set": bson.M{
 			"childrenRole": remainRoles,
 			"updateT":      util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
-		},
 	}
 
 	err = db.C(roleapp.CollectionNameRole).UpdateId(dbRole.Id, update)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodeRoleDelChildRole, ophistory.TargetRole, dbRole.Id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, "")
 	return
@@ -429,6 +499,10 @@ func GetRoleInfoHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	role, err := roleapp.GetRoleById(db, id, true)
 	middleware.StopExec(err)
+	if role != nil && !roleDataVisible(c, role.TenantId, role.DataFrom) {
+		returnfun.ReturnErrJson(c, "无指定id的数据")
+		return
+	}
 	returnfun.ReturnOKJson(c, role)
 	return
 }
@@ -440,6 +514,9 @@ func QueryRoleHandler(c *gin.Context, ds *dbandmq.Ds) {
 	// 过滤掉 admin
 	andCondition = append(andCondition, bson.M{"name": bson.M{"$ne": roleapp.AdminRoleName}})
 
+	// 只能看到当前租户的数据和系统内置的数据
+	andCondition = append(andCondition, roleapp.TenantVisibleFilter(GetCurTenantId(c)))
+
 	name := c.Query("name")
 	if name != "" {
 		andCondition = append(andCondition, bson.M{"name": bson.M{"$regex": name}})
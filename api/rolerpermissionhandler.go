@@ -2,7 +2,6 @@ package api
 
 import (
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/middleware"
@@ -27,11 +26,16 @@ func CreatePermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 	err := c.BindJSON(&form)
 	middleware.StopExec(err)
 
-	// 检查名字是否存在，不加锁
 	db := ds.CopyDs()
 	defer db.Close()
 
-	dbp, err := roleapp.GetPermissionByName(db, form.Name, false)
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeItem, form.ItemIds) {
+		return
+	}
+
+	// 检查名字是否存在，不加锁
+
+	dbp, err := roleapp.GetPermissionByName(db, GetCurTenantId(c), form.Name, false)
 	middleware.StopExec(err)
 
 	if dbp != nil {
@@ -42,9 +46,10 @@ func CreatePermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 	permission := &roleapp.Permission{
 		Id:       util.GenerateDataId(),
 		Name:     form.Name,
-		ItemIds:  form.ItemIds, // 不检查 itemIds 的合法性
+		ItemIds:  form.ItemIds,
 		Menu:     form.Menu,
 		Button:   form.Button,
+		TenantId: GetCurTenantId(c),
 		DataFrom: roleapp.DataFromUser,
 		Deleted:  false,
 		CreateT:  util.GetCurTime(),
@@ -56,11 +61,11 @@ func CreatePermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 	if curUser == nil {
 		middleware.StopExec(errors.New("获取当前用户信息失败"))
 	}
-	opAction := fmt.Sprintf("新建permission，名字是[%s]", form.Name)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	permission.History = append(permission.History, opHis)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": permission.Name}).SetDiff(nil, permission)
 	err = roleapp.SavePermission(db, permission)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodePermissionCreate, ophistory.TargetPermission, permission.Id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, permission)
 	return
@@ -85,6 +90,13 @@ func AddItemToPermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypePermission, id) {
+		return
+	}
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeItem, form.ItemIds) {
+		return
+	}
+
 	dbp, err := roleapp.GetPermissionById(db, id, false)
 	middleware.StopExec(err)
 	if dbp == nil || dbp.Deleted {
@@ -94,18 +106,22 @@ func AddItemToPermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	// 检查 itemIds 合法性 todo
 
+	before := ophistory.Snapshot(dbp)
 	dbp.ItemIds = append(dbp.ItemIds, form.ItemIds...)
 	dbp.ItemIds = util.UniqueStringArray(dbp.ItemIds)
 	dbp.UpdateT = util.GetCurTime()
 
 	// op history
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("添加 itemids %s", form.ItemIds)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	dbp.History = append(dbp.History, opHis)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name":    dbp.Name,
+		"itemIds": form.ItemIds,
+	}).SetDiff(before, dbp)
 
 	err = roleapp.UpdatePermission(db, dbp)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodePermissionAddItems, ophistory.TargetPermission, dbp.Id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, dbp)
 	return
@@ -130,6 +146,10 @@ func RemoveItemFromPermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypePermission, id) {
+		return
+	}
+
 	dbp, err := roleapp.GetPermissionById(db, id, false)
 	middleware.StopExec(err)
 
@@ -155,17 +175,21 @@ func RemoveItemFromPermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 		}
 	}
 
+	before := ophistory.Snapshot(dbp)
 	dbp.ItemIds = remainIds
 	dbp.UpdateT = util.GetCurTime()
 
 	// op history
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("移除 itemids %s", form.ItemIds)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	dbp.History = append(dbp.History, opHis)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"name":    dbp.Name,
+		"itemIds": form.ItemIds,
+	}).SetDiff(before, dbp)
 
 	err = roleapp.UpdatePermission(db, dbp)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodePermissionDelItems, ophistory.TargetPermission, dbp.Id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, dbp)
 	return
@@ -193,10 +217,22 @@ func UpdatePermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkRoleDataOwner(c, db, roleapp.IdTypePermission, id) {
+		return
+	}
+
+	dbp, err := roleapp.GetPermissionById(db, id, false)
+	middleware.StopExec(err)
+	if dbp == nil {
+		returnfun.ReturnErrJson(c, "无指定id的权限")
+		return
+	}
+
 	// op history
+	after := *dbp
+	after.Name, after.Menu, after.Button, after.Deleted = form.Name, form.Menu, form.Button, false
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("更新permission信息, name[%s], menu[%s], button[%s]", form.Name, form.Menu, form.Button)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": form.Name}).SetDiff(dbp, &after)
 
 	update := bson.M{
 		"$set": bson.M{
@@ -206,13 +242,12 @@ func UpdatePermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 			"deleted": false, // 如果被删除过，这里相当于重新上线
 			"updateT": util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
-		},
 	}
 
 	err = db.C(roleapp.CollectionNamePermission).UpdateId(id, update)
 	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodePermissionUpdate, ophistory.TargetPermission, id)
+	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, "")
 	return
@@ -226,25 +261,36 @@ func DeletePermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 		return
 	}
 
-	// op history
-	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("删除权限")
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-
 	update := bson.M{
 		"$set": bson.M{
 			"deleted": true,
 			"updateT": util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
-		},
 	}
 
 	db := ds.CopyDs()
 	defer db.Close()
 
-	err := db.C(roleapp.CollectionNamePermission).UpdateId(id, update)
+	if !checkRoleDataOwner(c, db, roleapp.IdTypePermission, id) {
+		return
+	}
+
+	dbp, err := roleapp.GetPermissionById(db, id, false)
+	middleware.StopExec(err)
+	if dbp == nil {
+		returnfun.ReturnErrJson(c, "无指定id的权限")
+		return
+	}
+
+	// op history
+	after := *dbp
+	after.Deleted = true
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": dbp.Name}).SetDiff(dbp, &after)
+
+	err = db.C(roleapp.CollectionNamePermission).UpdateId(id, update)
+	middleware.StopExec(err)
+	err = ophistory.Record(db, opHis, ophistory.CodePermissionDelete, ophistory.TargetPermission, id)
 	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, "")
@@ -259,6 +305,10 @@ func GetPermissionInfoHandler(c *gin.Context, ds *dbandmq.Ds) {
 
 	p, err := roleapp.GetPermissionById(db, id, true)
 	middleware.StopExec(err)
+	if p != nil && !roleDataVisible(c, p.TenantId, p.DataFrom) {
+		returnfun.ReturnErrJson(c, "无指定id的数据")
+		return
+	}
 
 	returnfun.ReturnOKJson(c, p)
 	return
@@ -271,6 +321,9 @@ func QueryPermissionHandler(c *gin.Context, ds *dbandmq.Ds) {
 	// 过滤掉 admin
 	andCondition = append(andCondition, bson.M{"name": bson.M{"$ne": roleapp.AdminPermissionName}})
 
+	// 只能看到当前租户的数据和系统内置的数据
+	andCondition = append(andCondition, roleapp.TenantVisibleFilter(GetCurTenantId(c)))
+
 	name := c.Query("name")
 	if name != "" {
 		andCondition = append(andCondition, bson.M{"name": bson.M{"$regex": name}})
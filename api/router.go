@@ -2,6 +2,7 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/userandrole/config"
 )
@@ -120,6 +121,11 @@ func RoleRouter(db *dbandmq.Ds, g *gin.RouterGroup) {
 			DelChildRoleFromRoleHandler(c, db)
 		})
 
+		// 设置 role 是否需要审批以及审批人
+		rR.PUT("/:id/approval", func(c *gin.Context) {
+			SetRoleApprovalHandler(c, db)
+		})
+
 		// 查看 role 明细
 		rR.GET("/:id", func(c *gin.Context) {
 			GetRoleInfoHandler(c, db)
@@ -160,6 +166,32 @@ func UserRouter(uo *UserOption, g *gin.RouterGroup) {
 			MeHandler(c, uo)
 		})
 
+		// 用户修改自己的资料
+		userR.PUT("/me", func(c *gin.Context) {
+			UpdateMyProfileHandler(c, uo)
+		})
+
+		// 用户读取、绑定、解绑自己的登录方式
+		userR.GET("/me/auths", func(c *gin.Context) {
+			GetMyLinkedAuthsHandler(c, uo)
+		})
+		userR.POST("/me/link", func(c *gin.Context) {
+			LinkAuthHandler(c, uo)
+		})
+		userR.POST("/me/unlink", func(c *gin.Context) {
+			UnlinkAuthHandler(c, uo)
+		})
+
+		// 用户自己申请 role，审批通过后赋予
+		userR.POST("/me/accessrequest", func(c *gin.Context) {
+			CreateAccessRequestHandler(c, uo.Ds)
+		})
+
+		// 读取自己的授权申请
+		userR.GET("/me/accessrequests", func(c *gin.Context) {
+			QueryMyAccessRequestHandler(c, uo.Ds)
+		})
+
 		// 退出登录
 		userR.GET("/logout", func(c *gin.Context) {
 			LogoutHandler(c, uo)
@@ -193,6 +225,25 @@ func UserRouter(uo *UserOption, g *gin.RouterGroup) {
 			GetUserInfoHandler(c, uo)
 		})
 
+		// 管理员修改某个用户的资料
+		userR.PUT("/user/:id", func(c *gin.Context) {
+			UpdateUserProfileHandler(c, uo)
+		})
+
+		// 管理员维护用户自定义属性定义
+		userR.POST("/attrdef", func(c *gin.Context) {
+			CreateAttrDefHandler(c, uo)
+		})
+		userR.PUT("/attrdef/:id", func(c *gin.Context) {
+			UpdateAttrDefHandler(c, uo)
+		})
+		userR.DELETE("/attrdef/:id", func(c *gin.Context) {
+			DeleteAttrDefHandler(c, uo)
+		})
+		userR.GET("/attrdefs", func(c *gin.Context) {
+			GetAttrDefsHandler(c, uo)
+		})
+
 		// 根据 openid 读取用户信息
 		userR.GET("/wx/openid/:id", func(c *gin.Context) {
 			GetUserByWeChatOpenIdHandler(c, uo)
@@ -212,6 +263,23 @@ func UserRouter(uo *UserOption, g *gin.RouterGroup) {
 		userR.GET("/users", func(c *gin.Context) {
 			QueryUserHandler(c, uo)
 		})
+
+		// 管理员合并账户，预览、合并、撤销、读取合并记录
+		userR.POST("/merge/preview", func(c *gin.Context) {
+			PreviewMergeUserHandler(c, uo)
+		})
+		userR.POST("/merge", func(c *gin.Context) {
+			MergeUserHandler(c, uo)
+		})
+		userR.POST("/merge/undo/:id", func(c *gin.Context) {
+			UndoMergeUserHandler(c, uo)
+		})
+		userR.GET("/merge/:id", func(c *gin.Context) {
+			GetMergeJournalHandler(c, uo)
+		})
+		userR.GET("/merges", func(c *gin.Context) {
+			QueryMergeJournalHandler(c, uo)
+		})
 	}
 
 	// 不需要 auth 的
@@ -222,6 +290,29 @@ func UserRouter(uo *UserOption, g *gin.RouterGroup) {
 			LoginByIdPasswdHandler(c, uo)
 		})
 
+		// 自助注册账户密码登录方式的账户
+		noAuthR.POST("/register", func(c *gin.Context) {
+			RegisterHandler(c, uo)
+		})
+
+		// 发送邮箱验证码
+		noAuthR.POST("/email/sendcode", func(c *gin.Context) {
+			SendEmailCodeHandler(c, uo)
+		})
+
+		// 找回密码，发送验证码与设置新密码
+		noAuthR.POST("/passwd/forgot", func(c *gin.Context) {
+			ForgotPasswdHandler(c, uo)
+		})
+		noAuthR.POST("/passwd/reset", func(c *gin.Context) {
+			ResetPasswdByCodeHandler(c, uo)
+		})
+
+		// ldap / active directory 账户密码登录
+		noAuthR.POST("/ldap/login", func(c *gin.Context) {
+			LoginByLdapHandler(c, uo)
+		})
+
 		// 读取微信 appid
 		noAuthR.GET("/wx/appid", func(c *gin.Context) {
 			GetWeChatAppIdHandler(c, uo)
@@ -280,6 +371,16 @@ func UserWithRoleRouter(db *dbandmq.Ds, g *gin.RouterGroup) {
 			RemoveRolesFromUserHandler(c, db)
 		})
 
+		// 指定由某个用户管理的其他用户
+		uwrR.POST("/addmanagedusers", func(c *gin.Context) {
+			AddManagedUsersHandler(c, db)
+		})
+
+		// 取消指定的管理关系
+		uwrR.POST("/delmanagedusers", func(c *gin.Context) {
+			RemoveManagedUsersHandler(c, db)
+		})
+
 		// 读取指定用户的 roles 信息
 		uwrR.GET("/user/:id", func(c *gin.Context) {
 			GetUserRolesHandler(c, db)
@@ -290,6 +391,124 @@ func UserWithRoleRouter(db *dbandmq.Ds, g *gin.RouterGroup) {
 			QueryUWRHandler(c, db)
 		})
 	}
+
+	// 需要审批的 role 的授权申请
+	grantR := auth.Group("/grantrequest")
+	{
+		// 通过申请，同时赋予 role
+		grantR.POST("/:id/approve", func(c *gin.Context) {
+			ApproveGrantRequestHandler(c, db)
+		})
+
+		// 拒绝申请
+		grantR.POST("/:id/reject", func(c *gin.Context) {
+			RejectGrantRequestHandler(c, db)
+		})
+
+		// 申请人撤回申请
+		grantR.POST("/:id/cancel", func(c *gin.Context) {
+			CancelGrantRequestHandler(c, db)
+		})
+
+		// 读取申请明细
+		grantR.GET("/:id", func(c *gin.Context) {
+			GetGrantRequestHandler(c, db)
+		})
+
+		// 搜索管理范围内用户的申请
+		auth.GET("/grantrequests", func(c *gin.Context) {
+			QueryGrantRequestHandler(c, db)
+		})
+
+		// 待自己审批的申请
+		auth.GET("/grantrequests/todo", func(c *gin.Context) {
+			QueryTodoGrantRequestHandler(c, db)
+		})
+	}
+}
+
+// 组织部门
+// r 用于移动部门时加锁
+func OrgRouter(db *dbandmq.Ds, r *redis.Client, g *gin.RouterGroup) {
+	orgR := g.Group("/org", func(c *gin.Context) {
+		Auth(c)
+	})
+	{
+		// 新建部门
+		orgR.POST("/unit", func(c *gin.Context) {
+			CreateOrgUnitHandler(c, db)
+		})
+
+		// 修改部门名字
+		orgR.PUT("/unit/:id", func(c *gin.Context) {
+			RenameOrgUnitHandler(c, db)
+		})
+
+		// 移动部门到新的上级部门下
+		orgR.POST("/unit/:id/move", func(c *gin.Context) {
+			MoveOrgUnitHandler(c, db, r)
+		})
+
+		// 删除部门，包含所有下级部门
+		orgR.DELETE("/unit/:id", func(c *gin.Context) {
+			DeleteOrgUnitHandler(c, db)
+		})
+
+		// 读取部门明细
+		orgR.GET("/unit/:id", func(c *gin.Context) {
+			GetOrgUnitHandler(c, db)
+		})
+
+		// 读取下级部门列表
+		orgR.GET("/units", func(c *gin.Context) {
+			GetChildOrgUnitsHandler(c, db)
+		})
+
+		// 添加部门成员
+		orgR.POST("/unit/:id/addmembers", func(c *gin.Context) {
+			AddOrgMembersHandler(c, db)
+		})
+
+		// 移除部门成员
+		orgR.POST("/unit/:id/delmembers", func(c *gin.Context) {
+			RemoveOrgMembersHandler(c, db)
+		})
+
+		// 设置用户的主部门
+		orgR.POST("/unit/:id/primary", func(c *gin.Context) {
+			SetPrimaryOrgHandler(c, db)
+		})
+
+		// 读取部门成员
+		orgR.GET("/unit/:id/members", func(c *gin.Context) {
+			GetOrgMembersHandler(c, db)
+		})
+
+		// 给部门添加角色，部门成员自动拥有
+		orgR.POST("/unit/:id/addroles", func(c *gin.Context) {
+			AddRolesToOrgHandler(c, db)
+		})
+
+		// 取消部门的角色
+		orgR.POST("/unit/:id/delroles", func(c *gin.Context) {
+			RemoveRolesFromOrgHandler(c, db)
+		})
+
+		// 设置部门负责人
+		orgR.POST("/unit/:id/addmanagers", func(c *gin.Context) {
+			AddOrgManagersHandler(c, db)
+		})
+
+		// 取消部门负责人
+		orgR.POST("/unit/:id/delmanagers", func(c *gin.Context) {
+			RemoveOrgManagersHandler(c, db)
+		})
+
+		// 读取用户所属的部门
+		orgR.GET("/user/:id", func(c *gin.Context) {
+			GetUserOrgsHandler(c, db)
+		})
+	}
 }
 
 // 系统配置
@@ -312,5 +531,189 @@ func SystemConfRouter(ds *dbandmq.Ds, conf *config.Config, g *gin.RouterGroup) {
 		sysR.POST("/import", func(c *gin.Context) {
 			ImportUserApiHandler(c, ds)
 		})
+
+		// 同步权限策略文件
+		sysR.POST("/sync", func(c *gin.Context) {
+			SyncPolicyHandler(c, ds)
+		})
+	}
+}
+
+// 用户组管理
+func GroupRouter(db *dbandmq.Ds, g *gin.RouterGroup) {
+	auth := g.Group("", func(c *gin.Context) {
+		Auth(c)
+	})
+
+	groupR := auth.Group("/group")
+	{
+		// 新建用户组
+		groupR.POST("", func(c *gin.Context) {
+			CreateGroupHandler(c, db)
+		})
+
+		// 修改用户组名字和描述
+		groupR.PUT("/:id", func(c *gin.Context) {
+			UpdateGroupHandler(c, db)
+		})
+
+		// 删除用户组
+		groupR.DELETE("/:id", func(c *gin.Context) {
+			DeleteGroupHandler(c, db)
+		})
+
+		// 读取用户组明细
+		groupR.GET("/:id", func(c *gin.Context) {
+			GetGroupHandler(c, db)
+		})
+
+		// 添加组成员
+		groupR.POST("/:id/addmembers", func(c *gin.Context) {
+			AddGroupMembersHandler(c, db)
+		})
+
+		// 移除组成员
+		groupR.POST("/:id/delmembers", func(c *gin.Context) {
+			RemoveGroupMembersHandler(c, db)
+		})
+
+		// 给用户组添加角色
+		groupR.POST("/:id/addroles", func(c *gin.Context) {
+			AddRolesToGroupHandler(c, db)
+		})
+
+		// 取消用户组的角色
+		groupR.POST("/:id/delroles", func(c *gin.Context) {
+			RemoveRolesFromGroupHandler(c, db)
+		})
+
+		// 搜索用户组
+		auth.GET("/groups", func(c *gin.Context) {
+			QueryGroupHandler(c, db)
+		})
+
+		// 读取用户所属的用户组
+		auth.GET("/groups/user/:id", func(c *gin.Context) {
+			GetUserGroupsHandler(c, db)
+		})
 	}
-}
\ No newline at end of file
+}
+
+// 租户管理，仅超级管理员可以操作
+func TenantRouter(db *dbandmq.Ds, g *gin.RouterGroup) {
+	auth := g.Group("", func(c *gin.Context) {
+		Auth(c)
+	})
+
+	tenantR := auth.Group("/tenant")
+	{
+		// 新建租户，同时创建租户管理员账户
+		tenantR.POST("", func(c *gin.Context) {
+			CreateTenantHandler(c, db)
+		})
+
+		// 修改租户名字和绑定的域名
+		tenantR.PUT("/:id", func(c *gin.Context) {
+			UpdateTenantHandler(c, db)
+		})
+
+		// 暂停租户
+		tenantR.POST("/:id/suspend", func(c *gin.Context) {
+			SuspendTenantHandler(c, db)
+		})
+
+		// 恢复租户
+		tenantR.POST("/:id/resume", func(c *gin.Context) {
+			ResumeTenantHandler(c, db)
+		})
+
+		// 读取租户明细
+		tenantR.GET("/:id", func(c *gin.Context) {
+			GetTenantHandler(c, db)
+		})
+
+		// 搜索租户
+		auth.GET("/tenants", func(c *gin.Context) {
+			QueryTenantHandler(c, db)
+		})
+	}
+}
+
+// 审计日志
+func AuditRouter(ao *AuditOption, g *gin.RouterGroup) {
+	auth := g.Group("", func(c *gin.Context) {
+		Auth(c)
+	})
+
+	// 搜索审计日志
+	auth.GET("/auditlogs", func(c *gin.Context) {
+		QueryAuditLogHandler(c, ao.Ds)
+	})
+
+	// 校验审计日志哈希链
+	auth.GET("/auditlogs/verify", func(c *gin.Context) {
+		VerifyAuditLogHandler(c, ao)
+	})
+}
+
+func WebhookRouter(db *dbandmq.Ds, g *gin.RouterGroup) {
+	auth := g.Group("", func(c *gin.Context) {
+		Auth(c)
+	})
+
+	webhookR := auth.Group("/webhook")
+	{
+		// 新建 webhook
+		webhookR.POST("", func(c *gin.Context) {
+			CreateWebhookHandler(c, db)
+		})
+
+		// 修改 webhook
+		webhookR.PUT("/:id", func(c *gin.Context) {
+			UpdateWebhookHandler(c, db)
+		})
+
+		// 重置签名密钥
+		webhookR.POST("/:id/secret", func(c *gin.Context) {
+			ResetWebhookSecretHandler(c, db)
+		})
+
+		// 删除 webhook
+		webhookR.DELETE("/:id", func(c *gin.Context) {
+			DeleteWebhookHandler(c, db)
+		})
+
+		// 读取 webhook 明细
+		webhookR.GET("/:id", func(c *gin.Context) {
+			GetWebhookHandler(c, db)
+		})
+
+		// 搜索 webhook
+		auth.GET("/webhooks", func(c *gin.Context) {
+			QueryWebhookHandler(c, db)
+		})
+
+		// 支持订阅的事件
+		auth.GET("/webhookevents", func(c *gin.Context) {
+			GetWebhookEventsHandler(c)
+		})
+	}
+
+	deliveryR := auth.Group("/webhookdelivery")
+	{
+		// 读取投递记录明细
+		deliveryR.GET("/:id", func(c *gin.Context) {
+			GetWebhookDeliveryHandler(c, db)
+		})
+
+		// 重新投递
+		deliveryR.POST("/:id/redeliver", func(c *gin.Context) {
+			RedeliverWebhookHandler(c, db)
+		})
+
+		// 搜索投递日志
+		auth.GET("/webhookdeliveries", func(c *gin.Context) {
+			QueryWebhookDeliveryHandler(c, db)
+		})
+	}
+}
@@ -5,19 +5,18 @@ import (
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/middleware"
 	"github.com/leyle/ginbase/returnfun"
-	"github.com/leyle/ginbase/util"
 	"github.com/leyle/userandrole/config"
 	"github.com/leyle/userandrole/migrate"
-	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
 	"github.com/leyle/userandrole/userapp"
-	"gopkg.in/mgo.v2/bson"
+	"strings"
 )
 
 // 读取返回 mongodb 和 redis 的配置
 // 仅 admin 账户能够读取数据
 func GetMongodbAndRedisConfHandler(c *gin.Context, conf *config.Config) {
 	curUser, _ := GetCurUserAndRole(c)
-	if curUser.IdPasswd.LoginId != userapp.AdminLoginId {
+	if curUser.IdPasswd.LoginId != userapp.AdminLoginId || !tenantapp.IsDefault(curUser.TenantId) {
 		returnfun.Return401Json(c, "不允许读取配置")
 		return
 	}
@@ -37,10 +36,10 @@ func GetMongodbAndRedisConfHandler(c *gin.Context, conf *config.Config) {
 }
 
 // 导出用户自定义 api
-// 包含 item / permission / role 三部分数据
+// 包含 item / permission / role 三部分数据，数据之间的引用使用 name，可以导入到其他环境
 func ExportUserApiHandler(c *gin.Context, ds *dbandmq.Ds) {
 	curUser, _ := GetCurUserAndRole(c)
-	if curUser.IdPasswd.LoginId != userapp.AdminLoginId {
+	if curUser.IdPasswd.LoginId != userapp.AdminLoginId || !tenantapp.IsDefault(curUser.TenantId) {
 		returnfun.Return401Json(c, "不允许读取配置")
 		return
 	}
@@ -53,39 +52,21 @@ func ExportUserApiHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
-	filter := &bson.M{
-		"dataFrom": bson.M{
-			"$ne": roleapp.DataFromSystem,
-		},
-		"deleted": false,
-	}
-
-
-	items, err := roleapp.GetFilterItems(db, filter)
-	middleware.StopExec(err)
-
-	permissions, err := roleapp.GetFilterPermissions(db, filter)
+	m, err := migrate.Export(db)
 	middleware.StopExec(err)
 
-	roles, err := roleapp.GetFilterRoles(db, filter)
-	middleware.StopExec(err)
-
-	m := &migrate.Migrate{
-		Items:       items,
-		Permissions: permissions,
-		Roles:       roles,
-	}
-
 	// 设置为文件下载 todo
 
 	returnfun.ReturnOKJson(c, m)
 	return
 }
 
-// 导出用户自定义的 api
+// 导入用户自定义的 api
+// mode 为 create / upsert / replace，默认 create；dryRun=true 时只返回导入计划，不写入数据
+// 存在冲突时不写入任何数据，写入过程中出错时回滚已写入的数据
 func ImportUserApiHandler(c *gin.Context, ds *dbandmq.Ds) {
 	curUser, _ := GetCurUserAndRole(c)
-	if curUser.IdPasswd.LoginId != userapp.AdminLoginId {
+	if curUser.IdPasswd.LoginId != userapp.AdminLoginId || !tenantapp.IsDefault(curUser.TenantId) {
 		returnfun.Return401Json(c, "不允许做此操作")
 		return
 	}
@@ -95,6 +76,13 @@ func ImportUserApiHandler(c *gin.Context, ds *dbandmq.Ds) {
 		return
 	}
 
+	mode := strings.ToLower(c.DefaultQuery("mode", migrate.ModeCreate))
+	if !migrate.IsValidMode(mode) {
+		returnfun.ReturnErrJson(c, "mode 只能是 create / upsert / replace")
+		return
+	}
+	dryRun := strings.ToUpper(c.Query("dryRun")) == "TRUE"
+
 	var form migrate.Migrate
 	err := c.BindJSON(&form)
 	middleware.StopExec(err)
@@ -102,43 +90,66 @@ func ImportUserApiHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
-	t := util.GetCurTime()
+	opHis := newOpHistory(c, curUser, "")
+	plan, err := migrate.Import(db, &form, mode, dryRun, opHis)
+	if err == migrate.ErrConflict {
+		returnfun.ReturnJson(c, 400, ErrCodeImportConflict, err.Error(), plan)
+		return
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, plan)
+	return
+}
 
-	var insertI []interface{}
-	for _, item := range form.Items {
-		item.DataFrom = roleapp.DataFromUser
-		item.CreateT = t
-		item.UpdateT = t
-		item.History = nil
-		insertI = append(insertI, item)
+// 同步权限策略文件
+// body 为 yaml 或 json 格式的策略文件，Content-Type 包含 json 时按 json 解析，其他按 yaml 解析
+// prune=true 时删除文件中没有的用户定义数据；dryRun=true 时只返回同步计划，不写入数据
+func SyncPolicyHandler(c *gin.Context, ds *dbandmq.Ds) {
+	curUser, _ := GetCurUserAndRole(c)
+	if curUser.IdPasswd.LoginId != userapp.AdminLoginId || !tenantapp.IsDefault(curUser.TenantId) {
+		returnfun.Return401Json(c, "不允许做此操作")
+		return
+	}
+
+	if curUser == nil {
+		returnfun.ReturnErrJson(c, "读取用户信息失败")
+		return
 	}
 
-	err = db.C(roleapp.CollectionNameItem).Insert(insertI...)
+	prune := strings.ToUpper(c.Query("prune")) == "TRUE"
+	dryRun := strings.ToUpper(c.Query("dryRun")) == "TRUE"
+
+	data, err := c.GetRawData()
 	middleware.StopExec(err)
 
-	insertI = []interface{}{}
-	for _, p := range form.Permissions {
-		p.DataFrom = roleapp.DataFromUser
-		p.CreateT = t
-		p.UpdateT = t
-		p.History = nil
-		insertI = append(insertI, p)
+	format := migrate.FormatYaml
+	if strings.Contains(c.ContentType(), "json") {
+		format = migrate.FormatJson
+	}
+	policy, err := migrate.ParsePolicy(data, format)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
 	}
-	err = db.C(roleapp.CollectionNamePermission).Insert(insertI...)
-	middleware.StopExec(err)
 
-	insertI = []interface{}{}
-	for _, r := range form.Roles {
-		r.DataFrom = roleapp.DataFromUser
-		r.CreateT = t
-		r.UpdateT = t
-		r.History = nil
-		insertI = append(insertI, r)
+	db := ds.CopyDs()
+	defer db.Close()
+
+	opHis := newOpHistory(c, curUser, "")
+	plan, err := migrate.Sync(db, policy, prune, dryRun, opHis)
+	if err == migrate.ErrConflict {
+		returnfun.ReturnJson(c, 400, ErrCodeImportConflict, err.Error(), plan)
+		return
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
 	}
-	err = db.C(roleapp.CollectionNameRole).Insert(insertI...)
-	middleware.StopExec(err)
 
-	returnfun.ReturnOKJson(c, "")
+	returnfun.ReturnOKJson(c, plan)
 	return
 }
-
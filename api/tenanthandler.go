@@ -0,0 +1,452 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// 请求头中传递租户 code
+const TenantHeader = "X-Tenant"
+
+const TenantCtxKey = "TENANTID"
+const tenantExplicitCtxKey = "TENANTEXPLICIT" // 请求头或域名明确指定了租户
+
+// 识别当前请求所属的租户
+// 优先级为 token 中的租户 > 请求头 X-Tenant > 域名绑定 > 默认租户
+// 这里处理请求头和域名，token 中的租户在 Auth 中处理
+func ResolveTenant(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	var tenant *tenantapp.Tenant
+	var err error
+	code := strings.TrimSpace(c.Request.Header.Get(TenantHeader))
+	if code != "" {
+		tenant, err = tenantapp.GetTenantByCode(db, code)
+		middleware.StopExec(err)
+		if tenant == nil {
+			returnfun.ReturnErrJson(c, tenantapp.ErrTenantNotFound.Error())
+			return
+		}
+	} else {
+		tenant, err = tenantapp.GetTenantByHost(db, c.Request.Host)
+		middleware.StopExec(err)
+	}
+
+	if tenant == nil {
+		c.Set(TenantCtxKey, tenantapp.DefaultTenantId)
+		c.Next()
+		return
+	}
+
+	if !tenant.IsActive() {
+		returnfun.Return403Json(c, tenantapp.ErrTenantSuspended.Error())
+		return
+	}
+
+	c.Set(TenantCtxKey, tenant.Id)
+	c.Set(tenantExplicitCtxKey, true)
+	c.Next()
+}
+
+// 当前请求所属的租户 id
+func GetCurTenantId(c *gin.Context) string {
+	tenantId, ok := c.Get(TenantCtxKey)
+	if !ok {
+		return tenantapp.DefaultTenantId
+	}
+	return tenantId.(string)
+}
+
+// token 验证通过后，以 token 中的租户为准
+// 请求头或域名指定了其他租户时拒绝
+func checkTokenTenant(c *gin.Context, user *userapp.User) bool {
+	tenantId := tenantapp.NormalizeId(user.TenantId)
+	if c.GetBool(tenantExplicitCtxKey) && tenantId != GetCurTenantId(c) {
+		returnfun.Return403Json(c, "token 与请求的租户不一致")
+		return false
+	}
+	c.Set(TenantCtxKey, tenantId)
+	return true
+}
+
+// 检查用户是否属于当前租户，用户不存在时交给调用方处理
+func checkUserTenant(c *gin.Context, db *dbandmq.Ds, userId string) bool {
+	user, err := userapp.GetUserById(db, userId)
+	middleware.StopExec(err)
+	if user != nil && tenantapp.NormalizeId(user.TenantId) != GetCurTenantId(c) {
+		returnfun.Return403Json(c, "无权管理该用户")
+		return false
+	}
+	return true
+}
+
+// 当前租户是否可以读取 item / permission / role
+func roleDataVisible(c *gin.Context, tenantId, dataFrom string) bool {
+	return roleapp.VisibleToTenant(tenantId, dataFrom, GetCurTenantId(c))
+}
+
+// 修改 item / permission / role 前检查数据是否属于当前租户
+// 系统内置数据只有默认租户可以修改，数据不存在时交给调用方处理
+func checkRoleDataOwner(c *gin.Context, db *dbandmq.Ds, idType, id string) bool {
+	var tenantId string
+	switch idType {
+	case roleapp.IdTypeItem:
+		item, err := roleapp.GetItemById(db, id)
+		middleware.StopExec(err)
+		if item == nil {
+			return true
+		}
+		tenantId = item.TenantId
+	case roleapp.IdTypePermission:
+		p, err := roleapp.GetPermissionById(db, id, false)
+		middleware.StopExec(err)
+		if p == nil {
+			return true
+		}
+		tenantId = p.TenantId
+	case roleapp.IdTypeRole:
+		role, err := roleapp.GetRoleById(db, id, false)
+		middleware.StopExec(err)
+		if role == nil {
+			return true
+		}
+		tenantId = role.TenantId
+	}
+
+	if tenantapp.NormalizeId(tenantId) != GetCurTenantId(c) {
+		returnfun.Return403Json(c, "无权修改此数据")
+		return false
+	}
+	return true
+}
+
+// 引用的 item / permission / role 必须对当前租户可见
+func checkRoleDataVisible(c *gin.Context, db *dbandmq.Ds, idType string, ids []string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+
+	visible := true
+	switch idType {
+	case roleapp.IdTypeItem:
+		items, err := roleapp.GetItemsByItemIds(db, ids)
+		middleware.StopExec(err)
+		for _, item := range items {
+			visible = visible && roleDataVisible(c, item.TenantId, item.DataFrom)
+		}
+	case roleapp.IdTypePermission:
+		ps, err := roleapp.GetPermissionsByPermissionIds(db, ids)
+		middleware.StopExec(err)
+		for _, p := range ps {
+			visible = visible && roleDataVisible(c, p.TenantId, p.DataFrom)
+		}
+	case roleapp.IdTypeRole:
+		roles, err := roleapp.GetRolesByRoleIds(db, ids, false)
+		middleware.StopExec(err)
+		for _, role := range roles {
+			visible = visible && roleDataVisible(c, role.TenantId, role.DataFrom)
+		}
+	}
+
+	if !visible {
+		returnfun.Return403Json(c, "包含其他租户的数据")
+		return false
+	}
+	return true
+}
+
+// 超级管理员，即默认租户的系统管理员，负责维护租户
+func isSuperAdmin(c *gin.Context) bool {
+	curUser, curRoles := GetCurUserAndRole(c)
+	if curUser == nil {
+		return false
+	}
+	return tenantapp.IsDefault(curUser.TenantId) && isAdminUser(curUser, curRoles)
+}
+
+func checkSuperAdmin(c *gin.Context) bool {
+	if !isSuperAdmin(c) {
+		returnfun.Return403Json(c, "仅超级管理员可以操作")
+		return false
+	}
+	return true
+}
+
+// 新建租户，同时创建租户的管理员账户
+// 管理员账户首次登录需要修改密码
+type CreateTenantForm struct {
+	Code         string   `json:"code" binding:"required"`
+	Name         string   `json:"name" binding:"required"`
+	Hosts        []string `json:"hosts"`
+	AdminLoginId string   `json:"adminLoginId" binding:"required"`
+	AdminPasswd  string   `json:"adminPasswd" binding:"required"`
+}
+
+func CreateTenantHandler(c *gin.Context, ds *dbandmq.Ds) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	var form CreateTenantForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	form.AdminLoginId = strings.TrimSpace(form.AdminLoginId)
+	if err = userapp.CheckLoginId(nil, form.AdminLoginId); err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+	if err = userapp.DefaultPasswdPolicy.Check(form.AdminPasswd); err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	adminRole, err := roleapp.GetRoleByName(db, tenantapp.DefaultTenantId, roleapp.AdminRoleName, false)
+	middleware.StopExec(err)
+	if adminRole == nil {
+		middleware.StopExec(errors.New("未初始化 admin 角色"))
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"code": form.Code, "name": form.Name})
+
+	tenant := &tenantapp.Tenant{
+		Id:      util.GenerateDataId(),
+		Code:    strings.TrimSpace(form.Code),
+		Name:    strings.TrimSpace(form.Name),
+		Hosts:   form.Hosts,
+		Status:  tenantapp.TenantStatusActive,
+		CreateT: util.GetCurTime(),
+	}
+	tenant.UpdateT = tenant.CreateT
+
+	err = tenantapp.CreateTenant(db, tenant)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	// 租户管理员，使用默认租户中的 admin 角色，管理范围限定在自己的租户内
+	// 管理员和授权保存失败时删除已创建的租户和账户，避免留下没有管理员的租户，重试时 code 也不会冲突
+	admin, err := userapp.NewIdPasswdAccount(db, tenant.Id, form.AdminLoginId, form.AdminPasswd, "", false, curUser.Id)
+	if err != nil {
+		_ = tenantapp.RemoveTenant(db, tenant.Id)
+		middleware.StopExec(err)
+	}
+
+	uwr := &userandrole.UserWithRole{
+		Id:       util.GenerateDataId(),
+		TenantId: tenant.Id,
+		UserId:   admin.Id,
+		UserName: admin.Name,
+		RoleIds:  []string{adminRole.Id},
+		CreateT:  util.GetCurTime(),
+	}
+	uwr.UpdateT = uwr.CreateT
+	err = userandrole.SaveUserWithRole(db, uwr, false)
+	if err != nil {
+		_ = userapp.RemoveIdPasswdAccount(db, admin.Id)
+		_ = tenantapp.RemoveTenant(db, tenant.Id)
+		middleware.StopExec(err)
+	}
+
+	// 全部成功后再记录，回滚的数据不会出现在审计日志和 webhook 中
+	err = ophistory.Record(db, opHis, ophistory.CodeTenantCreate, ophistory.TargetTenant, tenant.Id)
+	middleware.StopExec(err)
+	err = userapp.RecordAccountCreate(db, newOpHistory(c, curUser, ""), form.AdminLoginId, admin)
+	middleware.StopExec(err)
+	uwrOpHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"roleIds": uwr.RoleIds}).SetDiff(nil, uwr)
+	err = ophistory.Record(db, uwrOpHis, ophistory.CodeUwrAddRoles, ophistory.TargetUser, admin.Id)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"tenant": tenant,
+		"admin":  admin,
+	}
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 修改租户名字和绑定的域名
+type UpdateTenantForm struct {
+	Name  string   `json:"name" binding:"required"`
+	Hosts []string `json:"hosts"`
+}
+
+func UpdateTenantHandler(c *gin.Context, ds *dbandmq.Ds) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	var form UpdateTenantForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	tenant := getTenantById(c, db, c.Param("id"))
+	if tenant == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"name": form.Name, "hosts": form.Hosts})
+	err = tenantapp.UpdateTenantInfo(db, tenant.Id, strings.TrimSpace(form.Name), form.Hosts, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 暂停租户，租户下的用户无法登录，已有 token 验证失败
+type SuspendTenantForm struct {
+	Reason string `json:"reason"`
+}
+
+func SuspendTenantHandler(c *gin.Context, ds *dbandmq.Ds) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	var form SuspendTenantForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	updateTenantStatus(c, ds, tenantapp.TenantStatusSuspended, form.Reason)
+}
+
+// 恢复租户
+func ResumeTenantHandler(c *gin.Context, ds *dbandmq.Ds) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	updateTenantStatus(c, ds, tenantapp.TenantStatusActive, "")
+}
+
+func updateTenantStatus(c *gin.Context, ds *dbandmq.Ds, status, reason string) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	tenant := getTenantById(c, db, c.Param("id"))
+	if tenant == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"status": status, "reason": reason})
+	err := tenantapp.UpdateTenantStatus(db, tenant.Id, status, reason, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 读取租户明细
+func GetTenantHandler(c *gin.Context, ds *dbandmq.Ds) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	tenant := getTenantById(c, db, c.Param("id"))
+	if tenant == nil {
+		return
+	}
+
+	returnfun.ReturnOKJson(c, tenant)
+	return
+}
+
+// 搜索租户，支持 code / name 部分匹配，status 精确匹配
+func QueryTenantHandler(c *gin.Context, ds *dbandmq.Ds) {
+	if !checkSuperAdmin(c) {
+		return
+	}
+
+	var andCondition []bson.M
+
+	code := c.Query("code")
+	if code != "" {
+		andCondition = append(andCondition, bson.M{"code": bson.M{"$regex": code}})
+	}
+
+	name := c.Query("name")
+	if name != "" {
+		andCondition = append(andCondition, bson.M{"name": bson.M{"$regex": name}})
+	}
+
+	status := c.Query("status")
+	if status != "" {
+		andCondition = append(andCondition, bson.M{"status": strings.ToUpper(status)})
+	}
+
+	query := bson.M{}
+	if len(andCondition) > 0 {
+		query = bson.M{
+			"$and": andCondition,
+		}
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	Q := db.C(tenantapp.CollectionNameTenant).Find(query)
+	total, err := Q.Count()
+	middleware.StopExec(err)
+
+	var tenants []*tenantapp.Tenant
+	page, size, skip := util.GetPageAndSize(c)
+	err = Q.Sort("-createT.seconds").Skip(skip).Limit(size).All(&tenants)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"data":  tenants,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+func getTenantById(c *gin.Context, db *dbandmq.Ds, id string) *tenantapp.Tenant {
+	tenant, err := tenantapp.GetTenantById(db, id)
+	middleware.StopExec(err)
+	if tenant == nil {
+		returnfun.ReturnErrJson(c, tenantapp.ErrTenantNotFound.Error())
+		return nil
+	}
+	return tenant
+}
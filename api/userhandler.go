@@ -1,16 +1,17 @@
 package api
 
 import (
-	"fmt"
+	"errors"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis"
 	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/middleware"
 	"github.com/leyle/ginbase/returnfun"
 	"github.com/leyle/ginbase/util"
 	"github.com/leyle/smsapp"
+	"github.com/leyle/userandrole/auth"
 	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/orgapp"
 	"github.com/leyle/userandrole/roleapp"
 	"github.com/leyle/userandrole/userandrole"
 	"github.com/leyle/userandrole/userapp"
@@ -29,6 +30,8 @@ type CreateIdPasswdForm struct {
 	Passwd  string   `json:"passwd" binding:"required"`
 	Avatar  string   `json:"avatar"`  // 头像，非必输
 	RoleIds []string `json:"roleIds"` // 角色列表，非必输，此处选择的角色只能是当前用户的自身或下属角色，api 管理员不受此规则的控制
+
+	Attributes map[string]interface{} `json:"attributes"` // 自定义属性，必填属性必须传递
 }
 
 func CreateLoginIdPasswdAccountHandler(c *gin.Context, ro *UserOption) {
@@ -50,7 +53,7 @@ func CreateLoginIdPasswdAccountHandler(c *gin.Context, ro *UserOption) {
 	defer db.Close()
 
 	// 检查账户是否已存在
-	dbuser, err := userapp.GetUserByLoginId(db, form.LoginId)
+	dbuser, err := userapp.GetUserByLoginId(db, GetCurTenantId(c), form.LoginId)
 	middleware.StopExec(err)
 	if dbuser != nil {
 		returnfun.ReturnJson(c, 400, ErrCodeNameExist, "账户已存在", gin.H{"id": dbuser.Id})
@@ -62,31 +65,6 @@ func CreateLoginIdPasswdAccountHandler(c *gin.Context, ro *UserOption) {
 		return
 	}
 
-	salt := util.GenerateDataId()
-	passwd := form.Passwd + salt
-	hashP := util.Sha256(passwd)
-
-	user := &userapp.User{
-		Id:      util.GenerateDataId(),
-		Name:    form.LoginId,
-		Avatar:  form.Avatar,
-		CreateT: util.GetCurTime(),
-	}
-	user.UpdateT = user.CreateT
-
-	ulpa := &userapp.UserLoginIdPasswdAuth{
-		Id:      util.GenerateDataId(),
-		UserId:  user.Id,
-		LoginId: form.LoginId,
-		Avatar:  form.Avatar,
-		Salt:    salt,
-		Passwd:  hashP,
-		Init:    true,
-		SelfReg: false,
-		CreateT: user.CreateT,
-		UpdateT: user.CreateT,
-	}
-
 	curUser, curRoles := GetCurUserAndRole(c)
 	if curUser == nil {
 		returnfun.ReturnErrJson(c, "获取当前用户失败")
@@ -101,29 +79,36 @@ func CreateLoginIdPasswdAccountHandler(c *gin.Context, ro *UserOption) {
 		}
 	}
 
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeRole, form.RoleIds) {
+		return
+	}
+
+	attrs, err := checkCreateAttributes(db, GetCurTenantId(c), form.Attributes)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
 	// op history
-	opAction := fmt.Sprintf("新建账户密码登录方式，loginId[%s]", form.LoginId)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	user.History = append(user.History, opHis)
+	opHis := newOpHistory(c, curUser, "")
 
-	err = db.C(userapp.CollectionNameUser).Insert(user)
+	user, err := userapp.CreateIdPasswdAccount(db, GetCurTenantId(c), form.LoginId, form.Passwd, form.Avatar, false, opHis)
 	if err != nil {
 		Logger.Errorf(middleware.GetReqId(c), "注册账户[%s]失败, %s", form.LoginId, err.Error())
 		returnfun.ReturnErrJson(c, err.Error())
 		return
 	}
 
-	err = db.C(userapp.CollectionNameIdPasswd).Insert(ulpa)
+	err = userapp.SetUserAttributes(db, user.Id, attrs)
 	if err != nil {
-		Logger.Errorf(middleware.GetReqId(c), "注册账户[%s]失败，%s", form.LoginId, err.Error())
 		returnfun.ReturnErrJson(c, err.Error())
 		return
 	}
-	user.IdPasswd = ulpa
+	user.Attributes = attrs
 
-	// 如果有 roleids 信息，同步赋予
+	// 如果有 roleids 信息，同步赋予，需要审批的 role 生成授权申请
 	if len(form.RoleIds) > 0 {
-		_, err = addRoleToUser(db, curUser, user.Id, form.RoleIds)
+		_, _, err = grantRolesToUser(c, db, curUser, user.Id, form.RoleIds, 0, "")
 		middleware.StopExec(err)
 	}
 
@@ -133,7 +118,7 @@ func CreateLoginIdPasswdAccountHandler(c *gin.Context, ro *UserOption) {
 
 // 检查当前用户是否有权限操作指定的 roleIds
 func shareRoleIsValid(curUser *userapp.User, curRoles []*roleapp.Role, roleIds []string) bool {
-	if curUser.Id == userapp.AdminUserId {
+	if curUser.Id == userapp.AdminUserId() {
 		return true
 	}
 
@@ -174,73 +159,32 @@ func UpdatePasswdHandler(c *gin.Context, ro *UserOption) {
 	err := c.BindJSON(&form)
 	middleware.StopExec(err)
 
-	if len(form.Passwd) < 6 {
-		returnfun.ReturnErrJson(c, "密码过短")
+	err = passwdPolicy(ro).Check(form.Passwd)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
 		return
 	}
 
 	curUser, _ := GetCurUserAndRole(c)
-	userId := curUser.Id
 	db := ro.Ds.CopyDs()
 	defer db.Close()
 
-	err = resetPasswd(db, ro.R, userId, form.Passwd)
+	ulpa, err := userapp.GetIdPasswdAuthByUserId(db, curUser.Id)
 	middleware.StopExec(err)
-
-	// op history
-	opAction := fmt.Sprintf("用户修改自己账户的登录密码")
-	opHis := ophistory.NewOpHistory(userId, curUser.Name, opAction)
-
-	updateOp := bson.M{
-		"$push": bson.M{
-			"history": opHis,
-		},
+	if ulpa == nil {
+		returnfun.ReturnErrJson(c, "没有账户密码登录方式")
+		return
 	}
 
-	err = db.C(userapp.CollectionNameUser).UpdateId(userId, updateOp)
+	// 所有登录方式的 token 都会失效
+	opHis := newOpHistory(c, curUser, "")
+	_, err = userapp.ResetIdPasswd(db, ro.R, passwdPolicy(ro), ulpa.TenantId, ulpa.LoginId, form.Passwd, false, ophistory.CodeUserPasswd, opHis)
 	middleware.StopExec(err)
 
 	returnfun.ReturnOKJson(c, "")
 	return
 }
 
-// 重置或修改密码
-// 修改成功后，要删除调用 redis 中存储的 token 信息
-func resetPasswd(db *dbandmq.Ds, r *redis.Client, userId, newP string) error {
-	salt := util.GenerateDataId()
-	p := newP + salt
-	hashP := util.Sha256(p)
-
-	f := bson.M{
-		"userId": userId,
-	}
-
-	update := bson.M{
-		"$set": bson.M{
-			"salt":    salt,
-			"passwd":  hashP,
-			"init":    false,
-			"updateT": util.GetCurTime(),
-		},
-	}
-
-	err := db.C(userapp.CollectionNameIdPasswd).Update(f, update)
-	if err != nil {
-		Logger.Errorf("", "reset 用户[%s]passwd失败, %s", userId, err.Error())
-		return err
-	}
-
-	// 删除token
-	err = userapp.DeleteToken(r, userId, userapp.LoginTypeIdPasswd)
-	if err != nil {
-		return err
-	}
-
-	Logger.Infof("", "reset 用户[%s]密码成功", userId)
-
-	return nil
-}
-
 // 使用账户密码登录
 type LoginIdPasswdForm struct {
 	LoginId  string `json:"loginId" binding:"required"`
@@ -262,7 +206,7 @@ func LoginByIdPasswdHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
-	dbuser, err := userapp.GetUserByLoginId(db, form.LoginId)
+	dbuser, err := userapp.GetUserByLoginId(db, GetCurTenantId(c), form.LoginId)
 	middleware.StopExec(err)
 
 	if dbuser == nil {
@@ -271,7 +215,7 @@ func LoginByIdPasswdHandler(c *gin.Context, uo *UserOption) {
 	}
 
 	// 先检查是否 ban
-	if dbuser.Ban {
+	if dbuser.IsBanned() {
 		returnfun.Return401Json(c, "banned")
 		return
 	}
@@ -300,6 +244,7 @@ func LoginByIdPasswdHandler(c *gin.Context, uo *UserOption) {
 	// 记录登录信息
 	lh := &ophistory.LoginHistory{
 		Id:        util.GenerateDataId(),
+		TenantId:  GetCurTenantId(c),
 		UserId:    dbuser.Id,
 		UserName:  dbuser.Name,
 		LoginType: userapp.LoginTypeIdPasswd,
@@ -363,8 +308,7 @@ func LoginByWeChatHandler(c *gin.Context, uo *UserOption) {
 
 	wxOpt, ok := uo.WeChatOpt[platform]
 	if !ok {
-		Logger.Errorf(middleware.GetReqId(c), "发生严重错误，微信授权未做相关信息配置")
-		returnfun.ReturnJson(c, 500, 500, "微信登录未配置相关信息", "")
+		returnfun.ReturnErrJson(c, "微信登录未配置相关信息")
 		return
 	}
 
@@ -390,13 +334,13 @@ func LoginByWeChatHandler(c *gin.Context, uo *UserOption) {
 	// 新建或更新登录信息
 	db := uo.Ds.CopyDs()
 	defer db.Close()
-	user, token, err := userapp.SaveWeChatLogin(db, uo.R, &wxInfo)
+	user, token, err := userapp.SaveWeChatLogin(db, uo.R, GetCurTenantId(c), &wxInfo)
 	if err != nil {
 		returnfun.Return401Json(c, err.Error())
 		return
 	}
 
-	if user.Ban {
+	if user.IsBanned() {
 		returnfun.Return401Json(c, "banned")
 		return
 	}
@@ -408,6 +352,7 @@ func LoginByWeChatHandler(c *gin.Context, uo *UserOption) {
 	// 保存登录成功的信息
 	lh := &ophistory.LoginHistory{
 		Id:        util.GenerateDataId(),
+		TenantId:  GetCurTenantId(c),
 		UserId:    user.Id,
 		UserName:  user.Name,
 		LoginType: userapp.LoginTypeWeChat,
@@ -444,8 +389,7 @@ func LoginByWeChatXiaoChengXuHandler(c *gin.Context, uo *UserOption) {
 	platform := userapp.WeChatOptPlatformXiaoChengXu
 	wxOpt, ok := uo.WeChatOpt[platform]
 	if !ok {
-		Logger.Errorf(middleware.GetReqId(c), "发生严重错误，微信授权未做相关信息配置")
-		returnfun.ReturnJson(c, 500, 500, "微信登录未配置相关信息", "")
+		returnfun.ReturnErrJson(c, "微信登录未配置相关信息")
 		return
 	}
 
@@ -474,13 +418,13 @@ func LoginByWeChatXiaoChengXuHandler(c *gin.Context, uo *UserOption) {
 		OpenID:  c2s.OpenID,
 		Unionid: c2s.UnionID,
 	}
-	dbUser, err := userapp.GetUserByOpenId(db, wxInfo.OpenID)
+	dbUser, err := userapp.GetUserByOpenId(db, GetCurTenantId(c), wxInfo.OpenID)
 	middleware.StopExec(err)
 
 	// 1. 全新用户
 	// 存储并生成用户信息
 	if dbUser == nil {
-		_, token, err := userapp.SaveWeChatLogin(db, uo.R, wxInfo)
+		_, token, err := userapp.SaveWeChatLogin(db, uo.R, GetCurTenantId(c), wxInfo)
 		middleware.StopExec(err)
 
 		// 返回补充用户信息的提示
@@ -488,7 +432,7 @@ func LoginByWeChatXiaoChengXuHandler(c *gin.Context, uo *UserOption) {
 		return
 	}
 
-	if dbUser.Ban {
+	if dbUser.IsBanned() {
 		returnfun.Return401Json(c, "banned")
 		return
 	}
@@ -514,6 +458,7 @@ func LoginByWeChatXiaoChengXuHandler(c *gin.Context, uo *UserOption) {
 	// 保存登录成功的信息
 	lh := &ophistory.LoginHistory{
 		Id:        util.GenerateDataId(),
+		TenantId:  GetCurTenantId(c),
 		UserId:    dbUser.Id,
 		UserName:  dbUser.Name,
 		LoginType: userapp.LoginTypeWeChat,
@@ -585,6 +530,9 @@ func FullXiaoChengXuProfileHandler(c *gin.Context, uo *UserOption) {
 		"$set": bson.M{
 			"name": form.Nickname,
 		},
+		"$inc": bson.M{
+			"version": 1,
+		},
 	}
 	err = db.C(userapp.CollectionNameUser).UpdateId(curUser.Id, updateUser)
 	middleware.StopExec(err)
@@ -594,7 +542,7 @@ func FullXiaoChengXuProfileHandler(c *gin.Context, uo *UserOption) {
 		OpenID: curUser.WeChatAuth.OpenId,
 	}
 
-	user, token, err := userapp.SaveWeChatLogin(db, uo.R, wxInfo)
+	user, token, err := userapp.SaveWeChatLogin(db, uo.R, GetCurTenantId(c), wxInfo)
 	middleware.StopExec(err)
 
 	uwr, err := userandrole.GetUserRoles(db, user.Id)
@@ -603,6 +551,7 @@ func FullXiaoChengXuProfileHandler(c *gin.Context, uo *UserOption) {
 	// 保存登录成功的信息
 	lh := &ophistory.LoginHistory{
 		Id:        util.GenerateDataId(),
+		TenantId:  GetCurTenantId(c),
 		UserId:    user.Id,
 		UserName:  user.Name,
 		LoginType: userapp.LoginTypeWeChat,
@@ -633,6 +582,11 @@ type SendSmsForm struct {
 }
 
 func SendSmsHandler(c *gin.Context, uo *UserOption) {
+	if uo.PhoneOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置短信发送")
+		return
+	}
+
 	var form SendSmsForm
 	err := c.BindJSON(&form)
 	middleware.StopExec(err)
@@ -658,6 +612,11 @@ type CheckSmsForm struct {
 }
 
 func CheckSmsHandler(c *gin.Context, uo *UserOption) {
+	if uo.PhoneOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置短信发送")
+		return
+	}
+
 	var form CheckSmsForm
 	err := c.BindJSON(&form)
 	middleware.StopExec(err)
@@ -678,10 +637,10 @@ func CheckSmsHandler(c *gin.Context, uo *UserOption) {
 	// 新建或更新 phone 账户
 	db := uo.Ds.CopyDs()
 	defer db.Close()
-	user, token, err := userapp.SavePhoneLogin(db, uo.R, form.Phone)
+	user, token, err := userapp.SavePhoneLogin(db, uo.R, GetCurTenantId(c), form.Phone)
 	middleware.StopExec(err)
 
-	if user.Ban {
+	if user.IsBanned() {
 		returnfun.Return401Json(c, "banned")
 		return
 	}
@@ -693,6 +652,7 @@ func CheckSmsHandler(c *gin.Context, uo *UserOption) {
 	// 保存登录信息
 	lh := &ophistory.LoginHistory{
 		Id:        util.GenerateDataId(),
+		TenantId:  GetCurTenantId(c),
 		UserId:    user.Id,
 		UserName:  user.Name,
 		LoginType: userapp.LoginTypePhone,
@@ -750,6 +710,8 @@ type CreateLoginPhoneForm struct {
 	Phone   string   `json:"phone" binding:"required"`
 	Avatar  string   `json:"avatar"`
 	RoleIds []string `json:"roleIds"` // 角色列表，非必输，此处选择的角色只能是当前用户的自身或下属角色，api 管理员不受此规则的控制
+
+	Attributes map[string]interface{} `json:"attributes"` // 自定义属性，必填属性必须传递
 }
 
 func CreateLoginPhoneHandler(c *gin.Context, uo *UserOption) {
@@ -772,32 +734,44 @@ func CreateLoginPhoneHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
-	user, err := userapp.GetUserByPhone(db, form.Phone)
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeRole, form.RoleIds) {
+		return
+	}
+
+	user, err := userapp.GetUserByPhone(db, GetCurTenantId(c), form.Phone)
 	middleware.StopExec(err)
 	if user != nil {
 		returnfun.ReturnJson(c, 400, ErrCodeNameExist, "phone已存在", gin.H{"id": user.Id})
 		return
 	}
 
-	user, err = userapp.InitPhoneAuth(db, form.Phone, form.Avatar)
+	attrs, err := checkCreateAttributes(db, GetCurTenantId(c), form.Attributes)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	user, err = userapp.InitPhoneAuth(db, GetCurTenantId(c), form.Phone, form.Avatar, curUser.Id)
 	middleware.StopExec(err)
 
-	// 记录 ophistory
-	opAction := fmt.Sprintf("管理员给手机号[%s]初始化账户", form.Phone)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	updateOp := bson.M{
-		"$push": bson.M{
-			"history": opHis,
-		},
+	err = userapp.SetUserAttributes(db, user.Id, attrs)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
 	}
+	user.Attributes = attrs
 
-	_ = db.C(userapp.CollectionNameUser).UpdateId(user.Id, updateOp)
+	// 记录 ophistory
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"account": form.Phone})
+	opHis.SetDiff(nil, user)
+	recordErr := ophistory.Record(db, opHis, ophistory.CodeUserCreate, ophistory.TargetUser, user.Id)
 
-	// 如果有 roleids 信息，同步赋予
+	// 如果有 roleids 信息，同步赋予，需要审批的 role 生成授权申请
 	if len(form.RoleIds) > 0 {
-		_, err = addRoleToUser(db, curUser, user.Id, form.RoleIds)
+		_, _, err = grantRolesToUser(c, db, curUser, user.Id, form.RoleIds, 0, "")
 		middleware.StopExec(err)
 	}
+	middleware.StopExec(recordErr)
 
 	returnfun.ReturnOKJson(c, user)
 	return
@@ -815,6 +789,11 @@ type WeChatBindPhoneForm struct {
 }
 
 func WeChatBindPhoneHandler(c *gin.Context, uo *UserOption) {
+	if uo.PhoneOpt == nil {
+		returnfun.ReturnErrJson(c, "未配置短信发送")
+		return
+	}
+
 	var form WeChatBindPhoneForm
 	err := c.BindJSON(&form)
 	middleware.StopExec(err)
@@ -843,17 +822,18 @@ func WeChatBindPhoneHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
-	phoneUser, err := userapp.GetUserByPhone(db, form.Phone)
+	phoneUser, err := userapp.GetUserByPhone(db, GetCurTenantId(c), form.Phone)
 	middleware.StopExec(err)
 	if phoneUser == nil {
 		// 账户不存在，直接创建一个 userId 是当前微信号所属的数据
 		ph := &userapp.PhoneAuth{
-			Id:      util.GenerateDataId(),
-			UserId:  curUser.Id,
-			Phone:   form.Phone,
-			Init:    false,
-			SelfReg: true,
-			CreateT: util.GetCurTime(),
+			Id:       util.GenerateDataId(),
+			TenantId: GetCurTenantId(c),
+			UserId:   curUser.Id,
+			Phone:    form.Phone,
+			Init:     false,
+			SelfReg:  true,
+			CreateT:  util.GetCurTime(),
 		}
 		ph.UpdateT = ph.CreateT
 
@@ -861,19 +841,20 @@ func WeChatBindPhoneHandler(c *gin.Context, uo *UserOption) {
 		middleware.StopExec(err)
 
 		// op history
-		opAction := fmt.Sprintf("微信绑定手机号[%s]时，手机号不存在，创建新的 phoneAuth，并关联到当前用户下", form.Phone)
-		opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+		opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"phone": form.Phone})
 		update := bson.M{
 			"$set": bson.M{
 				"updateT": util.GetCurTime(),
 			},
-			"$push": bson.M{
-				"history": opHis,
+			"$inc": bson.M{
+				"version": 1,
 			},
 		}
 
 		err = db.C(userapp.CollectionNameUser).UpdateId(curUser.Id, update)
 		middleware.StopExec(err)
+		err = ophistory.Record(db, opHis, ophistory.CodeUserBindPhone, ophistory.TargetUser, curUser.Id)
+		middleware.StopExec(err)
 	} else {
 		// 以 phone 为主，迁移微信登录信息
 		// 1. 更新原微信 userId
@@ -891,39 +872,57 @@ func WeChatBindPhoneHandler(c *gin.Context, uo *UserOption) {
 		middleware.StopExec(err)
 
 		// 2. 更新原 wechat user 信息
-		opActionB := fmt.Sprintf("微信绑定手机号[%s]，手机账户已存在，本账户就被禁用", form.Phone)
-		opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opActionB)
+		opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+			"phone":       form.Phone,
+			"phoneUserId": phoneUser.Id,
+		})
+		before := ophistory.Snapshot(curUser)
 
 		updateB := bson.M{
 			"$set": bson.M{
 				"referId":   phoneUser.Id,
 				"ban":       true,
+				"banStartT": int64(0),
 				"banT":      math.MaxInt64,
 				"banReason": userapp.CombineAccountBanReason,
 				"updateT":   util.GetCurTime(),
 			},
-			"$push": bson.M{
-				"history": opHis,
+			"$inc": bson.M{
+				"version": 1,
 			},
 		}
 		err = db.C(userapp.CollectionNameUser).UpdateId(curUser.Id, updateB)
 		middleware.StopExec(err)
+		after := *curUser
+		after.ReferId, after.Ban, after.BanStartT, after.BanT, after.BanReason = phoneUser.Id, true, 0, math.MaxInt64, userapp.CombineAccountBanReason
+		after.Version++
+		opHis.SetDiff(before, &after)
+		// 审计日志写入失败时继续迁移，最后返回错误
+		recordErr := ophistory.Record(db, opHis, ophistory.CodeUserBindPhoneBan, ophistory.TargetUser, curUser.Id)
+
+		// 原账户被禁用，移除所有 token
+		_ = userapp.DeleteUserTokens(uo.R, curUser.Id)
 
 		// 3. 更新 phone user 信息
-		opActionC := fmt.Sprintf("微信[%s]绑定手机号[%s]，从原账户[%s]迁移过来微信信息", curUser.WeChatAuth.OpenId, form.Phone, curUser.Id)
-		opHis = ophistory.NewOpHistory(curUser.Id, curUser.Name, opActionC)
+		opHis = newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+			"phone":        form.Phone,
+			"wechatUserId": curUser.Id,
+		})
 
 		updateC := bson.M{
 			"$set": bson.M{
 				"updateT": util.GetCurTime(),
 			},
-			"$push": bson.M{
-				"history": opHis,
+			"$inc": bson.M{
+				"version": 1,
 			},
 		}
 
 		err = db.C(userapp.CollectionNameUser).UpdateId(phoneUser.Id, updateC)
 		middleware.StopExec(err)
+		err = ophistory.Record(db, opHis, ophistory.CodeUserBindPhoneMove, ophistory.TargetUser, phoneUser.Id)
+		middleware.StopExec(err)
+		middleware.StopExec(recordErr)
 	}
 	returnfun.ReturnOKJson(c, "")
 	return
@@ -951,7 +950,8 @@ func TokenCheckHandler(c *gin.Context, uo *UserOption) {
 
 	retData := &Ret{}
 
-	tVal, err := userapp.CheckToken(uo.R, form.Token)
+	// 与接口验证使用同一套逻辑，包含封禁状态的检查
+	user, err := auth.ValidateToken(AuthOption, form.Token)
 	if err != nil {
 		retData.Valid = false
 		retData.Reason = err.Error()
@@ -962,7 +962,16 @@ func TokenCheckHandler(c *gin.Context, uo *UserOption) {
 	// 读取角色
 	db := uo.Ds.CopyDs()
 	defer db.Close()
-	uwr, err := userandrole.GetUserRoles(db, tVal.User.Id)
+	uwr, err := userandrole.GetUserRoles(db, user.Id)
+	if err != nil {
+		retData.Valid = false
+		retData.Reason = err.Error()
+		returnfun.ReturnOKJson(c, retData)
+		return
+	}
+
+	// 只返回公开的自定义属性
+	user, err = publicUserView(db, user)
 	if err != nil {
 		retData.Valid = false
 		retData.Reason = err.Error()
@@ -971,7 +980,7 @@ func TokenCheckHandler(c *gin.Context, uo *UserOption) {
 	}
 
 	retData.Valid = true
-	retData.User = tVal.User
+	retData.User = user
 	retData.Roles = roleapp.RemoveDefaultRole(uwr.Roles)
 	retData.ChildrenRole = uwr.ChildrenRole
 	retData.Menus = uwr.Menus
@@ -982,10 +991,12 @@ func TokenCheckHandler(c *gin.Context, uo *UserOption) {
 }
 
 // 管理员封禁用户
+// startT 大于当前时间时为定时封禁，到时间后生效，比如合同到期时间
 type BanForm struct {
 	UserId string `json:"userId" binding:"required"`
 	Reason string `json:"reason"`
-	T      int64  `json:"t"` // 截至时间
+	StartT int64  `json:"startT"` // 生效时间，非必输，不传时立即生效
+	T      int64  `json:"t"`      // 截至时间，非必输，不传时默认封禁一年
 }
 
 func BanUserHandler(c *gin.Context, uo *UserOption) {
@@ -996,6 +1007,10 @@ func BanUserHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
+	if !checkUserScope(c, db, form.UserId) {
+		return
+	}
+
 	user, err := userapp.GetUserById(db, form.UserId)
 	middleware.StopExec(err)
 
@@ -1010,39 +1025,35 @@ func BanUserHandler(c *gin.Context, uo *UserOption) {
 		return
 	}
 
-	if user.Id == curUser.Id || user.Id == userapp.AdminUserId {
+	if user.Id == curUser.Id || user.Id == userapp.AdminUserId() {
 		returnfun.ReturnErrJson(c, "不能禁用自己")
 		return
 	}
 
-	t := time.Now().Unix() + 365*24*60*60
-	if form.T > 0 && form.T > time.Now().Unix() {
-		t = form.T
-	}
-
 	// op history
-	opAction := fmt.Sprintf("封禁用户[%s][%s], reason[%s],到期时间[%d]", user.Id, user.Name, form.Reason, t)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+	opHis := newOpHistory(c, curUser, "")
 
-	update := bson.M{
-		"$set": bson.M{
-			"ban":       true,
-			"banReason": form.Reason,
-			"banT":      t,
-			"updateT":   util.GetCurTime(),
-		},
-		"$push": bson.M{
-			"history": opHis,
-		},
+	// 审计日志写入失败时封禁已经生效，仍然强制下线，最后返回错误
+	err = userapp.BanUser(db, user.Id, form.Reason, form.StartT, form.T, opHis)
+	if err != nil && !errors.Is(err, ophistory.ErrRecordFailed) {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
 	}
+	recordErr := err
+
+	// 立即生效的封禁，移除用户所有登录方式的 token，强制下线
+	// 定时封禁在生效后由 token 验证时移除
+	if form.StartT <= time.Now().Unix() {
+		err = userapp.DeleteUserTokens(uo.R, user.Id)
+		middleware.StopExec(err)
+	}
+	middleware.StopExec(recordErr)
 
-	err = db.C(userapp.CollectionNameUser).UpdateId(user.Id, update)
-	middleware.StopExec(err)
 	returnfun.ReturnOKJson(c, "")
 	return
 }
 
-// 管理员解禁用户
+// 管理员解禁用户，同时会取消未生效的定时封禁
 type UnBanForm struct {
 	UserId string `json:"userId" binding:"required"`
 	Reason string `json:"reason"`
@@ -1056,6 +1067,10 @@ func UnBanUserHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
+	if !checkUserScope(c, db, form.UserId) {
+		return
+	}
+
 	user, err := userapp.GetUserById(db, form.UserId)
 	middleware.StopExec(err)
 
@@ -1070,22 +1085,9 @@ func UnBanUserHandler(c *gin.Context, uo *UserOption) {
 		returnfun.ReturnErrJson(c, "获取当前用户失败")
 		return
 	}
-	opAction := fmt.Sprintf("解禁用户[%s][%s], reason[%s]", user.Id, user.Name, form.Reason)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+	opHis := newOpHistory(c, curUser, "")
 
-	update := bson.M{
-		"$set": bson.M{
-			"ban":       false,
-			"banReason": form.Reason,
-			"banT":      0,
-			"updateT":   util.GetCurTime(),
-		},
-		"$push": bson.M{
-			"history": opHis,
-		},
-	}
-
-	err = db.C(userapp.CollectionNameUser).UpdateId(user.Id, update)
+	err = userapp.UnBanUser(db, user.Id, form.Reason, opHis)
 	middleware.StopExec(err)
 	returnfun.ReturnOKJson(c, "")
 	return
@@ -1104,6 +1106,10 @@ func ResetPasswdHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
+	if !checkUserScope(c, db, form.UserId) {
+		return
+	}
+
 	user, err := userapp.GetUserById(db, form.UserId)
 	middleware.StopExec(err)
 
@@ -1112,7 +1118,7 @@ func ResetPasswdHandler(c *gin.Context, uo *UserOption) {
 		return
 	}
 
-	if user.Id == userapp.AdminUserId {
+	if user.Id == userapp.AdminUserId() {
 		returnfun.Return403Json(c, "无权做此操作")
 		return
 	}
@@ -1139,24 +1145,25 @@ func ResetPasswdHandler(c *gin.Context, uo *UserOption) {
 
 	// op history
 	curUser, _ := GetCurUserAndRole(c)
-	opAction := fmt.Sprintf("重置用户[%s][%s]的密码", user.Id, user.Name)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"userName": user.Name})
 
 	updateOpHis := bson.M{
 		"$set": bson.M{
 			"updateT": util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
+		"$inc": bson.M{
+			"version": 1,
 		},
 	}
 
 	err = db.C(userapp.CollectionNameUser).UpdateId(user.Id, updateOpHis)
 	middleware.StopExec(err)
-
-	// 删除已经登录的 token
+	// 先移除 token，审计日志写入失败时密码已经修改，旧的 token 也需要失效
 	_ = userapp.DeleteToken(uo.R, user.Id, userapp.LoginTypeIdPasswd)
 
+	err = ophistory.Record(db, opHis, ophistory.CodeUserResetPasswd, ophistory.TargetUser, user.Id)
+	middleware.StopExec(err)
+
 	retData := gin.H{
 		"passwd": passwd,
 	}
@@ -1172,6 +1179,10 @@ func GetUserInfoHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
+	if !checkUserScope(c, db, userId) {
+		return
+	}
+
 	user, err := userapp.GetUserFullInfoById(db, userId)
 	middleware.StopExec(err)
 
@@ -1201,7 +1212,7 @@ func GetUserByWeChatOpenIdHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
-	dbuser, err := userapp.GetUserByOpenId(db, openId)
+	dbuser, err := userapp.GetUserByOpenId(db, GetCurTenantId(c), openId)
 	middleware.StopExec(err)
 	if dbuser == nil {
 		returnfun.ReturnErrJson(c, "无指定 openId 的用户信息")
@@ -1231,7 +1242,7 @@ func GetUserByPhoneHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
-	dbuser, err := userapp.GetUserByPhone(db, phone)
+	dbuser, err := userapp.GetUserByPhone(db, GetCurTenantId(c), phone)
 	middleware.StopExec(err)
 	if dbuser == nil {
 		returnfun.ReturnErrJson(c, "无指定 phone 的用户信息")
@@ -1260,6 +1271,10 @@ func GetUserLoginHistoryHandler(c *gin.Context, uo *UserOption) {
 	db := uo.Ds.CopyDs()
 	defer db.Close()
 
+	if !checkUserScope(c, db, userId) {
+		return
+	}
+
 	page, _, _ := util.GetPageAndSize(c)
 
 	lhs, err := ophistory.GetLoginHistoryByUserId(db, userId, page)
@@ -1284,7 +1299,7 @@ func QueryUserHandler(c *gin.Context, uo *UserOption) {
 	if loginId != "" {
 		hasArg = true
 		userIds = []string{}
-		lps, err := userapp.QueryLoginIdAuthByLoginId(db, loginId)
+		lps, err := userapp.QueryLoginIdAuthByLoginId(db, GetCurTenantId(c), loginId)
 		middleware.StopExec(err)
 		for _, lp := range lps {
 			userIds = append(userIds, lp.UserId)
@@ -1295,7 +1310,7 @@ func QueryUserHandler(c *gin.Context, uo *UserOption) {
 	if phone != "" {
 		hasArg = true
 		userIds = []string{}
-		pas, err := userapp.QueryPhoneAuthByPhone(db, phone)
+		pas, err := userapp.QueryPhoneAuthByPhone(db, GetCurTenantId(c), phone)
 		middleware.StopExec(err)
 		for _, pa := range pas {
 			userIds = append(userIds, pa.UserId)
@@ -1306,21 +1321,44 @@ func QueryUserHandler(c *gin.Context, uo *UserOption) {
 	if nickname != "" {
 		hasArg = true
 		userIds = []string{}
-		wcas, err := userapp.QueryWeChatAuthByNickname(db, nickname)
+		wcas, err := userapp.QueryWeChatAuthByNickname(db, GetCurTenantId(c), nickname)
 		middleware.StopExec(err)
 		for _, wca := range wcas {
 			userIds = append(userIds, wca.UserId)
 		}
 	}
 
-	query := bson.M{}
+	// 按部门搜索，包含所有下级部门的成员
+	orgId := c.Query("orgid")
+	if orgId != "" {
+		orgIds, err := orgapp.SubtreeIds(db, []string{orgId})
+		middleware.StopExec(err)
+		orgUserIds, err := orgapp.GetOrgMemberUserIds(db, orgIds)
+		middleware.StopExec(err)
+		userIds = intersectIds(userIds, orgUserIds, hasArg)
+		hasArg = true
+	}
+
+	// 部门负责人只能搜索到自己管理范围内的用户
+	scopeUserIds, err := getManageScope(c, db).UserIds(db)
+	middleware.StopExec(err)
+	if scopeUserIds != nil {
+		userIds = intersectIds(userIds, scopeUserIds, hasArg)
+		hasArg = true
+	}
+
+	// 按自定义属性搜索，可以与上面的条件同时使用
+	query, err := attrQuery(c, db)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
 	if hasArg {
-		query = bson.M{
-			"_id": bson.M{
-				"$in": userIds,
-			},
+		query["_id"] = bson.M{
+			"$in": userIds,
 		}
 	}
+	query["tenantId"] = GetCurTenantId(c)
 
 	Q := db.C(userapp.CollectionNameUser).Find(query)
 	total, err := Q.Count()
@@ -1341,3 +1379,20 @@ func QueryUserHandler(c *gin.Context, uo *UserOption) {
 	returnfun.ReturnOKJson(c, retData)
 	return
 }
+
+// 取两个 id 列表的交集，hasA 为 false 时 a 未作为条件使用，直接返回 b
+func intersectIds(a, b []string, hasA bool) []string {
+	if !hasA {
+		return b
+	}
+	ret := []string{}
+	for _, id := range a {
+		for _, v := range b {
+			if id == v {
+				ret = append(ret, id)
+				break
+			}
+		}
+	}
+	return ret
+}
@@ -8,6 +8,9 @@ import (
 	"github.com/leyle/ginbase/middleware"
 	"github.com/leyle/ginbase/returnfun"
 	"github.com/leyle/smsapp"
+	"github.com/leyle/userandrole/emailapp"
+	"github.com/leyle/userandrole/ldapapp"
+	"github.com/leyle/userandrole/ophistory"
 	"github.com/leyle/userandrole/auth"
 	"github.com/leyle/userandrole/roleapp"
 	"github.com/leyle/userandrole/userapp"
@@ -23,6 +26,11 @@ type UserOption struct {
 	R *redis.Client
 	WeChatOpt map[string]*userapp.WeChatOption // 微信配置， key 是平台
 	PhoneOpt *smsapp.SmsOption // phone 发送配置
+	LdapOpt *ldapapp.LdapOption // ldap 登录配置，为 nil 时不启用
+	EmailOpt *emailapp.EmailOption // 邮件发送配置，为 nil 时不支持邮箱验证
+	RegOpt *RegisterOption // 自助注册配置，为 nil 时不开放注册
+	ForgotOpt *ForgotPasswdOption // 找回密码配置，为 nil 时不开放找回密码
+	ProfileOpt *ProfileOption // 用户资料可修改字段配置，为 nil 时使用默认配置
 }
 
 // 要求所有接口都登录才行？或者说，使用这个方法的接口的，默认必须要验证的
@@ -50,6 +58,9 @@ func Auth(c *gin.Context) {
 		returnfun.Return403Json(c, "Need Change passwd first")
 		return
 	case auth.AuthResultOK:
+		if !checkTokenTenant(c, result.User) {
+			return
+		}
 		c.Set(AuthResultCtxKey, result)
 	}
 	c.Next()
@@ -65,6 +76,15 @@ func GetCurUserAndRole(c *gin.Context) (*userapp.User, []*roleapp.Role) {
 	return result.User, result.Roles
 }
 
+// 新建操作记录，带上当前请求的租户、请求 id 和 ip，写入审计日志
+func newOpHistory(c *gin.Context, user *userapp.User, action string) *ophistory.OperationHistory {
+	opHis := ophistory.NewOpHistory(user.Id, user.Name, action)
+	opHis.TenantId = GetCurTenantId(c)
+	opHis.ReqId = middleware.GetReqId(c)
+	opHis.Ip = c.ClientIP()
+	return opHis
+}
+
 func debugPrintUserRoleInfo(c *gin.Context, result *auth.AuthResult) {
 	if result.User == nil {
 		return
@@ -2,24 +2,29 @@ package api
 
 import (
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/middleware"
 	"github.com/leyle/ginbase/returnfun"
 	"github.com/leyle/ginbase/util"
-	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/approvalapp"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
 	"github.com/leyle/userandrole/userandrole"
 	"github.com/leyle/userandrole/userapp"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 // uwr means user with role
 
 // 给用户添加 roles
+// 需要审批的 role 不直接赋予，而是生成待审批的授权申请
 type AddRolesToUserForm struct {
 	UserId string `json:"userId" binding:"required"`
 	RoleIds []string `json:"roleIds" binding:"required"`
+	ExpireT int64 `json:"expireT"` // 授权到期时间，unix 秒，非必输，不传表示长期有效
+	Reason string `json:"reason"` // 授权理由，生成授权申请时展示给审批人
 }
 func AddRolesToUserHandler(c *gin.Context, ds *dbandmq.Ds) {
 	var form AddRolesToUserForm
@@ -41,48 +46,43 @@ func AddRolesToUserHandler(c *gin.Context, ds *dbandmq.Ds) {
 		return
 	}
 
-	// 不用锁定数据，低频操作
-	uwr, err := addRoleToUser(db, curUser, form.UserId, form.RoleIds)
-	middleware.StopExec(err)
+	if !checkUserScope(c, db, form.UserId) {
+		return
+	}
 
-	returnfun.ReturnOKJson(c, uwr)
-	return
-}
+	if !checkRoleDataVisible(c, db, roleapp.IdTypeRole, form.RoleIds) {
+		return
+	}
 
-func addRoleToUser(db *dbandmq.Ds, curUser *userapp.User, userId string, roleIds []string) (*userandrole.UserWithRole, error) {
-	// 检查 uwr 是否存在，不存在新建，存在就是更新
-	uwr, err := userandrole.GetUserWithRoleByUserId(db, userId)
+	err = approvalapp.CheckExpireT(form.ExpireT, time.Now().Unix())
 	if err != nil {
-		return nil, err
-	}
-	update := true
-	if uwr == nil {
-		update = false
-		uwr = &userandrole.UserWithRole{
-			Id:       util.GenerateDataId(),
-			UserId:   userId,
-			RoleIds:  roleIds,
-			CreateT:  util.GetCurTime(),
-		}
-		uwr.UpdateT = uwr.CreateT
-	} else {
-		uwr.RoleIds = append(uwr.RoleIds, roleIds...)
+		returnfun.ReturnErrJson(c, err.Error())
+		return
 	}
-	uwr.RoleIds = util.UniqueStringArray(uwr.RoleIds)
 
-	opAction := fmt.Sprintf("给用户[%s]添加roleIds %s", userId, roleIds)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	uwr.History = append(uwr.History, opHis)
+	// 不用锁定数据，低频操作
+	uwr, reqs, err := grantRolesToUser(c, db, curUser, form.UserId, form.RoleIds, form.ExpireT, form.Reason)
+	middleware.StopExec(err)
 
-	err = userandrole.SaveUserWithRole(db, uwr, update)
-	if err != nil {
-		return nil, err
+	// 全部直接赋予时返回值与之前保持一致
+	if len(reqs) == 0 {
+		returnfun.ReturnOKJson(c, uwr)
+		return
 	}
 
-	// 同步追加操作记录到对应的用户上
-	_ = userapp.AppendOpHistoryToUser(db, userId, opHis)
+	retData := gin.H{
+		"userWithRole":    uwr,
+		"pendingRequests": reqs,
+	}
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
 
-	return uwr, nil
+// expireT 为 0 表示长期有效
+func addRoleToUser(c *gin.Context, db *dbandmq.Ds, curUser *userapp.User, userId string, roleIds []string, expireT int64) (*userandrole.UserWithRole, error) {
+	// 操作人与用户属于同一个租户
+	opHis := newOpHistory(c, curUser, "")
+	return userandrole.AddUserRoles(db, tenantapp.NormalizeId(curUser.TenantId), userId, roleIds, expireT, opHis)
 }
 
 // 取消 用户的某些 roles
@@ -105,6 +105,10 @@ func RemoveRolesFromUserHandler(c *gin.Context, ds *dbandmq.Ds) {
 		return
 	}
 
+	if !checkUserScope(c, db, form.UserId) {
+		return
+	}
+
 	uwr, err := userandrole.GetUserWithRoleByUserId(db, form.UserId)
 	middleware.StopExec(err)
 	if uwr == nil {
@@ -112,33 +116,10 @@ func RemoveRolesFromUserHandler(c *gin.Context, ds *dbandmq.Ds) {
 		return
 	}
 
-	var remainIds []string
-	for _, dbr := range uwr.RoleIds {
-		remain := true
-		for _, rid := range form.RoleIds {
-			if dbr == rid {
-				remain = false
-				break
-			}
-		}
-		if remain {
-			remainIds = append(remainIds, dbr)
-		}
-	}
-
-	uwr.RoleIds = remainIds
-	uwr.UpdateT = util.GetCurTime()
-
-	// op history
-	opAction := fmt.Sprintf("移除用户 roleIds %s", form.RoleIds)
-	opHis := ophistory.NewOpHistory(curUser.Id, curUser.Name, opAction)
-	uwr.History = append(uwr.History, opHis)
-
-	err = userandrole.UpdateUserWithRole(db, uwr)
+	opHis := newOpHistory(c, curUser, "")
+	err = userandrole.RemoveUserRoles(db, uwr, form.RoleIds, opHis)
 	middleware.StopExec(err)
 
-	// 同步操作记录到用户历史记录
-	_ = userapp.AppendOpHistoryToUser(db, form.UserId, opHis)
 	returnfun.ReturnOKJson(c, uwr)
 	return
 }
@@ -149,6 +130,10 @@ func GetUserRolesHandler(c *gin.Context, ds *dbandmq.Ds) {
 	db := ds.CopyDs()
 	defer db.Close()
 
+	if !checkUserScope(c, db, id) {
+		return
+	}
+
 	uwr, err := userandrole.GetUserRoles(db, id)
 	middleware.StopExec(err)
 	if uwr == nil {
@@ -160,16 +145,74 @@ func GetUserRolesHandler(c *gin.Context, ds *dbandmq.Ds) {
 	return
 }
 
+// 明确指定由某个用户管理的其他用户，被管理的用户在 managerId 的管理范围内
+// 操作人需要同时能管理 managerId 和这些用户
+type ManageUsersForm struct {
+	ManagerId string   `json:"managerId" binding:"required"`
+	UserIds   []string `json:"userIds" binding:"required"`
+}
+
+func AddManagedUsersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateManagedUsers(c, ds, true)
+}
+
+func RemoveManagedUsersHandler(c *gin.Context, ds *dbandmq.Ds) {
+	updateManagedUsers(c, ds, false)
+}
+
+func updateManagedUsers(c *gin.Context, ds *dbandmq.Ds, add bool) {
+	var form ManageUsersForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	for _, userId := range append([]string{form.ManagerId}, form.UserIds...) {
+		if !checkUserScope(c, db, userId) {
+			return
+		}
+	}
+
+	var userIds []string
+	for _, userId := range form.UserIds {
+		if userId != form.ManagerId {
+			userIds = append(userIds, userId)
+		}
+	}
+	if len(userIds) == 0 {
+		returnfun.ReturnErrJson(c, "不能管理自己")
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "")
+	err = userandrole.UpdateManageUsers(db, GetCurTenantId(c), form.ManagerId, userIds, add, opHis)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
 // 读取授权了的用户列表
 func QueryUWRHandler(c *gin.Context, ds *dbandmq.Ds) {
 	var uwrs []*userandrole.UserWithRole
 	page, size, skip := util.GetPageAndSize(c)
 
-	query := bson.M{}
+	query := bson.M{
+		"tenantId": GetCurTenantId(c),
+	}
 
 	db := ds.CopyDs()
 	defer db.Close()
 
+	// 只能看到自己管理范围内的用户
+	scopeUserIds, err := getManageScope(c, db).UserIds(db)
+	middleware.StopExec(err)
+	if scopeUserIds != nil {
+		query["userId"] = bson.M{"$in": scopeUserIds}
+	}
+
 	Q := db.C(userandrole.CollectionNameUserWithRole).Find(query)
 	total, err := Q.Count()
 	middleware.StopExec(err)
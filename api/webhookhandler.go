@@ -0,0 +1,283 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/middleware"
+	"github.com/leyle/ginbase/returnfun"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/webhookapp"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// webhook 订阅管理
+// 用户和权限数据变化时，向订阅了对应事件的地址发送签名的 POST 请求，失败后按间隔重试
+
+// 新建 webhook，secret 为空时自动生成，只在新建和重置时返回
+type CreateWebhookForm struct {
+	Url         string   `json:"url" binding:"required"`
+	Description string   `json:"description"`
+	Secret      string   `json:"secret"`
+	Events      []string `json:"events" binding:"required"`
+}
+
+func CreateWebhookHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form CreateWebhookForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"url": form.Url, "events": form.Events})
+	w, err := webhookapp.CreateWebhook(db, GetCurTenantId(c), form.Url, form.Description, form.Secret, form.Events, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	retData := gin.H{
+		"webhook": w,
+		"secret":  w.Secret,
+	}
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 修改 webhook
+type UpdateWebhookForm struct {
+	Url         string   `json:"url" binding:"required"`
+	Description string   `json:"description"`
+	Events      []string `json:"events" binding:"required"`
+	Enable      bool     `json:"enable"`
+}
+
+func UpdateWebhookHandler(c *gin.Context, ds *dbandmq.Ds) {
+	var form UpdateWebhookForm
+	err := c.BindJSON(&form)
+	middleware.StopExec(err)
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	w := getTenantWebhook(c, db, c.Param("id"))
+	if w == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{
+		"url":    form.Url,
+		"events": form.Events,
+		"enable": form.Enable,
+	})
+	err = webhookapp.UpdateWebhook(db, w, form.Url, form.Description, form.Events, form.Enable, opHis)
+	if errors.Is(err, ophistory.ErrRecordFailed) {
+		middleware.StopExec(err)
+	}
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, w)
+	return
+}
+
+// 重置签名密钥
+func ResetWebhookSecretHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	w := getTenantWebhook(c, db, c.Param("id"))
+	if w == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"url": w.Url})
+	err := webhookapp.ResetWebhookSecret(db, w, opHis)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"webhook": w,
+		"secret":  w.Secret,
+	}
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 删除 webhook，投递日志保留
+func DeleteWebhookHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	w := getTenantWebhook(c, db, c.Param("id"))
+	if w == nil {
+		return
+	}
+
+	curUser, _ := GetCurUserAndRole(c)
+	opHis := newOpHistory(c, curUser, "").SetParams(ophistory.Params{"url": w.Url})
+	err := webhookapp.DeleteWebhook(db, w, opHis)
+	middleware.StopExec(err)
+
+	returnfun.ReturnOKJson(c, "")
+	return
+}
+
+// 读取 webhook 明细
+func GetWebhookHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	w := getTenantWebhook(c, db, c.Param("id"))
+	if w == nil {
+		return
+	}
+
+	returnfun.ReturnOKJson(c, w)
+	return
+}
+
+// 搜索 webhook，可以按订阅的事件过滤
+func QueryWebhookHandler(c *gin.Context, ds *dbandmq.Ds) {
+	query := bson.M{
+		"tenantId": GetCurTenantId(c),
+	}
+
+	event := c.Query("event")
+	if event != "" {
+		query["events"] = event
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	Q := db.C(webhookapp.CollectionNameWebhook).Find(query)
+	total, err := Q.Count()
+	middleware.StopExec(err)
+
+	var ws []*webhookapp.Webhook
+	page, size, skip := util.GetPageAndSize(c)
+	err = Q.Sort("-_id").Skip(skip).Limit(size).All(&ws)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"data":  ws,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 支持订阅的事件
+func GetWebhookEventsHandler(c *gin.Context) {
+	returnfun.ReturnOKJson(c, webhookapp.Events)
+	return
+}
+
+// 搜索投递日志
+// 可以按 webhook、事件 id、事件和投递状态过滤，按时间倒序
+func QueryWebhookDeliveryHandler(c *gin.Context, ds *dbandmq.Ds) {
+	query := bson.M{
+		"tenantId": GetCurTenantId(c),
+	}
+
+	for _, key := range []string{"webhookId", "eventId", "event"} {
+		val := c.Query(key)
+		if val != "" {
+			query[key] = val
+		}
+	}
+	status := strings.ToUpper(c.Query("status"))
+	if status != "" {
+		query["status"] = status
+	}
+
+	db := ds.CopyDs()
+	defer db.Close()
+
+	Q := db.C(webhookapp.CollectionNameDelivery).Find(query)
+	total, err := Q.Count()
+	middleware.StopExec(err)
+
+	var dls []*webhookapp.Delivery
+	page, size, skip := util.GetPageAndSize(c)
+	err = Q.Sort("-createT.seconds").Skip(skip).Limit(size).All(&dls)
+	middleware.StopExec(err)
+
+	retData := gin.H{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"data":  dls,
+	}
+
+	returnfun.ReturnOKJson(c, retData)
+	return
+}
+
+// 读取投递记录明细
+func GetWebhookDeliveryHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	d := getTenantDelivery(c, db, c.Param("id"))
+	if d == nil {
+		return
+	}
+
+	returnfun.ReturnOKJson(c, d)
+	return
+}
+
+// 手动重新投递，生成一条新的投递记录
+func RedeliverWebhookHandler(c *gin.Context, ds *dbandmq.Ds) {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	d := getTenantDelivery(c, db, c.Param("id"))
+	if d == nil {
+		return
+	}
+
+	nd, err := webhookapp.Redeliver(db, d)
+	if err != nil {
+		returnfun.ReturnErrJson(c, err.Error())
+		return
+	}
+
+	returnfun.ReturnOKJson(c, nd)
+	return
+}
+
+func getTenantWebhook(c *gin.Context, db *dbandmq.Ds, id string) *webhookapp.Webhook {
+	w, err := webhookapp.GetWebhookById(db, id)
+	middleware.StopExec(err)
+	if w == nil || w.TenantId != GetCurTenantId(c) {
+		returnfun.ReturnErrJson(c, webhookapp.ErrWebhookNotFound.Error())
+		return nil
+	}
+	return w
+}
+
+func getTenantDelivery(c *gin.Context, db *dbandmq.Ds, id string) *webhookapp.Delivery {
+	d, err := webhookapp.GetDeliveryById(db, id)
+	middleware.StopExec(err)
+	if d == nil || d.TenantId != GetCurTenantId(c) {
+		returnfun.ReturnErrJson(c, webhookapp.ErrDeliveryNotFound.Error())
+		return nil
+	}
+	return d
+}
@@ -0,0 +1,43 @@
+package approvalapp
+
+import "testing"
+
+func TestCanReview(t *testing.T) {
+	req := &GrantRequest{
+		UserId:          "u1",
+		RequesterId:     "u2",
+		ApproverRoleIds: []string{"r1"},
+	}
+
+	cases := []struct {
+		reviewerId string
+		roleIds    []string
+		isAdmin    bool
+		ok         bool
+	}{
+		{"u3", []string{"r1"}, false, true},
+		{"u3", []string{"r2"}, false, false},
+		{"u3", nil, true, true},
+		{"u1", []string{"r1"}, true, false}, // 被授权的用户
+		{"u2", []string{"r1"}, true, false}, // 申请人
+	}
+
+	for i, tc := range cases {
+		if req.CanReview(tc.reviewerId, tc.roleIds, tc.isAdmin) != tc.ok {
+			t.Errorf("case %d: CanReview = %v, want %v", i, !tc.ok, tc.ok)
+		}
+	}
+}
+
+func TestCheckExpireT(t *testing.T) {
+	now := int64(1600000000)
+	if CheckExpireT(0, now) != nil {
+		t.Error("0 表示长期有效")
+	}
+	if CheckExpireT(now+1, now) != nil {
+		t.Error("未来时间应当有效")
+	}
+	if CheckExpireT(now, now) == nil {
+		t.Error("当前时间应当无效")
+	}
+}
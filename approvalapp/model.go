@@ -0,0 +1,228 @@
+package approvalapp
+
+import (
+	"errors"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 授权申请
+// 给用户赋予需要审批的 role 时，不直接生效，而是生成待审批的申请
+// 用户也可以自己申请 role，审批通过后才赋予
+const CollectionNameGrantRequest = "roleGrantRequest"
+
+var IKGrantRequest = &dbandmq.IndexKey{
+	Collection:    CollectionNameGrantRequest,
+	SingleKey:     []string{"tenantId", "userId", "roleId", "requesterId", "approverRoleIds", "status"},
+	CompositeKeys: [][]string{{"userId", "roleId", "status"}},
+}
+
+// 申请状态
+const (
+	StatusPending  = "PENDING"  // 待审批
+	StatusApproved = "APPROVED" // 已通过，role 已赋予
+	StatusRejected = "REJECTED" // 已拒绝
+	StatusCanceled = "CANCELED" // 申请人撤回
+)
+
+// 申请来源
+const (
+	SourceGrant = "GRANT" // 管理员给用户赋予 role
+	SourceApply = "APPLY" // 用户自己申请
+)
+
+type GrantRequest struct {
+	Id       string `json:"id" bson:"_id"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
+
+	// 被授权的用户和 role
+	UserId   string `json:"userId" bson:"userId"`
+	UserName string `json:"userName" bson:"userName"`
+	RoleId   string `json:"roleId" bson:"roleId"`
+	RoleName string `json:"roleName" bson:"roleName"`
+
+	// 创建申请时从 role 上复制，为空时只有管理员可以审批
+	ApproverRoleIds []string `json:"approverRoleIds" bson:"approverRoleIds"`
+
+	Source        string `json:"source" bson:"source"`
+	RequesterId   string `json:"requesterId" bson:"requesterId"`
+	RequesterName string `json:"requesterName" bson:"requesterName"`
+	Reason        string `json:"reason" bson:"reason"`
+
+	// 授权到期时间，unix 秒，0 表示长期有效
+	ExpireT int64 `json:"expireT" bson:"expireT"`
+
+	Status       string `json:"status" bson:"status"`
+	ReviewerId   string `json:"reviewerId" bson:"reviewerId"`
+	ReviewerName string `json:"reviewerName" bson:"reviewerName"`
+	Comment      string `json:"comment" bson:"comment"`
+
+	CreateT *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT *util.CurTime `json:"updateT" bson:"updateT"`
+}
+
+var (
+	ErrRequestNotFound   = errors.New("无指定id的授权申请")
+	ErrRequestNotPending = errors.New("授权申请已处理")
+	ErrInvalidExpireT    = errors.New("授权到期时间必须晚于当前时间")
+)
+
+// 检查授权到期时间，0 表示长期有效
+func CheckExpireT(expireT, now int64) error {
+	if expireT != 0 && expireT <= now {
+		return ErrInvalidExpireT
+	}
+	return nil
+}
+
+// 审批人不能是被授权的用户，也不能是申请人
+// 管理员可以审批所有申请，其他人需要拥有申请上的某个审批 role
+func (r *GrantRequest) CanReview(reviewerId string, reviewerRoleIds []string, isAdmin bool) bool {
+	if reviewerId == r.UserId || reviewerId == r.RequesterId {
+		return false
+	}
+	if isAdmin {
+		return true
+	}
+	for _, rid := range reviewerRoleIds {
+		for _, aid := range r.ApproverRoleIds {
+			if rid == aid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func GetGrantRequestById(db *dbandmq.Ds, id string) (*GrantRequest, error) {
+	var req *GrantRequest
+	err := db.C(CollectionNameGrantRequest).FindId(id).One(&req)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取授权申请失败, %s", id, err.Error())
+		return nil, err
+	}
+	return req, nil
+}
+
+// 读取用户对某个 role 待审批的申请
+func GetPendingRequest(db *dbandmq.Ds, userId, roleId string) (*GrantRequest, error) {
+	f := bson.M{
+		"userId": userId,
+		"roleId": roleId,
+		"status": StatusPending,
+	}
+	var req *GrantRequest
+	err := db.C(CollectionNameGrantRequest).Find(f).One(&req)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "读取用户[%s]role[%s]待审批的申请失败, %s", userId, roleId, err.Error())
+		return nil, err
+	}
+	return req, nil
+}
+
+// 新建授权申请，同一个用户同一个 role 已有待审批的申请时直接返回已有的申请
+func CreateGrantRequest(db *dbandmq.Ds, req *GrantRequest, opHis *ophistory.OperationHistory) (*GrantRequest, error) {
+	dbreq, err := GetPendingRequest(db, req.UserId, req.RoleId)
+	if err != nil {
+		return nil, err
+	}
+	if dbreq != nil {
+		return dbreq, nil
+	}
+
+	req.Id = util.GenerateDataId()
+	req.Status = StatusPending
+	req.CreateT = util.GetCurTime()
+	req.UpdateT = req.CreateT
+	if req.ApproverRoleIds == nil {
+		req.ApproverRoleIds = []string{}
+	}
+
+	err = db.C(CollectionNameGrantRequest).Insert(req)
+	if err != nil {
+		Logger.Errorf("", "新建用户[%s]role[%s]的授权申请失败, %s", req.UserId, req.RoleId, err.Error())
+		return nil, err
+	}
+	err = ophistory.Record(db, opHis, ophistory.CodeGrantRequestCreate, ophistory.TargetGrantRequest, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// 申请状态对应的审计日志操作类型
+func StatusCode(status string) string {
+	switch status {
+	case StatusApproved:
+		return ophistory.CodeGrantRequestApproved
+	case StatusRejected:
+		return ophistory.CodeGrantRequestRejected
+	case StatusCanceled:
+		return ophistory.CodeGrantRequestCanceled
+	}
+	return ophistory.CodeGrantRequestCreate
+}
+
+// 处理待审批的申请，审批通过、拒绝或撤回
+// 带状态条件更新，同一个申请只会被处理一次
+func CloseGrantRequest(db *dbandmq.Ds, req *GrantRequest, status, reviewerId, reviewerName, comment string, opHis *ophistory.OperationHistory) error {
+	f := bson.M{
+		"_id":    req.Id,
+		"status": StatusPending,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":       status,
+			"reviewerId":   reviewerId,
+			"reviewerName": reviewerName,
+			"comment":      comment,
+			"updateT":      util.GetCurTime(),
+		},
+	}
+	err := db.C(CollectionNameGrantRequest).Update(f, update)
+	if err == mgo.ErrNotFound {
+		return ErrRequestNotPending
+	}
+	if err != nil {
+		Logger.Errorf("", "更新授权申请[%s]状态为[%s]失败, %s", req.Id, status, err.Error())
+		return err
+	}
+
+	req.Status = status
+	req.ReviewerId = reviewerId
+	req.ReviewerName = reviewerName
+	req.Comment = comment
+	return ophistory.Record(db, opHis, StatusCode(status), ophistory.TargetGrantRequest, req.Id)
+}
+
+// 审批通过后赋予 role 失败时，恢复为待审批，可以重新审批
+func ReopenGrantRequest(db *dbandmq.Ds, req *GrantRequest) error {
+	f := bson.M{
+		"_id":    req.Id,
+		"status": StatusApproved,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":       StatusPending,
+			"reviewerId":   "",
+			"reviewerName": "",
+			"comment":      "",
+			"updateT":      util.GetCurTime(),
+		},
+	}
+	err := db.C(CollectionNameGrantRequest).Update(f, update)
+	if err != nil {
+		Logger.Errorf("", "恢复授权申请[%s]为待审批失败, %s", req.Id, err.Error())
+		return err
+	}
+
+	req.Status = StatusPending
+	req.ReviewerId = ""
+	req.ReviewerName = ""
+	req.Comment = ""
+	return nil
+}
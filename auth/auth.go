@@ -6,7 +6,10 @@ import (
 	"github.com/go-redis/redis"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/userandrole/changebus"
+	"github.com/leyle/userandrole/ophistory"
 	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
 	"github.com/leyle/userandrole/userandrole"
 	"github.com/leyle/userandrole/userapp"
 	. "github.com/leyle/ginbase/consolelog"
@@ -27,7 +30,7 @@ func (o *Option) InitAuth() error {
 	defer ao.close()
 
 	// 初始化adminid
-	admin, err := userapp.GetUserByLoginId(ao.db, userapp.AdminLoginId)
+	admin, err := userapp.GetUserByLoginId(ao.db, tenantapp.DefaultTenantId, userapp.AdminLoginId)
 	if err != nil {
 		return err
 	}
@@ -35,10 +38,10 @@ func (o *Option) InitAuth() error {
 		Logger.Errorf("", "读取admin账户信息为空，也许是你的数据库配置错误？")
 		return errors.New("读取admin账户信息为空，也许是数据库配置错误")
 	}
-	userapp.AdminUserId = admin.Id
+	userapp.SetAdminUserId(admin.Id)
 
 	// 初始化默认用户id
-	defaultRole, err := roleapp.GetRoleByName(ao.db, roleapp.DefaultRoleName, false)
+	defaultRole, err := roleapp.GetRoleByName(ao.db, tenantapp.DefaultTenantId, roleapp.DefaultRoleName, false)
 	if err != nil {
 		return err
 	}
@@ -46,7 +49,7 @@ func (o *Option) InitAuth() error {
 		Logger.Errorf("", "读取默认角色信息为空，也许是你的数据库配置错误？")
 		return errors.New("读取默认角色信息为空，也许是数据库配置错误")
 	}
-	roleapp.DefaultRoleId = defaultRole.Id
+	roleapp.SetDefaultRoleId(defaultRole.Id)
 
 	// 载入不可修改信息
 	err = roleapp.LoadCanNotModifyIds(ao.db)
@@ -57,6 +60,48 @@ func (o *Option) InitAuth() error {
 	return nil
 }
 
+// 多实例部署时，订阅数据变化通知，重新加载本地缓存的数据
+// 需要在 InitAuth 之后调用
+func (o *Option) SubscribeChanges() {
+	reloadRoleIds := func(ev *changebus.Event) {
+		db := o.Ds.CopyDs()
+		defer db.Close()
+		_ = roleapp.ReloadSystemIds(db)
+	}
+	changebus.OnChange(reloadRoleIds, changebus.KindRole, changebus.KindPermission, changebus.KindItem)
+
+	// 只有新建、合并用户或者修改了 admin 本身时才需要重新读取
+	// 其他的用户修改很频繁，本实例的通知在请求中同步处理，不能每次都查询数据库
+	reloadAdminId := func(ev *changebus.Event) {
+		if !adminIdMayChange(ev) {
+			return
+		}
+		db := o.Ds.CopyDs()
+		defer db.Close()
+		_ = userapp.ReloadAdminUserId(db)
+	}
+	changebus.OnChange(reloadAdminId, changebus.KindUser)
+
+	changebus.Start(o.R)
+}
+
+func adminIdMayChange(ev *changebus.Event) bool {
+	switch ev.Code {
+	case ophistory.CodeUserCreate, ophistory.CodeUserRegister, ophistory.CodeUserMerge, ophistory.CodeUserUnMerge, changebus.CodeResync:
+		return true
+	}
+	adminId := userapp.AdminUserId()
+	if adminId == "" {
+		return true
+	}
+	for _, id := range ev.Ids {
+		if id == adminId {
+			return true
+		}
+	}
+	return false
+}
+
 func (ao *Option) new() *Option {
 	db := ao.Ds.CopyDs()
 	newAo := &Option{
@@ -93,6 +138,7 @@ func NewAuthResult() *AuthResult {
 }
 
 var NoPermission = errors.New("无当前资源权限")
+var ErrUserBanned = errors.New("banned")
 
 // resource 可以为空，为空时不校验
 func AuthLoginAndRole(ao *Option, token, method, uri, resource string) *AuthResult {
@@ -145,16 +191,74 @@ func AuthLoginAndRole(ao *Option, token, method, uri, resource string) *AuthResu
 	return ar
 }
 
+// 只验证 token，不验证权限
+func ValidateToken(ao *Option, token string) (*userapp.User, error) {
+	newAo := ao.new()
+	defer newAo.close()
+
+	return AuthToken(newAo, token)
+}
+
 // 验证 token
 // token 有效时，返回 user 信息
+// 封禁状态以数据库中的当前数据为准，不使用登录时缓存的 user 信息
 func AuthToken(ao *Option, token string) (*userapp.User, error) {
 	tkVal, err := userapp.CheckToken(ao.R, token)
 	if err != nil {
 		Logger.Errorf("", "AuthToken 时，token验证失败, %s", err.Error())
 		return nil, err
 	}
+	user := tkVal.User
+
+	dbUser, err := userapp.GetUserById(ao.db, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if dbUser == nil {
+		Logger.Errorf("", "AuthToken 时，用户[%s]不存在", user.Id)
+		_ = userapp.DeleteUserTokens(ao.R, user.Id)
+		return nil, errors.New("用户不存在")
+	}
+
+	// 封禁到期或者定时封禁生效，都以当前时间判断
+	if dbUser.IsBanned() {
+		Logger.Infof("", "AuthToken 时，用户[%s]已被封禁，移除所有token", user.Id)
+		_ = userapp.DeleteUserTokens(ao.R, user.Id)
+		return nil, ErrUserBanned
+	}
+
+	// 租户暂停期间 token 验证失败，恢复后可以继续使用
+	tenant, err := tenantapp.GetTenantById(ao.db, dbUser.TenantId)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		return nil, tenantapp.ErrTenantNotFound
+	}
+	if !tenant.IsActive() {
+		Logger.Infof("", "AuthToken 时，用户[%s]所属租户[%s]已暂停", user.Id, tenant.Code)
+		return nil, tenantapp.ErrTenantSuspended
+	}
+
+	// 用户信息有变化，刷新 token 中缓存的用户信息
+	if dbUser.Version != user.Version {
+		fullUser, err := userapp.GetUserFullInfoById(ao.db, user.Id)
+		if err != nil {
+			return nil, err
+		}
+		if fullUser == nil {
+			return nil, errors.New("用户不存在")
+		}
+		fullUser.LoginType = user.LoginType
+		fullUser.Platform = user.Platform
+		fullUser.Ip = user.Ip
+
+		// 刷新失败不影响本次验证，下次验证时会再次刷新
+		_ = userapp.RefreshTokenUser(ao.R, tkVal, fullUser)
+		user = fullUser
+	}
 
-	return tkVal.User, nil
+	return user, nil
 }
 
 // 验证权限
@@ -0,0 +1,191 @@
+package changebus
+
+import (
+	"encoding/json"
+	"github.com/go-redis/redis"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 数据变化通知
+// 多个实例部署时，各实例在本地缓存的数据（默认角色 id、admin id、不可修改的数据 id 等）会过期
+// 数据修改后通过 redis pub/sub 广播，每个实例收到后清理或者重新加载本地缓存
+const Channel = "USERANDROLE:CHANGE"
+
+// 变化的数据类型，与审计日志操作类型 code 的前缀相同
+const (
+	KindUser       = "user"
+	KindUwr        = "uwr"
+	KindItem       = "item"
+	KindPermission = "permission"
+	KindRole       = "role"
+	KindOrg        = "org"
+	KindGroup      = "group"
+	KindTenant     = "tenant"
+)
+
+type Event struct {
+	Kind   string   `json:"kind"`
+	Code   string   `json:"code"` // 审计日志的操作类型
+	Ids    []string `json:"ids"`
+	Source string   `json:"source"` // 发出通知的实例
+	T      int64    `json:"t"`
+}
+
+// 收到通知后的处理方法，处理本实例和其他实例的修改
+type Handler func(ev *Event)
+
+var (
+	mu       sync.RWMutex
+	handlers = make(map[string][]Handler)
+	client   *redis.Client
+)
+
+// 当前实例的 id，忽略自己发出的通知
+var InstanceId = util.GenerateDataId()
+
+// 注册指定数据类型变化时的处理方法，程序启动时调用
+func OnChange(handler Handler, kinds ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, kind := range kinds {
+		handlers[kind] = append(handlers[kind], handler)
+	}
+}
+
+func dispatch(ev *Event) {
+	mu.RLock()
+	hs := handlers[ev.Kind]
+	mu.RUnlock()
+
+	for _, h := range hs {
+		h(ev)
+	}
+}
+
+// 通知数据变化，先处理本实例的缓存，再广播给其他实例
+// 未调用 Start 时只处理本实例
+func Publish(kind, code string, ids ...string) error {
+	ev := &Event{
+		Kind:   kind,
+		Code:   code,
+		Ids:    ids,
+		Source: InstanceId,
+		T:      util.CurUnixTime(),
+	}
+	dispatch(ev)
+
+	mu.RLock()
+	r := client
+	mu.RUnlock()
+	if r == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	err = r.Publish(Channel, string(data)).Err()
+	if err != nil {
+		Logger.Errorf("", "广播数据变化[%s][%s]失败, %s", kind, code, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 设置广播使用的 redis 客户端，只修改数据不需要接收通知时（比如命令行）使用
+func SetClient(r *redis.Client) {
+	mu.Lock()
+	client = r
+	mu.Unlock()
+}
+
+// 订阅断线重连后发出的通知，重连期间其他实例的通知可能已经丢失
+// 处理方法收到后需要重新加载全部缓存数据
+const CodeResync = "changebus.resync"
+
+// 长时间没有通知时 ping 一次，检查订阅的连接是否已断开
+var PingInterval = 30 * time.Second
+
+// 订阅其他实例的通知，程序启动时调用
+// 断线后 redis 客户端会自动重连并重新订阅，重新订阅成功后给所有数据类型发出 CodeResync 通知
+func Start(r *redis.Client) {
+	SetClient(r)
+
+	ps := r.Subscribe(Channel)
+	go receive(ps)
+}
+
+func receive(ps *redis.PubSub) {
+	subscribed := false
+	for {
+		msg, err := ps.ReceiveTimeout(PingInterval)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// 连接断开时 ping 失败，下次读取时重连
+				_ = ps.Ping()
+				continue
+			}
+			Logger.Errorf("", "接收数据变化通知失败, %s", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if subscribed {
+				Logger.Infof("", "数据变化通知重新订阅成功，重新加载本地缓存")
+				resync()
+			}
+			subscribed = true
+		case *redis.Message:
+			var ev Event
+			err = json.Unmarshal([]byte(m.Payload), &ev)
+			if err != nil {
+				Logger.Errorf("", "解析数据变化通知失败, %s", err.Error())
+				continue
+			}
+			if ev.Source == InstanceId {
+				continue
+			}
+			Logger.Debugf("", "收到实例[%s]的数据变化通知[%s][%s]%v", ev.Source, ev.Kind, ev.Code, ev.Ids)
+			dispatch(&ev)
+		}
+	}
+}
+
+// 给所有注册了处理方法的数据类型发出 CodeResync 通知
+func resync() {
+	mu.RLock()
+	var kinds []string
+	for kind := range handlers {
+		kinds = append(kinds, kind)
+	}
+	mu.RUnlock()
+
+	for _, kind := range kinds {
+		dispatch(&Event{
+			Kind:   kind,
+			Code:   CodeResync,
+			Source: InstanceId,
+			T:      util.CurUnixTime(),
+		})
+	}
+}
+
+// 审计日志写入后的回调，通过 ophistory.AddRecordHook 注册
+// 所有修改数据的操作都会写审计日志，按操作类型的前缀转换成数据变化通知
+func OnAuditRecord(db *dbandmq.Ds, log *ophistory.OperationHistory) {
+	idx := strings.Index(log.Code, ".")
+	if idx <= 0 {
+		return
+	}
+	_ = Publish(log.Code[:idx], log.Code, log.TargetId)
+}
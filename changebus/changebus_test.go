@@ -0,0 +1,51 @@
+package changebus
+
+import (
+	"github.com/leyle/userandrole/ophistory"
+	"testing"
+)
+
+func TestPublishLocal(t *testing.T) {
+	var got []*Event
+	OnChange(func(ev *Event) {
+		got = append(got, ev)
+	}, KindRole, KindPermission)
+
+	_ = Publish(KindRole, ophistory.CodeRoleUpdate, "r1")
+	_ = Publish(KindUser, ophistory.CodeUserBan, "u1")
+
+	// 审计日志按 code 前缀转换
+	OnAuditRecord(nil, &ophistory.OperationHistory{Code: ophistory.CodePermissionDelete, TargetId: "p1"})
+	OnAuditRecord(nil, &ophistory.OperationHistory{Code: ophistory.CodeLegacy, TargetId: "x"})
+
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2", len(got))
+	}
+	if got[0].Kind != KindRole || got[0].Ids[0] != "r1" || got[0].Source != InstanceId {
+		t.Errorf("event 0 = %+v", got[0])
+	}
+	if got[1].Kind != KindPermission || got[1].Code != ophistory.CodePermissionDelete || got[1].Ids[0] != "p1" {
+		t.Errorf("event 1 = %+v", got[1])
+	}
+}
+
+func TestResync(t *testing.T) {
+	var got []*Event
+	OnChange(func(ev *Event) {
+		got = append(got, ev)
+	}, KindUser, KindOrg)
+
+	// 重新订阅后每个注册了处理方法的数据类型都会收到通知
+	resync()
+
+	kinds := make(map[string]bool)
+	for _, ev := range got {
+		if ev.Code != CodeResync {
+			t.Errorf("event code = %s, want %s", ev.Code, CodeResync)
+		}
+		kinds[ev.Kind] = true
+	}
+	if len(got) != 2 || !kinds[KindUser] || !kinds[KindOrg] {
+		t.Fatalf("got %+v, want resync of user and org", got)
+	}
+}
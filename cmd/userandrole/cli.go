@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/userandrole/changebus"
+	"github.com/leyle/userandrole/config"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userapp"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 运维使用的子命令，不带子命令时启动服务
+// userandrole <command> [subcommand] -c conf.yaml [-json] ...
+var commands = map[string]func(args []string) int{
+	"validate": runValidate,
+	"sync":     runSync,
+	"user":     runUser,
+	"role":     runRole,
+	"session":  runSession,
+	"export":   runExport,
+	"import":   runImport,
+	"doctor":   runDoctor,
+}
+
+// 有下一级子命令的命令，比如 user create
+type subCommands map[string]func(args []string) int
+
+func (sc subCommands) run(name string, args []string) int {
+	if len(args) > 0 {
+		if run, ok := sc[args[0]]; ok {
+			return run(args[1:])
+		}
+	}
+
+	var names []string
+	for n := range sc {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "用法: %s %s [参数]\n", name, strings.Join(names, "|"))
+	return 2
+}
+
+func commandNames() string {
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// 子命令共用的参数，-c 配置文件，-json 以 json 格式输出结果，方便脚本处理
+type cmdFlags struct {
+	*flag.FlagSet
+	cfile string
+	json  bool
+}
+
+func newCmdFlags(name string) *cmdFlags {
+	f := &cmdFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	f.StringVar(&f.cfile, "c", "", "-c /path/to/config/file")
+	f.BoolVar(&f.json, "json", false, "以 json 格式输出结果")
+	return f
+}
+
+func (f *cmdFlags) parse(args []string) {
+	_ = f.Parse(args)
+
+	// 日志输出到 stdout，json 输出时关闭，避免混在结果中
+	if f.json {
+		Logger.SetLogLevel(LogLevelOff)
+	} else {
+		Logger.SetLogLevel(LogLevelWarn)
+	}
+}
+
+// 连接数据库后的命令行环境
+type cli struct {
+	json bool
+	conf *config.Config
+	r    *redis.Client
+	ds   *dbandmq.Ds
+	db   *dbandmq.Ds
+}
+
+// 连接数据库，加载服务启动时初始化的系统数据，不指定 -c 时只从环境变量读取配置
+// 注册审计日志的回调，命令修改的数据会通知运行中的实例和 webhook
+func (f *cmdFlags) open() (*cli, error) {
+	conf, rClient, ds, err := connect(f.cfile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cli{
+		json: f.json,
+		conf: conf,
+		r:    rClient,
+		ds:   ds,
+		db:   ds.CopyDs(),
+	}
+
+	err = roleapp.ReloadSystemIds(c.db)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	err = userapp.ReloadAdminUserId(c.db)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	addHooks()
+	changebus.SetClient(rClient)
+
+	return c, nil
+}
+
+func (c *cli) close() {
+	c.db.Close()
+	c.ds.Close()
+}
+
+// 输出结果，-json 时输出 data，否则调用 text 输出文本
+func (c *cli) output(data interface{}, text func()) int {
+	if c.json {
+		printJson(data)
+		return 0
+	}
+	text()
+	return 0
+}
+
+// 输出错误，返回进程的退出码
+func (f *cmdFlags) fail(err error) int {
+	if f.json {
+		printJson(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Fprintln(os.Stderr, "错误:", err.Error())
+	}
+	return 1
+}
+
+func printJson(data interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(data)
+}
+
+// 读取默认租户中 loginId 对应的用户，命令行只操作默认租户
+func (c *cli) loadUser(loginId string) (*userapp.User, error) {
+	loginId = strings.TrimSpace(loginId)
+	if loginId == "" {
+		return nil, errors.New("缺少 -login 参数")
+	}
+	user, err := userapp.GetUserByLoginId(c.db, tenantapp.DefaultTenantId, loginId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("用户[%s]不存在", loginId)
+	}
+	return user, nil
+}
+
+// 读取密码，终端中不回显输入并要求确认，否则读取 stdin 的第一行
+// 不从命令行参数读取密码，避免出现在 shell 的历史记录中
+func readPasswd(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("从 stdin 读取密码失败")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	p1, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "再次输入确认: ")
+	p2, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(p1) != string(p2) {
+		return "", errors.New("两次输入的密码不一致")
+	}
+	return string(p1), nil
+}
+
+// 逗号分隔的参数
+func splitList(s string) []string {
+	var ret []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
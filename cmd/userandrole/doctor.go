@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+	"github.com/leyle/userandrole/webhookapp"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// 检查运行环境和系统内置数据，有检查失败时退出码为 1
+// userandrole doctor -c conf.yaml [-json]
+
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN" // 不影响服务运行，需要关注
+	checkFail = "FAIL"
+)
+
+type checkResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type doctor struct {
+	c       *cli
+	results []*checkResult
+}
+
+func (d *doctor) add(name, status, format string, args ...interface{}) {
+	d.results = append(d.results, &checkResult{
+		Name:    name,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func runDoctor(args []string) int {
+	f := newCmdFlags("doctor")
+	f.parse(args)
+
+	// 连接失败时直接返回，redis 连接时已经 ping 过
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	d := &doctor{c: c}
+	d.checkConn()
+	d.checkTenant()
+	d.checkAdmin()
+	d.checkDefaultRole()
+	d.checkAuditChain()
+	d.checkDelivery()
+
+	failed := false
+	for _, r := range d.results {
+		if r.Status == checkFail {
+			failed = true
+		}
+	}
+
+	c.output(d.results, func() {
+		for _, r := range d.results {
+			fmt.Printf("[%-4s] %s: %s\n", r.Status, r.Name, r.Message)
+		}
+	})
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func (d *doctor) checkConn() {
+	err := d.c.db.Se.Ping()
+	if err != nil {
+		d.add("mongodb", checkFail, "ping 失败, %s", err.Error())
+	} else {
+		d.add("mongodb", checkOK, "连接正常")
+	}
+
+	err = d.c.r.Ping().Err()
+	if err != nil {
+		d.add("redis", checkFail, "ping 失败, %s", err.Error())
+	} else {
+		d.add("redis", checkOK, "连接正常")
+	}
+}
+
+func (d *doctor) checkTenant() {
+	t, err := tenantapp.GetTenantById(d.c.db, tenantapp.DefaultTenantId)
+	switch {
+	case err != nil:
+		d.add("tenant", checkFail, "读取默认租户失败, %s", err.Error())
+	case t == nil:
+		d.add("tenant", checkFail, "默认租户不存在，启动一次服务完成初始化")
+	case !t.IsActive():
+		d.add("tenant", checkFail, "默认租户已停用")
+	default:
+		d.add("tenant", checkOK, "默认租户正常")
+	}
+}
+
+// admin 账户存在、没有被封禁，并且拥有 admin role
+func (d *doctor) checkAdmin() {
+	user, err := userapp.GetUserByLoginId(d.c.db, tenantapp.DefaultTenantId, userapp.AdminLoginId)
+	if err != nil {
+		d.add("admin", checkFail, "读取 admin 账户失败, %s", err.Error())
+		return
+	}
+	if user == nil {
+		d.add("admin", checkFail, "admin 账户不存在，启动一次服务完成初始化")
+		return
+	}
+	if user.IsBannedAt(time.Now().Unix()) {
+		d.add("admin", checkFail, "admin 账户被封禁")
+		return
+	}
+
+	role, err := roleapp.GetRoleByName(d.c.db, tenantapp.DefaultTenantId, roleapp.AdminRoleName, false)
+	if err != nil {
+		d.add("admin", checkFail, "读取 admin role 失败, %s", err.Error())
+		return
+	}
+	if role == nil || role.Deleted {
+		d.add("admin", checkFail, "admin role 不存在，启动一次服务完成初始化")
+		return
+	}
+
+	uwr, err := userandrole.GetUserWithRoleByUserId(d.c.db, user.Id)
+	if err != nil {
+		d.add("admin", checkFail, "读取 admin 的 roles 失败, %s", err.Error())
+		return
+	}
+	hasRole := false
+	if uwr != nil {
+		for _, rid := range uwr.RoleIds {
+			if rid == role.Id {
+				hasRole = true
+			}
+		}
+	}
+	if !hasRole {
+		d.add("admin", checkFail, "admin 账户没有 admin role，启动一次服务重新赋予")
+		return
+	}
+
+	d.add("admin", checkOK, "admin 账户和 admin role 正常")
+}
+
+func (d *doctor) checkDefaultRole() {
+	role, err := roleapp.GetRoleByName(d.c.db, tenantapp.DefaultTenantId, roleapp.DefaultRoleName, false)
+	switch {
+	case err != nil:
+		d.add("defaultRole", checkFail, "读取默认角色失败, %s", err.Error())
+	case role == nil || role.Deleted:
+		d.add("defaultRole", checkFail, "默认角色不存在，启动一次服务完成初始化")
+	default:
+		d.add("defaultRole", checkOK, "默认角色正常")
+	}
+}
+
+// 升级前的审计日志在服务启动时加入哈希链
+func (d *doctor) checkAuditChain() {
+	n, err := d.c.db.C(ophistory.CollectionNameAuditLog).Find(bson.M{"seq": bson.M{"$exists": false}}).Count()
+	switch {
+	case err != nil:
+		d.add("auditChain", checkFail, "读取审计日志失败, %s", err.Error())
+	case n > 0:
+		d.add("auditChain", checkWarn, "%d 条审计日志不在哈希链上，启动一次服务完成迁移", n)
+	default:
+		d.add("auditChain", checkOK, "审计日志都在哈希链上")
+	}
+}
+
+func (d *doctor) checkDelivery() {
+	n, err := d.c.db.C(webhookapp.CollectionNameDelivery).Find(bson.M{"status": webhookapp.DeliveryStatusFailed}).Count()
+	switch {
+	case err != nil:
+		d.add("webhook", checkFail, "读取 webhook 投递记录失败, %s", err.Error())
+	case n > 0:
+		d.add("webhook", checkWarn, "%d 条 webhook 投递失败", n)
+	default:
+		d.add("webhook", checkOK, "没有投递失败的 webhook 事件")
+	}
+}
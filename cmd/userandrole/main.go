@@ -5,23 +5,41 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis"
+	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/middleware"
 	"github.com/leyle/smsapp"
 	"github.com/leyle/userandrole/api"
+	"github.com/leyle/userandrole/approvalapp"
+	"github.com/leyle/userandrole/changebus"
 	. "github.com/leyle/userandrole/auth"
 	"github.com/leyle/userandrole/config"
+	"github.com/leyle/userandrole/emailapp"
+	"github.com/leyle/userandrole/ldapapp"
 	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/groupapp"
+	"github.com/leyle/userandrole/orgapp"
 	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
 	"github.com/leyle/userandrole/userandrole"
 	"github.com/leyle/userandrole/userapp"
 	"github.com/leyle/userandrole/util"
+	"github.com/leyle/userandrole/webhookapp"
 	ginbaseutil "github.com/leyle/ginbase/util"
-	"gopkg.in/mgo.v2/bson"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 )
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
 	var err error
 	var port string
 	var reset string
@@ -31,45 +49,40 @@ func main() {
 	flag.StringVar(&cfile, "c", "", "-c /path/to/config/file")
 
 	// 注意，这里在 cli 中直接输入密码的方式不安全，bash 历史记录中会看到这些数据
-	flag.StringVar(&reset, "r", "", "-s new admin passwd")
-	flag.Parse()
-	if cfile == "" {
-		fmt.Println("缺少运行的配置文件")
-		os.Exit(1)
+	// 建议使用 user reset-passwd 子命令，从终端或 stdin 读取密码
+	flag.StringVar(&reset, "r", "", "-r new admin passwd，建议使用 user reset-passwd 子命令")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "用法: %s [-c conf] [-p port]\n      %s %s -h\n", os.Args[0], os.Args[0], commandNames())
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	conf, err := config.LoadConf(cfile)
+	// 不指定配置文件时只从环境变量读取配置
+	conf, rClient, ds, err := connect(cfile)
 	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+	defer ds.Close()
 	if port != "" {
 		conf.Server.Port = port
 	}
-
-	ro := &dbandmq.RedisOption{
-		Host:   conf.Redis.Host,
-		Port:   conf.Redis.Port,
-		Passwd: conf.Redis.Passwd,
-		DbNum:  conf.Redis.DbNum,
-	}
-	rClient, err := dbandmq.NewRedisClient(ro)
-	if err != nil {
-		fmt.Println(err)
+	if conf.Server.Port == "" && reset == "" {
+		fmt.Printf("缺少 server.port 配置，使用 -p 参数或环境变量 %s 指定\n", config.EnvName("server.port"))
 		os.Exit(1)
 	}
 
-	ds := dbandmq.NewDs(conf.Mongodb.Host, conf.Mongodb.Port, conf.Mongodb.User, conf.Mongodb.Passwd, conf.Mongodb.Database)
-	defer ds.Close()
-
 	// 检查是否需要重置密码
 	if reset != "" {
-		err = resetAdminPasswd(ds, rClient, reset)
+		addHooks()
+		changebus.SetClient(rClient)
+		_, err = resetUserPasswd(ds, rClient, userapp.AdminLoginId, reset, false)
 		if err != nil {
-			return
-		} else {
-			fmt.Println("重置 admin 密码成功")
-			return
+			fmt.Println("重置 admin 密码失败", err.Error())
+			os.Exit(1)
 		}
+		fmt.Println("重置 admin 密码成功")
+		return
 	}
 
 	// 创建 indexkey
@@ -80,6 +93,34 @@ func main() {
 		os.Exit(1)
 	}
 
+	// 用户组成员唯一索引
+	err = groupapp.EnsureMemberIndex(ds)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// 部门成员唯一索引
+	err = orgapp.EnsureMemberIndex(ds)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// 初始化默认租户，历史数据归属到默认租户
+	err = initTenant(ds)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// 各个数据中的 history 迁移到审计日志
+	err = migrateHistory(ds)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	// 初始化 admin 和相关权限
 	err = userandrole.InitAdminWithRole(ds)
 	if err != nil {
@@ -94,6 +135,24 @@ func main() {
 		os.Exit(1)
 	}
 
+	addHooks()
+
+	// webhook 事件后台投递
+	if conf.Webhook != nil {
+		err = webhookapp.SetAllowTargets(conf.Webhook.AllowTargets)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	webhookapp.StartDeliveryJob(ds)
+
+	// 后台解除到期的封禁
+	userapp.StartBanExpiryJob(ds)
+
+	// 后台移除到期的授权
+	userandrole.StartRoleExpiryJob(ds)
+
 	// 初始化验证相关需要的配置
 	authOption := &Option{
 		R:   rClient,
@@ -101,6 +160,9 @@ func main() {
 	}
 	api.AuthOption = authOption
 
+	// 订阅其他实例的数据变化通知
+	authOption.SubscribeChanges()
+
 	uriPrefix := "/api"
 	if conf.UriPrefix != "" {
 		uriPrefix = uriPrefix + conf.UriPrefix
@@ -120,36 +182,54 @@ func main() {
 	ginbaseutil.MAX_ONE_PAGE_SIZE = 10000
 
 	r := middleware.SetupGin()
-	apiRouter := r.Group(uriPrefix)
+	apiRouter := r.Group(uriPrefix, func(c *gin.Context) {
+		api.ResolveTenant(c, ds)
+	})
 
 	// 权限接口
 	api.RoleRouter(ds, apiRouter.Group(""))
 
 	// 用户接口
-	// 微信配置
+	// 微信配置，只添加配置了 appid 的平台，未配置的平台不能使用微信登录
 	wxOpt := make(map[string]*userapp.WeChatOption)
-	wxOpt[userapp.WeChatOptPlatformWeb] = &userapp.WeChatOption{
-		AppId:  conf.WeChat.Web.AppId,
-		Secret: conf.WeChat.Web.Secret,
-		Token:  conf.WeChat.Web.Token,
-		AesKey: conf.WeChat.Web.AesKey,
-	}
-	wxOpt[userapp.WeChatOptPlatformApp] = &userapp.WeChatOption{
-		AppId:  conf.WeChat.App.AppId,
-		Secret: conf.WeChat.App.Secret,
-	}
-	wxOpt[userapp.WeChatOptPlatformXiaoChengXu] = &userapp.WeChatOption{
-		AppId:  conf.WeChat.XiaoChengXu.AppId,
-		Secret: conf.WeChat.XiaoChengXu.Secret,
-	}
-	// 短信配置
-	smsOpt := &smsapp.SmsOption{
-		Account: conf.PhoneSms.Account,
-		Passwd:  conf.PhoneSms.Password,
-		Url:     conf.PhoneSms.Url,
-		R:       rClient,
-		Debug:   conf.PhoneSms.Debug,
-		Default: true,
+	if wc := conf.WeChat; wc != nil {
+		if wc.Web != nil && wc.Web.AppId != "" {
+			wxOpt[userapp.WeChatOptPlatformWeb] = &userapp.WeChatOption{
+				AppId:  wc.Web.AppId,
+				Secret: wc.Web.Secret,
+				Token:  wc.Web.Token,
+				AesKey: wc.Web.AesKey,
+			}
+		}
+		if wc.App != nil && wc.App.AppId != "" {
+			wxOpt[userapp.WeChatOptPlatformApp] = &userapp.WeChatOption{
+				AppId:  wc.App.AppId,
+				Secret: wc.App.Secret,
+			}
+		}
+		if wc.XiaoChengXu != nil && wc.XiaoChengXu.AppId != "" {
+			wxOpt[userapp.WeChatOptPlatformXiaoChengXu] = &userapp.WeChatOption{
+				AppId:  wc.XiaoChengXu.AppId,
+				Secret: wc.XiaoChengXu.Secret,
+			}
+		}
+	}
+	if len(wxOpt) == 0 {
+		Logger.Info("", "未配置微信，不启用微信登录")
+	}
+	// 短信配置，未配置时手机号登录、绑定等接口不可用
+	var smsOpt *smsapp.SmsOption
+	if conf.SmsEnabled() {
+		smsOpt = &smsapp.SmsOption{
+			Account: conf.PhoneSms.Account,
+			Passwd:  conf.PhoneSms.Password,
+			Url:     conf.PhoneSms.Url,
+			R:       rClient,
+			Debug:   conf.PhoneSms.Debug,
+			Default: true,
+		}
+	} else {
+		Logger.Info("", "未配置短信，不启用手机号验证码相关功能")
 	}
 	userOption := &api.UserOption{
 		Ds: ds,
@@ -157,16 +237,106 @@ func main() {
 		WeChatOpt: wxOpt,
 		PhoneOpt: smsOpt,
 	}
+	// 邮件配置
+	if conf.EmailEnabled() {
+		userOption.EmailOpt = &emailapp.EmailOption{
+			Host:   conf.Email.Host,
+			Port:   conf.Email.Port,
+			User:   conf.Email.User,
+			Passwd: conf.Email.Passwd,
+			From:   conf.Email.From,
+			R:      rClient,
+			Debug:  conf.Email.Debug,
+		}
+	}
+	// 自助注册配置
+	if conf.Register != nil && conf.Register.Enable {
+		regOpt, err := newRegisterOption(conf.Register)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		userOption.RegOpt = regOpt
+	}
+	// 找回密码配置
+	if conf.ForgotPasswd != nil && conf.ForgotPasswd.Enable {
+		userOption.ForgotOpt = &api.ForgotPasswdOption{
+			RateLimit:  conf.ForgotPasswd.RateLimit,
+			RateWindow: time.Duration(conf.ForgotPasswd.RateWindow) * time.Second,
+		}
+	}
+	// 用户资料修改配置
+	if conf.Profile != nil {
+		profileOpt, err := newProfileOption(conf.Profile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		userOption.ProfileOpt = profileOpt
+	}
+	// ldap 配置
+	if conf.Ldap != nil && conf.Ldap.Enable {
+		ldapOpt := &ldapapp.LdapOption{
+			Url:                conf.Ldap.Url,
+			StartTLS:           conf.Ldap.StartTLS,
+			InsecureSkipVerify: conf.Ldap.InsecureSkipVerify,
+			BindDN:             conf.Ldap.BindDN,
+			BindPasswd:         conf.Ldap.BindPasswd,
+			BaseDN:             conf.Ldap.BaseDN,
+			UserFilter:         conf.Ldap.UserFilter,
+			NameAttr:           conf.Ldap.NameAttr,
+			EmailAttr:          conf.Ldap.EmailAttr,
+			GroupAttr:          conf.Ldap.GroupAttr,
+		}
+		for _, gm := range conf.Ldap.GroupMapping {
+			ldapOpt.GroupMapping = append(ldapOpt.GroupMapping, &ldapapp.GroupMapping{
+				Group: gm.Group,
+				Roles: gm.Roles,
+			})
+		}
+		userOption.LdapOpt = ldapOpt
+	}
 
 	middleware.AddIgnoreReadReqBodyPath(uriPrefix + "/user/idpasswd/login",
 												uriPrefix + "/user/idpasswd/resetpasswd",
 												uriPrefix + "/user/idpasswd/changepasswd",
-												uriPrefix + "/user/idpasswd")
+												uriPrefix + "/user/idpasswd",
+												uriPrefix + "/user/ldap/login",
+												uriPrefix + "/user/register",
+												uriPrefix + "/user/passwd/reset",
+												uriPrefix + "/user/me/link")
 	api.UserRouter(userOption, apiRouter.Group(""))
 
 	// 用户与权限映射关系的接口
 	api.UserWithRoleRouter(ds, apiRouter.Group(""))
 
+	// 组织部门的接口
+	api.OrgRouter(ds, userOption.R, apiRouter.Group(""))
+
+	// 用户组的接口
+	api.GroupRouter(ds, apiRouter.Group(""))
+
+	// 租户管理接口
+	api.TenantRouter(ds, apiRouter.Group(""))
+
+	// 审计日志接口
+	auditOption := &api.AuditOption{
+		Ds: ds,
+	}
+	if conf.Audit != nil && conf.Audit.CheckpointFile != "" {
+		cpOpt, err := newCheckpointOption(conf.Audit)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		auditOption.Checkpoint = cpOpt
+		ophistory.StartCheckpointJob(ds, cpOpt)
+	}
+	api.AuditRouter(auditOption, apiRouter.Group(""))
+
+	// webhook 接口
+	api.WebhookRouter(ds, apiRouter.Group(""))
+
 	// 系统配置的接口
 	// 过滤掉本接口返回的数据
 	middleware.AddIgnoreReadReqBodyPath("/api/sys/conf")
@@ -184,14 +354,184 @@ func main() {
 	}
 }
 
+// 读取配置文件，连接 redis 和 mongodb
+func connect(cfile string) (*config.Config, *redis.Client, *dbandmq.Ds, error) {
+	conf, err := config.LoadConf(cfile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ro := &dbandmq.RedisOption{
+		Host:   conf.Redis.Host,
+		Port:   conf.Redis.Port,
+		Passwd: conf.Redis.Passwd,
+		DbNum:  conf.Redis.DbNum,
+	}
+	rClient, err := dbandmq.NewRedisClient(ro)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ds := dbandmq.NewDs(conf.Mongodb.Host, conf.Mongodb.Port, conf.Mongodb.User, conf.Mongodb.Passwd, conf.Mongodb.Database)
+	return conf, rClient, ds, nil
+}
+
+// 审计日志写入后的回调，服务和修改数据的命令都需要注册
+func addHooks() {
+	// 审计日志转换成数据变化通知，广播给其他实例
+	ophistory.AddRecordHook(changebus.OnAuditRecord)
+
+	// 审计日志和登录记录转换成 webhook 事件，由服务后台投递
+	ophistory.AddRecordHook(webhookapp.OnAuditRecord)
+	ophistory.AddLoginHook(webhookapp.OnLogin)
+}
+
+// 根据配置生成自助注册的选项
+func newRegisterOption(rc *config.RegisterConf) (*api.RegisterOption, error) {
+	pattern := rc.LoginIdPattern
+	if pattern == "" {
+		pattern = userapp.DefaultLoginIdPattern
+	}
+	reg, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("注册配置中 loginidpattern 错误, %s", err.Error())
+	}
+
+	minLen := rc.PasswdMinLen
+	if minLen <= 0 {
+		minLen = userapp.DefaultPasswdPolicy.MinLen
+	}
+
+	verify := strings.ToUpper(rc.Verify)
+	switch verify {
+	case "":
+		verify = api.RegisterVerifyNone
+	case api.RegisterVerifyNone, api.RegisterVerifyPhone, api.RegisterVerifyEmail:
+	default:
+		return nil, fmt.Errorf("注册配置中 verify 值[%s]错误", rc.Verify)
+	}
+
+	ro := &api.RegisterOption{
+		LoginIdPattern: reg,
+		Passwd: &userapp.PasswdPolicy{
+			MinLen:      minLen,
+			NeedLetter:  rc.PasswdNeedLetter,
+			NeedDigit:   rc.PasswdNeedDigit,
+			NeedSpecial: rc.PasswdNeedSpecial,
+		},
+		Verify:     verify,
+		RateLimit:  rc.RateLimit,
+		RateWindow: time.Duration(rc.RateWindow) * time.Second,
+	}
+	if rc.Captcha != nil && rc.Captcha.Enable {
+		ro.Captcha = &userapp.CaptchaOption{
+			VerifyUrl: rc.Captcha.VerifyUrl,
+			Secret:    rc.Captcha.Secret,
+		}
+	}
+
+	return ro, nil
+}
+
+// 需要在租户内唯一的字段
+var tenantUniqueKeys = []struct {
+	Collection string
+	Key        string
+}{
+	{userapp.CollectionNameIdPasswd, "loginId"},
+	{userapp.CollectionNamePhone, "phone"},
+	{userapp.CollectionNameWeChat, "openId"},
+	{userapp.CollectionNameLdap, "loginId"},
+	{userapp.CollectionNameEmail, "email"},
+	{roleapp.CollectionNameItem, "name"},
+	{roleapp.CollectionNamePermission, "name"},
+	{roleapp.CollectionNameRole, "name"},
+	{groupapp.CollectionNameGroup, "name"},
+}
+
+func initTenant(ds *dbandmq.Ds) error {
+	_, err := tenantapp.InsureDefaultTenant(ds)
+	if err != nil {
+		return err
+	}
+
+	collections := []string{
+		userapp.CollectionNameUser,
+		userandrole.CollectionNameUserWithRole,
+		userandrole.CollectionNameMergeJournal,
+		orgapp.CollectionNameOrgUnit,
+	}
+	for _, uk := range tenantUniqueKeys {
+		collections = append(collections, uk.Collection)
+	}
+	err = tenantapp.MigrateTenantId(ds, collections)
+	if err != nil {
+		return err
+	}
+
+	for _, uk := range tenantUniqueKeys {
+		err = tenantapp.EnsureUniqueIndex(ds, uk.Collection, uk.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 唯一的自定义属性在租户内唯一
+	return userapp.EnsureAttrIndexes(ds)
+}
+
+func migrateHistory(ds *dbandmq.Ds) error {
+	db := ds.CopyDs()
+	defer db.Close()
+
+	hcs := []*ophistory.HistoryCollection{
+		{Collection: userapp.CollectionNameUser, TargetType: ophistory.TargetUser, IdField: "_id"},
+		{Collection: userandrole.CollectionNameUserWithRole, TargetType: ophistory.TargetUser, IdField: "userId"},
+		{Collection: roleapp.CollectionNameItem, TargetType: ophistory.TargetItem, IdField: "_id"},
+		{Collection: roleapp.CollectionNamePermission, TargetType: ophistory.TargetPermission, IdField: "_id"},
+		{Collection: roleapp.CollectionNameRole, TargetType: ophistory.TargetRole, IdField: "_id"},
+		{Collection: orgapp.CollectionNameOrgUnit, TargetType: ophistory.TargetOrg, IdField: "_id"},
+		{Collection: groupapp.CollectionNameGroup, TargetType: ophistory.TargetGroup, IdField: "_id"},
+		{Collection: tenantapp.CollectionNameTenant, TargetType: ophistory.TargetTenant, IdField: "_id"},
+		{Collection: approvalapp.CollectionNameGrantRequest, TargetType: ophistory.TargetGrantRequest, IdField: "_id"},
+	}
+	err := ophistory.MigrateEmbeddedHistory(db, hcs)
+	if err != nil {
+		return err
+	}
+
+	// 升级前的记录和迁移过来的记录加入哈希链
+	err = ophistory.EnsureChainIndex(db)
+	if err != nil {
+		return err
+	}
+	return ophistory.ChainAuditLogs(db)
+}
+
 func addIndexkey() {
 	// user
+	dbandmq.AddIndexKey(userapp.IKUser)
 	dbandmq.AddIndexKey(userapp.IKIdPasswd)
 	dbandmq.AddIndexKey(userapp.IKPhone)
 	dbandmq.AddIndexKey(userapp.IKWeChat)
+	dbandmq.AddIndexKey(userapp.IKLdap)
+	dbandmq.AddIndexKey(userapp.IKEmail)
+	dbandmq.AddIndexKey(userapp.IKAttrDef)
 
 	// uwr
 	dbandmq.AddIndexKey(userandrole.IKUserWithRole)
+	dbandmq.AddIndexKey(userandrole.IKMergeJournal)
+
+	// org
+	dbandmq.AddIndexKey(orgapp.IKOrgUnit)
+	dbandmq.AddIndexKey(orgapp.IKOrgMember)
+
+	// group
+	dbandmq.AddIndexKey(groupapp.IKGroup)
+	dbandmq.AddIndexKey(groupapp.IKGroupMember)
+
+	// 授权申请
+	dbandmq.AddIndexKey(approvalapp.IKGrantRequest)
 
 	// role
 	dbandmq.AddIndexKey(roleapp.IKItem)
@@ -200,34 +540,75 @@ func addIndexkey() {
 
 	// ophistory
 	dbandmq.AddIndexKey(ophistory.IKLoginHistory)
+	dbandmq.AddIndexKey(ophistory.IKAuditLog)
+
+	// tenant
+	dbandmq.AddIndexKey(tenantapp.IKTenant)
+
+	// webhook
+	dbandmq.AddIndexKey(webhookapp.IKWebhook)
+	dbandmq.AddIndexKey(webhookapp.IKDelivery)
 }
 
-// 重置密码，还要求删除已经生效的 token
-func resetAdminPasswd(ds *dbandmq.Ds, redisC *redis.Client, passwd string) error {
-	salt := ginbaseutil.GenerateDataId()
-	p := passwd + salt
-	hashP := ginbaseutil.Sha256(p)
-
-	update := bson.M{
-		"$set": bson.M{
-			"salt": salt,
-			"passwd": hashP,
-			"updateT": ginbaseutil.GetCurTime(),
-		},
+// 根据配置生成审计日志检查点导出的选项
+func newCheckpointOption(ac *config.AuditConf) (*ophistory.CheckpointOption, error) {
+	if ac.SignKey == "" {
+		return nil, fmt.Errorf("审计日志配置了 checkpointfile，但是未配置 signkey")
+	}
+	interval := ac.CheckpointInterval
+	if interval <= 0 {
+		interval = 3600
 	}
 
-	filter := bson.M{
-		"loginId": userapp.AdminLoginId,
+	opt := &ophistory.CheckpointOption{
+		File:     ac.CheckpointFile,
+		Interval: time.Duration(interval) * time.Second,
+		SignKey:  ac.SignKey,
 	}
+	return opt, nil
+}
 
-	err := ds.C(userapp.CollectionNameIdPasswd).Update(filter, update)
-	if err != nil {
-		fmt.Println("重置 admin 密码失败", err.Error())
-		return err
+// 根据配置生成用户资料修改的选项，字段名必须是支持修改的字段
+func newProfileOption(pc *config.ProfileConf) (*api.ProfileOption, error) {
+	checkFields := func(fields []string) error {
+		for _, f := range fields {
+			if !userapp.IsProfileField(f) {
+				return fmt.Errorf("profile 配置中的字段[%s]不支持修改", f)
+			}
+		}
+		return nil
 	}
 
-	// 清理掉可能的 token
-	// todo
+	po := &api.ProfileOption{
+		SelfFields:  pc.SelfFields,
+		AdminFields: pc.AdminFields,
+	}
+	if po.SelfFields == nil {
+		po.SelfFields = api.DefaultProfileOption.SelfFields
+	}
+	if po.AdminFields == nil {
+		po.AdminFields = api.DefaultProfileOption.AdminFields
+	}
+	if err := checkFields(po.SelfFields); err != nil {
+		return nil, err
+	}
+	if err := checkFields(po.AdminFields); err != nil {
+		return nil, err
+	}
 
-	return nil
-}
\ No newline at end of file
+	for _, rc := range pc.Roles {
+		if err := checkFields(rc.SelfFields); err != nil {
+			return nil, err
+		}
+		if err := checkFields(rc.AdminFields); err != nil {
+			return nil, err
+		}
+		po.Roles = append(po.Roles, &api.ProfileRoleOption{
+			Role:        rc.Role,
+			SelfFields:  rc.SelfFields,
+			AdminFields: rc.AdminFields,
+		})
+	}
+
+	return po, nil
+}
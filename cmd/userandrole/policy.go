@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/leyle/userandrole/migrate"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+)
+
+// 权限策略文件和数据导入导出的子命令
+// userandrole validate -f policy.yaml [-c conf.yaml]
+// userandrole sync -c conf.yaml -f policy.yaml [-prune] [-dry-run]
+// userandrole export -c conf.yaml [-format yaml|json] [-o file]
+// userandrole import -c conf.yaml -f file [-mode create|upsert|replace] [-dry-run]
+
+// 检查结果
+type validateResult struct {
+	Problems []string      `json:"problems"`
+	External []string      `json:"external"`
+	Plan     *migrate.Plan `json:"plan,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// 检查策略文件，不指定配置文件时不连接数据库，可以在 CI 中运行
+// 指定配置文件时同时检查引用的数据在数据库中是否存在，相当于 sync -dry-run
+func runValidate(args []string) int {
+	f := newCmdFlags("validate")
+	pfile := f.String("f", "", "-f /path/to/policy.yaml")
+	prune := f.Bool("prune", false, "与 -c 一起使用，按 sync -prune 检查")
+	f.parse(args)
+
+	policy, err := loadPolicy(*pfile)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	ret := &validateResult{Problems: []string{}, External: []string{}}
+	problems, external := migrate.Validate(policy)
+	ret.Problems = append(ret.Problems, problems...)
+	ret.External = append(ret.External, external...)
+	if len(ret.Problems) == 0 && f.cfile != "" {
+		c, err := f.open()
+		if err != nil {
+			return f.fail(err)
+		}
+		defer c.close()
+
+		ret.Plan, err = migrate.Sync(c.db, policy, *prune, true, cliOpHistory())
+		if err != nil {
+			ret.Error = err.Error()
+		}
+	}
+
+	if f.json {
+		printJson(ret)
+	} else {
+		for _, problem := range ret.Problems {
+			fmt.Println("错误:", problem)
+		}
+		if len(ret.External) > 0 {
+			fmt.Println("引用的策略文件以外的数据，同步的环境中需要已存在:")
+			for _, ref := range ret.External {
+				fmt.Println("  ", ref)
+			}
+		}
+		if ret.Plan != nil {
+			printPlan(ret.Plan)
+		}
+		if ret.Error != "" {
+			fmt.Println(ret.Error)
+		}
+	}
+
+	if len(ret.Problems) > 0 || ret.Error != "" {
+		return 1
+	}
+	if !f.json {
+		fmt.Println("策略文件检查通过")
+	}
+	return 0
+}
+
+// 同步策略文件到数据库
+func runSync(args []string) int {
+	f := newCmdFlags("sync")
+	pfile := f.String("f", "", "-f /path/to/policy.yaml")
+	prune := f.Bool("prune", false, "删除策略文件中没有的用户定义数据")
+	dryRun := f.Bool("dry-run", false, "只输出同步计划，不写入数据")
+	f.parse(args)
+
+	policy, err := loadPolicy(*pfile)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	plan, err := migrate.Sync(c.db, policy, *prune, *dryRun, cliOpHistory())
+	return c.outputPlan(plan, err, *dryRun, "同步完成")
+}
+
+// 导出默认租户中用户定义的 item / permission / role，可以作为策略文件使用
+func runExport(args []string) int {
+	f := newCmdFlags("export")
+	format := f.String("format", migrate.FormatYaml, "导出格式，yaml 或 json")
+	output := f.String("o", "", "导出的文件，不传时输出到 stdout")
+	f.parse(args)
+
+	if *format != migrate.FormatYaml && *format != migrate.FormatJson {
+		return f.fail(fmt.Errorf("不支持的导出格式[%s]", *format))
+	}
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	m, err := migrate.Export(c.db)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	var data []byte
+	if *format == migrate.FormatJson {
+		data, err = json.MarshalIndent(m, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(m)
+	}
+	if err != nil {
+		return f.fail(err)
+	}
+
+	if *output == "" {
+		_, _ = os.Stdout.Write(data)
+		return 0
+	}
+	err = ioutil.WriteFile(*output, data, 0644)
+	if err != nil {
+		return f.fail(err)
+	}
+	return c.output(map[string]int{
+		"items":       len(m.Items),
+		"permissions": len(m.Permissions),
+		"roles":       len(m.Roles),
+	}, func() {
+		fmt.Printf("导出 item %d，permission %d，role %d 到[%s]\n", len(m.Items), len(m.Permissions), len(m.Roles), *output)
+	})
+}
+
+// 导入导出的数据，文件格式与策略文件相同，但是不能包含 users
+func runImport(args []string) int {
+	f := newCmdFlags("import")
+	pfile := f.String("f", "", "-f /path/to/export.yaml")
+	mode := f.String("mode", migrate.ModeCreate, "导入模式，create / upsert / replace")
+	dryRun := f.Bool("dry-run", false, "只输出导入计划，不写入数据")
+	f.parse(args)
+
+	policy, err := loadPolicy(*pfile)
+	if err != nil {
+		return f.fail(err)
+	}
+	if len(policy.Users) > 0 {
+		return f.fail(errors.New("导入的文件不能包含 users，用户的 roles 请使用 sync 同步"))
+	}
+	if !migrate.IsValidMode(*mode) {
+		return f.fail(fmt.Errorf("不支持的导入模式[%s]", *mode))
+	}
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	plan, err := migrate.Import(c.db, &policy.Migrate, *mode, *dryRun, cliOpHistory())
+	return c.outputPlan(plan, err, *dryRun, "导入完成")
+}
+
+func loadPolicy(pfile string) (*migrate.Policy, error) {
+	if pfile == "" {
+		return nil, errors.New("缺少 -f 参数")
+	}
+	return migrate.LoadPolicyFile(pfile)
+}
+
+// 命令行操作的审计日志，没有登录用户
+func cliOpHistory() *ophistory.OperationHistory {
+	opHis := ophistory.NewOpHistory("", "cli", "")
+	opHis.TenantId = tenantapp.DefaultTenantId
+	return opHis
+}
+
+// 输出导入或同步的计划，有冲突时同时输出计划和错误
+func (c *cli) outputPlan(plan *migrate.Plan, err error, dryRun bool, doneMsg string) int {
+	if c.json {
+		ret := map[string]interface{}{"plan": plan}
+		if err != nil {
+			ret["error"] = err.Error()
+		}
+		printJson(ret)
+	} else {
+		if plan != nil {
+			printPlan(plan)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "错误:", err.Error())
+		} else if !dryRun {
+			fmt.Println(doneMsg)
+		}
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func printPlan(plan *migrate.Plan) {
+	fmt.Printf("模式[%s]，新建%d，修改%d，删除%d，未变化%d\n", plan.Mode, plan.Create, plan.Update, plan.Delete, plan.Unchanged)
+	for _, ch := range plan.Changes {
+		if ch.Action == migrate.ActionUnchanged {
+			continue
+		}
+		fmt.Printf("  [%s] %s[%s]\n", ch.Action, ch.Type, ch.Name)
+		if ch.Action != migrate.ActionUpdate {
+			continue
+		}
+		for _, c := range ch.Changes {
+			fmt.Printf("      %s: %v -> %v\n", c.Field, c.Old, c.New)
+		}
+	}
+	for _, conflict := range plan.Conflicts {
+		fmt.Println("冲突:", conflict)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// role 管理的子命令，只操作默认租户，role 使用 name 指定
+// userandrole role list|grant|revoke -c conf.yaml ...
+func runRole(args []string) int {
+	return subCommands{
+		"list":   runRoleList,
+		"grant":  runRoleGrant,
+		"revoke": runRoleRevoke,
+	}.run("role", args)
+}
+
+func runRoleList(args []string) int {
+	f := newCmdFlags("role list")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	filter := &bson.M{
+		"tenantId": tenantapp.DefaultTenantId,
+		"deleted":  false,
+	}
+	roles, err := roleapp.GetFilterRoles(c.db, filter)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	return c.output(roles, func() {
+		for _, role := range roles {
+			approval := ""
+			if role.RequireApproval {
+				approval = "，需要审批"
+			}
+			fmt.Printf("%s[%s]，来源 %s%s\n", role.Name, role.Id, role.DataFrom, approval)
+		}
+	})
+}
+
+// 直接给用户赋予 roles，需要审批的 role 不能通过命令行赋予
+func runRoleGrant(args []string) int {
+	f := newCmdFlags("role grant")
+	loginId := f.String("login", "", "登录账户")
+	names := f.String("roles", "", "role name，多个用逗号分隔")
+	expire := f.Duration("expire", 0, "授权时长，比如 720h，不传表示长期有效")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	user, roleIds, err := c.loadGrant(*loginId, *names, true)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	var expireT int64
+	if *expire > 0 {
+		expireT = time.Now().Add(*expire).Unix()
+	}
+	uwr, err := userandrole.AddUserRoles(c.db, tenantapp.DefaultTenantId, user.Id, roleIds, expireT, cliOpHistory())
+	if err != nil {
+		return f.fail(err)
+	}
+
+	return c.output(uwr, func() {
+		fmt.Printf("给用户[%s]赋予 roles %s 成功\n", *loginId, *names)
+	})
+}
+
+// 移除用户直接赋予的 roles
+func runRoleRevoke(args []string) int {
+	f := newCmdFlags("role revoke")
+	loginId := f.String("login", "", "登录账户")
+	names := f.String("roles", "", "role name，多个用逗号分隔")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	user, roleIds, err := c.loadGrant(*loginId, *names, false)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	uwr, err := userandrole.GetUserWithRoleByUserId(c.db, user.Id)
+	if err != nil {
+		return f.fail(err)
+	}
+	if uwr == nil {
+		return f.fail(fmt.Errorf("用户[%s]没有直接赋予的 roles", *loginId))
+	}
+	err = userandrole.RemoveUserRoles(c.db, uwr, roleIds, cliOpHistory())
+	if err != nil {
+		return f.fail(err)
+	}
+
+	return c.output(uwr, func() {
+		fmt.Printf("移除用户[%s]的 roles %s 成功\n", *loginId, *names)
+	})
+}
+
+// 读取授权的用户和 roles，admin 账户的 roles 不能通过命令行修改
+// grant 时检查 role 是否需要审批，移除不需要
+func (c *cli) loadGrant(loginId, names string, grant bool) (*userapp.User, []string, error) {
+	user, err := c.loadUser(loginId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Id == userapp.AdminUserId() {
+		return nil, nil, errors.New("admin 账户的 roles 不能修改")
+	}
+
+	roleNames := splitList(names)
+	if len(roleNames) == 0 {
+		return nil, nil, errors.New("缺少 -roles 参数")
+	}
+	var roleIds []string
+	for _, name := range roleNames {
+		role, err := roleapp.GetRoleByName(c.db, tenantapp.DefaultTenantId, name, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if role == nil || role.Deleted {
+			return nil, nil, fmt.Errorf("role[%s]不存在", name)
+		}
+		if grant && role.RequireApproval {
+			return nil, nil, fmt.Errorf("role[%s]需要审批，请通过授权申请赋予", name)
+		}
+		roleIds = append(roleIds, role.Id)
+	}
+	return user, roleIds, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+	"strings"
+	"time"
+)
+
+// 用户管理的子命令，只操作默认租户中账户密码登录方式的用户
+// userandrole user create|ban|unban|reset-passwd|show -c conf.yaml -login xxx
+func runUser(args []string) int {
+	return subCommands{
+		"create":       runUserCreate,
+		"ban":          runUserBan,
+		"unban":        runUserUnBan,
+		"reset-passwd": runUserResetPasswd,
+		"show":         runUserShow,
+	}.run("user", args)
+}
+
+// 新建账户，密码从终端或 stdin 读取，首次登录需要修改密码
+func runUserCreate(args []string) int {
+	f := newCmdFlags("user create")
+	loginId := f.String("login", "", "登录账户")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	*loginId = strings.TrimSpace(*loginId)
+	if *loginId == "" {
+		return f.fail(errors.New("缺少 -login 参数"))
+	}
+	dbuser, err := userapp.GetUserByLoginId(c.db, tenantapp.DefaultTenantId, *loginId)
+	if err != nil {
+		return f.fail(err)
+	}
+	if dbuser != nil {
+		return f.fail(fmt.Errorf("账户[%s]已存在", *loginId))
+	}
+
+	passwd, err := readPasswd("输入密码: ")
+	if err != nil {
+		return f.fail(err)
+	}
+	if err = userapp.DefaultPasswdPolicy.Check(passwd); err != nil {
+		return f.fail(err)
+	}
+
+	user, err := userapp.CreateIdPasswdAccount(c.db, tenantapp.DefaultTenantId, *loginId, passwd, "", false, cliOpHistory())
+	if err != nil {
+		return f.fail(err)
+	}
+
+	return c.output(user, func() {
+		fmt.Printf("新建账户[%s]成功，userId[%s]\n", *loginId, user.Id)
+	})
+}
+
+// 立即封禁用户并强制下线，-duration 为 0 时使用默认时长
+func runUserBan(args []string) int {
+	f := newCmdFlags("user ban")
+	loginId := f.String("login", "", "登录账户")
+	reason := f.String("reason", "", "封禁原因")
+	duration := f.Duration("duration", 0, "封禁时长，比如 72h")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	user, err := c.loadUser(*loginId)
+	if err != nil {
+		return f.fail(err)
+	}
+	if user.Id == userapp.AdminUserId() {
+		return f.fail(errors.New("不能禁用 admin 账户"))
+	}
+
+	var endT int64
+	if *duration > 0 {
+		endT = time.Now().Add(*duration).Unix()
+	}
+	// 审计日志写入失败时封禁已经生效，仍然强制下线
+	err = userapp.BanUser(c.db, user.Id, *reason, 0, endT, cliOpHistory())
+	if err != nil && !errors.Is(err, ophistory.ErrRecordFailed) {
+		return f.fail(err)
+	}
+	recordErr := err
+	err = userapp.DeleteUserTokens(c.r, user.Id)
+	if err != nil {
+		return f.fail(err)
+	}
+	if recordErr != nil {
+		return f.fail(recordErr)
+	}
+
+	return c.output(map[string]string{"userId": user.Id}, func() {
+		fmt.Printf("封禁用户[%s]成功\n", *loginId)
+	})
+}
+
+func runUserUnBan(args []string) int {
+	f := newCmdFlags("user unban")
+	loginId := f.String("login", "", "登录账户")
+	reason := f.String("reason", "", "解禁原因")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	user, err := c.loadUser(*loginId)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	err = userapp.UnBanUser(c.db, user.Id, *reason, cliOpHistory())
+	if err != nil {
+		return f.fail(err)
+	}
+
+	return c.output(map[string]string{"userId": user.Id}, func() {
+		fmt.Printf("解禁用户[%s]成功\n", *loginId)
+	})
+}
+
+// 重置账户密码登录方式的密码，密码从终端或 stdin 读取，不传 -login 时重置 admin 的密码
+// 用户所有登录方式的 token 都会失效，-init 时下次登录需要修改密码
+func runUserResetPasswd(args []string) int {
+	f := newCmdFlags("user reset-passwd")
+	loginId := f.String("login", userapp.AdminLoginId, "登录账户")
+	init := f.Bool("init", false, "下次登录需要修改密码")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	passwd, err := readPasswd(fmt.Sprintf("输入[%s]的新密码: ", *loginId))
+	if err != nil {
+		return f.fail(err)
+	}
+
+	ulpa, err := resetUserPasswd(c.ds, c.r, *loginId, passwd, *init)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	return c.output(map[string]string{"userId": ulpa.UserId}, func() {
+		fmt.Printf("重置[%s]的密码成功，已移除所有登录 token\n", *loginId)
+	})
+}
+
+// 重置默认租户中账户的密码
+func resetUserPasswd(ds *dbandmq.Ds, r *redis.Client, loginId, passwd string, init bool) (*userapp.UserLoginIdPasswdAuth, error) {
+	db := ds.CopyDs()
+	defer db.Close()
+	return userapp.ResetIdPasswd(db, r, userapp.DefaultPasswdPolicy, tenantapp.DefaultTenantId, loginId, passwd, init, ophistory.CodeUserResetPasswd, cliOpHistory())
+}
+
+// 用户的登录方式、封禁状态和所有生效的 roles
+type userDetail struct {
+	User  *userapp.User             `json:"user"`
+	Roles *userandrole.UserWithRole `json:"roles"`
+}
+
+func runUserShow(args []string) int {
+	f := newCmdFlags("user show")
+	loginId := f.String("login", "", "登录账户")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	user, err := c.loadUser(*loginId)
+	if err != nil {
+		return f.fail(err)
+	}
+	user, err = userapp.GetUserFullInfoById(c.db, user.Id)
+	if err != nil {
+		return f.fail(err)
+	}
+	uwr, err := userandrole.GetUserRoles(c.db, user.Id)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	detail := &userDetail{
+		User:  user,
+		Roles: uwr,
+	}
+	return c.output(detail, func() {
+		fmt.Printf("userId:  %s\n", user.Id)
+		fmt.Printf("name:    %s\n", user.Name)
+		fmt.Printf("loginId: %s\n", *loginId)
+		if user.IsBannedAt(time.Now().Unix()) {
+			fmt.Printf("状态:    封禁至 %s，原因[%s]\n", util.FmtTimestampTime(user.BanT), user.BanReason)
+		} else {
+			fmt.Println("状态:    正常")
+		}
+		fmt.Println("roles:")
+		printUserRoles(uwr)
+	})
+}
+
+func printUserRoles(uwr *userandrole.UserWithRole) {
+	for _, role := range uwr.Roles {
+		var sources []string
+		for _, s := range uwr.RoleSources[role.Id] {
+			if s.Name != "" {
+				sources = append(sources, s.Type+":"+s.Name)
+			} else {
+				sources = append(sources, s.Type)
+			}
+		}
+		expire := ""
+		for _, re := range uwr.RoleExpires {
+			if re.RoleId == role.Id {
+				expire = "，到期时间 " + util.FmtTimestampTime(re.ExpireT)
+			}
+		}
+		fmt.Printf("  %s[%s]，来源 %s%s\n", role.Name, role.Id, strings.Join(sources, ","), expire)
+	}
+}
+
+// 会话管理的子命令
+// userandrole session revoke -c conf.yaml -login xxx
+func runSession(args []string) int {
+	return subCommands{
+		"revoke": runSessionRevoke,
+	}.run("session", args)
+}
+
+// 移除用户所有登录方式的 token，强制下线
+func runSessionRevoke(args []string) int {
+	f := newCmdFlags("session revoke")
+	loginId := f.String("login", "", "登录账户")
+	f.parse(args)
+
+	c, err := f.open()
+	if err != nil {
+		return f.fail(err)
+	}
+	defer c.close()
+
+	user, err := c.loadUser(*loginId)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	err = userapp.DeleteUserTokens(c.r, user.Id)
+	if err != nil {
+		return f.fail(err)
+	}
+	err = ophistory.Record(c.db, cliOpHistory(), ophistory.CodeUserRevokeSession, ophistory.TargetUser, user.Id)
+	if err != nil {
+		return f.fail(err)
+	}
+
+	return c.output(map[string]string{"userId": user.Id}, func() {
+		fmt.Printf("用户[%s]已强制下线\n", *loginId)
+	})
+}
@@ -1,9 +1,9 @@
 package config
 
 import (
-	"errors"
 	"fmt"
 	"github.com/spf13/viper"
+	"os"
 )
 
 type Config struct {
@@ -19,6 +19,20 @@ type Config struct {
 	WeChat *WeChatLoginConf `yaml:"wechat"`
 
 	PhoneSms *SmsConf `yaml:"phonesms"`
+
+	Ldap *LdapConf `yaml:"ldap"`
+
+	Email *EmailConf `yaml:"email"`
+
+	Register *RegisterConf `yaml:"register"`
+
+	ForgotPasswd *ForgotPasswdConf `yaml:"forgotpasswd"`
+
+	Profile *ProfileConf `yaml:"profile"`
+
+	Audit *AuditConf `yaml:"audit"`
+
+	Webhook *WebhookConf `yaml:"webhook"`
 }
 
 type ServerConf struct {
@@ -74,24 +88,139 @@ type SmsConf struct {
 	Debug bool `yaml:"debug"`
 }
 
+// 邮件发送
+type EmailConf struct {
+	Host string `yaml:"host"`
+	Port int `yaml:"port"`
+	User string `yaml:"user"`
+	Passwd string `yaml:"passwd"`
+	From string `yaml:"from"`
+	Debug bool `yaml:"debug"`
+}
+
+// 账户密码方式的自助注册
+type RegisterConf struct {
+	Enable bool `yaml:"enable"`
+	LoginIdPattern string `yaml:"loginidpattern"` // loginId 格式，正则表达式
+
+	// 密码策略
+	PasswdMinLen int `yaml:"passwdminlen"`
+	PasswdNeedLetter bool `yaml:"passwdneedletter"`
+	PasswdNeedDigit bool `yaml:"passwdneeddigit"`
+	PasswdNeedSpecial bool `yaml:"passwdneedspecial"`
+
+	Verify string `yaml:"verify"` // 注册时的验证方式 NONE / PHONE / EMAIL
+
+	Captcha *CaptchaConf `yaml:"captcha"`
+
+	// 同一个 ip 在 ratewindow 秒内最多请求 ratelimit 次，0 为不限制
+	RateLimit int `yaml:"ratelimit"`
+	RateWindow int `yaml:"ratewindow"`
+}
+
+// 通过手机号或邮箱验证码找回密码
+type ForgotPasswdConf struct {
+	Enable bool `yaml:"enable"`
+	// 同一个 ip 在 ratewindow 秒内最多请求 ratelimit 次，0 为不限制
+	RateLimit int `yaml:"ratelimit"`
+	RateWindow int `yaml:"ratewindow"`
+}
+
+// 用户资料可修改的字段
+type ProfileConf struct {
+	SelfFields []string `yaml:"selffields"` // 用户可以修改自己的字段
+	AdminFields []string `yaml:"adminfields"` // 管理员可以修改其他用户的字段
+	Roles []*ProfileRoleConf `yaml:"roles"` // 按角色配置，匹配到时覆盖上面的默认值
+}
+
+type ProfileRoleConf struct {
+	Role string `yaml:"role"` // role name
+	SelfFields []string `yaml:"selffields"`
+	AdminFields []string `yaml:"adminfields"`
+}
+
+// 审计日志，定期导出签名的哈希链检查点到文件
+type AuditConf struct {
+	CheckpointFile string `yaml:"checkpointfile"` // 为空时不导出
+	CheckpointInterval int `yaml:"checkpointinterval"` // 导出间隔，单位秒
+	SignKey string `yaml:"signkey"` // 检查点签名密钥
+}
+
+// webhook 默认不能投递到本机、内网等地址
+type WebhookConf struct {
+	AllowTargets []string `yaml:"allowtargets"` // 允许投递的内网地址，ip、网段或者域名
+}
+
+// 人机验证
+type CaptchaConf struct {
+	Enable bool `yaml:"enable"`
+	VerifyUrl string `yaml:"verifyurl"`
+	Secret string `yaml:"secret"`
+}
+
+// ldap / active directory 登录
+type LdapConf struct {
+	Enable bool `yaml:"enable"`
+	Url string `yaml:"url"` // ldap://host:389 或 ldaps://host:636
+	StartTLS bool `yaml:"starttls"`
+	InsecureSkipVerify bool `yaml:"insecureskipverify"`
+	BindDN string `yaml:"binddn"`
+	BindPasswd string `yaml:"bindpasswd"`
+	BaseDN string `yaml:"basedn"`
+	UserFilter string `yaml:"userfilter"`
+	NameAttr string `yaml:"nameattr"`
+	EmailAttr string `yaml:"emailattr"`
+	GroupAttr string `yaml:"groupattr"`
+	GroupMapping []*LdapGroupMapping `yaml:"groupmapping"`
+}
+
+// 目录分组与 role name 的映射
+type LdapGroupMapping struct {
+	Group string `yaml:"group"`
+	Roles []string `yaml:"roles"`
+}
+
+// 读取配置文件，使用环境变量覆盖后检查配置，返回的错误由调用方输出
+// path 为空时只从环境变量读取
 func LoadConf(path string) (*Config, error) {
-	if path == "" {
-		return nil, errors.New("path不能为空")
+	v := viper.New()
+	if path != "" {
+		v.SetConfigFile(path)
+		err := v.ReadInConfig()
+		if err != nil {
+			return nil, fmt.Errorf("读取配置文件失败, %s", err.Error())
+		}
 	}
 
-	viper.SetConfigFile(path)
-	err := viper.ReadInConfig()
-	if err != nil {
-		fmt.Println("读取配置文件失败", err.Error())
-		return nil, err
+	problems := applyEnv(v, os.LookupEnv)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
 	}
 
 	var c Config
-	err = viper.Unmarshal(&c)
+	err := v.Unmarshal(&c)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败, %s", err.Error())
+	}
+	if c.Server == nil {
+		c.Server = &ServerConf{}
+	}
+
+	err = c.Validate()
 	if err != nil {
-		fmt.Println("读取配置文件失败", err.Error())
 		return nil, err
 	}
 
 	return &c, nil
-}
\ No newline at end of file
+}
+
+// 配置了账户或者 debug 时启用短信发送，未启用时手机号登录、绑定等接口不可用
+func (c *Config) SmsEnabled() bool {
+	sc := c.PhoneSms
+	return sc != nil && (sc.Debug || sc.Account != "" || sc.Password != "")
+}
+
+// 配置了 host 时启用邮件发送
+func (c *Config) EmailEnabled() bool {
+	return c.Email != nil && c.Email.Host != ""
+}
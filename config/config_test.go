@@ -0,0 +1,119 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func validConfig() *Config {
+	return &Config{
+		Server:  &ServerConf{Port: "9300"},
+		Mongodb: &MongodbConf{Host: "127.0.0.1", Port: "27017", Database: "test"},
+		Redis:   &RedisConf{Host: "127.0.0.1", Port: "6379"},
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if name := EnvName("wechat.app.secret"); name != "USERANDROLE_WECHAT_APP_SECRET" {
+		t.Errorf("EnvName = %s", name)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	_ = ioutil.WriteFile(secret, []byte("s3cret\n"), 0600)
+
+	env := map[string]string{
+		"USERANDROLE_MONGODB_HOST":        "mongo",
+		"USERANDROLE_MONGODB_PASSWD_FILE": secret,
+		"USERANDROLE_REDIS_DBNUM":         "3",
+		"USERANDROLE_LDAP_ENABLE":         "true",
+		"USERANDROLE_PROFILE_SELFFIELDS":  "name, avatar",
+		"USERANDROLE_LDAP_GROUPMAPPING":   `[{"group": "cn=ops", "roles": ["运维"]}]`,
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	v := viper.New()
+	if problems := applyEnv(v, lookup); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	var c Config
+	if err := v.Unmarshal(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Mongodb.Host != "mongo" || c.Mongodb.Passwd != "s3cret" {
+		t.Errorf("mongodb = %+v", c.Mongodb)
+	}
+	if c.Redis.DbNum != 3 || !c.Ldap.Enable {
+		t.Errorf("redis = %+v, ldap = %+v", c.Redis, c.Ldap)
+	}
+	if len(c.Profile.SelfFields) != 2 || c.Profile.SelfFields[1] != "avatar" {
+		t.Errorf("profile = %+v", c.Profile)
+	}
+	if len(c.Ldap.GroupMapping) != 1 || c.Ldap.GroupMapping[0].Roles[0] != "运维" {
+		t.Errorf("groupmapping = %+v", c.Ldap.GroupMapping)
+	}
+
+	// 错误的值和同时设置值与文件时，列出所有的问题
+	env = map[string]string{
+		"USERANDROLE_REDIS_DBNUM":         "x",
+		"USERANDROLE_MONGODB_PASSWD":      "a",
+		"USERANDROLE_MONGODB_PASSWD_FILE": secret,
+	}
+	if problems := applyEnv(viper.New(), lookup); len(problems) != 2 {
+		t.Errorf("problems = %v", problems)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未配置的可选功能不启用，不需要检查
+	c := validConfig()
+	c.WeChat = &WeChatLoginConf{App: &WeChatLoginAppConf{}}
+	c.PhoneSms = &SmsConf{Url: "https://sms"}
+	if err := c.Validate(); err != nil || c.SmsEnabled() {
+		t.Errorf("err = %v, sms = %v", err, c.SmsEnabled())
+	}
+
+	c = &Config{
+		Redis:        &RedisConf{Host: "127.0.0.1", Port: "abc"},
+		WeChat:       &WeChatLoginConf{App: &WeChatLoginAppConf{AppId: "wx"}},
+		PhoneSms:     &SmsConf{Account: "a"},
+		Register:     &RegisterConf{Enable: true, Verify: "EMAIL", LoginIdPattern: "("},
+		ForgotPasswd: &ForgotPasswdConf{Enable: true, RateLimit: 10},
+		Audit:        &AuditConf{CheckpointFile: "/tmp/cp"},
+	}
+	err := c.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("err = %v", err)
+	}
+	want := []string{
+		"mongodb.host", "mongodb.port", "mongodb.database", "redis.port",
+		"wechat.app.secret", "phonesms.password", "phonesms.url",
+		"register.loginidpattern", "register.verify", "forgotpasswd.ratewindow", "signkey",
+	}
+	if len(verr.Problems) != len(want) {
+		t.Fatalf("problems = %v", verr.Problems)
+	}
+	for i, w := range want {
+		if !strings.Contains(verr.Problems[i], w) {
+			t.Errorf("problem %d = %s, want %s", i, verr.Problems[i], w)
+		}
+	}
+}
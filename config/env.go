@@ -0,0 +1,121 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// 所有配置项都可以通过环境变量覆盖，环境变量优先于配置文件
+// 变量名为前缀加上大写的 key，层级之间使用下划线，比如 mongodb.passwd 对应 USERANDROLE_MONGODB_PASSWD
+// 变量名加上 _FILE 后缀时，值为文件路径，读取文件内容作为配置值，用于从 docker / k8s secret 文件读取密码等数据
+// 列表类型的配置项，字符串列表使用逗号分隔，对象列表使用 json 数组
+const EnvPrefix = "USERANDROLE"
+
+const envFileSuffix = "_FILE"
+
+// 配置项在配置文件中的 key 和类型
+type confKey struct {
+	Key string
+	Typ reflect.Type
+}
+
+// 根据 Config 的 yaml tag 列出所有的配置项
+func confKeys(t reflect.Type, prefix string) []*confKey {
+	var keys []*confKey
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			keys = append(keys, confKeys(ft, key+".")...)
+			continue
+		}
+		keys = append(keys, &confKey{Key: key, Typ: ft})
+	}
+	return keys
+}
+
+// 配置项对应的环境变量名
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// 读取环境变量覆盖配置文件中的值，lookup 为 os.LookupEnv，测试时可以替换
+// 返回所有环境变量的错误
+func applyEnv(v *viper.Viper, lookup func(string) (string, bool)) []string {
+	var problems []string
+	for _, k := range confKeys(reflect.TypeOf(Config{}), "") {
+		name := EnvName(k.Key)
+		val, ok := lookup(name)
+		if file, fok := lookup(name + envFileSuffix); fok {
+			if ok {
+				problems = append(problems, fmt.Sprintf("%s 和 %s 不能同时设置", name, name+envFileSuffix))
+				continue
+			}
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s 读取文件失败, %s", name+envFileSuffix, err.Error()))
+				continue
+			}
+			// 文件末尾通常有换行
+			val, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+
+		value, err := parseEnv(k.Typ, val)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s 的值[%s]错误, %s", name, val, err.Error()))
+			continue
+		}
+		v.Set(k.Key, value)
+	}
+	return problems
+}
+
+func parseEnv(t reflect.Type, val string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		if val == "" {
+			return false, nil
+		}
+		return strconv.ParseBool(val)
+	case reflect.Int:
+		if val == "" {
+			return 0, nil
+		}
+		return strconv.Atoi(val)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			ret := []string{}
+			for _, s := range strings.Split(val, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					ret = append(ret, s)
+				}
+			}
+			return ret, nil
+		}
+		var ret []interface{}
+		err := json.Unmarshal([]byte(val), &ret)
+		if err != nil {
+			return nil, fmt.Errorf("需要 json 数组")
+		}
+		return ret, nil
+	default:
+		return val, nil
+	}
+}
@@ -0,0 +1,195 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 配置检查的错误，包含所有的问题，启动时一次列出
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "配置错误:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) add(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) required(key, val string) {
+	if strings.TrimSpace(val) == "" {
+		v.add("%s 不能为空（环境变量 %s）", key, EnvName(key))
+	}
+}
+
+func (v *validator) port(key, val string) {
+	if val == "" {
+		return
+	}
+	p, err := strconv.Atoi(val)
+	if err != nil || p <= 0 || p > 65535 {
+		v.add("%s 的值[%s]不是有效的端口", key, val)
+	}
+}
+
+// 同一个 ip 在 ratewindow 秒内最多请求 ratelimit 次
+func (v *validator) rate(prefix string, limit, window int) {
+	if limit < 0 || window < 0 {
+		v.add("%s.ratelimit 和 %s.ratewindow 不能小于 0", prefix, prefix)
+	} else if limit > 0 && window == 0 {
+		v.add("%s.ratelimit 大于 0 时需要配置 %s.ratewindow", prefix, prefix)
+	}
+}
+
+// 检查配置，返回 *ValidationError
+// mongodb 和 redis 必须配置，其他可选的功能未配置时不启用，配置了就需要完整
+// server.port 可以由启动参数指定，由启动服务时检查
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if c.Server != nil {
+		v.port("server.port", c.Server.Port)
+	}
+
+	if c.Mongodb == nil {
+		c.Mongodb = &MongodbConf{}
+	}
+	v.required("mongodb.host", c.Mongodb.Host)
+	v.required("mongodb.port", c.Mongodb.Port)
+	v.port("mongodb.port", c.Mongodb.Port)
+	v.required("mongodb.database", c.Mongodb.Database)
+
+	if c.Redis == nil {
+		c.Redis = &RedisConf{}
+	}
+	v.required("redis.host", c.Redis.Host)
+	v.required("redis.port", c.Redis.Port)
+	v.port("redis.port", c.Redis.Port)
+	if c.Redis.DbNum < 0 {
+		v.add("redis.dbnum 不能小于 0")
+	}
+
+	if c.WeChat != nil {
+		if c.WeChat.App != nil {
+			v.wechat("wechat.app", c.WeChat.App.AppId, c.WeChat.App.Secret)
+		}
+		if c.WeChat.XiaoChengXu != nil {
+			v.wechat("wechat.xiaochengxu", c.WeChat.XiaoChengXu.AppId, c.WeChat.XiaoChengXu.Secret)
+		}
+		if c.WeChat.Web != nil {
+			v.wechat("wechat.web", c.WeChat.Web.AppId, c.WeChat.Web.Secret)
+		}
+	}
+
+	// debug 时不真的发送短信，不需要账户
+	if c.SmsEnabled() && !c.PhoneSms.Debug {
+		v.required("phonesms.account", c.PhoneSms.Account)
+		v.required("phonesms.password", c.PhoneSms.Password)
+		v.required("phonesms.url", c.PhoneSms.Url)
+	}
+
+	if c.EmailEnabled() && (c.Email.Port <= 0 || c.Email.Port > 65535) {
+		v.add("email.port 的值[%d]不是有效的端口", c.Email.Port)
+	}
+
+	if c.Register != nil && c.Register.Enable {
+		c.validateRegister(v)
+	}
+
+	if c.ForgotPasswd != nil && c.ForgotPasswd.Enable {
+		if !c.SmsEnabled() && !c.EmailEnabled() {
+			v.add("forgotpasswd 需要配置 phonesms 或 email")
+		}
+		v.rate("forgotpasswd", c.ForgotPasswd.RateLimit, c.ForgotPasswd.RateWindow)
+	}
+
+	if c.Ldap != nil && c.Ldap.Enable {
+		v.required("ldap.url", c.Ldap.Url)
+		if c.Ldap.Url != "" && !strings.HasPrefix(c.Ldap.Url, "ldap://") && !strings.HasPrefix(c.Ldap.Url, "ldaps://") {
+			v.add("ldap.url 需要以 ldap:// 或 ldaps:// 开头")
+		}
+		v.required("ldap.basedn", c.Ldap.BaseDN)
+		for i, gm := range c.Ldap.GroupMapping {
+			if gm == nil || gm.Group == "" {
+				v.add("ldap.groupmapping[%d].group 不能为空", i)
+			}
+		}
+	}
+
+	if c.Audit != nil && c.Audit.CheckpointFile != "" {
+		if c.Audit.SignKey == "" {
+			v.add("audit 配置了 checkpointfile，但是未配置 signkey（环境变量 %s）", EnvName("audit.signkey"))
+		}
+		if c.Audit.CheckpointInterval < 0 {
+			v.add("audit.checkpointinterval 不能小于 0")
+		}
+	}
+
+	if c.Webhook != nil {
+		for _, t := range c.Webhook.AllowTargets {
+			if !strings.Contains(t, "/") {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(strings.TrimSpace(t)); err != nil {
+				v.add("webhook.allowtargets 中的网段[%s]错误", t)
+			}
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// 配置了 appid 的平台启用微信登录，appid 和 secret 需要同时配置
+func (v *validator) wechat(prefix, appId, secret string) {
+	if appId != "" && secret == "" {
+		v.required(prefix+".secret", secret)
+	}
+	if appId == "" && secret != "" {
+		v.required(prefix+".appid", appId)
+	}
+}
+
+func (c *Config) validateRegister(v *validator) {
+	rc := c.Register
+	if rc.LoginIdPattern != "" {
+		if _, err := regexp.Compile(rc.LoginIdPattern); err != nil {
+			v.add("register.loginidpattern 错误, %s", err.Error())
+		}
+	}
+	if rc.PasswdMinLen < 0 {
+		v.add("register.passwdminlen 不能小于 0")
+	}
+
+	switch strings.ToUpper(rc.Verify) {
+	case "", "NONE":
+	case "PHONE":
+		if !c.SmsEnabled() {
+			v.add("register.verify 为 PHONE，但是未配置 phonesms")
+		}
+	case "EMAIL":
+		if !c.EmailEnabled() {
+			v.add("register.verify 为 EMAIL，但是未配置 email")
+		}
+	default:
+		v.add("register.verify 的值[%s]错误，可选值 NONE / PHONE / EMAIL", rc.Verify)
+	}
+
+	if rc.Captcha != nil && rc.Captcha.Enable {
+		v.required("register.captcha.verifyurl", rc.Captcha.VerifyUrl)
+		v.required("register.captcha.secret", rc.Captcha.Secret)
+	}
+
+	v.rate("register", rc.RateLimit, rc.RateWindow)
+}
@@ -0,0 +1,29 @@
+package emailapp
+
+import (
+	"errors"
+	"github.com/go-redis/redis"
+	. "github.com/leyle/ginbase/consolelog"
+	"strings"
+)
+
+// 检查邮箱验证码，验证成功后删除
+func (e *EmailOption) CheckCode(email, code string) (bool, error) {
+	key := EmailRedisPrefix + strings.ToLower(strings.TrimSpace(email))
+	dbcode, err := e.R.Get(key).Result()
+	if err != nil && err != redis.Nil {
+		Logger.Errorf("", "从 redis 读取邮箱[%s]对应的 code 失败, %s", email, err.Error())
+		return false, err
+	}
+
+	if err == redis.Nil {
+		return false, errors.New("验证码已失效")
+	}
+
+	if dbcode != code {
+		return false, nil
+	}
+
+	e.R.Del(key)
+	return true, nil
+}
@@ -0,0 +1,22 @@
+package emailapp
+
+import "github.com/go-redis/redis"
+
+const EmailRedisPrefix = "EMAIL:CODE:"
+
+// 验证码长度与有效期（分钟）
+var (
+	MAX_CODE_LEN    = 6
+	CODE_EXPIRE_MIN = 10
+)
+
+// 发送邮件的配置
+type EmailOption struct {
+	Host   string // smtp 服务地址
+	Port   int
+	User   string
+	Passwd string
+	From   string // 发件人，为空时使用 User
+	R      *redis.Client
+	Debug  bool // 如果 true，就不真的发送邮件
+}
@@ -0,0 +1,84 @@
+package emailapp
+
+import (
+	"crypto/rand"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"math/big"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// 给邮箱发送验证码，验证码保存在 redis 中
+func (e *EmailOption) SendCode(email, subject string) error {
+	email = strings.TrimSpace(email)
+	if !IsValidEmail(email) {
+		return fmt.Errorf("错误的邮箱地址[%s]", email)
+	}
+
+	code := GenerateCode(MAX_CODE_LEN)
+	content := fmt.Sprintf("验证码：【%s】，%d分钟内有效，请勿提供给别人。", code, CODE_EXPIRE_MIN)
+
+	if e.Debug {
+		Logger.Debugf("", "debug 模式，不发送邮件，邮箱[%s]的验证码是[%s]", email, code)
+	} else {
+		err := e.SendMail(email, subject, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	key := EmailRedisPrefix + strings.ToLower(email)
+	return e.R.Set(key, code, time.Duration(CODE_EXPIRE_MIN)*time.Minute).Err()
+}
+
+// 发送一封纯文本邮件
+func (e *EmailOption) SendMail(to, subject, content string) error {
+	from := e.From
+	if from == "" {
+		from = e.User
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		from, to, subject, content)
+
+	addr := fmt.Sprintf("%s:%d", e.Host, e.Port)
+	var auth smtp.Auth
+	if e.User != "" {
+		auth = smtp.PlainAuth("", e.User, e.Passwd, e.Host)
+	}
+
+	err := smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+	if err != nil {
+		Logger.Errorf("", "给邮箱[%s]发送邮件失败, %s", to, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// 生成 n 位数字验证码
+func GenerateCode(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		v, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			v = big.NewInt(int64(time.Now().UnixNano() % 10))
+		}
+		sb.WriteString(v.String())
+	}
+	return sb.String()
+}
+
+// 简单检查邮箱格式
+func IsValidEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return false
+	}
+	if strings.ContainsAny(email, " \r\n") {
+		return false
+	}
+	return strings.Contains(email[at+1:], ".")
+}
@@ -5,6 +5,8 @@ go 1.13
 require (
 	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b // indirect
 	github.com/gin-gonic/gin v1.4.0
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.3.0
 	github.com/go-redis/redis v6.15.6+incompatible
 	github.com/gomodule/redigo v2.0.0+incompatible // indirect
 	github.com/json-iterator/go v1.1.7
@@ -12,5 +14,7 @@ require (
 	github.com/leyle/smsapp v1.0.1
 	github.com/silenceper/wechat v2.0.0+incompatible
 	github.com/spf13/viper v1.4.0
+	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,330 @@
+package groupapp
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// 用户组，批量给用户赋予 roles
+// 与部门不同，用户组没有层级，只用于授权，不影响管理范围
+const CollectionNameGroup = "userGroup"
+
+var IKGroup = &dbandmq.IndexKey{
+	Collection: CollectionNameGroup,
+	SingleKey:  []string{"tenantId", "roleIds"},
+}
+
+type Group struct {
+	Id          string `json:"id" bson:"_id"`
+	TenantId    string `json:"tenantId" bson:"tenantId"`
+	Name        string `json:"name" bson:"name"` // 租户内唯一，tenantId + name 唯一索引
+	Description string `json:"description" bson:"description"`
+
+	// 组成员自动拥有这些 roles，移出组后立即失去
+	RoleIds []string `json:"roleIds" bson:"roleIds"`
+
+	CreateT *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT *util.CurTime `json:"updateT" bson:"updateT"`
+}
+
+// 组成员
+const CollectionNameGroupMember = "groupMember"
+
+// groupId + userId 的唯一索引由 EnsureMemberIndex 建立
+var IKGroupMember = &dbandmq.IndexKey{
+	Collection: CollectionNameGroupMember,
+	SingleKey:  []string{"userId", "groupId"},
+}
+
+type GroupMember struct {
+	Id      string        `json:"id" bson:"_id"`
+	GroupId string        `json:"groupId" bson:"groupId"`
+	UserId  string        `json:"userId" bson:"userId"`
+	CreateT *util.CurTime `json:"createT" bson:"createT"`
+}
+
+const MaxGroupNameLen = 64
+
+var (
+	ErrGroupNotFound  = errors.New("无指定id的用户组")
+	ErrGroupNameExist = errors.New("已有同名用户组")
+)
+
+func checkGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("用户组名称不能为空")
+	}
+	if len([]rune(name)) > MaxGroupNameLen {
+		return "", fmt.Errorf("用户组名称长度不能超过%d", MaxGroupNameLen)
+	}
+	return name, nil
+}
+
+func GetGroupById(db *dbandmq.Ds, id string) (*Group, error) {
+	var g *Group
+	err := db.C(CollectionNameGroup).FindId(id).One(&g)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取用户组失败, %s", id, err.Error())
+		return nil, err
+	}
+	return g, nil
+}
+
+func GetGroupsByIds(db *dbandmq.Ds, ids []string) ([]*Group, error) {
+	var gs []*Group
+	err := db.C(CollectionNameGroup).Find(bson.M{"_id": bson.M{"$in": ids}}).All(&gs)
+	if err != nil {
+		Logger.Errorf("", "根据ids读取用户组失败, %s", err.Error())
+		return nil, err
+	}
+	return gs, nil
+}
+
+func groupNameExist(db *dbandmq.Ds, tenantId, name, excludeId string) (bool, error) {
+	f := bson.M{
+		"tenantId": tenantId,
+		"name":     name,
+		"_id":      bson.M{"$ne": excludeId},
+	}
+	cnt, err := db.C(CollectionNameGroup).Find(f).Count()
+	if err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+func CreateGroup(db *dbandmq.Ds, tenantId, name, description string, opHis *ophistory.OperationHistory) (*Group, error) {
+	name, err := checkGroupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	exist, err := groupNameExist(db, tenantId, name, "")
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		return nil, ErrGroupNameExist
+	}
+
+	g := &Group{
+		Id:          util.GenerateDataId(),
+		TenantId:    tenantId,
+		Name:        name,
+		Description: description,
+		RoleIds:     []string{},
+		CreateT:     util.GetCurTime(),
+	}
+	g.UpdateT = g.CreateT
+
+	err = db.C(CollectionNameGroup).Insert(g)
+	if err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrGroupNameExist
+		}
+		Logger.Errorf("", "新建用户组[%s]失败, %s", name, err.Error())
+		return nil, err
+	}
+	if opHis != nil {
+		err = ophistory.Record(db, opHis, ophistory.CodeGroupCreate, ophistory.TargetGroup, g.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// 修改用户组名字和描述
+func UpdateGroupInfo(db *dbandmq.Ds, g *Group, name, description string, opHis *ophistory.OperationHistory) error {
+	name, err := checkGroupName(name)
+	if err != nil {
+		return err
+	}
+
+	exist, err := groupNameExist(db, g.TenantId, name, g.Id)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return ErrGroupNameExist
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"name":        name,
+			"description": description,
+			"updateT":     util.GetCurTime(),
+		},
+	}
+	err = db.C(CollectionNameGroup).UpdateId(g.Id, update)
+	if err != nil {
+		if mgo.IsDup(err) {
+			return ErrGroupNameExist
+		}
+		Logger.Errorf("", "修改用户组[%s]信息失败, %s", g.Id, err.Error())
+		return err
+	}
+	g.Name = name
+	g.Description = description
+	return ophistory.Record(db, opHis, ophistory.CodeGroupUpdate, ophistory.TargetGroup, g.Id)
+}
+
+// 删除用户组，同时删除成员关系，成员通过本组获得的 roles 随之失效
+func DeleteGroup(db *dbandmq.Ds, g *Group) error {
+	err := db.C(CollectionNameGroup).RemoveId(g.Id)
+	if err != nil {
+		Logger.Errorf("", "删除用户组[%s]失败, %s", g.Id, err.Error())
+		return err
+	}
+
+	_, err = db.C(CollectionNameGroupMember).RemoveAll(bson.M{"groupId": g.Id})
+	if err != nil {
+		Logger.Errorf("", "删除用户组[%s]的成员关系失败, %s", g.Id, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 给用户组添加或移除 roles
+func UpdateGroupRoles(db *dbandmq.Ds, g *Group, roleIds []string, add bool, opHis *ophistory.OperationHistory) error {
+	var op bson.M
+	if add {
+		op = bson.M{"$addToSet": bson.M{"roleIds": bson.M{"$each": roleIds}}}
+	} else {
+		op = bson.M{"$pullAll": bson.M{"roleIds": roleIds}}
+	}
+	op["$set"] = bson.M{"updateT": util.GetCurTime()}
+
+	err := db.C(CollectionNameGroup).UpdateId(g.Id, op)
+	if err != nil {
+		Logger.Errorf("", "修改用户组[%s]的roles失败, %s", g.Id, err.Error())
+		return err
+	}
+	return ophistory.Record(db, opHis, ophistory.CodeGroupRoles, ophistory.TargetGroup, g.Id)
+}
+
+// 添加组成员，已经是成员的用户不变
+func AddGroupMembers(db *dbandmq.Ds, groupId string, userIds []string) error {
+	for _, userId := range userIds {
+		f := bson.M{
+			"groupId": groupId,
+			"userId":  userId,
+		}
+		update := bson.M{
+			"$setOnInsert": bson.M{
+				"_id":     util.GenerateDataId(),
+				"createT": util.GetCurTime(),
+			},
+		}
+		_, err := db.C(CollectionNameGroupMember).Upsert(f, update)
+		// 并发添加同一个成员时，其中一个 upsert 会违反唯一索引，成员已存在
+		if err != nil && !mgo.IsDup(err) {
+			Logger.Errorf("", "添加用户[%s]到用户组[%s]失败, %s", userId, groupId, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// 移除组成员
+func RemoveGroupMembers(db *dbandmq.Ds, groupId string, userIds []string) error {
+	f := bson.M{
+		"groupId": groupId,
+		"userId":  bson.M{"$in": userIds},
+	}
+	_, err := db.C(CollectionNameGroupMember).RemoveAll(f)
+	if err != nil {
+		Logger.Errorf("", "从用户组[%s]移除成员失败, %s", groupId, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 读取组成员的 userIds
+func GetGroupMemberUserIds(db *dbandmq.Ds, groupId string) ([]string, error) {
+	var ms []*GroupMember
+	err := db.C(CollectionNameGroupMember).Find(bson.M{"groupId": groupId}).All(&ms)
+	if err != nil {
+		Logger.Errorf("", "读取用户组[%s]的成员失败, %s", groupId, err.Error())
+		return nil, err
+	}
+
+	var userIds []string
+	for _, m := range ms {
+		userIds = append(userIds, m.UserId)
+	}
+	return userIds, nil
+}
+
+// 读取用户所属的用户组
+func GetUserGroups(db *dbandmq.Ds, userId string) ([]*Group, error) {
+	var ms []*GroupMember
+	err := db.C(CollectionNameGroupMember).Find(bson.M{"userId": userId}).All(&ms)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]所属的用户组失败, %s", userId, err.Error())
+		return nil, err
+	}
+	if len(ms) == 0 {
+		return nil, nil
+	}
+
+	var groupIds []string
+	for _, m := range ms {
+		groupIds = append(groupIds, m.GroupId)
+	}
+	return GetGroupsByIds(db, groupIds)
+}
+
+// 组成员的 groupId + userId 唯一索引，并发添加同一个成员时不会重复
+// 升级前建立的非唯一索引会被替换，已有的重复成员关系只保留一条
+func EnsureMemberIndex(db *dbandmq.Ds) error {
+	c := db.C(CollectionNameGroupMember)
+	key := []string{"groupId", "userId"}
+
+	indexes, err := c.Indexes()
+	if err != nil {
+		Logger.Errorf("", "读取用户组成员索引失败, %s", err.Error())
+		return err
+	}
+	for _, idx := range indexes {
+		if idx.Name == "groupId_1_userId_1" && !idx.Unique {
+			_ = c.DropIndexName(idx.Name)
+		}
+	}
+
+	var dups []struct {
+		Ids []string `bson:"ids"`
+	}
+	pipeline := []bson.M{
+		{"$group": bson.M{"_id": bson.M{"groupId": "$groupId", "userId": "$userId"}, "ids": bson.M{"$push": "$_id"}, "cnt": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"cnt": bson.M{"$gt": 1}}},
+	}
+	err = c.Pipe(pipeline).AllowDiskUse().All(&dups)
+	if err != nil {
+		Logger.Errorf("", "查找重复的用户组成员失败, %s", err.Error())
+		return err
+	}
+	for _, dup := range dups {
+		_, err = c.RemoveAll(bson.M{"_id": bson.M{"$in": dup.Ids[1:]}})
+		if err != nil {
+			Logger.Errorf("", "删除重复的用户组成员失败, %s", err.Error())
+			return err
+		}
+	}
+
+	err = c.EnsureIndex(mgo.Index{Key: key, Unique: true})
+	if err != nil {
+		Logger.Errorf("", "建立用户组成员唯一索引失败, %s", err.Error())
+		return err
+	}
+	return nil
+}
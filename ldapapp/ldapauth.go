@@ -0,0 +1,151 @@
+package ldapapp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/util"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// 使用账户密码在目录中验证用户
+// 1. 使用服务账户（或匿名）连接目录，按 UserFilter 搜索出用户 dn
+// 2. 使用用户 dn 和密码重新 bind，bind 成功即验证通过
+func (o *LdapOption) Authenticate(loginId, passwd string) (*LdapUser, error) {
+	loginId = strings.TrimSpace(loginId)
+	// 空密码在 ldap 中会被当成匿名 bind 而成功，必须拒绝
+	if loginId == "" || passwd == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := o.dial()
+	if err != nil {
+		Logger.Errorf("", "连接ldap服务[%s]失败, %s", o.Url, err.Error())
+		return nil, err
+	}
+	defer conn.Close()
+
+	if o.BindDN != "" {
+		err = conn.Bind(o.BindDN, o.BindPasswd)
+		if err != nil {
+			Logger.Errorf("", "ldap服务账户[%s]bind失败, %s", o.BindDN, err.Error())
+			return nil, err
+		}
+	}
+
+	userFilter := o.UserFilter
+	if userFilter == "" {
+		userFilter = DefaultUserFilter
+	}
+	groupAttr := o.GroupAttr
+	if groupAttr == "" {
+		groupAttr = DefaultGroupAttr
+	}
+
+	attrs := []string{"dn", groupAttr}
+	if o.NameAttr != "" {
+		attrs = append(attrs, o.NameAttr)
+	}
+	if o.EmailAttr != "" {
+		attrs = append(attrs, o.EmailAttr)
+	}
+
+	filter := fmt.Sprintf(userFilter, ldap.EscapeFilter(loginId))
+	req := ldap.NewSearchRequest(o.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false, filter, attrs, nil)
+	sr, err := conn.Search(req)
+	if err != nil {
+		// 匹配到多个用户时服务器返回超出数量限制，与多个结果一样按验证失败处理
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			Logger.Infof("", "ldap搜索用户[%s]结果超过1个，验证失败", loginId)
+			return nil, ErrInvalidCredentials
+		}
+		Logger.Errorf("", "ldap搜索用户[%s]失败, %s", loginId, err.Error())
+		return nil, err
+	}
+
+	if len(sr.Entries) != 1 {
+		Logger.Infof("", "ldap搜索用户[%s]结果数量为[%d]，验证失败", loginId, len(sr.Entries))
+		return nil, ErrInvalidCredentials
+	}
+	entry := sr.Entries[0]
+
+	// 使用用户自己的 dn 和密码 bind
+	err = conn.Bind(entry.DN, passwd)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		Logger.Errorf("", "ldap用户[%s]bind失败, %s", entry.DN, err.Error())
+		return nil, err
+	}
+
+	lu := &LdapUser{
+		Dn:      entry.DN,
+		LoginId: loginId,
+		Name:    loginId,
+		Groups:  entry.GetAttributeValues(groupAttr),
+	}
+	if o.NameAttr != "" {
+		if name := entry.GetAttributeValue(o.NameAttr); name != "" {
+			lu.Name = name
+		}
+	}
+	if o.EmailAttr != "" {
+		lu.Email = entry.GetAttributeValue(o.EmailAttr)
+	}
+
+	return lu, nil
+}
+
+func (o *LdapOption) dial() (*ldap.Conn, error) {
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if u, err := url.Parse(o.Url); err == nil {
+		tlsConf.ServerName = u.Hostname()
+	}
+
+	conn, err := ldap.DialURL(o.Url, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tlsConf))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if o.StartTLS && strings.HasPrefix(strings.ToLower(o.Url), "ldap://") {
+		err = conn.StartTLS(tlsConf)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// 根据配置的映射关系，把目录分组转换为 role name 列表
+// 分组 dn 比较时不区分大小写
+func (o *LdapOption) MapGroupsToRoleNames(groups []string) []string {
+	var names []string
+	for _, gm := range o.GroupMapping {
+		for _, group := range groups {
+			if strings.EqualFold(strings.TrimSpace(gm.Group), strings.TrimSpace(group)) {
+				names = append(names, gm.Roles...)
+				break
+			}
+		}
+	}
+
+	if len(names) > 1 {
+		names = util.UniqueStringArray(names)
+	}
+
+	return names
+}
@@ -0,0 +1,187 @@
+package ldapapp
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"strings"
+	"testing"
+)
+
+// 一个进程内的最小 ldap 服务，只支持 bind / search / unbind
+type testDirUser struct {
+	dn     string
+	uid    string
+	passwd string
+	name   string
+	groups []string
+}
+
+const (
+	testServiceDN     = "cn=svc,dc=example,dc=com"
+	testServicePasswd = "svcpasswd"
+)
+
+var testDirUsers = []*testDirUser{
+	{
+		dn:     "uid=alice,ou=people,dc=example,dc=com",
+		uid:    "alice",
+		passwd: "alicepasswd",
+		name:   "Alice",
+		groups: []string{"cn=Admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+	},
+}
+
+func startTestLdapServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestLdapConn(conn)
+		}
+	}()
+
+	return "ldap://" + ln.Addr().String()
+}
+
+func serveTestLdapConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgId := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			passwd := op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if dn == testServiceDN && passwd == testServicePasswd {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, u := range testDirUsers {
+				if dn == u.dn && passwd == u.passwd {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			_, _ = conn.Write(testLdapResult(msgId, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, u := range testDirUsers {
+				if strings.Contains(filter, "uid="+u.uid+")") {
+					_, _ = conn.Write(testLdapEntry(msgId, u).Bytes())
+				}
+			}
+			_, _ = conn.Write(testLdapResult(msgId, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func testLdapEnvelope(msgId int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgId, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func testLdapResult(msgId int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return testLdapEnvelope(msgId, op)
+}
+
+func testLdapEntry(msgId int64, u *testDirUser) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, u.dn, ""))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	addAttr := func(name string, vals ...string) {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range vals {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	addAttr("displayName", u.name)
+	addAttr("memberOf", u.groups...)
+	op.AppendChild(attrs)
+
+	return testLdapEnvelope(msgId, op)
+}
+
+func testLdapOption(url string) *LdapOption {
+	return &LdapOption{
+		Url:        url,
+		BindDN:     testServiceDN,
+		BindPasswd: testServicePasswd,
+		BaseDN:     "dc=example,dc=com",
+		UserFilter: "(uid=%s)",
+		NameAttr:   "displayName",
+		GroupAttr:  "memberOf",
+		GroupMapping: []*GroupMapping{
+			{Group: "CN=admins,OU=groups,DC=example,DC=com", Roles: []string{"admin-role", "ops-role"}},
+			{Group: "cn=nobody,ou=groups,dc=example,dc=com", Roles: []string{"nobody-role"}},
+		},
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	opt := testLdapOption(startTestLdapServer(t))
+
+	lu, err := opt.Authenticate("alice", "alicepasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lu.Dn != testDirUsers[0].dn || lu.Name != "Alice" || len(lu.Groups) != 2 {
+		t.Errorf("unexpected ldap user %+v", lu)
+	}
+
+	roles := opt.MapGroupsToRoleNames(lu.Groups)
+	if len(roles) != 2 {
+		t.Errorf("unexpected mapped roles %s", roles)
+	}
+	for _, name := range roles {
+		if name != "admin-role" && name != "ops-role" {
+			t.Errorf("unexpected mapped role %s", name)
+		}
+	}
+}
+
+func TestAuthenticateInvalid(t *testing.T) {
+	opt := testLdapOption(startTestLdapServer(t))
+
+	cases := []struct {
+		loginId string
+		passwd  string
+	}{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"bob", "alicepasswd"},
+		{"", "alicepasswd"},
+	}
+
+	for _, tc := range cases {
+		_, err := opt.Authenticate(tc.loginId, tc.passwd)
+		if err != ErrInvalidCredentials {
+			t.Errorf("Authenticate(%q, %q) err = %v, want ErrInvalidCredentials", tc.loginId, tc.passwd, err)
+		}
+	}
+}
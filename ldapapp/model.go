@@ -0,0 +1,52 @@
+package ldapapp
+
+import (
+	"errors"
+	"time"
+)
+
+// ldap / active directory 登录配置
+type LdapOption struct {
+	Url                string // ldap://host:389 或 ldaps://host:636
+	StartTLS           bool   // ldap:// 协议时是否升级为 tls
+	InsecureSkipVerify bool   // 是否跳过证书校验，仅测试环境使用
+
+	// 用于搜索用户的服务账户，为空时使用匿名搜索
+	BindDN     string
+	BindPasswd string
+
+	BaseDN     string
+	UserFilter string // 搜索用户的过滤条件，%s 会被替换为 loginId，比如 (sAMAccountName=%s) 或 (uid=%s)
+
+	NameAttr  string // 用户展示名称的属性，比如 displayName，为空时使用 loginId
+	EmailAttr string // 邮箱属性，比如 mail
+	GroupAttr string // 用户所属分组的属性，比如 memberOf
+
+	GroupMapping []*GroupMapping // 目录分组与 role 的映射关系
+
+	Timeout time.Duration // 连接超时时间，为 0 时使用默认值
+}
+
+// 目录分组与 role 的映射
+// group 为分组的 dn，不区分大小写
+type GroupMapping struct {
+	Group string   `json:"group"`
+	Roles []string `json:"roles"` // role name 列表
+}
+
+// 从目录中读取出来的用户信息
+type LdapUser struct {
+	Dn      string   `json:"dn"`
+	LoginId string   `json:"loginId"`
+	Name    string   `json:"name"`
+	Email   string   `json:"email"`
+	Groups  []string `json:"groups"`
+}
+
+const (
+	DefaultUserFilter = "(uid=%s)"
+	DefaultGroupAttr  = "memberOf"
+	DefaultTimeout    = 10 * time.Second
+)
+
+var ErrInvalidCredentials = errors.New("账户或密码错误")
@@ -0,0 +1,190 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/userandrole"
+	"sync"
+)
+
+var ErrConflict = errors.New("导入的数据存在冲突")
+
+// 同一个实例同时只执行一个导入，读取数据库到写入完成之间数据不会被其他导入修改
+var importMu sync.Mutex
+
+// 导入数据，生成导入计划后按计划写入
+// dryRun 时只返回导入计划；有冲突时返回导入计划和 ErrConflict，不写入任何数据
+// 写入过程中出错时回滚已经写入的数据
+func Import(db *dbandmq.Ds, m *Migrate, mode string, dryRun bool, opHis *ophistory.OperationHistory) (*Plan, error) {
+	if !IsValidMode(mode) {
+		return nil, fmt.Errorf("不支持的导入模式[%s]", mode)
+	}
+
+	return run(db, dryRun, opHis, func(cur *current) (*Plan, error) {
+		return buildPlan(m, mode, cur), nil
+	})
+}
+
+// 读取数据库中的数据，生成计划并写入
+func run(db *dbandmq.Ds, dryRun bool, opHis *ophistory.OperationHistory, build func(cur *current) (*Plan, error)) (*Plan, error) {
+	importMu.Lock()
+	defer importMu.Unlock()
+
+	cur, err := loadCurrent(db)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := build(cur)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Conflicts) > 0 {
+		return p, ErrConflict
+	}
+	if dryRun {
+		return p, nil
+	}
+
+	err = p.apply(db)
+	if err != nil {
+		return p, err
+	}
+
+	err = p.record(db, opHis)
+	if err != nil {
+		return p, err
+	}
+	Logger.Infof("", "导入数据完成，模式[%s]，新建%d，修改%d，删除%d，未变化%d", p.Mode, p.Create, p.Update, p.Delete, p.Unchanged)
+	return p, nil
+}
+
+func collectionName(typ string) string {
+	switch typ {
+	case TypeItem:
+		return roleapp.CollectionNameItem
+	case TypePermission:
+		return roleapp.CollectionNamePermission
+	case TypeUser:
+		return userandrole.CollectionNameUserWithRole
+	default:
+		return roleapp.CollectionNameRole
+	}
+}
+
+// 按顺序写入，mongodb 没有使用事务，出错时按相反的顺序恢复修改前的数据，删除新建的数据
+func (p *Plan) apply(db *dbandmq.Ds) error {
+	var done []*Change
+	for _, ch := range p.Changes {
+		if ch.Action == ActionUnchanged {
+			continue
+		}
+
+		var err error
+		if ch.before == nil {
+			err = db.C(collectionName(ch.Type)).Insert(ch.after)
+		} else {
+			err = db.C(collectionName(ch.Type)).UpdateId(ch.Id, ch.after)
+		}
+		if err != nil {
+			Logger.Errorf("", "导入数据，写入%s[%s]失败, %s，开始回滚", ch.Type, ch.Name, err.Error())
+			rollback(db, done)
+			return fmt.Errorf("写入%s[%s]失败，已回滚, %s", ch.Type, ch.Name, err.Error())
+		}
+		done = append(done, ch)
+	}
+	return nil
+}
+
+func rollback(db *dbandmq.Ds, done []*Change) {
+	for i := len(done) - 1; i >= 0; i-- {
+		ch := done[i]
+		var err error
+		if ch.before == nil {
+			err = db.C(collectionName(ch.Type)).RemoveId(ch.Id)
+		} else {
+			err = db.C(collectionName(ch.Type)).UpdateId(ch.Id, ch.before)
+		}
+		if err != nil {
+			Logger.Errorf("", "导入数据回滚%s[%s][%s]失败, %s", ch.Type, ch.Name, ch.Id, err.Error())
+		}
+	}
+}
+
+var actionCodes = map[string]map[string]string{
+	TypeItem: {
+		ActionCreate: ophistory.CodeItemCreate,
+		ActionUpdate: ophistory.CodeItemUpdate,
+		ActionDelete: ophistory.CodeItemDelete,
+	},
+	TypePermission: {
+		ActionCreate: ophistory.CodePermissionCreate,
+		ActionUpdate: ophistory.CodePermissionUpdate,
+		ActionDelete: ophistory.CodePermissionDelete,
+	},
+	TypeRole: {
+		ActionCreate: ophistory.CodeRoleCreate,
+		ActionUpdate: ophistory.CodeRoleUpdate,
+		ActionDelete: ophistory.CodeRoleDelete,
+	},
+}
+
+// 全部写入成功后再写审计日志，回滚的数据不会留下记录
+// 审计日志的回调会通知其他实例和 webhook
+// 写入失败时继续写入其他的记录，返回第一个错误
+func (p *Plan) record(db *dbandmq.Ds, opHis *ophistory.OperationHistory) error {
+	var ret error
+	keep := func(err error) {
+		if ret == nil {
+			ret = err
+		}
+	}
+	for _, ch := range p.Changes {
+		if ch.Type == TypeUser {
+			keep(recordGrant(db, opHis, ch))
+			continue
+		}
+		code, ok := actionCodes[ch.Type][ch.Action]
+		if !ok {
+			continue
+		}
+
+		params := ophistory.Params{"name": ch.Name, "import": p.Mode}
+		if item, ok := ch.after.(*roleapp.Item); ok {
+			params["method"] = item.Method
+			params["path"] = item.Path
+		}
+		h := *opHis
+		h.SetParams(params)
+		h.Changes = ch.Changes
+		keep(ophistory.Record(db, &h, code, ch.Type, ch.Id))
+	}
+	return ret
+}
+
+// 用户的 roles 变化按添加和移除分别记录
+func recordGrant(db *dbandmq.Ds, opHis *ophistory.OperationHistory, ch *Change) error {
+	if ch.Action == ActionUnchanged {
+		return nil
+	}
+	var err error
+	if len(ch.added) > 0 {
+		h := *opHis
+		h.SetParams(ophistory.Params{"roleIds": ch.added, "loginId": ch.Name})
+		h.Changes = ch.Changes
+		err = ophistory.Record(db, &h, ophistory.CodeUwrAddRoles, ophistory.TargetUser, ch.targetId)
+	}
+	if len(ch.removed) > 0 {
+		h := *opHis
+		h.SetParams(ophistory.Params{"roleIds": ch.removed, "loginId": ch.Name})
+		h.Changes = ch.Changes
+		if derr := ophistory.Record(db, &h, ophistory.CodeUwrDelRoles, ophistory.TargetUser, ch.targetId); err == nil {
+			err = derr
+		}
+	}
+	return err
+}
@@ -0,0 +1,279 @@
+package migrate
+
+import (
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+	"testing"
+)
+
+func testCurrent() *current {
+	return &current{
+		items: []*roleapp.Item{
+			{Id: "i-admin", TenantId: tenantapp.DefaultTenantId, Name: "admin:GET", Method: "GET", Path: "*", DataFrom: roleapp.DataFromSystem},
+			{Id: "i1", TenantId: tenantapp.DefaultTenantId, Name: "list user", Method: "GET", Path: "/api/users", DataFrom: roleapp.DataFromUser},
+			{Id: "i2", TenantId: tenantapp.DefaultTenantId, Name: "old", Method: "GET", Path: "/api/old", DataFrom: roleapp.DataFromUser, Deleted: true},
+		},
+		permissions: []*roleapp.Permission{
+			{Id: "p1", TenantId: tenantapp.DefaultTenantId, Name: "user read", ItemIds: []string{"i1", "i2"}, DataFrom: roleapp.DataFromUser},
+			{Id: "p2", TenantId: tenantapp.DefaultTenantId, Name: "extra", ItemIds: []string{"i1"}, DataFrom: roleapp.DataFromUser},
+		},
+		roles: []*roleapp.Role{
+			{Id: "r-default", TenantId: tenantapp.DefaultTenantId, Name: roleapp.DefaultRoleName, DataFrom: roleapp.DataFromSystem},
+			{Id: "r1", TenantId: tenantapp.DefaultTenantId, Name: "viewer", PermissionIds: []string{"p1"},
+				ChildrenRoles: []*roleapp.ChildRole{{Id: "r-default", Name: roleapp.DefaultRoleName}}, DataFrom: roleapp.DataFromUser},
+		},
+	}
+}
+
+func TestExportReimportUnchanged(t *testing.T) {
+	cur := testCurrent()
+	m := cur.export()
+	if len(m.Items) != 1 || len(m.Permissions) != 2 || len(m.Roles) != 1 {
+		t.Fatalf("export = %d items, %d permissions, %d roles", len(m.Items), len(m.Permissions), len(m.Roles))
+	}
+	// 引用已删除的 item 不导出，引用系统数据按 name 导出
+	if ps := m.Permissions[1]; ps.Name != "user read" || len(ps.Items) != 1 || ps.Items[0] != "list user" {
+		t.Errorf("permission = %+v", ps)
+	}
+	if r := m.Roles[0]; len(r.ChildrenRoles) != 1 || r.ChildrenRoles[0] != roleapp.DefaultRoleName {
+		t.Errorf("role = %+v", r)
+	}
+
+	for _, mode := range []string{ModeUpsert, ModeReplace} {
+		p := buildPlan(m, mode, testCurrent())
+		if len(p.Conflicts) > 0 {
+			t.Fatalf("%s conflicts = %v", mode, p.Conflicts)
+		}
+		// 导出时丢弃了已删除 item 的引用，p1 会更新
+		if p.Create != 0 || p.Update != 1 || p.Delete != 0 || p.Unchanged != 3 {
+			t.Errorf("%s plan = %d/%d/%d/%d", mode, p.Create, p.Update, p.Delete, p.Unchanged)
+		}
+	}
+
+	p := buildPlan(m, ModeCreate, testCurrent())
+	if len(p.Conflicts) != 4 {
+		t.Errorf("create conflicts = %v", p.Conflicts)
+	}
+}
+
+func TestPlanModes(t *testing.T) {
+	m := &Migrate{
+		Items: []*Item{
+			{Name: "old", Method: "get", Path: "/api/old/:id"},
+			{Name: "new", Method: "POST", Path: "/api/new"},
+		},
+		Permissions: []*Permission{
+			{Name: "writer", Items: []string{"new", "old", "new", "admin:GET"}},
+		},
+		Roles: []*Role{
+			{Name: "editor", Permissions: []string{"writer"}, ChildrenRoles: []string{"reviewer"}, ApproverRoles: []string{"reviewer"}},
+			{Name: "reviewer", Permissions: []string{"writer"}},
+		},
+	}
+
+	p := buildPlan(m, ModeCreate, testCurrent())
+	if len(p.Conflicts) > 0 {
+		t.Fatalf("conflicts = %v", p.Conflicts)
+	}
+	if p.Create != 5 || len(p.Changes) != 5 {
+		t.Fatalf("plan = %+v", p)
+	}
+	// 已删除的同名 item 重新启用，id 不变
+	if ch := p.Changes[0]; ch.Id != "i2" || ch.Action != ActionCreate {
+		t.Errorf("old item = %+v", ch)
+	}
+	item := p.Changes[0].after.(*roleapp.Item)
+	if item.Method != "GET" || item.Path != "/api/old/*" {
+		t.Errorf("item = %+v", item)
+	}
+	ps := p.Changes[2].after.(*roleapp.Permission)
+	if len(ps.ItemIds) != 3 || ps.ItemIds[0] != p.itemIds["new"] || ps.ItemIds[1] != "i2" || ps.ItemIds[2] != "i-admin" {
+		t.Errorf("permission itemIds = %v", ps.ItemIds)
+	}
+	editor := p.Changes[3].after.(*roleapp.Role)
+	reviewerId := p.roleIds["reviewer"]
+	if len(editor.ChildrenRoles) != 1 || editor.ChildrenRoles[0].Id != reviewerId || editor.ChildrenRoles[0].Name != "reviewer" {
+		t.Errorf("editor childrenRole = %v", editor.ChildrenRoles)
+	}
+	if len(editor.ApproverRoleIds) != 1 || editor.ApproverRoleIds[0] != reviewerId {
+		t.Errorf("editor approverRoleIds = %v", editor.ApproverRoleIds)
+	}
+
+	// replace 删除目录中没有的用户数据，不删除系统数据
+	p = buildPlan(m, ModeReplace, testCurrent())
+	if len(p.Conflicts) > 0 {
+		t.Fatalf("conflicts = %v", p.Conflicts)
+	}
+	var deleted []string
+	for _, ch := range p.Changes {
+		if ch.Action == ActionDelete {
+			deleted = append(deleted, ch.Id)
+		}
+	}
+	if len(deleted) != 4 || deleted[0] != "r1" || deleted[1] != "p2" || deleted[2] != "p1" || deleted[3] != "i1" {
+		t.Errorf("deleted = %v", deleted)
+	}
+}
+
+func TestPlanConflicts(t *testing.T) {
+	m := &Migrate{
+		Items: []*Item{
+			{Name: "admin:GET", Method: "GET", Path: "*"},
+			{Name: "a", Method: "GET", Path: "/a"},
+			{Name: "a", Method: "GET", Path: "/a"},
+		},
+		Permissions: []*Permission{
+			{Name: "p", Items: []string{"missing"}},
+			// replace 模式下 extra 会被删除，不能引用
+			{Name: "q", Items: []string{"list user"}},
+		},
+		Roles: []*Role{
+			{Name: "r", Permissions: []string{"extra"}},
+		},
+	}
+
+	p := buildPlan(m, ModeReplace, testCurrent())
+	want := []string{
+		"item[admin:GET]与系统内置数据重名",
+		"item[a]在目录中重复",
+		"permission[p]引用的item[missing]不存在",
+		"permission[q]引用的item[list user]不存在",
+		"role[r]引用的permission[extra]不存在",
+	}
+	if len(p.Conflicts) != len(want) {
+		t.Fatalf("conflicts = %v", p.Conflicts)
+	}
+	for i := range want {
+		if p.Conflicts[i] != want[i] {
+			t.Errorf("conflicts[%d] = %s, want %s", i, p.Conflicts[i], want[i])
+		}
+	}
+
+	p = buildPlan(m, ModeUpsert, testCurrent())
+	if len(p.Conflicts) != 3 {
+		t.Errorf("upsert conflicts = %v", p.Conflicts)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	data := `
+items:
+  - name: list user
+    method: GET
+    path: /api/users
+permissions:
+  - name: user read
+    items: [list user]
+roles:
+  - name: viewer
+    permissions: [user read]
+    childrenRole: [注册用户默认角色]
+users:
+  - loginId: alice
+    roles: [viewer]
+`
+	p, err := ParsePolicy([]byte(data), PolicyFormat("policy.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Items) != 1 || len(p.Permissions) != 1 || len(p.Roles) != 1 || len(p.Users) != 1 {
+		t.Fatalf("policy = %+v", p)
+	}
+	if p.Roles[0].ChildrenRoles[0] != roleapp.DefaultRoleName || p.Users[0].Roles[0] != "viewer" {
+		t.Errorf("role = %+v, user = %+v", p.Roles[0], p.Users[0])
+	}
+
+	problems, external := Validate(p)
+	if len(problems) != 0 || len(external) != 1 || external[0] != "role["+roleapp.DefaultRoleName+"]" {
+		t.Errorf("Validate = %v, %v", problems, external)
+	}
+
+	// 拼写错误的字段
+	if _, err = ParsePolicy([]byte("roles:\n  - name: a\n    permission: [b]\n"), FormatYaml); err == nil {
+		t.Errorf("yaml with unknown field parsed")
+	}
+	p, err = ParsePolicy([]byte(`{"items": [{"name": "a", "method": "GET", "path": "/a"}], "users": [{"loginId": "admin"}]}`), PolicyFormat("p.json"))
+	if err != nil || len(p.Items) != 1 {
+		t.Fatalf("json = %+v, %v", p, err)
+	}
+	if problems, _ = Validate(p); len(problems) != 1 {
+		t.Errorf("Validate admin grant = %v", problems)
+	}
+	if _, err = ParsePolicy([]byte(`{"item": []}`), FormatJson); err == nil {
+		t.Errorf("json with unknown field parsed")
+	}
+}
+
+func TestPlanGrants(t *testing.T) {
+	cur := testCurrent()
+	cur.roles = append(cur.roles, &roleapp.Role{Id: "r2", TenantId: tenantapp.DefaultTenantId, Name: "auditor", DataFrom: roleapp.DataFromUser, RequireApproval: true})
+	p := &Policy{
+		Migrate: *cur.export(),
+		Users: []*UserGrant{
+			{LoginId: "alice", Roles: []string{"viewer", roleapp.DefaultRoleName}},
+			{LoginId: "bob", Roles: []string{"viewer"}},
+		},
+	}
+	p.Roles = p.Roles[1:] // 不包含需要审批的 auditor
+	targets := map[string]*grantTarget{
+		"alice": {
+			user: &userapp.User{Id: "u1", Name: "alice"},
+			uwr:  &userandrole.UserWithRole{Id: "w1", UserId: "u1", RoleIds: []string{"r-default", "old"}},
+		},
+		"bob": {user: &userapp.User{Id: "u2", Name: "bob"}},
+	}
+
+	plan := buildPlan(&p.Migrate, ModeUpsert, cur)
+	plan.planGrants(p.Users, targets, cur)
+	if len(plan.Conflicts) > 0 {
+		t.Fatalf("conflicts = %v", plan.Conflicts)
+	}
+	grants := plan.Changes[len(plan.Changes)-2:]
+	alice := grants[0].after.(*userandrole.UserWithRole)
+	if grants[0].Action != ActionUpdate || len(alice.RoleIds) != 3 || len(grants[0].added) != 1 || grants[0].added[0] != "r1" || len(grants[0].removed) != 0 {
+		t.Errorf("alice = %v, %+v", alice.RoleIds, grants[0])
+	}
+	bob := grants[1].after.(*userandrole.UserWithRole)
+	if grants[1].Action != ActionCreate || grants[1].targetId != "u2" || len(bob.RoleIds) != 1 || bob.RoleIds[0] != "r1" {
+		t.Errorf("bob = %+v", grants[1])
+	}
+
+	// prune 移除文件中没有的 role，auditor 被删除不能再引用
+	plan = buildPlan(&p.Migrate, ModeReplace, cur)
+	plan.planGrants(p.Users, targets, cur)
+	alice = plan.Changes[len(plan.Changes)-2].after.(*userandrole.UserWithRole)
+	if len(alice.RoleIds) != 2 || alice.RoleIds[0] != "r-default" || alice.RoleIds[1] != "r1" {
+		t.Errorf("pruned alice = %v", alice.RoleIds)
+	}
+
+	// 审批赋予的 role 不在文件中，prune 时也保留
+	full := &Policy{Migrate: *cur.export(), Users: p.Users}
+	targets["alice"].uwr.RoleIds = []string{"r-default", "r2", "old"}
+	plan = buildPlan(&full.Migrate, ModeReplace, cur)
+	plan.planGrants(full.Users, targets, cur)
+	ch := plan.Changes[len(plan.Changes)-2]
+	alice = ch.after.(*userandrole.UserWithRole)
+	if len(alice.RoleIds) != 3 || alice.RoleIds[1] != "r2" || len(ch.removed) != 1 || ch.removed[0] != "old" {
+		t.Errorf("pruned alice with approval role = %v, removed %v", alice.RoleIds, ch.removed)
+	}
+
+	p.Users = append(p.Users, &UserGrant{LoginId: "carol"}, &UserGrant{LoginId: "bob", Roles: []string{"auditor"}})
+	p.Users[1].Roles = []string{"auditor"}
+	plan = buildPlan(&p.Migrate, ModeUpsert, cur)
+	plan.planGrants(p.Users, targets, cur)
+	want := []string{
+		"user[bob]的role[auditor]需要审批，不能在策略文件中赋予",
+		"用户[carol]不存在",
+		"用户[bob]在策略文件中重复",
+	}
+	if len(plan.Conflicts) != len(want) {
+		t.Fatalf("conflicts = %v", plan.Conflicts)
+	}
+	for i := range want {
+		if plan.Conflicts[i] != want[i] {
+			t.Errorf("conflicts[%d] = %s, want %s", i, plan.Conflicts[i], want[i])
+		}
+	}
+}
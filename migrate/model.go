@@ -1,10 +1,174 @@
 package migrate
 
-import "github.com/leyle/userandrole/roleapp"
+import (
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+)
 
-// 数据的导出和导入结构
+// 数据的导出和导入结构，只包含默认租户中用户定义的 item / permission / role
+// 数据之间的引用使用 name 而不是 id，不同环境的数据 id 不同，按 name 对应
+// 引用的数据可以是目录中的数据，也可以是导入环境中已存在的数据（比如系统内置的 admin 数据）
 type Migrate struct {
-	Items []*roleapp.Item `json:"items"`
-	Permissions []*roleapp.Permission `json:"permissions"`
-	Roles []*roleapp.Role `json:"roles"`
-}
\ No newline at end of file
+	Items       []*Item       `json:"items" yaml:"items"`
+	Permissions []*Permission `json:"permissions" yaml:"permissions"`
+	Roles       []*Role       `json:"roles" yaml:"roles"`
+}
+
+type Item struct {
+	Name     string `json:"name" yaml:"name"`
+	Method   string `json:"method" yaml:"method"`
+	Path     string `json:"path" yaml:"path"`
+	Resource string `json:"resource" yaml:"resource"`
+	Menu     string `json:"menu" yaml:"menu"`
+	Button   string `json:"button" yaml:"button"`
+}
+
+type Permission struct {
+	Name   string   `json:"name" yaml:"name"`
+	Items  []string `json:"items" yaml:"items"` // item name 列表
+	Menu   string   `json:"menu" yaml:"menu"`
+	Button string   `json:"button" yaml:"button"`
+}
+
+type Role struct {
+	Name            string   `json:"name" yaml:"name"`
+	Permissions     []string `json:"permissions" yaml:"permissions"`   // permission name 列表
+	ChildrenRoles   []string `json:"childrenRole" yaml:"childrenRole"` // 下属 role name 列表
+	Menu            string   `json:"menu" yaml:"menu"`
+	Button          string   `json:"button" yaml:"button"`
+	RequireApproval bool     `json:"requireApproval" yaml:"requireApproval"`
+	ApproverRoles   []string `json:"approverRoles" yaml:"approverRoles"` // 审批人 role name 列表
+}
+
+// 数据库中默认租户的 item / permission / role，包含已删除和系统内置的数据
+type current struct {
+	items       []*roleapp.Item
+	permissions []*roleapp.Permission
+	roles       []*roleapp.Role
+}
+
+func loadCurrent(db *dbandmq.Ds) (*current, error) {
+	filter := &bson.M{
+		"tenantId": tenantapp.DefaultTenantId,
+	}
+
+	var err error
+	cur := &current{}
+	cur.items, err = roleapp.GetFilterItems(db, filter)
+	if err != nil {
+		return nil, err
+	}
+	cur.permissions, err = roleapp.GetFilterPermissions(db, filter)
+	if err != nil {
+		return nil, err
+	}
+	cur.roles, err = roleapp.GetFilterRoles(db, filter)
+	if err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// 导出默认租户中用户定义的数据，按 name 排序，方便对比不同时间导出的文件
+func Export(db *dbandmq.Ds) (*Migrate, error) {
+	cur, err := loadCurrent(db)
+	if err != nil {
+		return nil, err
+	}
+	return cur.export(), nil
+}
+
+func (cur *current) export() *Migrate {
+	// 引用的已删除数据不导出
+	itemNames := make(map[string]string)
+	for _, item := range cur.items {
+		if !item.Deleted {
+			itemNames[item.Id] = item.Name
+		}
+	}
+	pNames := make(map[string]string)
+	for _, p := range cur.permissions {
+		if !p.Deleted {
+			pNames[p.Id] = p.Name
+		}
+	}
+	roleNames := make(map[string]string)
+	for _, role := range cur.roles {
+		if !role.Deleted {
+			roleNames[role.Id] = role.Name
+		}
+	}
+
+	m := &Migrate{
+		Items:       []*Item{},
+		Permissions: []*Permission{},
+		Roles:       []*Role{},
+	}
+	for _, item := range cur.items {
+		if !exportable(item.DataFrom, item.Deleted) {
+			continue
+		}
+		m.Items = append(m.Items, &Item{
+			Name:     item.Name,
+			Method:   item.Method,
+			Path:     item.Path,
+			Resource: item.Resource,
+			Menu:     item.Menu,
+			Button:   item.Button,
+		})
+	}
+
+	for _, p := range cur.permissions {
+		if !exportable(p.DataFrom, p.Deleted) {
+			continue
+		}
+		m.Permissions = append(m.Permissions, &Permission{
+			Name:   p.Name,
+			Items:  idsToNames(p.ItemIds, itemNames),
+			Menu:   p.Menu,
+			Button: p.Button,
+		})
+	}
+
+	for _, role := range cur.roles {
+		if !exportable(role.DataFrom, role.Deleted) {
+			continue
+		}
+		var childIds []string
+		for _, cr := range role.ChildrenRoles {
+			childIds = append(childIds, cr.Id)
+		}
+		m.Roles = append(m.Roles, &Role{
+			Name:            role.Name,
+			Permissions:     idsToNames(role.PermissionIds, pNames),
+			ChildrenRoles:   idsToNames(childIds, roleNames),
+			Menu:            role.Menu,
+			Button:          role.Button,
+			RequireApproval: role.RequireApproval,
+			ApproverRoles:   idsToNames(role.ApproverRoleIds, roleNames),
+		})
+	}
+
+	sort.Slice(m.Items, func(i, j int) bool { return m.Items[i].Name < m.Items[j].Name })
+	sort.Slice(m.Permissions, func(i, j int) bool { return m.Permissions[i].Name < m.Permissions[j].Name })
+	sort.Slice(m.Roles, func(i, j int) bool { return m.Roles[i].Name < m.Roles[j].Name })
+
+	return m
+}
+
+func exportable(dataFrom string, deleted bool) bool {
+	return dataFrom != roleapp.DataFromSystem && !deleted
+}
+
+func idsToNames(ids []string, names map[string]string) []string {
+	ret := []string{}
+	for _, id := range ids {
+		if name, ok := names[id]; ok {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,389 @@
+package migrate
+
+import (
+	"fmt"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"sort"
+	"strings"
+)
+
+// 导入模式
+const (
+	ModeCreate  = "create"  // 只新建，已存在同名数据时冲突
+	ModeUpsert  = "upsert"  // 按 name 新建或更新
+	ModeReplace = "replace" // 按 name 新建或更新，并删除目录中没有的用户数据
+)
+
+func IsValidMode(mode string) bool {
+	return mode == ModeCreate || mode == ModeUpsert || mode == ModeReplace
+}
+
+// 每条数据的变化
+const (
+	ActionCreate    = "create" // 新建，或者重新启用已删除的同名数据
+	ActionUpdate    = "update"
+	ActionDelete    = "delete"
+	ActionUnchanged = "unchanged"
+)
+
+// 数据类型，与审计日志的 targetType 相同
+const (
+	TypeItem       = ophistory.TargetItem
+	TypePermission = ophistory.TargetPermission
+	TypeRole       = ophistory.TargetRole
+	TypeUser       = ophistory.TargetUser // 策略文件中用户的 roles
+)
+
+type Change struct {
+	Type    string              `json:"type"`
+	Id      string              `json:"id"`
+	Name    string              `json:"name"`
+	Action  string              `json:"action"`
+	Changes []*ophistory.Change `json:"changes,omitempty"` // 与数据库中数据的差异，字段名与数据库一致
+
+	before interface{} // 修改前的数据，新建时为 nil，出错时用来回滚
+	after  interface{}
+
+	// 用户的 roles 变化，审计日志的 targetId 是 userId
+	targetId string
+	added    []string
+	removed  []string
+}
+
+// 导入计划，按执行顺序排列
+// 有冲突时不能导入，dryRun 时返回给调用方查看
+type Plan struct {
+	Mode      string    `json:"mode"`
+	Create    int       `json:"create"`
+	Update    int       `json:"update"`
+	Delete    int       `json:"delete"`
+	Unchanged int       `json:"unchanged"`
+	Conflicts []string  `json:"conflicts"`
+	Changes   []*Change `json:"changes"`
+
+	// 目录中数据的 name 对应导入后的 id
+	itemIds map[string]string
+	pIds    map[string]string
+	roleIds map[string]string
+	roles   map[string]*roleapp.Role // 目录中的 role 导入后的数据
+}
+
+func (p *Plan) conflict(format string, args ...interface{}) {
+	p.Conflicts = append(p.Conflicts, fmt.Sprintf(format, args...))
+}
+
+// before 为 nil 时是新建
+func (p *Plan) add(typ, id, name string, before, after interface{}) *Change {
+	ch := &Change{
+		Type:   typ,
+		Id:     id,
+		Name:   name,
+		before: before,
+		after:  after,
+	}
+	ch.Changes = ophistory.Diff(before, after)
+
+	switch {
+	case before == nil:
+		ch.Action = ActionCreate
+		p.Create++
+	case len(ch.Changes) == 0:
+		ch.Action = ActionUnchanged
+		p.Unchanged++
+	case ophistory.Snapshot(before)["deleted"] == true:
+		ch.Action = ActionCreate
+		p.Create++
+	case ophistory.Snapshot(after)["deleted"] == true:
+		ch.Action = ActionDelete
+		p.Delete++
+	default:
+		ch.Action = ActionUpdate
+		p.Update++
+	}
+	p.Changes = append(p.Changes, ch)
+	return ch
+}
+
+// 对比目录和数据库中的数据，生成导入计划
+// 目录中的数据按 name 与数据库中的数据对应，引用的 name 转换成导入后的 id
+func buildPlan(m *Migrate, mode string, cur *current) *Plan {
+	p := &Plan{
+		Mode:      mode,
+		Conflicts: []string{},
+		Changes:   []*Change{},
+		itemIds:   make(map[string]string),
+		pIds:      make(map[string]string),
+		roleIds:   make(map[string]string),
+		roles:     make(map[string]*roleapp.Role),
+	}
+	t := util.GetCurTime()
+
+	// items
+	dbItems := make(map[string]*roleapp.Item)
+	for _, item := range cur.items {
+		dbItems[item.Name] = item
+	}
+	for _, ci := range m.Items {
+		name := strings.TrimSpace(ci.Name)
+		old := dbItems[name]
+		if !p.checkName(TypeItem, name, p.itemIds, old != nil, old != nil && old.Deleted, old != nil && old.DataFrom == roleapp.DataFromSystem) {
+			continue
+		}
+		if ci.Method == "" || ci.Path == "" {
+			p.conflict("item[%s]缺少 method 或 path", name)
+			continue
+		}
+
+		var after roleapp.Item
+		var before interface{}
+		if old != nil {
+			after = *old
+			before = old
+		} else {
+			after = roleapp.Item{
+				Id:       util.GenerateDataId(),
+				TenantId: tenantapp.DefaultTenantId,
+				DataFrom: roleapp.DataFromUser,
+				CreateT:  t,
+			}
+		}
+		after.Name = name
+		after.Method = strings.ToUpper(ci.Method)
+		after.Path = strings.ReplaceAll(ci.Path, ":id", "*")
+		after.Resource = ci.Resource
+		after.Menu = ci.Menu
+		after.Button = ci.Button
+		after.Deleted = false
+		after.UpdateT = t
+
+		p.itemIds[name] = after.Id
+		p.add(TypeItem, after.Id, name, before, &after)
+	}
+
+	// permissions
+	dbItemIds := make(map[string]string)
+	for _, item := range cur.items {
+		if p.referable(item.DataFrom, item.Deleted) {
+			dbItemIds[item.Name] = item.Id
+		}
+	}
+	dbPs := make(map[string]*roleapp.Permission)
+	for _, ps := range cur.permissions {
+		dbPs[ps.Name] = ps
+	}
+	for _, cp := range m.Permissions {
+		name := strings.TrimSpace(cp.Name)
+		old := dbPs[name]
+		if !p.checkName(TypePermission, name, p.pIds, old != nil, old != nil && old.Deleted, old != nil && old.DataFrom == roleapp.DataFromSystem) {
+			continue
+		}
+		itemIds, ok := p.resolve(TypePermission, name, TypeItem, cp.Items, p.itemIds, dbItemIds)
+		if !ok {
+			continue
+		}
+
+		var after roleapp.Permission
+		var before interface{}
+		if old != nil {
+			after = *old
+			before = old
+		} else {
+			after = roleapp.Permission{
+				Id:       util.GenerateDataId(),
+				TenantId: tenantapp.DefaultTenantId,
+				DataFrom: roleapp.DataFromUser,
+				CreateT:  t,
+			}
+		}
+		after.Name = name
+		after.ItemIds = itemIds
+		after.Menu = cp.Menu
+		after.Button = cp.Button
+		after.Deleted = false
+		after.UpdateT = t
+
+		p.pIds[name] = after.Id
+		p.add(TypePermission, after.Id, name, before, &after)
+	}
+
+	// roles，先确定目录中所有 role 的 id，role 之间可以互相引用
+	dbPIds := make(map[string]string)
+	for _, ps := range cur.permissions {
+		if p.referable(ps.DataFrom, ps.Deleted) {
+			dbPIds[ps.Name] = ps.Id
+		}
+	}
+	dbRoles := make(map[string]*roleapp.Role)
+	dbRoleIds := make(map[string]string)
+	for _, role := range cur.roles {
+		dbRoles[role.Name] = role
+		if p.referable(role.DataFrom, role.Deleted) {
+			dbRoleIds[role.Name] = role.Id
+		}
+	}
+	var roles []*Role
+	for _, cr := range m.Roles {
+		name := strings.TrimSpace(cr.Name)
+		old := dbRoles[name]
+		if !p.checkName(TypeRole, name, p.roleIds, old != nil, old != nil && old.Deleted, old != nil && old.DataFrom == roleapp.DataFromSystem) {
+			continue
+		}
+		if old != nil {
+			p.roleIds[name] = old.Id
+		} else {
+			p.roleIds[name] = util.GenerateDataId()
+		}
+		roles = append(roles, cr)
+	}
+	for _, cr := range roles {
+		name := strings.TrimSpace(cr.Name)
+		pids, ok1 := p.resolve(TypeRole, name, TypePermission, cr.Permissions, p.pIds, dbPIds)
+		childNames := dedupe(cr.ChildrenRoles)
+		childIds, ok2 := p.resolve(TypeRole, name, TypeRole, childNames, p.roleIds, dbRoleIds)
+		approverIds, ok3 := p.resolve(TypeRole, name, TypeRole, cr.ApproverRoles, p.roleIds, dbRoleIds)
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+
+		old := dbRoles[name]
+		var after roleapp.Role
+		var before interface{}
+		if old != nil {
+			after = *old
+			before = old
+		} else {
+			after = roleapp.Role{
+				Id:       p.roleIds[name],
+				TenantId: tenantapp.DefaultTenantId,
+				DataFrom: roleapp.DataFromUser,
+				CreateT:  t,
+			}
+		}
+		after.Name = name
+		after.PermissionIds = pids
+		after.ChildrenRoles = []*roleapp.ChildRole{}
+		for i, id := range childIds {
+			after.ChildrenRoles = append(after.ChildrenRoles, &roleapp.ChildRole{Id: id, Name: childNames[i]})
+		}
+		after.Menu = cr.Menu
+		after.Button = cr.Button
+		after.RequireApproval = cr.RequireApproval
+		after.ApproverRoleIds = approverIds
+		after.Deleted = false
+		after.UpdateT = t
+
+		p.roles[name] = &after
+		p.add(TypeRole, after.Id, name, before, &after)
+	}
+
+	if mode == ModeReplace {
+		p.planDelete(cur, t)
+	}
+
+	return p
+}
+
+// 检查目录中数据的 name，返回 false 时跳过这条数据
+func (p *Plan) checkName(typ, name string, seen map[string]string, exist, deleted, system bool) bool {
+	if name == "" {
+		p.conflict("%s 的 name 不能为空", typ)
+		return false
+	}
+	if _, ok := seen[name]; ok {
+		p.conflict("%s[%s]在目录中重复", typ, name)
+		return false
+	}
+	if system {
+		p.conflict("%s[%s]与系统内置数据重名", typ, name)
+		return false
+	}
+	if exist && !deleted && p.Mode == ModeCreate {
+		p.conflict("%s[%s]已存在", typ, name)
+		return false
+	}
+	return true
+}
+
+// 数据库中的数据导入后是否还存在，可以被目录中的数据引用
+// replace 模式下目录中没有的用户数据会被删除，不能引用
+func (p *Plan) referable(dataFrom string, deleted bool) bool {
+	if deleted {
+		return false
+	}
+	return p.Mode != ModeReplace || dataFrom == roleapp.DataFromSystem
+}
+
+// 把引用的 name 转换成 id，先查找目录中的数据，再查找数据库中的数据，重复的 name 只保留一个
+func (p *Plan) resolve(typ, name, refType string, refs []string, catalogue, db map[string]string) ([]string, bool) {
+	ids := []string{}
+	ok := true
+	for _, ref := range dedupe(refs) {
+		id, found := catalogue[ref]
+		if !found {
+			id, found = db[ref]
+		}
+		if !found {
+			p.conflict("%s[%s]引用的%s[%s]不存在", typ, name, refType, ref)
+			ok = false
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, ok
+}
+
+// replace 模式下删除目录中没有的用户数据，先删除 role，再删除 permission 和 item
+func (p *Plan) planDelete(cur *current, t *util.CurTime) {
+	roles := append([]*roleapp.Role{}, cur.roles...)
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	for _, role := range roles {
+		if _, ok := p.roleIds[role.Name]; ok || !exportable(role.DataFrom, role.Deleted) {
+			continue
+		}
+		after := *role
+		after.Deleted = true
+		after.UpdateT = t
+		p.add(TypeRole, role.Id, role.Name, role, &after)
+	}
+
+	ps := append([]*roleapp.Permission{}, cur.permissions...)
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	for _, permission := range ps {
+		if _, ok := p.pIds[permission.Name]; ok || !exportable(permission.DataFrom, permission.Deleted) {
+			continue
+		}
+		after := *permission
+		after.Deleted = true
+		after.UpdateT = t
+		p.add(TypePermission, permission.Id, permission.Name, permission, &after)
+	}
+
+	items := append([]*roleapp.Item{}, cur.items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	for _, item := range items {
+		if _, ok := p.itemIds[item.Name]; ok || !exportable(item.DataFrom, item.Deleted) {
+			continue
+		}
+		after := *item
+		after.Deleted = true
+		after.UpdateT = t
+		p.add(TypeItem, item.Id, item.Name, item, &after)
+	}
+}
+
+func dedupe(names []string) []string {
+	ret := []string{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ret = append(ret, name)
+	}
+	return ret
+}
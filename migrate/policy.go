@@ -0,0 +1,342 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userandrole"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 声明式的权限策略文件，yaml 或 json 格式，保存在 git 中，通过 sync 同步到数据库
+// 包含用户定义的 item / permission / role，以及可选的用户 roles
+// 系统内置数据仍然在程序启动时初始化，策略文件中可以按 name 引用
+type Policy struct {
+	Migrate `yaml:",inline"`
+	Users   []*UserGrant `json:"users" yaml:"users"`
+}
+
+// 默认租户中账户密码登录方式的用户拥有的 roles
+type UserGrant struct {
+	LoginId string   `json:"loginId" yaml:"loginId"`
+	Roles   []string `json:"roles" yaml:"roles"` // role name 列表
+}
+
+const (
+	FormatYaml = "yaml"
+	FormatJson = "json"
+)
+
+// 根据文件扩展名判断格式，.json 为 json，其他为 yaml
+func PolicyFormat(filename string) string {
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		return FormatJson
+	}
+	return FormatYaml
+}
+
+// 解析策略文件，不允许未知的字段，避免拼写错误的字段被忽略
+func ParsePolicy(data []byte, format string) (*Policy, error) {
+	var p Policy
+	var err error
+	if format == FormatJson {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	} else {
+		err = yaml.UnmarshalStrict(data, &p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析策略文件失败, %s", err.Error())
+	}
+	return &p, nil
+}
+
+func LoadPolicyFile(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data, PolicyFormat(filename))
+}
+
+// 系统内置数据的 name，策略文件中的数据不能与之重名
+func builtinNames() map[string]bool {
+	names := map[string]bool{
+		TypePermission + ":" + roleapp.AdminPermissionName: true,
+		TypeRole + ":" + roleapp.AdminRoleName:             true,
+		TypeRole + ":" + roleapp.DefaultRoleName:           true,
+	}
+	for _, name := range roleapp.AdminItemNames {
+		names[TypeItem+":"+name] = true
+	}
+	return names
+}
+
+// 不连接数据库检查策略文件，用于 CI
+// 返回错误列表和引用的文件以外的数据，文件以外的数据需要在同步的环境中已存在，sync 时检查
+func Validate(p *Policy) ([]string, []string) {
+	v := &validator{
+		builtin:  builtinNames(),
+		names:    make(map[string]bool),
+		external: make(map[string]bool),
+	}
+
+	for _, item := range p.Items {
+		name := v.checkName(TypeItem, item.Name)
+		if name != "" && (item.Method == "" || item.Path == "") {
+			v.problem("item[%s]缺少 method 或 path", name)
+		}
+	}
+	for _, ps := range p.Permissions {
+		v.checkName(TypePermission, ps.Name)
+	}
+	for _, role := range p.Roles {
+		v.checkName(TypeRole, role.Name)
+	}
+
+	for _, ps := range p.Permissions {
+		v.checkRefs(TypeItem, ps.Items)
+	}
+	for _, role := range p.Roles {
+		v.checkRefs(TypePermission, role.Permissions)
+		v.checkRefs(TypeRole, role.ChildrenRoles)
+		v.checkRefs(TypeRole, role.ApproverRoles)
+	}
+
+	loginIds := make(map[string]bool)
+	for _, g := range p.Users {
+		loginId := strings.TrimSpace(g.LoginId)
+		switch {
+		case loginId == "":
+			v.problem("users 中的 loginId 不能为空")
+		case loginIds[loginId]:
+			v.problem("用户[%s]在策略文件中重复", loginId)
+		case loginId == userapp.AdminLoginId:
+			v.problem("admin 账户的 roles 不能通过策略文件修改")
+		}
+		loginIds[loginId] = true
+		v.checkRefs(TypeRole, g.Roles)
+	}
+
+	var external []string
+	for ref := range v.external {
+		external = append(external, ref)
+	}
+	sort.Strings(external)
+	return v.problems, external
+}
+
+type validator struct {
+	builtin  map[string]bool
+	names    map[string]bool // type:name
+	external map[string]bool
+	problems []string
+}
+
+func (v *validator) problem(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) checkName(typ, name string) string {
+	name = strings.TrimSpace(name)
+	key := typ + ":" + name
+	switch {
+	case name == "":
+		v.problem("%s 的 name 不能为空", typ)
+		return ""
+	case v.names[key]:
+		v.problem("%s[%s]在策略文件中重复", typ, name)
+		return ""
+	case v.builtin[key]:
+		v.problem("%s[%s]与系统内置数据重名", typ, name)
+		return ""
+	}
+	v.names[key] = true
+	return name
+}
+
+func (v *validator) checkRefs(typ string, refs []string) {
+	for _, ref := range dedupe(refs) {
+		if !v.names[typ+":"+ref] {
+			v.external[fmt.Sprintf("%s[%s]", typ, ref)] = true
+		}
+	}
+}
+
+// 同步策略文件到数据库，item / permission / role 按 name 新建或更新
+// prune 时删除文件中没有的用户定义数据，并移除文件中列出的用户不在文件中的 roles
+// 其他规则与导入相同
+func Sync(db *dbandmq.Ds, p *Policy, prune, dryRun bool, opHis *ophistory.OperationHistory) (*Plan, error) {
+	mode := ModeUpsert
+	if prune {
+		mode = ModeReplace
+	}
+
+	return run(db, dryRun, opHis, func(cur *current) (*Plan, error) {
+		targets, err := loadGrantTargets(db, p.Users)
+		if err != nil {
+			return nil, err
+		}
+		plan := buildPlan(&p.Migrate, mode, cur)
+		plan.planGrants(p.Users, targets, cur)
+		return plan, nil
+	})
+}
+
+// 策略文件中的用户和当前的 roles
+type grantTarget struct {
+	user *userapp.User
+	uwr  *userandrole.UserWithRole
+}
+
+func loadGrantTargets(db *dbandmq.Ds, users []*UserGrant) (map[string]*grantTarget, error) {
+	targets := make(map[string]*grantTarget)
+	for _, g := range users {
+		loginId := strings.TrimSpace(g.LoginId)
+		if loginId == "" || targets[loginId] != nil {
+			continue
+		}
+		user, err := userapp.GetUserByLoginId(db, tenantapp.DefaultTenantId, loginId)
+		if err != nil {
+			return nil, err
+		}
+		target := &grantTarget{user: user}
+		if user != nil {
+			target.uwr, err = userandrole.GetUserWithRoleByUserId(db, user.Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		targets[loginId] = target
+	}
+	return targets, nil
+}
+
+// 用户的 roles 在 item / permission / role 之后写入
+// 新赋予的 role 长期有效，已有的限时授权保持不变
+// 需要审批的 role 不能通过策略文件赋予，replace 模式下也不会移除，只能通过撤销授权移除
+func (p *Plan) planGrants(users []*UserGrant, targets map[string]*grantTarget, cur *current) {
+	dbRoles := make(map[string]*roleapp.Role)
+	dbRoleIds := make(map[string]string)
+	approvalIds := make(map[string]bool)
+	for _, role := range cur.roles {
+		if p.referable(role.DataFrom, role.Deleted) {
+			dbRoles[role.Name] = role
+			dbRoleIds[role.Name] = role.Id
+		}
+		if role.RequireApproval {
+			approvalIds[role.Id] = true
+		}
+	}
+	for _, role := range p.roles {
+		if role.RequireApproval {
+			approvalIds[role.Id] = true
+		}
+	}
+	t := util.GetCurTime()
+
+	seen := make(map[string]bool)
+	for _, g := range users {
+		loginId := strings.TrimSpace(g.LoginId)
+		switch {
+		case loginId == "":
+			p.conflict("users 中的 loginId 不能为空")
+			continue
+		case seen[loginId]:
+			p.conflict("用户[%s]在策略文件中重复", loginId)
+			continue
+		case loginId == userapp.AdminLoginId:
+			p.conflict("admin 账户的 roles 不能通过策略文件修改")
+			continue
+		}
+		seen[loginId] = true
+
+		target := targets[loginId]
+		if target == nil || target.user == nil {
+			p.conflict("用户[%s]不存在", loginId)
+			continue
+		}
+		roleIds, ok := p.resolve(TypeUser, loginId, TypeRole, g.Roles, p.roleIds, dbRoleIds)
+		if !ok {
+			continue
+		}
+		for _, name := range dedupe(g.Roles) {
+			role := p.roles[name]
+			if role == nil {
+				role = dbRoles[name]
+			}
+			if role != nil && role.RequireApproval {
+				p.conflict("%s[%s]的role[%s]需要审批，不能在策略文件中赋予", TypeUser, loginId, name)
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		uwr := target.uwr
+		if uwr == nil && len(roleIds) == 0 {
+			continue
+		}
+
+		var after userandrole.UserWithRole
+		var before interface{}
+		var oldIds []string
+		if uwr != nil {
+			after = *uwr
+			before = uwr
+			oldIds = uwr.RoleIds
+		} else {
+			after = userandrole.UserWithRole{
+				Id:       util.GenerateDataId(),
+				TenantId: tenantapp.DefaultTenantId,
+				UserId:   target.user.Id,
+				UserName: target.user.Name,
+				CreateT:  t,
+			}
+		}
+
+		want := make(map[string]bool)
+		for _, id := range roleIds {
+			want[id] = true
+		}
+		held := make(map[string]bool)
+		newIds := []string{}
+		var added, removed []string
+		for _, id := range oldIds {
+			held[id] = true
+			if want[id] || p.Mode != ModeReplace || approvalIds[id] {
+				newIds = append(newIds, id)
+			} else {
+				removed = append(removed, id)
+			}
+		}
+		for _, id := range roleIds {
+			if !held[id] {
+				newIds = append(newIds, id)
+				added = append(added, id)
+			}
+		}
+		after.RoleIds = newIds
+		if len(removed) > 0 {
+			after.RemoveRoleExpires(removed)
+		}
+		after.UpdateT = t
+
+		ch := p.add(TypeUser, after.Id, loginId, before, &after)
+		ch.targetId = target.user.Id
+		ch.added = added
+		ch.removed = removed
+	}
+}
@@ -0,0 +1,170 @@
+package ophistory
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"sort"
+)
+
+// 操作类型，格式为 数据类型.操作
+const (
+	CodeUserCreate        = "user.create"
+	CodeUserRegister      = "user.register"
+	CodeUserPasswd        = "user.passwd"
+	CodeUserResetPasswd   = "user.resetpasswd"
+	CodeUserForgotPasswd  = "user.forgotpasswd"
+	CodeUserBan           = "user.ban"
+	CodeUserUnBan         = "user.unban"
+	CodeUserBanExpire     = "user.banexpire"
+	CodeUserProfile       = "user.profile"
+	CodeUserLink          = "user.link"
+	CodeUserLinkConflict  = "user.linkconflict"
+	CodeUserUnlink        = "user.unlink"
+	CodeUserBindPhone     = "user.bindphone"
+	CodeUserBindPhoneBan  = "user.bindphoneban"
+	CodeUserBindPhoneMove = "user.bindphonemove"
+	CodeUserMerge         = "user.merge"
+	CodeUserUnMerge       = "user.unmerge"
+	CodeUserRevokeSession = "user.revokesession"
+
+	CodeUwrAddRoles       = "uwr.addroles"
+	CodeUwrDelRoles       = "uwr.delroles"
+	CodeUwrExpire         = "uwr.expire"
+	CodeUwrLdapSync       = "uwr.ldapsync"
+	CodeUwrAddManageUsers = "uwr.addmanageusers"
+	CodeUwrDelManageUsers = "uwr.delmanageusers"
+	CodeUwrAddManageOrgs  = "uwr.addmanageorgs"
+	CodeUwrDelManageOrgs  = "uwr.delmanageorgs"
+
+	CodeItemCreate = "item.create"
+	CodeItemUpdate = "item.update"
+	CodeItemDelete = "item.delete"
+
+	CodePermissionCreate   = "permission.create"
+	CodePermissionAddItems = "permission.additems"
+	CodePermissionDelItems = "permission.delitems"
+	CodePermissionUpdate   = "permission.update"
+	CodePermissionDelete   = "permission.delete"
+
+	CodeRoleCreate       = "role.create"
+	CodeRoleAddPs        = "role.addps"
+	CodeRoleDelPs        = "role.delps"
+	CodeRoleUpdate       = "role.update"
+	CodeRoleDelete       = "role.delete"
+	CodeRoleAddChildRole = "role.addchildrole"
+	CodeRoleDelChildRole = "role.delchildrole"
+	CodeRoleApproval     = "role.approval"
+
+	CodeOrgCreate     = "org.create"
+	CodeOrgRename     = "org.rename"
+	CodeOrgMove       = "org.move"
+	CodeOrgDelete     = "org.delete"
+	CodeOrgRoles      = "org.roles"
+	CodeOrgAddMembers = "org.addmembers"
+	CodeOrgDelMembers = "org.delmembers"
+	CodeOrgPrimary    = "org.primary"
+
+	CodeGroupCreate     = "group.create"
+	CodeGroupUpdate     = "group.update"
+	CodeGroupDelete     = "group.delete"
+	CodeGroupRoles      = "group.roles"
+	CodeGroupAddMembers = "group.addmembers"
+	CodeGroupDelMembers = "group.delmembers"
+
+	CodeTenantCreate = "tenant.create"
+	CodeTenantUpdate = "tenant.update"
+	CodeTenantStatus = "tenant.status"
+
+	CodeGrantRequestCreate     = "grantrequest.create"
+	CodeGrantRequestApproved   = "grantrequest.approved"
+	CodeGrantRequestRejected   = "grantrequest.rejected"
+	CodeGrantRequestCanceled   = "grantrequest.canceled"
+	CodeGrantRequestGrantError = "grantrequest.granterror"
+
+	CodeWebhookCreate = "webhook.create"
+	CodeWebhookUpdate = "webhook.update"
+	CodeWebhookSecret = "webhook.secret"
+	CodeWebhookDelete = "webhook.delete"
+)
+
+// 操作参数，用于渲染操作描述
+type Params map[string]interface{}
+
+// 数据修改前后的差异，只记录有变化的顶层字段
+type Change struct {
+	Field string      `json:"field" bson:"field"`
+	Old   interface{} `json:"old" bson:"old"`
+	New   interface{} `json:"new" bson:"new"`
+}
+
+// 对比差异时忽略的字段，密码等敏感信息不能写入日志
+var diffIgnoreFields = map[string]bool{
+	"updateT":    true,
+	"salt":       true,
+	"passwd":     true,
+	"sessionKey": true,
+}
+
+// 把数据按数据库中保存的格式转换成 map，修改数据之前先保存一份，用于对比修改前后的差异
+// 使用 bson 而不是 json，roleIds / permissionIds 等接口不返回的字段也需要记录
+func Snapshot(v interface{}) map[string]interface{} {
+	if v == nil {
+		return map[string]interface{}{}
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return m
+	}
+
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return map[string]interface{}{}
+	}
+	m := make(map[string]interface{})
+	if err = bson.Unmarshal(data, &m); err != nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
+
+// 对比修改前后的数据，按字段名排序返回有变化的字段
+// before 或 after 为 nil 时表示新建或删除
+func Diff(before, after interface{}) []*Change {
+	bm := Snapshot(before)
+	am := Snapshot(after)
+
+	var fields []string
+	for k := range bm {
+		fields = append(fields, k)
+	}
+	for k := range am {
+		if _, ok := bm[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+
+	var changes []*Change
+	for _, field := range fields {
+		if diffIgnoreFields[field] {
+			continue
+		}
+		ov, nv := bm[field], am[field]
+		if reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		changes = append(changes, &Change{Field: field, Old: ov, New: nv})
+	}
+	return changes
+}
+
+// 设置操作参数
+func (h *OperationHistory) SetParams(params Params) *OperationHistory {
+	h.Params = params
+	return h
+}
+
+// 记录数据修改前后的差异，before 一般是修改前调用 Snapshot 保存的数据
+func (h *OperationHistory) SetDiff(before, after interface{}) *OperationHistory {
+	h.Changes = Diff(before, after)
+	return h
+}
@@ -0,0 +1,174 @@
+package ophistory
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 审计日志，所有的操作记录都保存在这里，不再追加到各个数据自身的 history 数组中
+const CollectionNameAuditLog = "auditLog"
+
+var IKAuditLog = &dbandmq.IndexKey{
+	Collection:    CollectionNameAuditLog,
+	SingleKey:     []string{"tenantId", "userId", "targetType", "targetId", "code", "reqId", "ip", "t.seconds"},
+	CompositeKeys: [][]string{{"targetType", "targetId"}},
+}
+
+// 被操作的数据类型
+const (
+	TargetUser         = "user" // 用户，包含用户的登录方式和 roles
+	TargetItem         = "item"
+	TargetPermission   = "permission"
+	TargetRole         = "role"
+	TargetOrg          = "org"
+	TargetGroup        = "group"
+	TargetTenant       = "tenant"
+	TargetGrantRequest = "grantRequest"
+	TargetWebhook      = "webhook"
+)
+
+// 从 history 数组迁移过来的记录没有操作类型
+const CodeLegacy = "legacy"
+
+// 写入审计日志失败，数据已经修改但没有留下记录，调用方需要返回错误，接口返回 500
+var ErrRecordFailed = errors.New("写入审计日志失败")
+
+// 审计日志写入后的回调，用于 webhook 等需要感知数据变化的功能
+type RecordHook func(db *dbandmq.Ds, log *OperationHistory)
+
+var recordHooks []RecordHook
+
+// 注册审计日志写入后的回调，程序启动时调用
+func AddRecordHook(hook RecordHook) {
+	recordHooks = append(recordHooks, hook)
+}
+
+// 写入审计日志，同一个操作涉及多个数据时每个数据一条记录
+// 每条记录使用新的 id，同一个 opHis 可以多次写入，写入时按顺序加入哈希链
+func Record(db *dbandmq.Ds, opHis *OperationHistory, code, targetType string, targetIds ...string) error {
+	var docs []*OperationHistory
+	for _, targetId := range targetIds {
+		log := *opHis
+		log.Id = util.GenerateDataId()
+		log.Code = code
+		log.TargetType = targetType
+		log.TargetId = targetId
+		if log.Action == "" {
+			log.Action = Render(&log, LangZh)
+		}
+		docs = append(docs, &log)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	err := insertChained(db, docs...)
+	if err != nil {
+		Logger.Errorf("", "写入审计日志[%s][%s]失败, %s", code, opHis.Action, err.Error())
+		return fmt.Errorf("%w, %s", ErrRecordFailed, err.Error())
+	}
+
+	for _, log := range docs {
+		for _, hook := range recordHooks {
+			hook(db, log)
+		}
+	}
+	return nil
+}
+
+// 包含 history 数组的数据表
+type HistoryCollection struct {
+	Collection string
+	TargetType string
+	IdField    string // 作为 targetId 的字段
+}
+
+// 把各个表中的 history 数组迁移到审计日志中，迁移后删除 history 字段
+// 同一条记录可能同时追加到了多个数据中，id 和 target 都相同的只保留一条，重复执行不会产生重复数据
+// 迁移过来的记录不在哈希链上，迁移后调用 ChainAuditLogs 按时间顺序加入
+func MigrateEmbeddedHistory(db *dbandmq.Ds, hcs []*HistoryCollection) error {
+	for _, hc := range hcs {
+		cnt := 0
+		f := bson.M{"history": bson.M{"$exists": true}}
+		iter := db.C(hc.Collection).Find(f).Iter()
+		var doc bson.M
+		for iter.Next(&doc) {
+			err := migrateDocHistory(db, hc, doc)
+			if err != nil {
+				_ = iter.Close()
+				return err
+			}
+			cnt++
+			doc = nil
+		}
+		if err := iter.Close(); err != nil {
+			Logger.Errorf("", "读取[%s]的history失败, %s", hc.Collection, err.Error())
+			return err
+		}
+		if cnt > 0 {
+			Logger.Infof("", "[%s]中%d条数据的history已迁移到审计日志", hc.Collection, cnt)
+		}
+	}
+	return nil
+}
+
+func migrateDocHistory(db *dbandmq.Ds, hc *HistoryCollection, doc bson.M) error {
+	targetId, _ := doc[hc.IdField].(string)
+	tenantId, _ := doc["tenantId"].(string)
+
+	raw, err := bson.Marshal(bson.M{"history": doc["history"]})
+	if err != nil {
+		return err
+	}
+	var tmp struct {
+		History []*OperationHistory `bson:"history"`
+	}
+	err = bson.Unmarshal(raw, &tmp)
+	if err != nil {
+		Logger.Errorf("", "解析[%s][%v]的history失败, %s", hc.Collection, doc["_id"], err.Error())
+		return err
+	}
+
+	for _, h := range tmp.History {
+		if h == nil {
+			continue
+		}
+		h.TenantId = tenantId
+		h.TargetType = hc.TargetType
+		h.TargetId = targetId
+		h.Code = CodeLegacy
+		if h.Id == "" {
+			h.Id = util.GenerateDataId()
+		}
+
+		err = db.C(CollectionNameAuditLog).Insert(h)
+		if mgo.IsDup(err) {
+			var dbh *OperationHistory
+			err = db.C(CollectionNameAuditLog).FindId(h.Id).One(&dbh)
+			if err != nil {
+				return err
+			}
+			if dbh.TargetType == h.TargetType && dbh.TargetId == h.TargetId {
+				continue
+			}
+			h.Id = util.GenerateDataId()
+			err = db.C(CollectionNameAuditLog).Insert(h)
+		}
+		if err != nil {
+			Logger.Errorf("", "迁移[%s][%v]的history失败, %s", hc.Collection, doc["_id"], err.Error())
+			return err
+		}
+	}
+
+	err = db.C(hc.Collection).UpdateId(doc["_id"], bson.M{"$unset": bson.M{"history": ""}})
+	if err != nil {
+		Logger.Errorf("", "删除[%s][%v]的history失败, %s", hc.Collection, doc["_id"], err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package ophistory
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"sync"
+	"time"
+)
+
+// 审计日志哈希链
+// 每条记录按写入顺序分配连续的 seq，hash = sha256(记录内容，包含上一条记录的 hash)
+// 修改或删除中间的记录都会导致链条断开，删除末尾的记录通过定期导出的签名检查点发现
+
+// 并发写入时 seq 冲突的重试次数
+const chainRetryTimes = 10
+
+// 同一个进程内串行写入，多个进程之间依赖 seq 的唯一索引
+var chainMu sync.Mutex
+
+// seq 的唯一索引，升级前的记录没有 seq，需要是 sparse 索引
+func EnsureChainIndex(db *dbandmq.Ds) error {
+	idx := mgo.Index{
+		Key:    []string{"seq"},
+		Unique: true,
+		Sparse: true,
+	}
+	err := db.C(CollectionNameAuditLog).EnsureIndex(idx)
+	if err != nil {
+		Logger.Errorf("", "建立审计日志seq唯一索引失败, %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// 计算记录的 hash
+// 先按数据库保存的格式转换一次，保证写入前和读取后计算的结果一致
+func ComputeHash(h *OperationHistory) string {
+	tmp := *h
+	tmp.Hash = ""
+	tmp.Text = ""
+
+	raw, err := bson.Marshal(&tmp)
+	if err != nil {
+		return ""
+	}
+	var saved OperationHistory
+	if err = bson.Unmarshal(raw, &saved); err != nil {
+		return ""
+	}
+
+	// json 中 map 的 key 是排序的
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return ""
+	}
+	return util.Sha256(string(data))
+}
+
+// 读取链条中最后一条记录，没有时返回 nil
+func lastChained(db *dbandmq.Ds) (*OperationHistory, error) {
+	var last *OperationHistory
+	err := db.C(CollectionNameAuditLog).Find(bson.M{"seq": bson.M{"$exists": true}}).Sort("-seq").One(&last)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		Logger.Errorf("", "读取审计日志最后一条记录失败, %s", err.Error())
+		return nil, err
+	}
+	return last, nil
+}
+
+// 把记录连接到链条末尾，id 和 seq 需要调用方保证未使用
+func linkTo(last, h *OperationHistory) {
+	h.Seq = 1
+	h.PrevHash = ""
+	if last != nil {
+		h.Seq = last.Seq + 1
+		h.PrevHash = last.Hash
+	}
+	h.Hash = ComputeHash(h)
+}
+
+// 按顺序写入审计日志并连接到链条末尾
+func insertChained(db *dbandmq.Ds, logs ...*OperationHistory) error {
+	chainMu.Lock()
+	defer chainMu.Unlock()
+
+	for _, h := range logs {
+		var err error
+		for i := 0; i < chainRetryTimes; i++ {
+			var last *OperationHistory
+			last, err = lastChained(db)
+			if err != nil {
+				return err
+			}
+			linkTo(last, h)
+			err = db.C(CollectionNameAuditLog).Insert(h)
+			if !mgo.IsDup(err) {
+				break
+			}
+			// 其他进程先写入了同一个 seq，重新读取末尾
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把还没有 seq 的记录按时间顺序连接到链条上
+// 升级前写入的记录和从 history 数组迁移过来的记录，在程序启动时调用
+func ChainAuditLogs(db *dbandmq.Ds) error {
+	chainMu.Lock()
+	defer chainMu.Unlock()
+
+	last, err := lastChained(db)
+	if err != nil {
+		return err
+	}
+
+	cnt := 0
+	f := bson.M{"seq": bson.M{"$exists": false}}
+	iter := db.C(CollectionNameAuditLog).Find(f).Sort("t.seconds", "_id").Iter()
+	var h *OperationHistory
+	for iter.Next(&h) {
+		linkTo(last, h)
+		update := bson.M{
+			"$set": bson.M{
+				"seq":      h.Seq,
+				"prevHash": h.PrevHash,
+				"hash":     h.Hash,
+			},
+		}
+		err = db.C(CollectionNameAuditLog).UpdateId(h.Id, update)
+		if err != nil {
+			_ = iter.Close()
+			Logger.Errorf("", "审计日志[%s]加入哈希链失败, %s", h.Id, err.Error())
+			return err
+		}
+		last = h
+		h = nil
+		cnt++
+	}
+	if err = iter.Close(); err != nil {
+		Logger.Errorf("", "读取未加入哈希链的审计日志失败, %s", err.Error())
+		return err
+	}
+	if cnt > 0 {
+		Logger.Infof("", "%d条审计日志已加入哈希链", cnt)
+	}
+	return nil
+}
+
+// 链条断开的位置
+type ChainBreak struct {
+	Seq    int64  `json:"seq"`
+	Id     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// 最多返回的断开位置个数
+const MaxChainBreaks = 100
+
+type ChainVerifyResult struct {
+	Total     int           `json:"total"`     // 检查的记录数
+	LastSeq   int64         `json:"lastSeq"`   // 最后一条记录的 seq
+	LastHash  string        `json:"lastHash"`  // 最后一条记录的 hash
+	Unchained int           `json:"unchained"` // 不在链条上的记录数，正常情况下为 0
+	Breaks    []*ChainBreak `json:"breaks"`
+	OK        bool          `json:"ok"`
+}
+
+func (r *ChainVerifyResult) addBreak(seq int64, id, reason string) {
+	r.OK = false
+	if len(r.Breaks) < MaxChainBreaks {
+		r.Breaks = append(r.Breaks, &ChainBreak{Seq: seq, Id: id, Reason: reason})
+	}
+}
+
+// 从头遍历哈希链，检查记录内容、前后连接关系和 seq 是否连续
+func VerifyChain(db *dbandmq.Ds) (*ChainVerifyResult, error) {
+	ret := &ChainVerifyResult{
+		OK:     true,
+		Breaks: []*ChainBreak{},
+	}
+
+	var err error
+	ret.Unchained, err = db.C(CollectionNameAuditLog).Find(bson.M{"seq": bson.M{"$exists": false}}).Count()
+	if err != nil {
+		Logger.Errorf("", "读取未加入哈希链的审计日志失败, %s", err.Error())
+		return nil, err
+	}
+	if ret.Unchained > 0 {
+		ret.OK = false
+	}
+
+	var prev *OperationHistory
+	iter := db.C(CollectionNameAuditLog).Find(bson.M{"seq": bson.M{"$exists": true}}).Sort("seq").Iter()
+	var h *OperationHistory
+	for iter.Next(&h) {
+		ret.Total++
+
+		expectSeq, expectPrev := int64(1), ""
+		if prev != nil {
+			expectSeq, expectPrev = prev.Seq+1, prev.Hash
+		}
+		if h.Seq != expectSeq {
+			ret.addBreak(h.Seq, h.Id, fmt.Sprintf("seq不连续，缺少%d到%d的记录", expectSeq, h.Seq-1))
+		} else if h.PrevHash != expectPrev {
+			ret.addBreak(h.Seq, h.Id, "prevHash与上一条记录的hash不一致")
+		}
+		if ComputeHash(h) != h.Hash {
+			ret.addBreak(h.Seq, h.Id, "记录内容与hash不一致")
+		}
+
+		prev = h
+		h = nil
+	}
+	if err = iter.Close(); err != nil {
+		Logger.Errorf("", "读取审计日志失败, %s", err.Error())
+		return nil, err
+	}
+
+	if prev != nil {
+		ret.LastSeq = prev.Seq
+		ret.LastHash = prev.Hash
+	}
+	return ret, nil
+}
+
+// 检查点，记录某个时间链条末尾的 seq 和 hash，使用密钥签名后导出到文件
+type Checkpoint struct {
+	Seq  int64         `json:"seq"`
+	Hash string        `json:"hash"`
+	T    *util.CurTime `json:"t"`
+	Sign string        `json:"sign"`
+}
+
+// 检查点导出配置
+type CheckpointOption struct {
+	File     string        // 导出的文件，每行一个 json
+	Interval time.Duration // 导出间隔
+	SignKey  string        // hmac-sha256 签名使用的密钥
+}
+
+func (cp *Checkpoint) sign(key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(fmt.Sprintf("%d:%s:%d", cp.Seq, cp.Hash, cp.T.Seconds)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cp *Checkpoint) CheckSign(key string) bool {
+	if cp.T == nil {
+		return false
+	}
+	return hmac.Equal([]byte(cp.Sign), []byte(cp.sign(key)))
+}
+
+// 读取链条末尾生成检查点，追加到文件中
+// lastSeq 为上次导出的 seq，没有新记录时不导出，返回本次导出的 seq
+func ExportCheckpoint(db *dbandmq.Ds, opt *CheckpointOption, lastSeq int64) (int64, error) {
+	last, err := lastChained(db)
+	if err != nil {
+		return lastSeq, err
+	}
+	if last == nil || last.Seq == lastSeq {
+		return lastSeq, nil
+	}
+
+	cp := &Checkpoint{
+		Seq:  last.Seq,
+		Hash: last.Hash,
+		T:    util.GetCurTime(),
+	}
+	cp.Sign = cp.sign(opt.SignKey)
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return lastSeq, err
+	}
+
+	f, err := os.OpenFile(opt.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		Logger.Errorf("", "打开审计日志检查点文件[%s]失败, %s", opt.File, err.Error())
+		return lastSeq, err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		Logger.Errorf("", "写入审计日志检查点文件[%s]失败, %s", opt.File, err.Error())
+		return lastSeq, err
+	}
+	return cp.Seq, nil
+}
+
+// 后台定时导出检查点，程序启动时调用
+func StartCheckpointJob(ds *dbandmq.Ds, opt *CheckpointOption) {
+	go func() {
+		var lastSeq int64
+		ticker := time.NewTicker(opt.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			db := ds.CopyDs()
+			lastSeq, _ = ExportCheckpoint(db, opt, lastSeq)
+			db.Close()
+		}
+	}()
+}
+
+// 校验检查点文件，签名不正确或者与数据库中对应 seq 的记录 hash 不一致时返回断开位置
+// 可以发现末尾记录被删除或者整个链条被重新生成
+func VerifyCheckpoints(db *dbandmq.Ds, opt *CheckpointOption) ([]*ChainBreak, error) {
+	f, err := os.Open(opt.File)
+	if os.IsNotExist(err) {
+		return []*ChainBreak{}, nil
+	}
+	if err != nil {
+		Logger.Errorf("", "打开审计日志检查点文件[%s]失败, %s", opt.File, err.Error())
+		return nil, err
+	}
+	defer f.Close()
+
+	breaks := []*ChainBreak{}
+	addBreak := func(seq int64, id, reason string) {
+		if len(breaks) < MaxChainBreaks {
+			breaks = append(breaks, &ChainBreak{Seq: seq, Id: id, Reason: reason})
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var cp Checkpoint
+		if err = json.Unmarshal(scanner.Bytes(), &cp); err != nil {
+			addBreak(0, "", fmt.Sprintf("检查点第%d行格式错误", line))
+			continue
+		}
+		if !cp.CheckSign(opt.SignKey) {
+			addBreak(cp.Seq, "", fmt.Sprintf("检查点第%d行签名错误", line))
+			continue
+		}
+
+		var h *OperationHistory
+		err = db.C(CollectionNameAuditLog).Find(bson.M{"seq": cp.Seq}).One(&h)
+		if err == mgo.ErrNotFound {
+			addBreak(cp.Seq, "", fmt.Sprintf("检查点第%d行对应的记录不存在", line))
+			continue
+		}
+		if err != nil {
+			Logger.Errorf("", "读取审计日志[%d]失败, %s", cp.Seq, err.Error())
+			return nil, err
+		}
+		if h.Hash != cp.Hash {
+			addBreak(cp.Seq, h.Id, fmt.Sprintf("检查点第%d行的hash与记录不一致", line))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.New("读取审计日志检查点文件失败, " + err.Error())
+	}
+	return breaks, nil
+}
@@ -7,13 +7,27 @@ import (
 	. "github.com/leyle/ginbase/consolelog"
 )
 
-// 操作历史记录
+// 操作历史记录，统一保存在审计日志表中，见 audit.go
 type OperationHistory struct {
 	Id string `json:"id" bson:"_id"`
-	UserId string `json:"userId" bson:"userId"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
+	UserId string `json:"userId" bson:"userId"` // 操作人
 	UserName string `json:"userName" bson:"userName"`
-	Action string `json:"action" bson:"action"` // 拼接起来操作字符串
+	TargetType string `json:"targetType" bson:"targetType"` // 被操作的数据类型
+	TargetId string `json:"targetId" bson:"targetId"`
+	Code string `json:"code" bson:"code"` // 操作类型，如 user.ban，见 action.go
+	Params Params `json:"params,omitempty" bson:"params,omitempty"` // 操作参数
+	Changes []*Change `json:"changes,omitempty" bson:"changes,omitempty"` // 数据修改前后的差异
+	Action string `json:"action" bson:"action"` // 中文操作描述，为空时写入时按 code 和 params 渲染
+	Text string `json:"text,omitempty" bson:"-"` // 读取时按语言渲染的操作描述
+	ReqId string `json:"reqId" bson:"reqId"`
+	Ip string `json:"ip" bson:"ip"`
 	T *util.CurTime `json:"t" bson:"t"`
+
+	// 哈希链，写入审计日志时生成，见 chain.go
+	Seq int64 `json:"seq,omitempty" bson:"seq,omitempty"`
+	PrevHash string `json:"prevHash,omitempty" bson:"prevHash,omitempty"`
+	Hash string `json:"hash,omitempty" bson:"hash,omitempty"`
 }
 
 func NewOpHistory(userId, userName, action string) *OperationHistory {
@@ -27,6 +41,15 @@ func NewOpHistory(userId, userName, action string) *OperationHistory {
 	return opHis
 }
 
+// 复制操作人、租户和请求信息，生成一条新的操作记录
+func (h *OperationHistory) WithAction(action string) *OperationHistory {
+	opHis := *h
+	opHis.Id = util.GenerateDataId()
+	opHis.Action = action
+	opHis.T = util.GetCurTime()
+	return &opHis
+}
+
 // 账户登录历史记录
 const CollectionNameLoginHistory = "loginHistory"
 var IKLoginHistory = &dbandmq.IndexKey{
@@ -35,6 +58,7 @@ var IKLoginHistory = &dbandmq.IndexKey{
 }
 type LoginHistory struct {
 	Id string `json:"id" bson:"_id"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
 	UserId string `json:"userId" bson:"userId"`
 	UserName string `json:"userName" bson:"userName"`
 	LoginType string `json:"loginType" bson:"loginType"` // 登录类型，账户密码、手机号、微信号等
@@ -63,6 +87,23 @@ func GetLoginHistoryByUserId(db *dbandmq.Ds, userId string, page int) ([]*LoginH
 	return lhs, nil
 }
 
+// 登录记录写入后的回调
+type LoginHook func(db *dbandmq.Ds, lh *LoginHistory)
+
+var loginHooks []LoginHook
+
+func AddLoginHook(hook LoginHook) {
+	loginHooks = append(loginHooks, hook)
+}
+
 func SaveLoginHistory(db *dbandmq.Ds, lh *LoginHistory) error {
-	return db.C(CollectionNameLoginHistory).Insert(lh)
+	err := db.C(CollectionNameLoginHistory).Insert(lh)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range loginHooks {
+		hook(db, lh)
+	}
+	return nil
 }
\ No newline at end of file
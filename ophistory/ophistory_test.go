@@ -0,0 +1,138 @@
+package ophistory
+
+import (
+	"github.com/leyle/ginbase/util"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+type testRole struct {
+	Id      string   `json:"id" bson:"_id"`
+	Name    string   `json:"name" bson:"name"`
+	RoleIds []string `json:"-" bson:"roleIds"`
+	Passwd  string   `json:"-" bson:"passwd"`
+}
+
+func TestDiff(t *testing.T) {
+	before := &testRole{Id: "1", Name: "a", RoleIds: []string{"r1"}, Passwd: "x"}
+	after := &testRole{Id: "1", Name: "b", RoleIds: []string{"r1", "r2"}, Passwd: "y"}
+
+	changes := Diff(before, after)
+	if len(changes) != 2 {
+		t.Fatalf("Diff returned %d changes, want 2", len(changes))
+	}
+	if changes[0].Field != "name" || changes[1].Field != "roleIds" {
+		t.Errorf("Diff fields = %s, %s, want name, roleIds", changes[0].Field, changes[1].Field)
+	}
+
+	// 新建
+	changes = Diff(nil, after)
+	for _, c := range changes {
+		if c.Old != nil {
+			t.Errorf("field %s old = %v, want nil", c.Field, c.Old)
+		}
+		if c.Field == "passwd" {
+			t.Errorf("passwd should be ignored")
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	h := &OperationHistory{
+		Code:   CodeRoleAddPs,
+		Params: Params{"name": "admin", "pids": []string{"p1", "p2"}},
+	}
+
+	cases := []struct {
+		lang string
+		text string
+	}{
+		{LangZh, "role[admin]添加permissionIds [p1, p2]"},
+		{LangEn, "Added permissions [p1, p2] to role [admin]"},
+		{"fr", "role[admin]添加permissionIds [p1, p2]"},
+	}
+	for _, tc := range cases {
+		if text := Render(h, tc.lang); text != tc.text {
+			t.Errorf("Render(%s) = %s, want %s", tc.lang, text, tc.text)
+		}
+	}
+
+	h = &OperationHistory{
+		Code:   CodeOrgRoles,
+		Params: Params{"name": "研发", "addRoleIds": []string{"r1"}, "delRoleIds": []string{}},
+	}
+	if text := Render(h, LangZh); text != "部门[研发]添加roleIds [r1]，移除roleIds []" {
+		t.Errorf("Render(org.roles) = %s", text)
+	}
+
+	// 新增的操作类型都要有中英文模板
+	for _, code := range []string{
+		CodeUserMerge, CodeUserUnMerge,
+		CodeOrgCreate, CodeOrgRename, CodeOrgMove, CodeOrgDelete, CodeOrgRoles, CodeOrgAddMembers, CodeOrgDelMembers, CodeOrgPrimary,
+		CodeGroupCreate, CodeGroupUpdate, CodeGroupDelete, CodeGroupRoles, CodeGroupAddMembers, CodeGroupDelMembers,
+		CodeTenantCreate, CodeTenantUpdate, CodeTenantStatus,
+		CodeGrantRequestCreate, CodeGrantRequestApproved, CodeGrantRequestRejected, CodeGrantRequestCanceled, CodeGrantRequestGrantError,
+		CodeWebhookCreate, CodeWebhookUpdate, CodeWebhookSecret, CodeWebhookDelete,
+	} {
+		if templates[code][LangZh] == "" || templates[code][LangEn] == "" {
+			t.Errorf("code[%s] has no template", code)
+		}
+	}
+
+	// 没有模板时使用记录的描述
+	h = &OperationHistory{Code: "legacy", Action: "旧记录"}
+	if text := Render(h, LangEn); text != "旧记录" {
+		t.Errorf("Render(legacy) = %s, want 旧记录", text)
+	}
+
+	if ParseLang("en-US,en;q=0.9") != LangEn || ParseLang("zh-CN") != LangZh || ParseLang("") != LangZh {
+		t.Errorf("ParseLang failed")
+	}
+}
+
+func TestComputeHash(t *testing.T) {
+	h := NewOpHistory("u1", "admin", "")
+	h.Code = CodeUwrAddRoles
+	h.Params = Params{"roleIds": []string{"r1", "r2"}, "cnt": 2}
+	h.Changes = Diff(&testRole{Id: "1"}, &testRole{Id: "1", RoleIds: []string{"r1", "r2"}})
+
+	first := NewOpHistory("u1", "admin", "first")
+	linkTo(nil, first)
+	linkTo(first, h)
+	if first.Seq != 1 || h.Seq != 2 || h.PrevHash != first.Hash {
+		t.Fatalf("linkTo failed, seq %d, %d", first.Seq, h.Seq)
+	}
+
+	// 保存到数据库再读取出来，hash 不变
+	raw, err := bson.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved *OperationHistory
+	if err = bson.Unmarshal(raw, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if ComputeHash(saved) != h.Hash {
+		t.Errorf("hash changed after bson roundtrip")
+	}
+
+	saved.Action = "修改过的描述"
+	if ComputeHash(saved) == h.Hash {
+		t.Errorf("hash not changed after modify")
+	}
+}
+
+func TestCheckpointSign(t *testing.T) {
+	cp := &Checkpoint{Seq: 10, Hash: "abc", T: util.GetCurTime()}
+	cp.Sign = cp.sign("key")
+	if !cp.CheckSign("key") {
+		t.Errorf("CheckSign failed")
+	}
+	if cp.CheckSign("other") {
+		t.Errorf("CheckSign with wrong key passed")
+	}
+	cp.Seq = 9
+	if cp.CheckSign("key") {
+		t.Errorf("CheckSign after modify passed")
+	}
+}
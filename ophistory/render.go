@@ -0,0 +1,345 @@
+package ophistory
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 渲染操作描述支持的语言
+const (
+	LangZh = "zh"
+	LangEn = "en"
+)
+
+// 操作描述模板，{key} 使用 params 中对应的值替换
+var templates = map[string]map[string]string{
+	CodeUserCreate: {
+		LangZh: "新建账户[{account}]",
+		LangEn: "Created account [{account}]",
+	},
+	CodeUserRegister: {
+		LangZh: "自助注册账户[{loginId}]",
+		LangEn: "Self-registered account [{loginId}]",
+	},
+	CodeUserPasswd: {
+		LangZh: "修改自己的登录密码",
+		LangEn: "Changed own password",
+	},
+	CodeUserResetPasswd: {
+		LangZh: "重置用户[{userName}]的登录密码",
+		LangEn: "Reset password of user [{userName}]",
+	},
+	CodeUserForgotPasswd: {
+		LangZh: "通过[{target}]验证码找回密码",
+		LangEn: "Recovered password via [{target}] verification code",
+	},
+	CodeUserBan: {
+		LangZh: "封禁用户，生效时间[{startT}]，到期时间[{endT}]，原因[{reason}]",
+		LangEn: "Banned user from [{startT}] until [{endT}], reason [{reason}]",
+	},
+	CodeUserUnBan: {
+		LangZh: "解除封禁，原因[{reason}]",
+		LangEn: "Lifted ban, reason [{reason}]",
+	},
+	CodeUserBanExpire: {
+		LangZh: "封禁到期[{endT}]，自动解禁",
+		LangEn: "Ban expired at [{endT}] and was lifted",
+	},
+	CodeUserProfile: {
+		LangZh: "修改用户资料[{field}]",
+		LangEn: "Updated profile field [{field}]",
+	},
+	CodeUserLink: {
+		LangZh: "绑定登录方式[{loginType}][{value}]",
+		LangEn: "Linked login method [{loginType}] [{value}]",
+	},
+	CodeUserLinkConflict: {
+		LangZh: "绑定登录方式[{loginType}][{value}]失败，已被其他账户[{ownerId}]使用",
+		LangEn: "Failed to link login method [{loginType}] [{value}], already used by account [{ownerId}]",
+	},
+	CodeUserUnlink: {
+		LangZh: "解绑登录方式[{loginType}][{value}]",
+		LangEn: "Unlinked login method [{loginType}] [{value}]",
+	},
+	CodeUserBindPhone: {
+		LangZh: "微信绑定手机号[{phone}]",
+		LangEn: "Bound phone [{phone}] to WeChat account",
+	},
+	CodeUserBindPhoneBan: {
+		LangZh: "微信绑定手机号[{phone}]，手机账户[{phoneUserId}]已存在，本账户被禁用",
+		LangEn: "Bound phone [{phone}] owned by account [{phoneUserId}], this account was disabled",
+	},
+	CodeUserBindPhoneMove: {
+		LangZh: "绑定手机号[{phone}]，从账户[{wechatUserId}]迁移过来微信登录方式",
+		LangEn: "Bound phone [{phone}], WeChat login moved from account [{wechatUserId}]",
+	},
+	CodeUserMerge: {
+		LangZh: "合并账户[{sourceId}]到[{targetId}]，合并记录[{journalId}]",
+		LangEn: "Merged account [{sourceId}] into [{targetId}], merge journal [{journalId}]",
+	},
+	CodeUserUnMerge: {
+		LangZh: "撤销合并记录[{journalId}]，账户[{sourceId}]的数据从[{targetId}]移回",
+		LangEn: "Undid merge journal [{journalId}], data of account [{sourceId}] moved back from [{targetId}]",
+	},
+	CodeUserRevokeSession: {
+		LangZh: "移除用户的所有登录 token，强制下线",
+		LangEn: "Revoked all login tokens of user",
+	},
+
+	CodeUwrAddRoles: {
+		LangZh: "添加roleIds {roleIds}",
+		LangEn: "Granted roles {roleIds}",
+	},
+	CodeUwrDelRoles: {
+		LangZh: "移除roleIds {roleIds}",
+		LangEn: "Revoked roles {roleIds}",
+	},
+	CodeUwrExpire: {
+		LangZh: "授权到期，自动移除roleIds {roleIds}",
+		LangEn: "Roles {roleIds} expired and were removed",
+	},
+	CodeUwrLdapSync: {
+		LangZh: "ldap 登录同步 roleIds {roleIds}",
+		LangEn: "Synced roles {roleIds} from ldap groups",
+	},
+	CodeUwrAddManageUsers: {
+		LangZh: "添加管理的用户 {ids}",
+		LangEn: "Added managed users {ids}",
+	},
+	CodeUwrDelManageUsers: {
+		LangZh: "取消管理的用户 {ids}",
+		LangEn: "Removed managed users {ids}",
+	},
+	CodeUwrAddManageOrgs: {
+		LangZh: "添加负责的部门 {ids}",
+		LangEn: "Added managed org units {ids}",
+	},
+	CodeUwrDelManageOrgs: {
+		LangZh: "取消负责的部门 {ids}",
+		LangEn: "Removed managed org units {ids}",
+	},
+
+	CodeItemCreate: {
+		LangZh: "新建item[{name}]，[{method}][{path}]",
+		LangEn: "Created item [{name}], [{method}] [{path}]",
+	},
+	CodeItemUpdate: {
+		LangZh: "修改item[{name}]",
+		LangEn: "Updated item [{name}]",
+	},
+	CodeItemDelete: {
+		LangZh: "删除item[{name}]",
+		LangEn: "Deleted item [{name}]",
+	},
+
+	CodePermissionCreate: {
+		LangZh: "新建permission[{name}]",
+		LangEn: "Created permission [{name}]",
+	},
+	CodePermissionAddItems: {
+		LangZh: "permission[{name}]添加itemIds {itemIds}",
+		LangEn: "Added items {itemIds} to permission [{name}]",
+	},
+	CodePermissionDelItems: {
+		LangZh: "permission[{name}]移除itemIds {itemIds}",
+		LangEn: "Removed items {itemIds} from permission [{name}]",
+	},
+	CodePermissionUpdate: {
+		LangZh: "修改permission[{name}]",
+		LangEn: "Updated permission [{name}]",
+	},
+	CodePermissionDelete: {
+		LangZh: "删除permission[{name}]",
+		LangEn: "Deleted permission [{name}]",
+	},
+
+	CodeRoleCreate: {
+		LangZh: "新建role[{name}]",
+		LangEn: "Created role [{name}]",
+	},
+	CodeRoleAddPs: {
+		LangZh: "role[{name}]添加permissionIds {pids}",
+		LangEn: "Added permissions {pids} to role [{name}]",
+	},
+	CodeRoleDelPs: {
+		LangZh: "role[{name}]移除permissionIds {pids}",
+		LangEn: "Removed permissions {pids} from role [{name}]",
+	},
+	CodeRoleUpdate: {
+		LangZh: "修改role[{name}]",
+		LangEn: "Updated role [{name}]",
+	},
+	CodeRoleDelete: {
+		LangZh: "删除role[{name}]",
+		LangEn: "Deleted role [{name}]",
+	},
+	CodeRoleAddChildRole: {
+		LangZh: "role[{name}]添加子role {childRoleIds}",
+		LangEn: "Added child roles {childRoleIds} to role [{name}]",
+	},
+	CodeRoleDelChildRole: {
+		LangZh: "role[{name}]移除子role {childRoleIds}",
+		LangEn: "Removed child roles {childRoleIds} from role [{name}]",
+	},
+	CodeRoleApproval: {
+		LangZh: "设置role[{name}]审批，requireApproval[{requireApproval}]，审批role {approverRoleIds}",
+		LangEn: "Set approval of role [{name}], requireApproval [{requireApproval}], approver roles {approverRoleIds}",
+	},
+
+	CodeOrgCreate: {
+		LangZh: "新建部门[{name}]",
+		LangEn: "Created org unit [{name}]",
+	},
+	CodeOrgRename: {
+		LangZh: "部门改名，[{oldName}] -> [{name}]",
+		LangEn: "Renamed org unit [{oldName}] to [{name}]",
+	},
+	CodeOrgMove: {
+		LangZh: "移动部门[{name}]，上级部门[{oldParentId}] -> [{parentId}]",
+		LangEn: "Moved org unit [{name}] from parent [{oldParentId}] to [{parentId}]",
+	},
+	CodeOrgDelete: {
+		LangZh: "删除部门[{name}]及下级部门 {ids}",
+		LangEn: "Deleted org unit [{name}] and its children {ids}",
+	},
+	CodeOrgRoles: {
+		LangZh: "部门[{name}]添加roleIds {addRoleIds}，移除roleIds {delRoleIds}",
+		LangEn: "Added roles {addRoleIds} to and removed roles {delRoleIds} from org unit [{name}]",
+	},
+	CodeOrgAddMembers: {
+		LangZh: "加入部门[{name}]",
+		LangEn: "Joined org unit [{name}]",
+	},
+	CodeOrgDelMembers: {
+		LangZh: "移出部门[{name}]",
+		LangEn: "Removed from org unit [{name}]",
+	},
+	CodeOrgPrimary: {
+		LangZh: "设置主部门为[{name}]",
+		LangEn: "Set primary org unit to [{name}]",
+	},
+
+	CodeGroupCreate: {
+		LangZh: "新建用户组[{name}]",
+		LangEn: "Created group [{name}]",
+	},
+	CodeGroupUpdate: {
+		LangZh: "修改用户组信息，name[{name}]，description[{description}]",
+		LangEn: "Updated group, name [{name}], description [{description}]",
+	},
+	CodeGroupDelete: {
+		LangZh: "删除用户组[{name}]",
+		LangEn: "Deleted group [{name}]",
+	},
+	CodeGroupRoles: {
+		LangZh: "用户组[{name}]添加roleIds {addRoleIds}，移除roleIds {delRoleIds}",
+		LangEn: "Added roles {addRoleIds} to and removed roles {delRoleIds} from group [{name}]",
+	},
+	CodeGroupAddMembers: {
+		LangZh: "加入用户组[{name}]",
+		LangEn: "Joined group [{name}]",
+	},
+	CodeGroupDelMembers: {
+		LangZh: "移出用户组[{name}]",
+		LangEn: "Removed from group [{name}]",
+	},
+
+	CodeTenantCreate: {
+		LangZh: "新建租户[{code}][{name}]",
+		LangEn: "Created tenant [{code}] [{name}]",
+	},
+	CodeTenantUpdate: {
+		LangZh: "修改租户信息，name[{name}]，hosts{hosts}",
+		LangEn: "Updated tenant, name [{name}], hosts {hosts}",
+	},
+	CodeTenantStatus: {
+		LangZh: "修改租户状态为[{status}]，原因[{reason}]",
+		LangEn: "Changed tenant status to [{status}], reason [{reason}]",
+	},
+
+	CodeGrantRequestCreate: {
+		LangZh: "申请给用户[{userName}]赋予role[{roleName}]",
+		LangEn: "Requested role [{roleName}] for user [{userName}]",
+	},
+	CodeGrantRequestApproved: {
+		LangZh: "通过授权申请[{requestId}]，用户[{userName}]，role[{roleName}]，意见[{comment}]",
+		LangEn: "Approved grant request [{requestId}], user [{userName}], role [{roleName}], comment [{comment}]",
+	},
+	CodeGrantRequestRejected: {
+		LangZh: "拒绝授权申请[{requestId}]，用户[{userName}]，role[{roleName}]，意见[{comment}]",
+		LangEn: "Rejected grant request [{requestId}], user [{userName}], role [{roleName}], comment [{comment}]",
+	},
+	CodeGrantRequestCanceled: {
+		LangZh: "撤回授权申请[{requestId}]，role[{roleName}]",
+		LangEn: "Canceled grant request [{requestId}], role [{roleName}]",
+	},
+	CodeGrantRequestGrantError: {
+		LangZh: "审批通过后赋予role[{roleName}]失败，申请[{requestId}]恢复为待审批，{error}",
+		LangEn: "Failed to grant role [{roleName}] after approval, request [{requestId}] reopened, {error}",
+	},
+
+	CodeWebhookCreate: {
+		LangZh: "新建webhook[{url}]，events{events}",
+		LangEn: "Created webhook [{url}], events {events}",
+	},
+	CodeWebhookUpdate: {
+		LangZh: "修改webhook[{url}]，events{events}，enable[{enable}]",
+		LangEn: "Updated webhook [{url}], events {events}, enable [{enable}]",
+	},
+	CodeWebhookSecret: {
+		LangZh: "重置webhook[{url}]签名密钥",
+		LangEn: "Reset signing secret of webhook [{url}]",
+	},
+	CodeWebhookDelete: {
+		LangZh: "删除webhook[{url}]",
+		LangEn: "Deleted webhook [{url}]",
+	},
+}
+
+var placeholderReg = regexp.MustCompile(`\{(\w+)\}`)
+
+// 按语言渲染操作描述，没有对应模板时返回记录时保存的中文描述
+// 不支持的语言使用中文
+func Render(h *OperationHistory, lang string) string {
+	tpls, ok := templates[h.Code]
+	if !ok {
+		return h.Action
+	}
+	tpl, ok := tpls[lang]
+	if !ok {
+		tpl = tpls[LangZh]
+	}
+
+	return placeholderReg.ReplaceAllStringFunc(tpl, func(m string) string {
+		key := m[1 : len(m)-1]
+		return fmtParam(h.Params[key])
+	})
+}
+
+// 数组显示为 [a, b]，其他直接格式化
+func fmtParam(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []string:
+		return "[" + strings.Join(val, ", ") + "]"
+	case []interface{}:
+		var vs []string
+		for _, s := range val {
+			vs = append(vs, fmtParam(s))
+		}
+		return "[" + strings.Join(vs, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// 从 Accept-Language 之类的字符串中解析语言，默认中文
+func ParseLang(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if strings.HasPrefix(lang, LangEn) {
+		return LangEn
+	}
+	return LangZh
+}
@@ -0,0 +1,555 @@
+package orgapp
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+)
+
+// 组织架构，部门树
+// 每个部门记录所有上级部门的 id，用于查询整个子树
+const CollectionNameOrgUnit = "orgUnit"
+
+var IKOrgUnit = &dbandmq.IndexKey{
+	Collection: CollectionNameOrgUnit,
+	SingleKey:  []string{"tenantId", "parentId", "path", "roleIds"},
+}
+
+type OrgUnit struct {
+	Id       string   `json:"id" bson:"_id"`
+	TenantId string   `json:"tenantId" bson:"tenantId"`
+	Name     string   `json:"name" bson:"name"`
+	ParentId string   `json:"parentId" bson:"parentId"` // 顶级部门为空
+	Path     []string `json:"path" bson:"path"`         // 所有上级部门 id，从顶级部门开始
+
+	// 部门成员自动拥有本部门及所有上级部门的 roles
+	RoleIds []string `json:"roleIds" bson:"roleIds"`
+
+	CreateT *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT *util.CurTime `json:"updateT" bson:"updateT"`
+}
+
+// 部门成员，一个用户可以属于多个部门，其中一个是主部门
+const CollectionNameOrgMember = "orgMember"
+
+// userId + orgId 的唯一索引由 EnsureMemberIndex 建立
+var IKOrgMember = &dbandmq.IndexKey{
+	Collection: CollectionNameOrgMember,
+	SingleKey:  []string{"userId", "orgId"},
+}
+
+type OrgMember struct {
+	Id      string        `json:"id" bson:"_id"`
+	UserId  string        `json:"userId" bson:"userId"`
+	OrgId   string        `json:"orgId" bson:"orgId"`
+	Primary bool          `json:"primary" bson:"primary"`
+	CreateT *util.CurTime `json:"createT" bson:"createT"`
+}
+
+const MaxOrgNameLen = 64
+
+var (
+	ErrOrgNotFound   = errors.New("无指定id的部门")
+	ErrOrgNameExist  = errors.New("同一上级部门下已有同名部门")
+	ErrOrgMoveToSelf = errors.New("不能移动到自身或下级部门下")
+)
+
+func checkOrgName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("部门名称不能为空")
+	}
+	if len([]rune(name)) > MaxOrgNameLen {
+		return "", fmt.Errorf("部门名称长度不能超过%d", MaxOrgNameLen)
+	}
+	return name, nil
+}
+
+func GetOrgUnitById(db *dbandmq.Ds, id string) (*OrgUnit, error) {
+	var ou *OrgUnit
+	err := db.C(CollectionNameOrgUnit).FindId(id).One(&ou)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取部门失败, %s", id, err.Error())
+		return nil, err
+	}
+	return ou, nil
+}
+
+func GetOrgUnitsByIds(db *dbandmq.Ds, ids []string) ([]*OrgUnit, error) {
+	var ous []*OrgUnit
+	err := db.C(CollectionNameOrgUnit).Find(bson.M{"_id": bson.M{"$in": ids}}).All(&ous)
+	if err != nil {
+		Logger.Errorf("", "根据ids读取部门失败, %s", err.Error())
+		return nil, err
+	}
+	return ous, nil
+}
+
+// 读取下级部门，parentId 为空时读取顶级部门
+func GetChildOrgUnits(db *dbandmq.Ds, tenantId, parentId string) ([]*OrgUnit, error) {
+	f := bson.M{
+		"tenantId": tenantId,
+		"parentId": parentId,
+	}
+	var ous []*OrgUnit
+	err := db.C(CollectionNameOrgUnit).Find(f).Sort("name").All(&ous)
+	if err != nil {
+		Logger.Errorf("", "读取部门[%s]的下级部门失败, %s", parentId, err.Error())
+		return nil, err
+	}
+	return ous, nil
+}
+
+// 展开部门子树，返回 ids 和所有下级部门的 id
+func SubtreeIds(db *dbandmq.Ds, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	f := bson.M{
+		"$or": []bson.M{
+			{"_id": bson.M{"$in": ids}},
+			{"path": bson.M{"$in": ids}},
+		},
+	}
+	var ous []*OrgUnit
+	err := db.C(CollectionNameOrgUnit).Find(f).Select(bson.M{"_id": 1}).All(&ous)
+	if err != nil {
+		Logger.Errorf("", "读取部门子树失败, %s", err.Error())
+		return nil, err
+	}
+
+	var ret []string
+	for _, ou := range ous {
+		ret = append(ret, ou.Id)
+	}
+	return ret, nil
+}
+
+func siblingNameExist(db *dbandmq.Ds, tenantId, parentId, name, excludeId string) (bool, error) {
+	f := bson.M{
+		"tenantId": tenantId,
+		"parentId": parentId,
+		"name":     name,
+		"_id":      bson.M{"$ne": excludeId},
+	}
+	cnt, err := db.C(CollectionNameOrgUnit).Find(f).Count()
+	if err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// 新建部门，parentId 为空时为顶级部门
+func CreateOrgUnit(db *dbandmq.Ds, tenantId, name, parentId string, opHis *ophistory.OperationHistory) (*OrgUnit, error) {
+	name, err := checkOrgName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	path := []string{}
+	if parentId != "" {
+		parent, err := GetOrgUnitById(db, parentId)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil || parent.TenantId != tenantId {
+			return nil, ErrOrgNotFound
+		}
+		path = append(append(path, parent.Path...), parent.Id)
+	}
+
+	exist, err := siblingNameExist(db, tenantId, parentId, name, "")
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		return nil, ErrOrgNameExist
+	}
+
+	ou := &OrgUnit{
+		Id:       util.GenerateDataId(),
+		TenantId: tenantId,
+		Name:     name,
+		ParentId: parentId,
+		Path:     path,
+		RoleIds:  []string{},
+		CreateT:  util.GetCurTime(),
+	}
+	ou.UpdateT = ou.CreateT
+
+	err = db.C(CollectionNameOrgUnit).Insert(ou)
+	if err != nil {
+		Logger.Errorf("", "新建部门[%s]失败, %s", name, err.Error())
+		return nil, err
+	}
+	if opHis != nil {
+		err = ophistory.Record(db, opHis, ophistory.CodeOrgCreate, ophistory.TargetOrg, ou.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ou, nil
+}
+
+// 部门改名
+func RenameOrgUnit(db *dbandmq.Ds, ou *OrgUnit, name string, opHis *ophistory.OperationHistory) error {
+	name, err := checkOrgName(name)
+	if err != nil {
+		return err
+	}
+
+	exist, err := siblingNameExist(db, ou.TenantId, ou.ParentId, name, ou.Id)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return ErrOrgNameExist
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"name":    name,
+			"updateT": util.GetCurTime(),
+		},
+	}
+	err = db.C(CollectionNameOrgUnit).UpdateId(ou.Id, update)
+	if err != nil {
+		Logger.Errorf("", "修改部门[%s]名称失败, %s", ou.Id, err.Error())
+		return err
+	}
+	ou.Name = name
+	return ophistory.Record(db, opHis, ophistory.CodeOrgRename, ophistory.TargetOrg, ou.Id)
+}
+
+// 移动部门到新的上级部门下，parentId 为空时移动为顶级部门
+// 同时更新所有下级部门的 path
+func MoveOrgUnit(db *dbandmq.Ds, ou *OrgUnit, parentId string, opHis *ophistory.OperationHistory) error {
+	newPath := []string{}
+	if parentId != "" {
+		parent, err := GetOrgUnitById(db, parentId)
+		if err != nil {
+			return err
+		}
+		if parent == nil || parent.TenantId != ou.TenantId {
+			return ErrOrgNotFound
+		}
+		if parent.Id == ou.Id || containsId(parent.Path, ou.Id) {
+			return ErrOrgMoveToSelf
+		}
+		newPath = append(append(newPath, parent.Path...), parent.Id)
+	}
+
+	exist, err := siblingNameExist(db, ou.TenantId, parentId, ou.Name, ou.Id)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return ErrOrgNameExist
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"parentId": parentId,
+			"path":     newPath,
+			"updateT":  util.GetCurTime(),
+		},
+	}
+	err = db.C(CollectionNameOrgUnit).UpdateId(ou.Id, update)
+	if err != nil {
+		Logger.Errorf("", "移动部门[%s]失败, %s", ou.Id, err.Error())
+		return err
+	}
+	// 下级部门的 path 中，本部门之前的部分替换为新的 path
+	var children []*OrgUnit
+	err = db.C(CollectionNameOrgUnit).Find(bson.M{"path": ou.Id}).All(&children)
+	if err != nil {
+		Logger.Errorf("", "读取部门[%s]的下级部门失败, %s", ou.Id, err.Error())
+		return err
+	}
+	for _, child := range children {
+		idx := indexOf(child.Path, ou.Id)
+		path := append(append([]string{}, newPath...), child.Path[idx:]...)
+		err = db.C(CollectionNameOrgUnit).UpdateId(child.Id, bson.M{"$set": bson.M{"path": path}})
+		if err != nil {
+			Logger.Errorf("", "移动部门[%s]时，更新下级部门[%s]失败, %s", ou.Id, child.Id, err.Error())
+			return err
+		}
+	}
+
+	ou.ParentId = parentId
+	ou.Path = newPath
+	return ophistory.Record(db, opHis, ophistory.CodeOrgMove, ophistory.TargetOrg, ou.Id)
+}
+
+// 删除部门及所有下级部门，同时删除这些部门的成员关系，返回被删除的部门 id
+func DeleteOrgUnit(db *dbandmq.Ds, ou *OrgUnit) ([]string, error) {
+	ids, err := SubtreeIds(db, []string{ou.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.C(CollectionNameOrgUnit).RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		Logger.Errorf("", "删除部门[%s]失败, %s", ou.Id, err.Error())
+		return nil, err
+	}
+
+	// 被删除部门中的主部门成员，需要重新选择主部门
+	var members []*OrgMember
+	err = db.C(CollectionNameOrgMember).Find(bson.M{"orgId": bson.M{"$in": ids}, "primary": true}).All(&members)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.C(CollectionNameOrgMember).RemoveAll(bson.M{"orgId": bson.M{"$in": ids}})
+	if err != nil {
+		Logger.Errorf("", "删除部门[%s]的成员关系失败, %s", ou.Id, err.Error())
+		return nil, err
+	}
+
+	for _, m := range members {
+		_ = ensurePrimary(db, m.UserId)
+	}
+
+	return ids, nil
+}
+
+// 给部门添加或移除 roles
+func UpdateOrgRoles(db *dbandmq.Ds, ou *OrgUnit, roleIds []string, add bool, opHis *ophistory.OperationHistory) error {
+	var op bson.M
+	if add {
+		op = bson.M{"$addToSet": bson.M{"roleIds": bson.M{"$each": roleIds}}}
+	} else {
+		op = bson.M{"$pullAll": bson.M{"roleIds": roleIds}}
+	}
+	op["$set"] = bson.M{"updateT": util.GetCurTime()}
+
+	err := db.C(CollectionNameOrgUnit).UpdateId(ou.Id, op)
+	if err != nil {
+		Logger.Errorf("", "修改部门[%s]的roles失败, %s", ou.Id, err.Error())
+		return err
+	}
+	return ophistory.Record(db, opHis, ophistory.CodeOrgRoles, ophistory.TargetOrg, ou.Id)
+}
+
+// 用户通过所属部门及其上级部门获得的 roleIds
+func GetUserOrgRoleIds(db *dbandmq.Ds, userId string) ([]string, error) {
+	orgIds, err := GetUserOrgIds(db, userId)
+	if err != nil || len(orgIds) == 0 {
+		return nil, err
+	}
+
+	ous, err := GetOrgUnitsByIds(db, orgIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, ou := range ous {
+		ids = append(ids, ou.Id)
+		ids = append(ids, ou.Path...)
+	}
+
+	var all []*OrgUnit
+	err = db.C(CollectionNameOrgUnit).Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"roleIds": 1}).All(&all)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]所属部门的roles失败, %s", userId, err.Error())
+		return nil, err
+	}
+
+	var roleIds []string
+	for _, ou := range all {
+		roleIds = append(roleIds, ou.RoleIds...)
+	}
+	if len(roleIds) > 1 {
+		roleIds = util.UniqueStringArray(roleIds)
+	}
+
+	return roleIds, nil
+}
+
+// 添加部门成员，已经是成员的用户不变
+// primary 为 true 时，本部门成为用户的主部门；用户没有主部门时，本部门自动成为主部门
+func AddOrgMembers(db *dbandmq.Ds, orgId string, userIds []string, primary bool) error {
+	for _, userId := range userIds {
+		f := bson.M{
+			"userId": userId,
+			"orgId":  orgId,
+		}
+		update := bson.M{
+			"$setOnInsert": bson.M{
+				"_id":     util.GenerateDataId(),
+				"primary": false,
+				"createT": util.GetCurTime(),
+			},
+		}
+		// 并发添加同一个成员时唯一索引冲突，已经是成员
+		_, err := db.C(CollectionNameOrgMember).Upsert(f, update)
+		if err != nil && !mgo.IsDup(err) {
+			Logger.Errorf("", "添加用户[%s]到部门[%s]失败, %s", userId, orgId, err.Error())
+			return err
+		}
+
+		if primary {
+			err = SetPrimaryOrg(db, userId, orgId)
+		} else {
+			err = ensurePrimary(db, userId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 移除部门成员
+func RemoveOrgMembers(db *dbandmq.Ds, orgId string, userIds []string) error {
+	f := bson.M{
+		"orgId":  orgId,
+		"userId": bson.M{"$in": userIds},
+	}
+	_, err := db.C(CollectionNameOrgMember).RemoveAll(f)
+	if err != nil {
+		Logger.Errorf("", "从部门[%s]移除成员失败, %s", orgId, err.Error())
+		return err
+	}
+
+	for _, userId := range userIds {
+		_ = ensurePrimary(db, userId)
+	}
+	return nil
+}
+
+// 设置用户的主部门，用户必须已经是该部门的成员
+func SetPrimaryOrg(db *dbandmq.Ds, userId, orgId string) error {
+	err := db.C(CollectionNameOrgMember).Update(bson.M{"userId": userId, "orgId": orgId}, bson.M{"$set": bson.M{"primary": true}})
+	if err == mgo.ErrNotFound {
+		return errors.New("用户不是该部门的成员")
+	}
+	if err != nil {
+		Logger.Errorf("", "设置用户[%s]主部门[%s]失败, %s", userId, orgId, err.Error())
+		return err
+	}
+
+	_, err = db.C(CollectionNameOrgMember).UpdateAll(bson.M{"userId": userId, "orgId": bson.M{"$ne": orgId}}, bson.M{"$set": bson.M{"primary": false}})
+	return err
+}
+
+// 用户有部门但没有主部门时，最早加入的部门成为主部门
+func ensurePrimary(db *dbandmq.Ds, userId string) error {
+	cnt, err := db.C(CollectionNameOrgMember).Find(bson.M{"userId": userId, "primary": true}).Count()
+	if err != nil || cnt > 0 {
+		return err
+	}
+
+	var m *OrgMember
+	err = db.C(CollectionNameOrgMember).Find(bson.M{"userId": userId}).Sort("createT.seconds").One(&m)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.C(CollectionNameOrgMember).UpdateId(m.Id, bson.M{"$set": bson.M{"primary": true}})
+}
+
+// 读取用户的部门关系
+func GetUserOrgMembers(db *dbandmq.Ds, userId string) ([]*OrgMember, error) {
+	var ms []*OrgMember
+	err := db.C(CollectionNameOrgMember).Find(bson.M{"userId": userId}).All(&ms)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]的部门失败, %s", userId, err.Error())
+		return nil, err
+	}
+	return ms, nil
+}
+
+func GetUserOrgIds(db *dbandmq.Ds, userId string) ([]string, error) {
+	ms, err := GetUserOrgMembers(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range ms {
+		ids = append(ids, m.OrgId)
+	}
+	return ids, nil
+}
+
+// 读取部门（包含所有下级部门）的成员 userId
+func GetOrgMemberUserIds(db *dbandmq.Ds, orgIds []string) ([]string, error) {
+	var userIds []string
+	err := db.C(CollectionNameOrgMember).Find(bson.M{"orgId": bson.M{"$in": orgIds}}).Distinct("userId", &userIds)
+	if err != nil {
+		Logger.Errorf("", "读取部门成员失败, %s", err.Error())
+		return nil, err
+	}
+	return userIds, nil
+}
+
+func containsId(ids []string, id string) bool {
+	return indexOf(ids, id) >= 0
+}
+
+func indexOf(ids []string, id string) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// 部门成员的 userId + orgId 唯一索引，并发添加同一个成员时不会重复
+// 升级前建立的非唯一索引会被替换，已有的重复成员关系只保留一条，优先保留主部门
+func EnsureMemberIndex(db *dbandmq.Ds) error {
+	c := db.C(CollectionNameOrgMember)
+	key := []string{"userId", "orgId"}
+
+	indexes, err := c.Indexes()
+	if err != nil {
+		Logger.Errorf("", "读取部门成员索引失败, %s", err.Error())
+		return err
+	}
+	for _, idx := range indexes {
+		if idx.Name == "userId_1_orgId_1" && !idx.Unique {
+			_ = c.DropIndexName(idx.Name)
+		}
+	}
+
+	var dups []struct {
+		Ids []string `bson:"ids"`
+	}
+	pipeline := []bson.M{
+		{"$sort": bson.M{"primary": -1}},
+		{"$group": bson.M{"_id": bson.M{"userId": "$userId", "orgId": "$orgId"}, "ids": bson.M{"$push": "$_id"}, "cnt": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"cnt": bson.M{"$gt": 1}}},
+	}
+	err = c.Pipe(pipeline).AllowDiskUse().All(&dups)
+	if err != nil {
+		Logger.Errorf("", "查找重复的部门成员失败, %s", err.Error())
+		return err
+	}
+	for _, dup := range dups {
+		_, err = c.RemoveAll(bson.M{"_id": bson.M{"$in": dup.Ids[1:]}})
+		if err != nil {
+			Logger.Errorf("", "删除重复的部门成员失败, %s", err.Error())
+			return err
+		}
+	}
+
+	err = c.EnsureIndex(mgo.Index{Key: key, Unique: true})
+	if err != nil {
+		Logger.Errorf("", "建立部门成员唯一索引失败, %s", err.Error())
+		return err
+	}
+	return nil
+}
@@ -1,13 +1,14 @@
 package roleapp
 
 import (
-	"fmt"
 	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/util"
 	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"sync"
 )
 
 // role -> permissions -> items
@@ -16,7 +17,23 @@ import (
 // 程序启动时，初始化出来的
 const DefaultRoleName = "注册用户默认角色"
 
-var DefaultRoleId = ""
+// 程序启动时初始化的数据 id，其他实例修改数据后通过 changebus 通知重新加载
+// 各实例的处理请求和接收通知在不同的 goroutine，需要加锁
+var sysIdsMu sync.RWMutex
+
+var defaultRoleId = ""
+
+func DefaultRoleId() string {
+	sysIdsMu.RLock()
+	defer sysIdsMu.RUnlock()
+	return defaultRoleId
+}
+
+func SetDefaultRoleId(id string) {
+	sysIdsMu.Lock()
+	defer sysIdsMu.Unlock()
+	defaultRoleId = id
+}
 
 const (
 	AdminRoleName       = "admin"
@@ -32,9 +49,9 @@ const (
 )
 
 var (
-	CanNotModifyItemIds       []string
-	CanNotModifyPermissionIds []string
-	CanNotMidifyRoleIds       []string
+	canNotModifyItemIds       []string
+	canNotModifyPermissionIds []string
+	canNotModifyRoleIds       []string
 )
 
 var AdminItemNames = []string{
@@ -53,18 +70,42 @@ const (
 	DataFromUser   = "USER"   // 用户传递的
 )
 
+// item / permission / role 的 name 在租户内唯一
+// 系统内置数据保存在默认租户中，所有租户都可以读取和使用，但只有默认租户可以修改
+func VisibleToTenant(dataTenantId, dataFrom, tenantId string) bool {
+	dataTenantId = tenantapp.NormalizeId(dataTenantId)
+	if dataTenantId == tenantId {
+		return true
+	}
+	return dataTenantId == tenantapp.DefaultTenantId && dataFrom == DataFromSystem
+}
+
+// 租户可以读取的数据的查询条件
+func TenantVisibleFilter(tenantId string) bson.M {
+	if tenantapp.IsDefault(tenantId) {
+		return bson.M{"tenantId": tenantapp.DefaultTenantId}
+	}
+	return bson.M{
+		"$or": []bson.M{
+			{"tenantId": tenantId},
+			{"tenantId": tenantapp.DefaultTenantId, "dataFrom": DataFromSystem},
+		},
+	}
+}
+
 // item
+// item / permission / role 的 name 在租户内唯一，联合索引在启动时建立
 const CollectionNameItem = "item"
 
 var IKItem = &dbandmq.IndexKey{
 	Collection: CollectionNameItem,
 	SingleKey:  []string{"name", "method", "path", "deleted"},
-	UniqueKey:  []string{"name"},
 }
 
 type Item struct {
-	Id   string `json:"id" bson:"_id"`
-	Name string `json:"name" bson:"name"`
+	Id       string `json:"id" bson:"_id"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
+	Name     string `json:"name" bson:"name"`
 	// api
 	Method   string `json:"method" bson:"method"`
 	Path     string `json:"path" bson:"path"`
@@ -78,8 +119,6 @@ type Item struct {
 
 	DataFrom string `json:"-" bson:"dataFrom"`
 
-	History []*ophistory.OperationHistory `json:"history" bson:"history"`
-
 	CreateT *util.CurTime `json:"-" bson:"createT"`
 	UpdateT *util.CurTime `json:"-" bson:"updateT"`
 }
@@ -90,12 +129,12 @@ const CollectionNamePermission = "permission"
 var IKPermission = &dbandmq.IndexKey{
 	Collection: CollectionNamePermission,
 	SingleKey:  []string{"name", "itemIds", "deleted"},
-	UniqueKey:  []string{"name"},
 }
 
 type Permission struct {
-	Id   string `json:"id" bson:"_id"`
-	Name string `json:"name" bson:"name"`
+	Id       string `json:"id" bson:"_id"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
+	Name     string `json:"name" bson:"name"`
 
 	ItemIds []string `json:"-" bson:"itemIds"`
 	Items   []*Item  `json:"items" bson:"-"`
@@ -107,8 +146,6 @@ type Permission struct {
 	Deleted  bool   `json:"deleted" bson:"deleted"`
 	DataFrom string `json:"-" bson:"dataFrom"`
 
-	History []*ophistory.OperationHistory `json:"history" bson:"history"`
-
 	CreateT *util.CurTime `json:"-" bson:"createT"`
 	UpdateT *util.CurTime `json:"-" bson:"updateT"`
 }
@@ -119,12 +156,12 @@ const CollectionNameRole = "role"
 var IKRole = &dbandmq.IndexKey{
 	Collection: CollectionNameRole,
 	SingleKey:  []string{"name", "permissionIds", "deleted"},
-	UniqueKey:  []string{"name"},
 }
 
 type Role struct {
-	Id   string `json:"id" bson:"_id"`
-	Name string `json:"name" bson:"name"`
+	Id       string `json:"id" bson:"_id"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
+	Name     string `json:"name" bson:"name"`
 
 	PermissionIds []string      `json:"-" bson:"permissionIds"`
 	Permissions   []*Permission `json:"permissions" bson:"-"`
@@ -136,11 +173,14 @@ type Role struct {
 	// 包含的下属 role 列表，当前 role 所属用户可以给自己的下属用户赋予的权限
 	ChildrenRoles []*ChildRole `json:"childrenRole" bson:"childrenRole"`
 
+	// 需要审批的 role，给用户赋予时生成待审批的授权申请，由拥有 ApproverRoleIds 的用户审批
+	// ApproverRoleIds 为空时只有管理员可以审批
+	RequireApproval bool     `json:"requireApproval" bson:"requireApproval"`
+	ApproverRoleIds []string `json:"approverRoleIds" bson:"approverRoleIds"`
+
 	Deleted  bool   `json:"deleted" bson:"deleted"`
 	DataFrom string `json:"-" bson:"dataFrom"`
 
-	History []*ophistory.OperationHistory `json:"history" bson:"history"`
-
 	CreateT *util.CurTime `json:"-" bson:"createT"`
 	UpdateT *util.CurTime `json:"-" bson:"updateT"`
 }
@@ -163,9 +203,10 @@ func GetItemById(db *dbandmq.Ds, id string) (*Item, error) {
 }
 
 // 根据 name 读取 item
-func GetItemByName(db *dbandmq.Ds, name string) (*Item, error) {
+func GetItemByName(db *dbandmq.Ds, tenantId, name string) (*Item, error) {
 	f := bson.M{
-		"name": name,
+		"tenantId": tenantId,
+		"name":     name,
 	}
 
 	var item *Item
@@ -192,18 +233,12 @@ func UpdateItem(db *dbandmq.Ds, item *Item) error {
 // 删除指定 id 的 item
 // 不需要单独的去删除包含了自己的 permission 中的数据
 // permission 中会标记这个数据，并且不做显示
-func DeleteItemById(db *dbandmq.Ds, userId, userName, id string) error {
-	opAction := fmt.Sprintf("删除 item, itemId[%s]", id)
-	opHis := ophistory.NewOpHistory(userId, userName, opAction)
-
+func DeleteItemById(db *dbandmq.Ds, id string, opHis *ophistory.OperationHistory) error {
 	update := bson.M{
 		"$set": bson.M{
 			"deleted": true,
 			"updateT": util.GetCurTime(),
 		},
-		"$push": bson.M{
-			"history": opHis,
-		},
 	}
 
 	err := db.C(CollectionNameItem).UpdateId(id, update)
@@ -211,13 +246,14 @@ func DeleteItemById(db *dbandmq.Ds, userId, userName, id string) error {
 		Logger.Errorf("", "删除item[%s]失败,%s", id, err.Error())
 		return err
 	}
-	return nil
+	return ophistory.Record(db, opHis, ophistory.CodeItemDelete, ophistory.TargetItem, id)
 }
 
 // 根据 name 读取 permission
-func GetPermissionByName(db *dbandmq.Ds, name string, more bool) (*Permission, error) {
+func GetPermissionByName(db *dbandmq.Ds, tenantId, name string, more bool) (*Permission, error) {
 	f := bson.M{
-		"name": name,
+		"tenantId": tenantId,
+		"name":     name,
 	}
 
 	var p *Permission
@@ -273,9 +309,10 @@ func UpdatePermission(db *dbandmq.Ds, p *Permission) error {
 }
 
 // 根据 name 读取 role
-func GetRoleByName(db *dbandmq.Ds, name string, more bool) (*Role, error) {
+func GetRoleByName(db *dbandmq.Ds, tenantId, name string, more bool) (*Role, error) {
 	f := bson.M{
-		"name": name,
+		"tenantId": tenantId,
+		"name":     name,
 	}
 
 	var role *Role
@@ -5,6 +5,7 @@ import (
 	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/tenantapp"
 	"gopkg.in/mgo.v2/bson"
 	"strings"
 	"sync"
@@ -199,7 +200,7 @@ func InsuranceAdminRole(db *dbandmq.Ds) (*Role, error) {
 }
 
 func addAdminItem(db *dbandmq.Ds, itemName string) (*Item, error) {
-	item, err := GetItemByName(db, itemName)
+	item, err := GetItemByName(db, tenantapp.DefaultTenantId, itemName)
 	if err != nil {
 		return nil, err
 	}
@@ -209,6 +210,7 @@ func addAdminItem(db *dbandmq.Ds, itemName string) (*Item, error) {
 		method := tmp[1]
 		item = &Item{
 			Id:       util.GenerateDataId(),
+			TenantId: tenantapp.DefaultTenantId,
 			Name:     itemName,
 			Method:   method,
 			Path:     "*",
@@ -217,7 +219,6 @@ func addAdminItem(db *dbandmq.Ds, itemName string) (*Item, error) {
 			Button:   "*",
 			DataFrom: DataFromSystem,
 			Deleted:  false,
-			History:  nil,
 			CreateT:  util.GetCurTime(),
 		}
 		item.UpdateT = item.CreateT
@@ -237,13 +238,14 @@ func addAdminItem(db *dbandmq.Ds, itemName string) (*Item, error) {
 }
 
 func addAdminPermission(db *dbandmq.Ds, itemIds []string) (*Permission, error) {
-	permission, err := GetPermissionByName(db, AdminPermissionName, false)
+	permission, err := GetPermissionByName(db, tenantapp.DefaultTenantId, AdminPermissionName, false)
 	if err != nil {
 		return nil, err
 	}
 	if permission == nil {
 		permission = &Permission{
 			Id:       util.GenerateDataId(),
+			TenantId: tenantapp.DefaultTenantId,
 			Name:     AdminPermissionName,
 			ItemIds:  itemIds,
 			Menu:     "*",
@@ -268,7 +270,7 @@ func addAdminPermission(db *dbandmq.Ds, itemIds []string) (*Permission, error) {
 }
 
 func addAdminRole(db *dbandmq.Ds, pids []string) (*Role, error) {
-	role, err := GetRoleByName(db, AdminRoleName, false)
+	role, err := GetRoleByName(db, tenantapp.DefaultTenantId, AdminRoleName, false)
 	if err != nil {
 		return nil, err
 	}
@@ -276,6 +278,7 @@ func addAdminRole(db *dbandmq.Ds, pids []string) (*Role, error) {
 	if role == nil {
 		role = &Role{
 			Id:            util.GenerateDataId(),
+			TenantId:      tenantapp.DefaultTenantId,
 			Name:          AdminRoleName,
 			PermissionIds: pids,
 			Menu:          "*",
@@ -302,7 +305,7 @@ func addAdminRole(db *dbandmq.Ds, pids []string) (*Role, error) {
 // 生成一个默认的普通role
 // 这里只需要占位，后面通过接口和页面去配置注册用户的相关权限
 func InsuranceDefaultRole(db *dbandmq.Ds) (*Role, error) {
-	role, err := GetRoleByName(db, DefaultRoleName, false)
+	role, err := GetRoleByName(db, tenantapp.DefaultTenantId, DefaultRoleName, false)
 	if err != nil {
 		return nil, err
 	}
@@ -310,6 +313,7 @@ func InsuranceDefaultRole(db *dbandmq.Ds) (*Role, error) {
 	if role == nil {
 		role = &Role{
 			Id:       util.GenerateDataId(),
+			TenantId: tenantapp.DefaultTenantId,
 			Name:     DefaultRoleName,
 			DataFrom: DataFromSystem,
 			Deleted:  false,
@@ -323,15 +327,15 @@ func InsuranceDefaultRole(db *dbandmq.Ds) (*Role, error) {
 	}
 
 	// 把 role.id 赋值给默认值
-	DefaultRoleId = role.Id
+	SetDefaultRoleId(role.Id)
 
 	Logger.Infof("", "启动roleapp，初始化普通用户role成功，roleId[%s]", role.Id)
 	return role, nil
 }
 
-// 初始化不能修改的数据id
+// 初始化不能修改的数据id，重复调用时使用数据库中最新的数据
 func LoadCanNotModifyIds(db *dbandmq.Ds) error {
-	role, err := GetRoleByName(db, AdminRoleName, true)
+	role, err := GetRoleByName(db, tenantapp.DefaultTenantId, AdminRoleName, true)
 	if err != nil {
 		return err
 	}
@@ -342,25 +346,49 @@ func LoadCanNotModifyIds(db *dbandmq.Ds) error {
 		return e
 	}
 
-	CanNotMidifyRoleIds = append(CanNotMidifyRoleIds, role.Id)
-	CanNotModifyPermissionIds = append(CanNotModifyPermissionIds, role.PermissionIds...)
+	roleIds := []string{role.Id}
+	permissionIds := append([]string{}, role.PermissionIds...)
+	var itemIds []string
 	for _, p := range role.Permissions {
-		CanNotModifyItemIds = append(CanNotModifyItemIds, p.ItemIds...)
+		itemIds = append(itemIds, p.ItemIds...)
 	}
 
-	Logger.Infof("", "启动roleapp，设置不可修改的roleIds %s, permissionIds %s, itemIds %s", CanNotMidifyRoleIds, CanNotModifyPermissionIds, CanNotModifyItemIds)
+	sysIdsMu.Lock()
+	canNotModifyRoleIds = roleIds
+	canNotModifyPermissionIds = permissionIds
+	canNotModifyItemIds = itemIds
+	sysIdsMu.Unlock()
+
+	Logger.Infof("", "启动roleapp，设置不可修改的roleIds %s, permissionIds %s, itemIds %s", roleIds, permissionIds, itemIds)
 	return nil
 }
 
+// 重新加载默认角色 id 和不可修改的数据 id
+// 其他实例修改了 role / permission / item 后调用
+func ReloadSystemIds(db *dbandmq.Ds) error {
+	role, err := GetRoleByName(db, tenantapp.DefaultTenantId, DefaultRoleName, false)
+	if err != nil {
+		return err
+	}
+	if role != nil {
+		SetDefaultRoleId(role.Id)
+	}
+
+	return LoadCanNotModifyIds(db)
+}
+
 // 检查修改的数据是否是不允许修改的
 func CanNotModifyThis(idType, id string) bool {
+	sysIdsMu.RLock()
+	defer sysIdsMu.RUnlock()
+
 	switch idType {
 	case IdTypeItem:
-		return inArray(id, CanNotModifyItemIds)
+		return inArray(id, canNotModifyItemIds)
 	case IdTypePermission:
-		return inArray(id, CanNotModifyPermissionIds)
+		return inArray(id, canNotModifyPermissionIds)
 	case IdTypeRole:
-		return inArray(id, CanNotMidifyRoleIds)
+		return inArray(id, canNotModifyRoleIds)
 	default:
 		return false
 	}
@@ -377,9 +405,10 @@ func inArray(id string, targets []string) bool {
 }
 
 func RemoveDefaultRole(roles []*Role) []*Role {
+	defaultId := DefaultRoleId()
 	var targets []*Role
 	for _, role := range roles {
-		if role.Id != DefaultRoleId {
+		if role.Id != defaultId {
 			targets = append(targets, role)
 		}
 	}
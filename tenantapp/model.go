@@ -0,0 +1,302 @@
+package tenantapp
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
+)
+
+// 多租户，同一套部署服务多个客户
+// 用户、登录方式、角色、权限、item、用户角色关联都带有 tenantId，唯一性限定在租户内
+const CollectionNameTenant = "tenant"
+
+var IKTenant = &dbandmq.IndexKey{
+	Collection: CollectionNameTenant,
+	SingleKey:  []string{"hosts", "status"},
+	UniqueKey:  []string{"code"},
+}
+
+// 默认租户，升级前的数据、admin 账户和系统内置的角色数据都属于默认租户
+// 默认租户的 admin 是超级管理员，负责维护其他租户
+const (
+	DefaultTenantId   = "default"
+	DefaultTenantCode = "default"
+	DefaultTenantName = "默认租户"
+)
+
+const (
+	TenantStatusActive    = "ACTIVE"
+	TenantStatusSuspended = "SUSPENDED" // 暂停后租户下的用户无法登录，已有 token 验证失败
+)
+
+var ErrTenantNotFound = errors.New("租户不存在")
+var ErrTenantSuspended = errors.New("租户已暂停")
+
+var tenantCodePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+type Tenant struct {
+	Id     string   `json:"id" bson:"_id"`
+	Code   string   `json:"code" bson:"code"` // 请求头 X-Tenant 中传递的值
+	Name   string   `json:"name" bson:"name"`
+	Hosts  []string `json:"hosts" bson:"hosts"` // 绑定的域名，按请求的 host 识别租户
+	Status string   `json:"status" bson:"status"`
+
+	SuspendReason string `json:"suspendReason" bson:"suspendReason"`
+
+	CreateT *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT *util.CurTime `json:"updateT" bson:"updateT"`
+}
+
+func (t *Tenant) IsActive() bool {
+	return t.Status == TenantStatusActive
+}
+
+// 升级前的数据没有 tenantId，视为默认租户
+func NormalizeId(tenantId string) string {
+	if tenantId == "" {
+		return DefaultTenantId
+	}
+	return tenantId
+}
+
+func IsDefault(tenantId string) bool {
+	return NormalizeId(tenantId) == DefaultTenantId
+}
+
+func CheckTenantCode(code string) error {
+	if !tenantCodePattern.MatchString(code) {
+		return errors.New("租户 code 只能包含小写字母、数字、下划线、中划线，以字母开头，长度2-32位")
+	}
+	return nil
+}
+
+// host 可能包含端口，统一去掉端口并转为小写
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if idx := strings.LastIndex(host, ":"); idx > 0 && !strings.HasSuffix(host, "]") {
+		host = host[:idx]
+	}
+	return host
+}
+
+func GetTenantById(db *dbandmq.Ds, id string) (*Tenant, error) {
+	var t *Tenant
+	err := db.C(CollectionNameTenant).FindId(NormalizeId(id)).One(&t)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取租户信息失败, %s", id, err.Error())
+		return nil, err
+	}
+	return t, nil
+}
+
+func GetTenantByCode(db *dbandmq.Ds, code string) (*Tenant, error) {
+	var t *Tenant
+	err := db.C(CollectionNameTenant).Find(bson.M{"code": code}).One(&t)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据code[%s]读取租户信息失败, %s", code, err.Error())
+		return nil, err
+	}
+	return t, nil
+}
+
+func GetTenantByHost(db *dbandmq.Ds, host string) (*Tenant, error) {
+	host = NormalizeHost(host)
+	if host == "" {
+		return nil, nil
+	}
+
+	var t *Tenant
+	err := db.C(CollectionNameTenant).Find(bson.M{"hosts": host}).One(&t)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据host[%s]读取租户信息失败, %s", host, err.Error())
+		return nil, err
+	}
+	return t, nil
+}
+
+// 检查 host 是否已经绑定到其他租户
+func checkHosts(db *dbandmq.Ds, tenantId string, hosts []string) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	f := bson.M{
+		"_id":   bson.M{"$ne": tenantId},
+		"hosts": bson.M{"$in": hosts},
+	}
+	var t *Tenant
+	err := db.C(CollectionNameTenant).Find(f).One(&t)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "检查租户 hosts 失败, %s", err.Error())
+		return err
+	}
+	if t != nil {
+		return fmt.Errorf("host 已绑定到租户[%s]", t.Code)
+	}
+	return nil
+}
+
+func normalizeHosts(hosts []string) []string {
+	var ret []string
+	for _, h := range hosts {
+		h = NormalizeHost(h)
+		if h != "" {
+			ret = append(ret, h)
+		}
+	}
+	if len(ret) > 1 {
+		ret = util.UniqueStringArray(ret)
+	}
+	return ret
+}
+
+func CreateTenant(db *dbandmq.Ds, t *Tenant) error {
+	if err := CheckTenantCode(t.Code); err != nil {
+		return err
+	}
+	t.Hosts = normalizeHosts(t.Hosts)
+	if err := checkHosts(db, t.Id, t.Hosts); err != nil {
+		return err
+	}
+
+	err := db.C(CollectionNameTenant).Insert(t)
+	if err != nil {
+		if mgo.IsDup(err) {
+			return fmt.Errorf("租户 code[%s]已存在", t.Code)
+		}
+		Logger.Errorf("", "新建租户[%s]失败, %s", t.Code, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 删除新建的租户，用于新建租户后创建管理员等步骤失败时回滚
+func RemoveTenant(db *dbandmq.Ds, id string) error {
+	err := db.C(CollectionNameTenant).RemoveId(id)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "回滚删除租户[%s]失败, %s", id, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 修改租户名字和绑定的域名，code 不可修改
+func UpdateTenantInfo(db *dbandmq.Ds, id, name string, hosts []string, opHis *ophistory.OperationHistory) error {
+	hosts = normalizeHosts(hosts)
+	if err := checkHosts(db, id, hosts); err != nil {
+		return err
+	}
+	if hosts == nil {
+		hosts = []string{}
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"name":    name,
+			"hosts":   hosts,
+			"updateT": util.GetCurTime(),
+		},
+	}
+	err := db.C(CollectionNameTenant).UpdateId(id, update)
+	if err != nil {
+		Logger.Errorf("", "修改租户[%s]信息失败, %s", id, err.Error())
+		return err
+	}
+	return ophistory.Record(db, opHis, ophistory.CodeTenantUpdate, ophistory.TargetTenant, id)
+}
+
+// 暂停或恢复租户
+func UpdateTenantStatus(db *dbandmq.Ds, id, status, reason string, opHis *ophistory.OperationHistory) error {
+	if IsDefault(id) {
+		return errors.New("默认租户不能暂停")
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"status":        status,
+			"suspendReason": reason,
+			"updateT":       util.GetCurTime(),
+		},
+	}
+	err := db.C(CollectionNameTenant).UpdateId(id, update)
+	if err != nil {
+		Logger.Errorf("", "修改租户[%s]状态为[%s]失败, %s", id, status, err.Error())
+		return err
+	}
+	return ophistory.Record(db, opHis, ophistory.CodeTenantStatus, ophistory.TargetTenant, id)
+}
+
+// 程序启动时确保默认租户存在
+func InsureDefaultTenant(db *dbandmq.Ds) (*Tenant, error) {
+	t, err := GetTenantById(db, DefaultTenantId)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		return t, nil
+	}
+
+	t = &Tenant{
+		Id:      DefaultTenantId,
+		Code:    DefaultTenantCode,
+		Name:    DefaultTenantName,
+		Hosts:   []string{},
+		Status:  TenantStatusActive,
+		CreateT: util.GetCurTime(),
+	}
+	t.UpdateT = t.CreateT
+	err = db.C(CollectionNameTenant).Insert(t)
+	if err != nil && !mgo.IsDup(err) {
+		Logger.Errorf("", "初始化默认租户失败, %s", err.Error())
+		return nil, err
+	}
+
+	Logger.Info("", "初始化默认租户成功")
+	return t, nil
+}
+
+// 升级前的数据没有 tenantId 字段，全部归属到默认租户
+func MigrateTenantId(db *dbandmq.Ds, collections []string) error {
+	f := bson.M{
+		"tenantId": bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"tenantId": DefaultTenantId,
+		},
+	}
+	for _, collection := range collections {
+		info, err := db.C(collection).UpdateAll(f, update)
+		if err != nil {
+			Logger.Errorf("", "给[%s]的历史数据设置默认租户失败, %s", collection, err.Error())
+			return err
+		}
+		if info.Updated > 0 {
+			Logger.Infof("", "给[%s]的[%d]条历史数据设置了默认租户", collection, info.Updated)
+		}
+	}
+	return nil
+}
+
+// 在租户内唯一的字段，建立 tenantId + key 的联合唯一索引
+// 升级前建立的 key 单独唯一索引会被删除
+func EnsureUniqueIndex(db *dbandmq.Ds, collection, key string) error {
+	_ = db.C(collection).DropIndex(key)
+
+	idx := mgo.Index{
+		Key:    []string{"tenantId", key},
+		Unique: true,
+	}
+	err := db.C(collection).EnsureIndex(idx)
+	if err != nil {
+		Logger.Errorf("", "建立[%s]租户内唯一索引[%s]失败, %s", collection, key, err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package userandrole
+
+import (
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// 有到期时间的授权
+type RoleExpire struct {
+	RoleId  string `json:"roleId" bson:"roleId"`
+	ExpireT int64  `json:"expireT" bson:"expireT"` // unix 秒
+}
+
+// 后台检查授权到期的间隔
+var RoleExpiryCheckInterval = time.Minute
+
+// 给已赋予的 role 设置到期时间，expireT 为 0 表示长期有效
+// 已经长期有效的 role 不会因为新的限时授权变成限时
+func (uwr *UserWithRole) SetRoleExpire(roleId string, expireT int64, held bool) {
+	idx := -1
+	for i, re := range uwr.RoleExpires {
+		if re.RoleId == roleId {
+			idx = i
+			break
+		}
+	}
+
+	if expireT == 0 {
+		if idx >= 0 {
+			uwr.RoleExpires = append(uwr.RoleExpires[:idx], uwr.RoleExpires[idx+1:]...)
+		}
+		return
+	}
+
+	if idx >= 0 {
+		uwr.RoleExpires[idx].ExpireT = expireT
+		return
+	}
+	if held {
+		return
+	}
+	uwr.RoleExpires = append(uwr.RoleExpires, &RoleExpire{RoleId: roleId, ExpireT: expireT})
+}
+
+// 移除 role 时同步移除到期时间
+func (uwr *UserWithRole) RemoveRoleExpires(roleIds []string) {
+	rm := make(map[string]bool)
+	for _, roleId := range roleIds {
+		rm[roleId] = true
+	}
+
+	var remain []*RoleExpire
+	for _, re := range uwr.RoleExpires {
+		if !rm[re.RoleId] {
+			remain = append(remain, re)
+		}
+	}
+	uwr.RoleExpires = remain
+}
+
+// 指定时间已到期的 roleIds
+func (uwr *UserWithRole) ExpiredRoleIdsAt(now int64) []string {
+	var roleIds []string
+	for _, re := range uwr.RoleExpires {
+		if re.ExpireT <= now {
+			roleIds = append(roleIds, re.RoleId)
+		}
+	}
+	return roleIds
+}
+
+// 移除所有已到期的授权，返回处理的用户数量
+// 使用带条件的更新，多个实例同时运行时同一条记录只会被处理一次
+func RemoveExpiredRoles(db *dbandmq.Ds) (int, error) {
+	now := time.Now().Unix()
+	f := bson.M{
+		"roleExpires.expireT": bson.M{"$lte": now},
+	}
+
+	var uwrs []*UserWithRole
+	err := db.C(CollectionNameUserWithRole).Find(f).All(&uwrs)
+	if err != nil {
+		Logger.Errorf("", "读取授权到期的用户失败, %s", err.Error())
+		return 0, err
+	}
+
+	cnt := 0
+	var recordErr error
+	for _, uwr := range uwrs {
+		expired := uwr.ExpiredRoleIdsAt(now)
+		if len(expired) == 0 {
+			continue
+		}
+
+		opHis := ophistory.NewOpHistory("", "system", "")
+		opHis.TenantId = tenantapp.NormalizeId(uwr.TenantId)
+		before := ophistory.Snapshot(uwr)
+
+		cf := bson.M{
+			"_id":         uwr.Id,
+			"roleExpires": uwr.RoleExpires,
+		}
+		uwr.RemoveRoleExpires(expired)
+		update := bson.M{
+			"$pullAll": bson.M{
+				"roleIds": expired,
+			},
+			"$set": bson.M{
+				"roleExpires": uwr.RoleExpires,
+				"updateT":     util.GetCurTime(),
+			},
+		}
+		err = db.C(CollectionNameUserWithRole).Update(cf, update)
+		if err != nil {
+			// 被其他实例处理或者被管理员修改了
+			Logger.Debugf("", "自动移除用户[%s]到期授权未更新, %s", uwr.UserId, err.Error())
+			continue
+		}
+		cnt++
+		uwr.RoleIds = removeRoleIds(uwr.RoleIds, expired)
+		opHis.SetParams(ophistory.Params{"roleIds": expired}).SetDiff(before, uwr)
+		err = ophistory.Record(db, opHis, ophistory.CodeUwrExpire, ophistory.TargetUser, uwr.UserId)
+		if err != nil && recordErr == nil {
+			recordErr = err
+		}
+		Logger.Infof("", "用户[%s]授权到期，移除 roleIds %s", uwr.UserId, expired)
+	}
+
+	// 审计日志写入失败时继续处理其他用户，返回第一个错误
+	return cnt, recordErr
+}
+
+// 后台定时移除到期的授权，程序启动时调用
+func StartRoleExpiryJob(ds *dbandmq.Ds) {
+	go func() {
+		ticker := time.NewTicker(RoleExpiryCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			db := ds.CopyDs()
+			_, _ = RemoveExpiredRoles(db)
+			db.Close()
+		}
+	}()
+}
@@ -0,0 +1,97 @@
+package userandrole
+
+import (
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"sort"
+	"strings"
+)
+
+// 根据 ldap 分组映射出来的 role name 列表，同步用户的 ldap roles
+// 不存在或已删除的 role name 会被忽略
+// 先在用户所属租户内查找，找不到时使用默认租户中的系统内置 role
+func SyncLdapRoles(db *dbandmq.Ds, tenantId, userId, userName string, roleNames []string) (*UserWithRole, error) {
+	var roleIds []string
+	for _, name := range roleNames {
+		role, err := roleapp.GetRoleByName(db, tenantId, name, false)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil && !tenantapp.IsDefault(tenantId) {
+			role, err = roleapp.GetRoleByName(db, tenantapp.DefaultTenantId, name, false)
+			if err != nil {
+				return nil, err
+			}
+			if role != nil && role.DataFrom != roleapp.DataFromSystem {
+				role = nil
+			}
+		}
+		if role == nil || role.Deleted {
+			Logger.Warnf("", "同步ldap用户[%s]的roles时，role[%s]不存在或已删除，忽略", userId, name)
+			continue
+		}
+		roleIds = append(roleIds, role.Id)
+	}
+	if len(roleIds) > 1 {
+		roleIds = util.UniqueStringArray(roleIds)
+	}
+
+	uwr, err := GetUserWithRoleByUserId(db, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	before := ophistory.Snapshot(uwr)
+	update := true
+	if uwr == nil {
+		if len(roleIds) == 0 {
+			return nil, nil
+		}
+		update = false
+		uwr = &UserWithRole{
+			Id:       util.GenerateDataId(),
+			TenantId: tenantId,
+			UserId:   userId,
+			UserName: userName,
+			CreateT:  util.GetCurTime(),
+		}
+	}
+
+	if sameIds(uwr.LdapRoleIds, roleIds) {
+		return uwr, nil
+	}
+
+	opHis := ophistory.NewOpHistory(userId, userName, "")
+	opHis.TenantId = tenantapp.NormalizeId(tenantId)
+	uwr.LdapRoleIds = roleIds
+	uwr.UpdateT = util.GetCurTime()
+
+	err = SaveUserWithRole(db, uwr, update)
+	if err != nil {
+		Logger.Errorf("", "同步ldap用户[%s]的roles失败, %s", userId, err.Error())
+		return nil, err
+	}
+
+	opHis.SetParams(ophistory.Params{"roleIds": roleIds}).SetDiff(before, uwr)
+	err = ophistory.Record(db, opHis, ophistory.CodeUwrLdapSync, ophistory.TargetUser, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return uwr, nil
+}
+
+func sameIds(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	return strings.Join(x, ",") == strings.Join(y, ",")
+}
@@ -0,0 +1,471 @@
+package userandrole
+
+import (
+	"errors"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"time"
+)
+
+// 账户合并记录，同时也是撤销合并时使用的日志
+// 合并是把 source 账户的数据迁移到 target 账户上，source 账户被禁用
+const CollectionNameMergeJournal = "mergeJournal"
+
+var IKMergeJournal = &dbandmq.IndexKey{
+	Collection: CollectionNameMergeJournal,
+	SingleKey:  []string{"sourceId", "targetId", "status"},
+}
+
+const (
+	MergeStatusMerging = "MERGING" // 正在合并，中途失败时停留在这个状态，可以撤销
+	MergeStatusMerged  = "MERGED"
+	MergeStatusUndone  = "UNDONE"
+)
+
+var (
+	ErrMergeSameUser      = errors.New("不能合并同一个账户")
+	ErrMergeUserNotFound  = errors.New("账户不存在")
+	ErrMergeAdmin         = errors.New("不能合并系统管理员账户")
+	ErrMergeAlreadyMerged = errors.New("账户已被合并到其他账户")
+	ErrMergeCanNotUndo    = errors.New("当前状态不能撤销合并")
+	ErrMergeCrossTenant   = errors.New("不能合并不同租户的账户")
+)
+
+type MergeJournal struct {
+	Id       string `json:"id" bson:"_id"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
+	SourceId string `json:"sourceId" bson:"sourceId"`
+	TargetId string `json:"targetId" bson:"targetId"`
+	Status   string `json:"status" bson:"status"`
+
+	// 迁移到 target 的登录方式
+	MovedAuths []*userapp.LinkedAuth `json:"movedAuths" bson:"movedAuths"`
+	// target 已有同类型的登录方式，保留在 source 上
+	SkippedAuths []*userapp.LinkedAuth `json:"skippedAuths" bson:"skippedAuths"`
+
+	// target 原本没有，合并时新增的 roleIds
+	AddedRoleIds     []string `json:"addedRoleIds" bson:"addedRoleIds"`
+	TargetUwrCreated bool     `json:"targetUwrCreated" bson:"targetUwrCreated"`
+
+	// AddedRoleIds 中限时授权的到期时间，合并后在 target 上保持不变
+	AddedRoleExpires []*RoleExpire `json:"addedRoleExpires" bson:"addedRoleExpires"`
+
+	// 迁移的登录历史记录 id，操作历史在审计日志中，不需要迁移
+	LoginHistoryIds []string `json:"loginHistoryIds" bson:"loginHistoryIds"`
+
+	// 合并前 source 的状态，撤销时恢复
+	SourceBefore *MergeUserState `json:"sourceBefore" bson:"sourceBefore"`
+
+	OpUserId   string        `json:"opUserId" bson:"opUserId"`
+	OpUserName string        `json:"opUserName" bson:"opUserName"`
+	UndoUserId string        `json:"undoUserId" bson:"undoUserId"`
+	UndoT      *util.CurTime `json:"undoT" bson:"undoT"`
+	CreateT    *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT    *util.CurTime `json:"updateT" bson:"updateT"`
+}
+
+type MergeUserState struct {
+	Ban       bool   `json:"ban" bson:"ban"`
+	BanStartT int64  `json:"banStartT" bson:"banStartT"`
+	BanT      int64  `json:"banT" bson:"banT"`
+	BanReason string `json:"banReason" bson:"banReason"`
+	ReferId   string `json:"referId" bson:"referId"`
+}
+
+// 计算合并计划，不修改任何数据，用于预览和实际合并
+func PlanMerge(db *dbandmq.Ds, sourceId, targetId string) (*MergeJournal, error) {
+	if sourceId == targetId {
+		return nil, ErrMergeSameUser
+	}
+	if sourceId == userapp.AdminUserId() || targetId == userapp.AdminUserId() {
+		return nil, ErrMergeAdmin
+	}
+
+	source, err := userapp.GetUserById(db, sourceId)
+	if err != nil {
+		return nil, err
+	}
+	target, err := userapp.GetUserById(db, targetId)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil || target == nil {
+		return nil, ErrMergeUserNotFound
+	}
+	if source.ReferId != "" || target.ReferId != "" {
+		return nil, ErrMergeAlreadyMerged
+	}
+	if tenantapp.NormalizeId(source.TenantId) != tenantapp.NormalizeId(target.TenantId) {
+		return nil, ErrMergeCrossTenant
+	}
+
+	mj := &MergeJournal{
+		Id:       util.GenerateDataId(),
+		TenantId: tenantapp.NormalizeId(target.TenantId),
+		SourceId: sourceId,
+		TargetId: targetId,
+		SourceBefore: &MergeUserState{
+			Ban:       source.Ban,
+			BanStartT: source.BanStartT,
+			BanT:      source.BanT,
+			BanReason: source.BanReason,
+			ReferId:   source.ReferId,
+		},
+	}
+
+	// 登录方式，除了微信外每种类型只能有一个，target 已有的保留在 source 上
+	sourceAuths, err := userapp.GetUserLinkedAuths(db, sourceId)
+	if err != nil {
+		return nil, err
+	}
+	targetAuths, err := userapp.GetUserLinkedAuths(db, targetId)
+	if err != nil {
+		return nil, err
+	}
+	targetHas := make(map[string]bool)
+	for _, a := range targetAuths {
+		targetHas[a.LoginType] = true
+	}
+	for _, a := range sourceAuths {
+		if a.LoginType != userapp.LoginTypeWeChat && targetHas[a.LoginType] {
+			mj.SkippedAuths = append(mj.SkippedAuths, a)
+		} else {
+			mj.MovedAuths = append(mj.MovedAuths, a)
+		}
+	}
+
+	// 手工赋予的 roles，默认角色和已到期还未移除的 roles 不需要迁移
+	sourceUwr, err := GetUserWithRoleByUserId(db, sourceId)
+	if err != nil {
+		return nil, err
+	}
+	targetUwr, err := GetUserWithRoleByUserId(db, targetId)
+	if err != nil {
+		return nil, err
+	}
+	if sourceUwr != nil {
+		mj.TargetUwrCreated = targetUwr == nil
+		expired := sourceUwr.ExpiredRoleIdsAt(time.Now().Unix())
+		for _, rid := range sourceUwr.RoleIds {
+			if rid == roleapp.DefaultRoleId() || containsId(expired, rid) || (targetUwr != nil && containsId(targetUwr.RoleIds, rid)) {
+				continue
+			}
+			if !containsId(mj.AddedRoleIds, rid) {
+				mj.AddedRoleIds = append(mj.AddedRoleIds, rid)
+			}
+		}
+		for _, re := range sourceUwr.RoleExpires {
+			if containsId(mj.AddedRoleIds, re.RoleId) {
+				mj.AddedRoleExpires = append(mj.AddedRoleExpires, re)
+			}
+		}
+		if len(mj.AddedRoleIds) == 0 {
+			mj.TargetUwrCreated = false
+		}
+	}
+
+	// 登录历史
+	var lhs []*ophistory.LoginHistory
+	err = db.C(ophistory.CollectionNameLoginHistory).Find(bson.M{"userId": sourceId}).Select(bson.M{"_id": 1}).All(&lhs)
+	if err != nil {
+		Logger.Errorf("", "合并账户时，读取用户[%s]登录历史失败, %s", sourceId, err.Error())
+		return nil, err
+	}
+	for _, lh := range lhs {
+		mj.LoginHistoryIds = append(mj.LoginHistoryIds, lh.Id)
+	}
+
+	return mj, nil
+}
+
+// 按照合并计划执行合并，先保存合并记录再修改数据，中途失败时可以根据记录撤销
+// opHis 提供操作人和请求信息，每一步的操作记录由它复制生成
+func ExecMerge(db *dbandmq.Ds, mj *MergeJournal, opHis *ophistory.OperationHistory) error {
+	t := util.GetCurTime()
+	mj.Status = MergeStatusMerging
+	mj.OpUserId = opHis.UserId
+	mj.OpUserName = opHis.UserName
+	mj.CreateT = t
+	mj.UpdateT = t
+
+	err := db.C(CollectionNameMergeJournal).Insert(mj)
+	if err != nil {
+		Logger.Errorf("", "保存合并账户[%s]->[%s]记录失败, %s", mj.SourceId, mj.TargetId, err.Error())
+		return err
+	}
+
+	// 1. 登录方式
+	for _, a := range mj.MovedAuths {
+		err = moveAuth(db, a, mj.SourceId, mj.TargetId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 2. roles，审计日志写入失败时继续合并，最后返回错误
+	var recordErr error
+	if len(mj.AddedRoleIds) > 0 {
+		err = addMergedRoles(db, mj, opHis)
+		if errors.Is(err, ophistory.ErrRecordFailed) {
+			recordErr = err
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// 3. 登录历史
+	if len(mj.LoginHistoryIds) > 0 {
+		_, err = db.C(ophistory.CollectionNameLoginHistory).UpdateAll(
+			bson.M{"_id": bson.M{"$in": mj.LoginHistoryIds}, "userId": mj.SourceId},
+			bson.M{"$set": bson.M{"userId": mj.TargetId}})
+		if err != nil {
+			Logger.Errorf("", "合并账户时，迁移登录历史失败, %s", err.Error())
+			return err
+		}
+	}
+
+	// 4. 禁用 source，清除定时封禁的生效时间，立即生效
+	update := bson.M{
+		"$set": bson.M{
+			"referId":   mj.TargetId,
+			"ban":       true,
+			"banStartT": int64(0),
+			"banT":      int64(math.MaxInt64),
+			"banReason": userapp.CombineAccountBanReason,
+			"updateT":   util.GetCurTime(),
+		},
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+	err = db.C(userapp.CollectionNameUser).UpdateId(mj.SourceId, update)
+	if err != nil {
+		Logger.Errorf("", "合并账户时，禁用账户[%s]失败, %s", mj.SourceId, err.Error())
+		return err
+	}
+	err = ophistory.Record(db, mergeOpHistory(opHis, mj), ophistory.CodeUserMerge, ophistory.TargetUser, mj.SourceId, mj.TargetId)
+	if recordErr == nil {
+		recordErr = err
+	}
+	_ = userapp.BumpUserVersion(db, mj.TargetId)
+
+	err = setMergeStatus(db, mj, MergeStatusMerged)
+	if err != nil {
+		return err
+	}
+	return recordErr
+}
+
+// 撤销合并，恢复 source 的状态并把迁移的数据移回去
+// 合并后 target 又解绑或迁移了的登录方式会被跳过
+func UndoMerge(db *dbandmq.Ds, mj *MergeJournal, opHis *ophistory.OperationHistory) error {
+	if mj.Status != MergeStatusMerged && mj.Status != MergeStatusMerging {
+		return ErrMergeCanNotUndo
+	}
+
+	// 1. 登录方式
+	for _, a := range mj.MovedAuths {
+		err := moveAuth(db, a, mj.TargetId, mj.SourceId)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+
+	// 2. roles，审计日志写入失败时继续撤销，最后返回错误
+	var recordErr error
+	if len(mj.AddedRoleIds) > 0 {
+		uwr, err := GetUserWithRoleByUserId(db, mj.TargetId)
+		if err != nil {
+			return err
+		}
+		if uwr != nil {
+			var remain []string
+			for _, rid := range uwr.RoleIds {
+				if !containsId(mj.AddedRoleIds, rid) {
+					remain = append(remain, rid)
+				}
+			}
+			uwr.RoleIds = remain
+			uwr.RemoveRoleExpires(mj.AddedRoleIds)
+			uwr.UpdateT = util.GetCurTime()
+			// 合并时新建的记录，合并后没有再添加其他数据就删除，恢复 target 合并前的状态
+			if mj.TargetUwrCreated && len(uwr.RoleIds) == 0 && len(uwr.LdapRoleIds) == 0 &&
+				len(uwr.ManageOrgIds) == 0 && len(uwr.ManageUserIds) == 0 {
+				err = db.C(CollectionNameUserWithRole).RemoveId(uwr.Id)
+			} else {
+				err = UpdateUserWithRole(db, uwr)
+			}
+			if err != nil {
+				return err
+			}
+			recordErr = ophistory.Record(db, opHis.WithAction("").SetParams(ophistory.Params{"roleIds": mj.AddedRoleIds}), ophistory.CodeUwrDelRoles, ophistory.TargetUser, mj.TargetId)
+		}
+	}
+
+	// 3. 登录历史
+	if len(mj.LoginHistoryIds) > 0 {
+		_, err := db.C(ophistory.CollectionNameLoginHistory).UpdateAll(
+			bson.M{"_id": bson.M{"$in": mj.LoginHistoryIds}, "userId": mj.TargetId},
+			bson.M{"$set": bson.M{"userId": mj.SourceId}})
+		if err != nil {
+			Logger.Errorf("", "撤销合并时，迁移登录历史失败, %s", err.Error())
+			return err
+		}
+	}
+
+	// 4. 恢复 source
+	sb := mj.SourceBefore
+	update := bson.M{
+		"$set": bson.M{
+			"referId":   sb.ReferId,
+			"ban":       sb.Ban,
+			"banStartT": sb.BanStartT,
+			"banT":      sb.BanT,
+			"banReason": sb.BanReason,
+			"updateT":   util.GetCurTime(),
+		},
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+	err := db.C(userapp.CollectionNameUser).UpdateId(mj.SourceId, update)
+	if err != nil {
+		Logger.Errorf("", "撤销合并时，恢复账户[%s]失败, %s", mj.SourceId, err.Error())
+		return err
+	}
+	err = ophistory.Record(db, mergeOpHistory(opHis, mj), ophistory.CodeUserUnMerge, ophistory.TargetUser, mj.SourceId, mj.TargetId)
+	if recordErr == nil {
+		recordErr = err
+	}
+	_ = userapp.BumpUserVersion(db, mj.TargetId)
+
+	mj.UndoUserId = opHis.UserId
+	mj.UndoT = util.GetCurTime()
+	err = setMergeStatus(db, mj, MergeStatusUndone)
+	if err != nil {
+		return err
+	}
+	return recordErr
+}
+
+func GetMergeJournalById(db *dbandmq.Ds, id string) (*MergeJournal, error) {
+	var mj *MergeJournal
+	err := db.C(CollectionNameMergeJournal).FindId(id).One(&mj)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取合并记录失败, %s", id, err.Error())
+		return nil, err
+	}
+	return mj, nil
+}
+
+// 读取租户内与用户相关的合并记录，userId 为空时读取租户内所有
+func QueryMergeJournal(db *dbandmq.Ds, tenantId, userId string, page, size int) ([]*MergeJournal, int, error) {
+	f := bson.M{
+		"tenantId": tenantId,
+	}
+	if userId != "" {
+		f["$or"] = []bson.M{
+			{"sourceId": userId},
+			{"targetId": userId},
+		}
+	}
+
+	query := db.C(CollectionNameMergeJournal).Find(f)
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var mjs []*MergeJournal
+	err = query.Sort("-_id").Skip((page - 1) * size).Limit(size).All(&mjs)
+	if err != nil {
+		Logger.Errorf("", "搜索合并记录失败, %s", err.Error())
+		return nil, 0, err
+	}
+
+	return mjs, total, nil
+}
+
+func moveAuth(db *dbandmq.Ds, a *userapp.LinkedAuth, fromId, toId string) error {
+	f := bson.M{
+		"_id":    a.Id,
+		"userId": fromId,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"userId":  toId,
+			"updateT": util.GetCurTime(),
+		},
+	}
+	err := db.C(userapp.AuthCollectionName(a.LoginType)).Update(f, update)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "迁移登录方式[%s][%s]从[%s]到[%s]失败, %s", a.LoginType, a.Value, fromId, toId, err.Error())
+	}
+	return err
+}
+
+func addMergedRoles(db *dbandmq.Ds, mj *MergeJournal, opHis *ophistory.OperationHistory) error {
+	uwr, err := GetUserWithRoleByUserId(db, mj.TargetId)
+	if err != nil {
+		return err
+	}
+
+	update := true
+	if uwr == nil {
+		update = false
+		uwr = &UserWithRole{
+			Id:       util.GenerateDataId(),
+			TenantId: mj.TenantId,
+			UserId:   mj.TargetId,
+			CreateT:  util.GetCurTime(),
+		}
+	}
+	uwr.RoleIds = append(uwr.RoleIds, mj.AddedRoleIds...)
+	uwr.RoleIds = util.UniqueStringArray(uwr.RoleIds)
+	for _, re := range mj.AddedRoleExpires {
+		uwr.SetRoleExpire(re.RoleId, re.ExpireT, false)
+	}
+	uwr.UpdateT = util.GetCurTime()
+
+	err = SaveUserWithRole(db, uwr, update)
+	if err != nil {
+		return err
+	}
+	return ophistory.Record(db, opHis.WithAction("").SetParams(ophistory.Params{"roleIds": mj.AddedRoleIds}), ophistory.CodeUwrAddRoles, ophistory.TargetUser, mj.TargetId)
+}
+
+// 合并和撤销合并的审计日志，来源账户和目标账户各一条
+func mergeOpHistory(opHis *ophistory.OperationHistory, mj *MergeJournal) *ophistory.OperationHistory {
+	return opHis.WithAction("").SetParams(ophistory.Params{
+		"sourceId":  mj.SourceId,
+		"targetId":  mj.TargetId,
+		"journalId": mj.Id,
+	})
+}
+
+func setMergeStatus(db *dbandmq.Ds, mj *MergeJournal, status string) error {
+	mj.Status = status
+	mj.UpdateT = util.GetCurTime()
+	err := db.C(CollectionNameMergeJournal).UpdateId(mj.Id, mj)
+	if err != nil {
+		Logger.Errorf("", "更新合并记录[%s]状态为[%s]失败, %s", mj.Id, status, err.Error())
+	}
+	return err
+}
+
+func containsId(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -14,30 +14,64 @@ import (
 const CollectionNameUserWithRole = "userWithRole"
 var IKUserWithRole = &dbandmq.IndexKey{
 	Collection:    CollectionNameUserWithRole,
-	SingleKey:     []string{"userId", "roleIds"},
+	SingleKey:     []string{"tenantId", "userId", "roleIds"},
 	UniqueKey:     []string{"userId"},
 }
 type UserWithRole struct {
 	Id string             `json:"id" bson:"_id"`
+	TenantId string       `json:"tenantId" bson:"tenantId"` // 与用户所属租户相同
 	UserId string         `json:"userId" bson:"userId"`
 	UserName string       `json:"userName" bson:"userName"`
 	Avatar string         `json:"avatar" bson:"avatar"`
 	RoleIds []string      `json:"-" bson:"roleIds"`
 	Roles []*roleapp.Role `json:"roles" bson:"-"`
 
+	// ldap 登录时根据目录分组映射得到的 roleIds，每次登录都会重新同步
+	// 与 RoleIds 分开存放，同步时不会影响手工赋予的 role
+	LdapRoleIds []string `json:"ldapRoleIds" bson:"ldapRoleIds"`
+
+	// RoleIds 中有到期时间的 role，到期后不再生效，由后台任务移除
+	RoleExpires []*RoleExpire `json:"roleExpires" bson:"roleExpires"`
+
 	// 返回给前端的所有的 menu 和 button 集合
 	Menus []string `json:"menus" bson:"-"`
 	Buttons []string `json:"buttons" bson:"-"`
 	ChildrenRole []*roleapp.ChildRole `json:"childrenRole" bson:"-"` // 所有的子角色
 
-	// 部门列表是自己可以管控的
+	// 部门列表是自己可以管控的，包含这些部门的所有下级部门
+	ManageOrgIds []string `json:"manageOrgIds" bson:"manageOrgIds"`
+
+	// 明确指定由自己管理的用户
+	ManageUserIds []string `json:"manageUserIds" bson:"manageUserIds"`
+
+	// 通过所属部门及上级部门获得的 roleIds，读取时计算，不存储
+	OrgRoleIds []string `json:"orgRoleIds" bson:"-"`
 
-	History []*ophistory.OperationHistory `json:"history" bson:"history"`
+	// 通过所属用户组获得的 roleIds，读取时计算，不存储
+	GroupRoleIds []string `json:"groupRoleIds" bson:"-"`
+
+	// 每个 roleId 的来源，一个 role 可能同时有多个来源
+	RoleSources map[string][]*RoleSource `json:"roleSources" bson:"-"`
 
 	CreateT *util.CurTime `json:"-" bson:"createT"`
 	UpdateT *util.CurTime `json:"-" bson:"updateT"`
 }
 
+// role 的来源
+const (
+	RoleSourceUser    = "USER"    // 直接赋予
+	RoleSourceLdap    = "LDAP"    // ldap 分组映射
+	RoleSourceDefault = "DEFAULT" // 所有用户都有的默认角色
+	RoleSourceOrg     = "ORG"     // 所属部门及上级部门
+	RoleSourceGroup   = "GROUP"   // 所属用户组，Id / Name 是用户组信息
+)
+
+type RoleSource struct {
+	Type string `json:"type"`
+	Id   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
 // 根据 userId 查询 userwithrole
 func GetUserWithRoleByUserId(db *dbandmq.Ds, userId string) (*UserWithRole, error) {
 	f := bson.M{
@@ -63,4 +97,66 @@ func SaveUserWithRole(db *dbandmq.Ds, uwr *UserWithRole, update bool) error {
 
 func UpdateUserWithRole(db *dbandmq.Ds, uwr *UserWithRole) error {
 	return db.C(CollectionNameUserWithRole).UpdateId(uwr.Id, uwr)
-}
\ No newline at end of file
+}
+
+// 直接给用户赋予 roles，不检查审批和操作人的权限，由调用方检查
+// 已经长期有效的 role 不会因为限时授权变成限时
+func AddUserRoles(db *dbandmq.Ds, tenantId, userId string, roleIds []string, expireT int64, opHis *ophistory.OperationHistory) (*UserWithRole, error) {
+	// 检查 uwr 是否存在，不存在新建，存在就是更新
+	uwr, err := GetUserWithRoleByUserId(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	before := ophistory.Snapshot(uwr)
+	update := true
+	if uwr == nil {
+		update = false
+		uwr = &UserWithRole{
+			Id:       util.GenerateDataId(),
+			TenantId: tenantId,
+			UserId:   userId,
+			CreateT:  util.GetCurTime(),
+		}
+		uwr.UpdateT = uwr.CreateT
+	}
+
+	held := make(map[string]bool)
+	for _, rid := range uwr.RoleIds {
+		held[rid] = true
+	}
+	for _, rid := range roleIds {
+		uwr.SetRoleExpire(rid, expireT, held[rid])
+	}
+	uwr.RoleIds = append(uwr.RoleIds, roleIds...)
+	uwr.RoleIds = util.UniqueStringArray(uwr.RoleIds)
+
+	opHis.SetParams(ophistory.Params{"roleIds": roleIds}).SetDiff(before, uwr)
+
+	err = SaveUserWithRole(db, uwr, update)
+	if err != nil {
+		return nil, err
+	}
+	err = ophistory.Record(db, opHis, ophistory.CodeUwrAddRoles, ophistory.TargetUser, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return uwr, nil
+}
+
+// 移除用户直接赋予的 roles，ldap、部门和用户组带来的 roles 不受影响
+func RemoveUserRoles(db *dbandmq.Ds, uwr *UserWithRole, roleIds []string, opHis *ophistory.OperationHistory) error {
+	before := ophistory.Snapshot(uwr)
+	uwr.RoleIds = removeRoleIds(uwr.RoleIds, roleIds)
+	uwr.RemoveRoleExpires(roleIds)
+	uwr.UpdateT = util.GetCurTime()
+
+	opHis.SetParams(ophistory.Params{"roleIds": roleIds}).SetDiff(before, uwr)
+
+	err := UpdateUserWithRole(db, uwr)
+	if err != nil {
+		Logger.Errorf("", "移除用户[%s]的roles失败, %s", uwr.UserId, err.Error())
+		return err
+	}
+	return ophistory.Record(db, opHis, ophistory.CodeUwrDelRoles, ophistory.TargetUser, uwr.UserId)
+}
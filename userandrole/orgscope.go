@@ -0,0 +1,231 @@
+package userandrole
+
+import (
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/orgapp"
+	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/userapp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 管理员可以管理的用户范围
+// 系统管理员不限制，其他用户只能管理：
+// 1. 自己创建的用户
+// 2. 自己负责的部门（包含下级部门）中的用户
+// 3. 明确指定由自己管理的用户
+type ManageScope struct {
+	All         bool     // 不限制范围
+	ManagerId   string   // 管理人
+	OrgIds      []string // 可以管理的部门 id，已包含所有下级部门
+	LinkUserIds []string // 明确指定由管理人管理的用户
+}
+
+// 读取用户的管理范围
+func GetManageScope(db *dbandmq.Ds, userId string, isAdmin bool) (*ManageScope, error) {
+	if isAdmin || userId == userapp.AdminUserId() {
+		return &ManageScope{All: true}, nil
+	}
+
+	scope := &ManageScope{ManagerId: userId}
+	uwr, err := GetUserWithRoleByUserId(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	if uwr == nil {
+		return scope, nil
+	}
+
+	scope.LinkUserIds = uwr.ManageUserIds
+	if len(uwr.ManageOrgIds) > 0 {
+		scope.OrgIds, err = orgapp.SubtreeIds(db, uwr.ManageOrgIds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return scope, nil
+}
+
+func (s *ManageScope) CanManageOrg(orgId string) bool {
+	return s.All || containsId(s.OrgIds, orgId)
+}
+
+// 满足任意一个条件即可管理，不限制范围时才能管理系统管理员
+func (s *ManageScope) CanManageUser(db *dbandmq.Ds, userId string) (bool, error) {
+	if s.All {
+		return true, nil
+	}
+
+	ok, err := s.inScope(db, userId)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	isAdmin, err := isAdminTarget(db, userId)
+	if err != nil {
+		return false, err
+	}
+	return !isAdmin, nil
+}
+
+func (s *ManageScope) inScope(db *dbandmq.Ds, userId string) (bool, error) {
+	if containsId(s.LinkUserIds, userId) {
+		return true, nil
+	}
+
+	orgIds, err := orgapp.GetUserOrgIds(db, userId)
+	if err != nil {
+		return false, err
+	}
+	for _, orgId := range orgIds {
+		if containsId(s.OrgIds, orgId) {
+			return true, nil
+		}
+	}
+
+	user, err := userapp.GetUserById(db, userId)
+	if err != nil {
+		return false, err
+	}
+	return user != nil && user.CreatedBy != "" && user.CreatedBy == s.ManagerId, nil
+}
+
+// 用户是否拥有 admin role，包括通过部门、用户组获得的
+func isAdminTarget(db *dbandmq.Ds, userId string) (bool, error) {
+	if userId == userapp.AdminUserId() {
+		return true, nil
+	}
+	uwr, err := GetUserRoles(db, userId)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range uwr.Roles {
+		if role.Name == roleapp.AdminRoleName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 管理范围内的所有用户 id，不限制范围时返回 nil
+func (s *ManageScope) UserIds(db *dbandmq.Ds) ([]string, error) {
+	if s.All {
+		return nil, nil
+	}
+
+	userIds := append([]string{}, s.LinkUserIds...)
+	if len(s.OrgIds) > 0 {
+		orgUserIds, err := orgapp.GetOrgMemberUserIds(db, s.OrgIds)
+		if err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, orgUserIds...)
+	}
+
+	createdIds, err := userapp.GetUserIdsByCreator(db, s.ManagerId)
+	if err != nil {
+		return nil, err
+	}
+	userIds = append(userIds, createdIds...)
+
+	if len(userIds) > 1 {
+		userIds = util.UniqueStringArray(userIds)
+	}
+	return userIds, nil
+}
+
+// 设置或取消用户负责的部门
+func UpdateManageOrgs(db *dbandmq.Ds, tenantId, userId string, orgIds []string, add bool, opHis *ophistory.OperationHistory) error {
+	code := ophistory.CodeUwrAddManageOrgs
+	if !add {
+		code = ophistory.CodeUwrDelManageOrgs
+	}
+	return updateManageIds(db, tenantId, userId, "manageOrgIds", orgIds, add, code, opHis)
+}
+
+// 设置或取消明确由用户管理的其他用户
+func UpdateManageUsers(db *dbandmq.Ds, tenantId, userId string, userIds []string, add bool, opHis *ophistory.OperationHistory) error {
+	code := ophistory.CodeUwrAddManageUsers
+	if !add {
+		code = ophistory.CodeUwrDelManageUsers
+	}
+	return updateManageIds(db, tenantId, userId, "manageUserIds", userIds, add, code, opHis)
+}
+
+func updateManageIds(db *dbandmq.Ds, tenantId, userId, field string, ids []string, add bool, code string, opHis *ophistory.OperationHistory) error {
+	uwr, err := GetUserWithRoleByUserId(db, userId)
+	if err != nil {
+		return err
+	}
+	before := ophistory.Snapshot(uwr)
+	if uwr == nil {
+		if !add {
+			return nil
+		}
+		uwr = &UserWithRole{
+			Id:       util.GenerateDataId(),
+			TenantId: tenantId,
+			UserId:   userId,
+			RoleIds:  []string{},
+			CreateT:  util.GetCurTime(),
+		}
+		uwr.UpdateT = uwr.CreateT
+		if field == "manageOrgIds" {
+			uwr.ManageOrgIds = ids
+		} else {
+			uwr.ManageUserIds = ids
+		}
+		err = SaveUserWithRole(db, uwr, false)
+	} else {
+		var op bson.M
+		if add {
+			op = bson.M{"$addToSet": bson.M{field: bson.M{"$each": ids}}}
+		} else {
+			op = bson.M{"$pullAll": bson.M{field: ids}}
+		}
+		op["$set"] = bson.M{"updateT": util.GetCurTime()}
+		err = db.C(CollectionNameUserWithRole).UpdateId(uwr.Id, op)
+	}
+	if err != nil {
+		Logger.Errorf("", "修改用户[%s]的[%s]失败, %s", userId, field, err.Error())
+		return err
+	}
+
+	after, err := GetUserWithRoleByUserId(db, userId)
+	if err != nil {
+		return err
+	}
+	opHis.SetParams(ophistory.Params{"ids": ids}).SetDiff(before, after)
+	return ophistory.Record(db, opHis, code, ophistory.TargetUser, userId)
+}
+
+// 部门被删除后，移除所有用户负责的这些部门
+func RemoveManageOrgIds(db *dbandmq.Ds, orgIds []string, opHis *ophistory.OperationHistory) error {
+	f := bson.M{
+		"manageOrgIds": bson.M{"$in": orgIds},
+	}
+	var userIds []string
+	err := db.C(CollectionNameUserWithRole).Find(f).Distinct("userId", &userIds)
+	if err != nil {
+		Logger.Errorf("", "读取负责这些部门的用户失败, %s", err.Error())
+		return err
+	}
+	if len(userIds) == 0 {
+		return nil
+	}
+
+	update := bson.M{
+		"$pullAll": bson.M{"manageOrgIds": orgIds},
+	}
+	_, err = db.C(CollectionNameUserWithRole).UpdateAll(f, update)
+	if err != nil {
+		Logger.Errorf("", "移除用户负责的部门失败, %s", err.Error())
+		return err
+	}
+
+	opHis = opHis.WithAction("").SetParams(ophistory.Params{"ids": orgIds})
+	return ophistory.Record(db, opHis, ophistory.CodeUwrDelManageOrgs, ophistory.TargetUser, userIds...)
+}
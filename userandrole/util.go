@@ -4,10 +4,14 @@ import (
 	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/groupapp"
+	"github.com/leyle/userandrole/orgapp"
 	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
 	"github.com/leyle/userandrole/userapp"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 func GetUserRoles(db *dbandmq.Ds, userId string) (*UserWithRole, error) {
@@ -22,18 +26,62 @@ func GetUserRoles(db *dbandmq.Ds, userId string) (*UserWithRole, error) {
 		return nil, err
 	}
 
+	sources := make(map[string][]*RoleSource)
+	addSource := func(roleIds []string, source *RoleSource) {
+		for _, roleId := range roleIds {
+			sources[roleId] = append(sources[roleId], source)
+		}
+	}
+
 	if uwr == nil {
 		Logger.Debugf("", "用户[%s]无任何角色，准备分配默认角色", userId)
 		// 用户没有任何授权，返回默认角色
 		uwr = &UserWithRole{
 			Id:       util.GenerateDataId(),
 			UserId:   userId,
-			RoleIds:  []string{roleapp.DefaultRoleId},
+			RoleIds:  []string{roleapp.DefaultRoleId()},
 		}
 	} else {
+		// 已到期的授权不再生效，后台任务会移除
+		if expired := uwr.ExpiredRoleIdsAt(time.Now().Unix()); len(expired) > 0 {
+			uwr.RoleIds = removeRoleIds(uwr.RoleIds, expired)
+		}
+		addSource(uwr.RoleIds, &RoleSource{Type: RoleSourceUser})
+
+		// ldap 分组映射过来的 roles
+		addSource(uwr.LdapRoleIds, &RoleSource{Type: RoleSourceLdap})
+		uwr.RoleIds = append(uwr.RoleIds, uwr.LdapRoleIds...)
+
 		// 所有用户都添加一个默认 roleId
-		uwr.RoleIds = append(uwr.RoleIds, roleapp.DefaultRoleId)
+		uwr.RoleIds = append(uwr.RoleIds, roleapp.DefaultRoleId())
+	}
+	addSource([]string{roleapp.DefaultRoleId()}, &RoleSource{Type: RoleSourceDefault})
+
+	// 所属部门及上级部门的 roles
+	orgRoleIds, err := orgapp.GetUserOrgRoleIds(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	addSource(orgRoleIds, &RoleSource{Type: RoleSourceOrg})
+	uwr.OrgRoleIds = orgRoleIds
+	uwr.RoleIds = append(uwr.RoleIds, orgRoleIds...)
+
+	// 所属用户组的 roles，移出用户组后下次读取即失效
+	groups, err := groupapp.GetUserGroups(db, userId)
+	if err != nil {
+		return nil, err
 	}
+	var groupRoleIds []string
+	for _, g := range groups {
+		addSource(g.RoleIds, &RoleSource{Type: RoleSourceGroup, Id: g.Id, Name: g.Name})
+		groupRoleIds = append(groupRoleIds, g.RoleIds...)
+	}
+	if len(groupRoleIds) > 1 {
+		groupRoleIds = util.UniqueStringArray(groupRoleIds)
+	}
+	uwr.GroupRoleIds = groupRoleIds
+	uwr.RoleIds = append(uwr.RoleIds, groupRoleIds...)
+	uwr.RoleSources = sources
 
 	roles, err := roleapp.GetRolesByRoleIds(db, uwr.RoleIds, true)
 	if err != nil {
@@ -154,6 +202,7 @@ func initAdminWithRole(db *dbandmq.Ds, userId, userName, roleId string) error {
 	if uwr == nil {
 		uwr = &UserWithRole{
 			Id:       util.GenerateDataId(),
+			TenantId: tenantapp.DefaultTenantId,
 			UserId:   userId,
 			UserName: userName,
 			Avatar:   "",
@@ -168,4 +217,18 @@ func initAdminWithRole(db *dbandmq.Ds, userId, userName, roleId string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+func removeRoleIds(roleIds, rmIds []string) []string {
+	rm := make(map[string]bool)
+	for _, roleId := range rmIds {
+		rm[roleId] = true
+	}
+
+	var remain []string
+	for _, roleId := range roleIds {
+		if !rm[roleId] {
+			remain = append(remain, roleId)
+		}
+	}
+	return remain
+}
@@ -0,0 +1,429 @@
+package userapp
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 管理员定义的用户自定义属性，比如工号、部门编码
+// 属性值存放在 user 表的 attributes 中
+const CollectionNameAttrDef = "attrDef"
+
+var IKAttrDef = &dbandmq.IndexKey{
+	Collection: CollectionNameAttrDef,
+	UniqueKey:  []string{"key"},
+}
+
+// 属性值类型
+const (
+	AttrTypeString = "STRING"
+	AttrTypeNumber = "NUMBER"
+	AttrTypeBool   = "BOOL"
+	AttrTypeDate   = "DATE" // 格式 2006-01-02
+)
+
+// 属性可见范围
+const (
+	AttrVisibilityPublic  = "PUBLIC"  // 会通过 token 验证等接口返回给下游服务
+	AttrVisibilityPrivate = "PRIVATE" // 只有用户自己和管理员可以看到
+)
+
+const AttrDateLayout = "2006-01-02"
+
+const MaxAttrStringLen = 256
+
+var attrKeyPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,31}$`)
+
+type AttrDef struct {
+	Id         string        `json:"id" bson:"_id"`
+	Key        string        `json:"key" bson:"key"`   // 创建后不可修改
+	Name       string        `json:"name" bson:"name"` // 显示名称
+	Type       string        `json:"type" bson:"type"` // 创建后不可修改
+	Required   bool          `json:"required" bson:"required"`
+	Unique     bool          `json:"unique" bson:"unique"`
+	Visibility string        `json:"visibility" bson:"visibility"`
+	CreateT    *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT    *util.CurTime `json:"updateT" bson:"updateT"`
+}
+
+// 检查属性定义本身是否合法
+func (ad *AttrDef) Check() error {
+	if !attrKeyPattern.MatchString(ad.Key) {
+		return errors.New("key 只能包含字母、数字、下划线，以字母开头，最长32位")
+	}
+	switch ad.Type {
+	case AttrTypeString, AttrTypeNumber, AttrTypeBool, AttrTypeDate:
+	default:
+		return fmt.Errorf("错误的 type 值[%s]", ad.Type)
+	}
+	if ad.Unique && ad.Type == AttrTypeBool {
+		return errors.New("BOOL 类型的属性不能设置为唯一")
+	}
+	switch ad.Visibility {
+	case AttrVisibilityPublic, AttrVisibilityPrivate:
+	default:
+		return fmt.Errorf("错误的 visibility 值[%s]", ad.Visibility)
+	}
+	return nil
+}
+
+// 把传递的值转换为属性类型对应的值
+// json 中的数字都是 float64
+func (ad *AttrDef) Convert(val interface{}) (interface{}, error) {
+	switch ad.Type {
+	case AttrTypeString:
+		s, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("属性[%s]必须是字符串", ad.Key)
+		}
+		s = strings.TrimSpace(s)
+		if len(s) > MaxAttrStringLen {
+			return nil, fmt.Errorf("属性[%s]长度不能超过%d", ad.Key, MaxAttrStringLen)
+		}
+		return s, nil
+	case AttrTypeNumber:
+		switch n := val.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		}
+		return nil, fmt.Errorf("属性[%s]必须是数字", ad.Key)
+	case AttrTypeBool:
+		b, ok := val.(bool)
+		if !ok {
+			return nil, fmt.Errorf("属性[%s]必须是 true 或 false", ad.Key)
+		}
+		return b, nil
+	case AttrTypeDate:
+		s, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("属性[%s]必须是日期字符串", ad.Key)
+		}
+		if _, err := time.Parse(AttrDateLayout, s); err != nil {
+			return nil, fmt.Errorf("属性[%s]日期格式错误，需要是[%s]", ad.Key, AttrDateLayout)
+		}
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("属性[%s]类型错误", ad.Key)
+}
+
+// 把查询参数中的字符串转换为属性类型对应的值
+func (ad *AttrDef) ParseQuery(s string) (interface{}, error) {
+	switch ad.Type {
+	case AttrTypeNumber:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("属性[%s]必须是数字", ad.Key)
+		}
+		return n, nil
+	case AttrTypeBool:
+		switch s {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("属性[%s]必须是 true 或 false", ad.Key)
+	}
+	return ad.Convert(s)
+}
+
+func isEmptyAttr(val interface{}) bool {
+	if val == nil {
+		return true
+	}
+	if s, ok := val.(string); ok && strings.TrimSpace(s) == "" {
+		return true
+	}
+	return false
+}
+
+// 校验属性值，返回转换后的值
+// attrs 中值为 nil 或空字符串表示删除该属性
+// old 为用户当前的属性，新建用户时为 nil，校验后 old 与 attrs 合并的结果必须包含所有必填属性
+func ValidateAttributes(defs []*AttrDef, old, attrs map[string]interface{}) (map[string]interface{}, error) {
+	defMap := make(map[string]*AttrDef)
+	for _, def := range defs {
+		defMap[def.Key] = def
+	}
+
+	ret := make(map[string]interface{})
+	for key, val := range attrs {
+		def, ok := defMap[key]
+		if !ok {
+			return nil, fmt.Errorf("未定义的属性[%s]", key)
+		}
+		if isEmptyAttr(val) {
+			ret[key] = nil
+			continue
+		}
+		v, err := def.Convert(val)
+		if err != nil {
+			return nil, err
+		}
+		ret[key] = v
+	}
+
+	for _, def := range defs {
+		if !def.Required {
+			continue
+		}
+		val, ok := ret[def.Key]
+		if !ok {
+			val = old[def.Key]
+		}
+		if isEmptyAttr(val) {
+			return nil, fmt.Errorf("属性[%s]为必填", def.Key)
+		}
+	}
+
+	return ret, nil
+}
+
+// 只保留指定可见范围的属性，未定义的属性不返回
+func FilterAttributes(defs []*AttrDef, attrs map[string]interface{}, visibility string) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for _, def := range defs {
+		if def.Visibility != visibility {
+			continue
+		}
+		if val, ok := attrs[def.Key]; ok {
+			ret[def.Key] = val
+		}
+	}
+	return ret
+}
+
+// 唯一属性的值不能被同一租户的其他用户使用
+func CheckUniqueAttributes(db *dbandmq.Ds, defs []*AttrDef, tenantId, userId string, attrs map[string]interface{}) error {
+	for _, def := range defs {
+		if !def.Unique {
+			continue
+		}
+		val := attrs[def.Key]
+		if val == nil {
+			continue
+		}
+		f := bson.M{
+			"_id":              bson.M{"$ne": userId},
+			"tenantId":         tenantId,
+			attrField(def.Key): val,
+		}
+		cnt, err := db.C(CollectionNameUser).Find(f).Count()
+		if err != nil {
+			Logger.Errorf("", "检查属性[%s]唯一性失败, %s", def.Key, err.Error())
+			return err
+		}
+		if cnt > 0 {
+			return fmt.Errorf("属性[%s]的值[%v]已被其他用户使用", def.Key, val)
+		}
+	}
+	return nil
+}
+
+func attrField(key string) string {
+	return "attributes." + key
+}
+
+// 唯一属性在租户内唯一，索引为 tenantId + 属性的联合索引
+func attrIndexName(key string) string {
+	return "tenant_attr_" + key
+}
+
+// 升级前建立的全局唯一索引
+func legacyAttrIndexName(key string) string {
+	return "attr_" + key
+}
+
+// 保存用户的属性，值为 nil 的属性被删除
+func SetUserAttributes(db *dbandmq.Ds, userId string, attrs map[string]interface{}) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	setM := bson.M{
+		"updateT": util.GetCurTime(),
+	}
+	unsetM := bson.M{}
+	for key, val := range attrs {
+		if val == nil {
+			unsetM[attrField(key)] = ""
+		} else {
+			setM[attrField(key)] = val
+		}
+	}
+
+	update := bson.M{
+		"$set": setM,
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+	if len(unsetM) > 0 {
+		update["$unset"] = unsetM
+	}
+
+	err := db.C(CollectionNameUser).UpdateId(userId, update)
+	if err != nil {
+		if mgo.IsDup(err) {
+			return errors.New("属性值已被其他用户使用")
+		}
+		Logger.Errorf("", "保存用户[%s]属性失败, %s", userId, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func GetAllAttrDefs(db *dbandmq.Ds) ([]*AttrDef, error) {
+	var defs []*AttrDef
+	err := db.C(CollectionNameAttrDef).Find(nil).Sort("key").All(&defs)
+	if err != nil {
+		Logger.Errorf("", "读取属性定义失败, %s", err.Error())
+		return nil, err
+	}
+	return defs, nil
+}
+
+func GetAttrDefById(db *dbandmq.Ds, id string) (*AttrDef, error) {
+	var def *AttrDef
+	err := db.C(CollectionNameAttrDef).FindId(id).One(&def)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取属性定义失败, %s", id, err.Error())
+		return nil, err
+	}
+	return def, nil
+}
+
+// 新建属性定义，唯一属性在 user 表上建立稀疏唯一索引
+func CreateAttrDef(db *dbandmq.Ds, def *AttrDef) error {
+	if def.Unique {
+		if err := ensureAttrIndex(db, def.Key); err != nil {
+			return err
+		}
+	}
+
+	err := db.C(CollectionNameAttrDef).Insert(def)
+	if err != nil {
+		if mgo.IsDup(err) {
+			return fmt.Errorf("属性[%s]已存在", def.Key)
+		}
+		Logger.Errorf("", "新建属性定义[%s]失败, %s", def.Key, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 修改属性定义，key 和 type 不可修改
+func UpdateAttrDef(db *dbandmq.Ds, old, def *AttrDef) error {
+	if def.Unique && !old.Unique {
+		// 已有重复数据时建立索引会失败
+		if err := ensureAttrIndex(db, def.Key); err != nil {
+			return err
+		}
+	}
+	if !def.Unique && old.Unique {
+		_ = db.C(CollectionNameUser).DropIndexName(attrIndexName(def.Key))
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"name":       def.Name,
+			"required":   def.Required,
+			"unique":     def.Unique,
+			"visibility": def.Visibility,
+			"updateT":    util.GetCurTime(),
+		},
+	}
+	err := db.C(CollectionNameAttrDef).UpdateId(old.Id, update)
+	if err != nil {
+		Logger.Errorf("", "修改属性定义[%s]失败, %s", old.Key, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 删除属性定义，同时删除所有用户的该属性值
+func DeleteAttrDef(db *dbandmq.Ds, def *AttrDef) error {
+	err := db.C(CollectionNameAttrDef).RemoveId(def.Id)
+	if err != nil {
+		Logger.Errorf("", "删除属性定义[%s]失败, %s", def.Key, err.Error())
+		return err
+	}
+
+	if def.Unique {
+		_ = db.C(CollectionNameUser).DropIndexName(attrIndexName(def.Key))
+	}
+
+	f := bson.M{
+		attrField(def.Key): bson.M{"$exists": true},
+	}
+	update := bson.M{
+		"$unset": bson.M{attrField(def.Key): ""},
+		"$inc":   bson.M{"version": 1},
+	}
+	_, err = db.C(CollectionNameUser).UpdateAll(f, update)
+	if err != nil {
+		Logger.Errorf("", "删除用户的属性[%s]值失败, %s", def.Key, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// 联合索引中 tenantId 总是存在，sparse 不会跳过没有该属性的用户
+// 使用 partialFilterExpression 只索引设置了属性的用户，mgo 的 Index 不支持，直接执行 createIndexes 命令
+func ensureAttrIndex(db *dbandmq.Ds, key string) error {
+	field := attrField(key)
+	cmd := bson.D{
+		{Name: "createIndexes", Value: CollectionNameUser},
+		{Name: "indexes", Value: []bson.M{
+			{
+				"key":    bson.D{{Name: "tenantId", Value: 1}, {Name: field, Value: 1}},
+				"name":   attrIndexName(key),
+				"unique": true,
+				"partialFilterExpression": bson.M{
+					field: bson.M{"$exists": true},
+				},
+			},
+		}},
+	}
+	err := db.C(CollectionNameUser).Database.Run(cmd, nil)
+	if err != nil {
+		Logger.Errorf("", "建立属性[%s]唯一索引失败, %s", key, err.Error())
+		return fmt.Errorf("属性[%s]在同一租户中已有重复的值，无法设置为唯一", key)
+	}
+	return nil
+}
+
+// 启动时检查唯一属性的索引，删除升级前的全局唯一索引，建立租户内唯一索引
+func EnsureAttrIndexes(db *dbandmq.Ds) error {
+	defs, err := GetAllAttrDefs(db)
+	if err != nil {
+		return err
+	}
+	for _, def := range defs {
+		if !def.Unique {
+			continue
+		}
+		_ = db.C(CollectionNameUser).DropIndexName(legacyAttrIndexName(def.Key))
+		err = ensureAttrIndex(db, def.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
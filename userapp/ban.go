@@ -0,0 +1,191 @@
+package userapp
+
+import (
+	"errors"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// 未指定到期时间时，默认封禁一年
+const DefaultBanDuration = 365 * 24 * 60 * 60
+
+// 后台检查封禁到期的间隔
+var BanExpiryCheckInterval = time.Minute
+
+// 当前是否处于封禁状态
+// 定时封禁未到生效时间，或者封禁已到期，都视为未封禁
+func (u *User) IsBanned() bool {
+	return u.IsBannedAt(time.Now().Unix())
+}
+
+func (u *User) IsBannedAt(now int64) bool {
+	if !u.Ban {
+		return false
+	}
+	if u.BanStartT > now {
+		return false
+	}
+	if u.BanT > 0 && u.BanT <= now {
+		return false
+	}
+	return true
+}
+
+// 封禁用户，startT 为 0 时立即生效，endT 为 0 时使用默认时长
+func BanUser(db *dbandmq.Ds, userId, reason string, startT, endT int64, opHis *ophistory.OperationHistory) error {
+	now := time.Now().Unix()
+	if startT <= now {
+		startT = 0
+	}
+	if endT <= 0 {
+		base := now
+		if startT > 0 {
+			base = startT
+		}
+		endT = base + DefaultBanDuration
+	}
+	if endT <= now || (startT > 0 && endT <= startT) {
+		return errors.New("封禁到期时间必须晚于当前时间和生效时间")
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"ban":       true,
+			"banReason": reason,
+			"banStartT": startT,
+			"banT":      endT,
+			"updateT":   util.GetCurTime(),
+		},
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+
+	// 返回修改前的数据，用于记录差异
+	var before *User
+	_, err := db.C(CollectionNameUser).FindId(userId).Apply(mgo.Change{Update: update}, &before)
+	if err != nil {
+		Logger.Errorf("", "封禁用户[%s]失败, %s", userId, err.Error())
+		return err
+	}
+
+	after := *before
+	after.Ban, after.BanReason, after.BanStartT, after.BanT = true, reason, startT, endT
+	after.Version++
+	showStartT := startT
+	if showStartT == 0 {
+		showStartT = now
+	}
+	opHis.SetParams(ophistory.Params{
+		"reason": reason,
+		"startT": util.FmtTimestampTime(showStartT),
+		"endT":   util.FmtTimestampTime(endT),
+	}).SetDiff(before, &after)
+	return ophistory.Record(db, opHis, ophistory.CodeUserBan, ophistory.TargetUser, userId)
+}
+
+// 解禁用户
+func UnBanUser(db *dbandmq.Ds, userId, reason string, opHis *ophistory.OperationHistory) error {
+	update := bson.M{
+		"$set": bson.M{
+			"ban":       false,
+			"banReason": reason,
+			"banStartT": int64(0),
+			"banT":      int64(0),
+			"updateT":   util.GetCurTime(),
+		},
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+
+	var before *User
+	_, err := db.C(CollectionNameUser).FindId(userId).Apply(mgo.Change{Update: update}, &before)
+	if err != nil {
+		Logger.Errorf("", "解禁用户[%s]失败, %s", userId, err.Error())
+		return err
+	}
+
+	after := *before
+	after.Ban, after.BanReason, after.BanStartT, after.BanT = false, reason, 0, 0
+	after.Version++
+	opHis.SetParams(ophistory.Params{"reason": reason}).SetDiff(before, &after)
+	return ophistory.Record(db, opHis, ophistory.CodeUserUnBan, ophistory.TargetUser, userId)
+}
+
+// 解除所有已到期的封禁，返回解除的数量
+// 使用带条件的更新，多个实例同时运行时同一个用户只会被处理一次
+func LiftExpiredBans(db *dbandmq.Ds) (int, error) {
+	now := time.Now().Unix()
+	f := bson.M{
+		"ban":  true,
+		"banT": bson.M{"$gt": 0, "$lte": now},
+	}
+
+	var users []*User
+	err := db.C(CollectionNameUser).Find(f).Select(bson.M{"_id": 1, "tenantId": 1, "name": 1, "banT": 1}).All(&users)
+	if err != nil {
+		Logger.Errorf("", "读取封禁到期的用户失败, %s", err.Error())
+		return 0, err
+	}
+
+	cnt := 0
+	var recordErr error
+	for _, user := range users {
+		opHis := ophistory.NewOpHistory("", "system", "")
+		opHis.TenantId = tenantapp.NormalizeId(user.TenantId)
+		opHis.SetParams(ophistory.Params{"endT": util.FmtTimestampTime(user.BanT)})
+
+		cf := bson.M{
+			"_id":  user.Id,
+			"ban":  true,
+			"banT": user.BanT,
+		}
+		update := bson.M{
+			"$set": bson.M{
+				"ban":       false,
+				"banReason": "",
+				"banStartT": int64(0),
+				"banT":      int64(0),
+				"updateT":   util.GetCurTime(),
+			},
+			"$inc": bson.M{
+				"version": 1,
+			},
+		}
+		err = db.C(CollectionNameUser).Update(cf, update)
+		if err != nil {
+			// 被其他实例处理或者被管理员修改了
+			Logger.Debugf("", "自动解禁用户[%s]未更新, %s", user.Id, err.Error())
+			continue
+		}
+		cnt++
+		err = ophistory.Record(db, opHis, ophistory.CodeUserBanExpire, ophistory.TargetUser, user.Id)
+		if err != nil && recordErr == nil {
+			recordErr = err
+		}
+		Logger.Infof("", "用户[%s][%s]封禁到期，自动解禁", user.Id, user.Name)
+	}
+
+	// 审计日志写入失败时继续处理其他用户，返回第一个错误
+	return cnt, recordErr
+}
+
+// 后台定时解除到期的封禁，程序启动时调用
+func StartBanExpiryJob(ds *dbandmq.Ds) {
+	go func() {
+		ticker := time.NewTicker(BanExpiryCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			db := ds.CopyDs()
+			_, _ = LiftExpiredBans(db)
+			db.Close()
+		}
+	}()
+}
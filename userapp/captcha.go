@@ -0,0 +1,59 @@
+package userapp
+
+import (
+	jsoniter "github.com/json-iterator/go"
+	. "github.com/leyle/ginbase/consolelog"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 外部人机验证服务配置，兼容 recaptcha / hcaptcha 的校验接口
+// 向 VerifyUrl POST secret/response/remoteip，返回 json 中 success 为 true 即通过
+type CaptchaOption struct {
+	VerifyUrl string
+	Secret    string
+}
+
+type captchaResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (o *CaptchaOption) Verify(token, ip string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	v := url.Values{}
+	v.Set("secret", o.Secret)
+	v.Set("response", token)
+	v.Set("remoteip", ip)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.PostForm(o.VerifyUrl, v)
+	if err != nil {
+		Logger.Errorf("", "调用人机验证接口失败, %s", err.Error())
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	var cr captchaResponse
+	err = jsoniter.Unmarshal(body, &cr)
+	if err != nil {
+		Logger.Errorf("", "解析人机验证接口返回数据失败, %s", err.Error())
+		return false, err
+	}
+
+	if !cr.Success {
+		Logger.Infof("", "人机验证未通过, %s", cr.ErrorCodes)
+	}
+
+	return cr.Success, nil
+}
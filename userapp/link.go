@@ -0,0 +1,171 @@
+package userapp
+
+import (
+	"errors"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/silenceper/wechat/oauth"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	ErrAuthConflict = errors.New("该登录方式已被其他账户使用")
+	ErrAuthExist    = errors.New("当前账户已绑定该类型的登录方式")
+	ErrAuthNotFound = errors.New("当前账户未绑定该登录方式")
+	ErrAuthLastOne  = errors.New("至少需要保留一种登录方式")
+)
+
+// 用户已绑定的登录方式，用于展示和解绑
+type LinkedAuth struct {
+	Id        string        `json:"id" bson:"id"`
+	LoginType string        `json:"loginType" bson:"loginType"`
+	Value     string        `json:"value" bson:"value"` // loginId / phone / openId / email
+	Name      string        `json:"name" bson:"name"`   // 微信暱称或目录中的名字
+	Platform  string        `json:"platform" bson:"platform"`
+	CreateT   *util.CurTime `json:"createT" bson:"createT"`
+}
+
+// 读取用户绑定的所有登录方式
+func GetUserLinkedAuths(db *dbandmq.Ds, userId string) ([]*LinkedAuth, error) {
+	f := bson.M{
+		"userId": userId,
+	}
+
+	var auths []*LinkedAuth
+
+	var idps []*UserLoginIdPasswdAuth
+	err := db.C(CollectionNameIdPasswd).Find(f).All(&idps)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]的idPasswdAuth失败, %s", userId, err.Error())
+		return nil, err
+	}
+	for _, a := range idps {
+		auths = append(auths, &LinkedAuth{Id: a.Id, LoginType: LoginTypeIdPasswd, Value: a.LoginId, CreateT: a.CreateT})
+	}
+
+	var phones []*PhoneAuth
+	err = db.C(CollectionNamePhone).Find(f).All(&phones)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]的phoneAuth失败, %s", userId, err.Error())
+		return nil, err
+	}
+	for _, a := range phones {
+		auths = append(auths, &LinkedAuth{Id: a.Id, LoginType: LoginTypePhone, Value: a.Phone, CreateT: a.CreateT})
+	}
+
+	var wxs []*WeChatAuth
+	err = db.C(CollectionNameWeChat).Find(f).All(&wxs)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]的weChatAuth失败, %s", userId, err.Error())
+		return nil, err
+	}
+	for _, a := range wxs {
+		auths = append(auths, &LinkedAuth{Id: a.Id, LoginType: LoginTypeWeChat, Value: a.OpenId, Name: a.Nickname, Platform: a.Platform, CreateT: a.CreateT})
+	}
+
+	var ldaps []*LdapAuth
+	err = db.C(CollectionNameLdap).Find(f).All(&ldaps)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]的ldapAuth失败, %s", userId, err.Error())
+		return nil, err
+	}
+	for _, a := range ldaps {
+		auths = append(auths, &LinkedAuth{Id: a.Id, LoginType: LoginTypeLdap, Value: a.LoginId, Name: a.Name, CreateT: a.CreateT})
+	}
+
+	var emails []*EmailAuth
+	err = db.C(CollectionNameEmail).Find(f).All(&emails)
+	if err != nil {
+		Logger.Errorf("", "读取用户[%s]的emailAuth失败, %s", userId, err.Error())
+		return nil, err
+	}
+	for _, a := range emails {
+		auths = append(auths, &LinkedAuth{Id: a.Id, LoginType: LoginTypeEmail, Value: a.Email, CreateT: a.CreateT})
+	}
+
+	return auths, nil
+}
+
+// 可以用来登录的方式数量，邮箱暂不支持登录，不计算在内
+func CountLoginAuths(auths []*LinkedAuth) int {
+	cnt := 0
+	for _, a := range auths {
+		if a.LoginType != LoginTypeEmail {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// 登录方式对应的数据表
+func AuthCollectionName(loginType string) string {
+	switch loginType {
+	case LoginTypeIdPasswd:
+		return CollectionNameIdPasswd
+	case LoginTypePhone:
+		return CollectionNamePhone
+	case LoginTypeWeChat:
+		return CollectionNameWeChat
+	case LoginTypeLdap:
+		return CollectionNameLdap
+	case LoginTypeEmail:
+		return CollectionNameEmail
+	}
+	return ""
+}
+
+// 给已有 user 添加一个微信登录方式
+func AddWeChatAuth(db *dbandmq.Ds, tenantId, userId, platform string, wxInfo *oauth.UserInfo) (*WeChatAuth, error) {
+	wxa := &WeChatAuth{
+		Id:       util.GenerateDataId(),
+		UserId:   userId,
+		TenantId: tenantId,
+		Platform: platform,
+		OpenId:   wxInfo.OpenID,
+		UnionId:  wxInfo.Unionid,
+		Nickname: wxInfo.Nickname,
+		Sex:      wxInfo.Sex,
+		Avatar:   wxInfo.HeadImgURL,
+		City:     wxInfo.City,
+		Province: wxInfo.Province,
+		Country:  wxInfo.Country,
+		CreateT:  util.GetCurTime(),
+	}
+	wxa.UpdateT = wxa.CreateT
+
+	err := db.C(CollectionNameWeChat).Insert(wxa)
+	if err != nil {
+		Logger.Errorf("", "给用户[%s]添加微信[%s]失败, %s", userId, wxInfo.OpenID, err.Error())
+		return nil, err
+	}
+	_ = BumpUserVersion(db, userId)
+
+	return wxa, nil
+}
+
+// 解绑用户的某个登录方式
+// 只删除属于该用户的记录，调用方需要先检查是否至少保留了一种登录方式
+func RemoveAuth(db *dbandmq.Ds, userId, loginType, authId string) error {
+	cname := AuthCollectionName(loginType)
+	if cname == "" {
+		return errors.New("错误的 loginType 值")
+	}
+
+	f := bson.M{
+		"_id":    authId,
+		"userId": userId,
+	}
+	err := db.C(cname).Remove(f)
+	if err == mgo.ErrNotFound {
+		return ErrAuthNotFound
+	}
+	if err != nil {
+		Logger.Errorf("", "解绑用户[%s]的[%s]登录方式[%s]失败, %s", userId, loginType, authId, err.Error())
+		return err
+	}
+	_ = BumpUserVersion(db, userId)
+
+	return nil
+}
@@ -5,12 +5,14 @@ import (
 	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ldapapp"
 	"github.com/leyle/userandrole/ophistory"
 	"github.com/silenceper/wechat"
 	"github.com/silenceper/wechat/cache"
 	"github.com/silenceper/wechat/oauth"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"sync"
 )
 
 // 定义一个程序管理员
@@ -19,7 +21,23 @@ const (
 	AdminLoginPasswd = "admin" // 系统初始化后，可以修改
 )
 
-var AdminUserId = ""
+// 程序启动时初始化，其他实例修改数据后通过 changebus 通知重新加载
+var (
+	adminUserIdMu sync.RWMutex
+	adminUserId   = ""
+)
+
+func AdminUserId() string {
+	adminUserIdMu.RLock()
+	defer adminUserIdMu.RUnlock()
+	return adminUserId
+}
+
+func SetAdminUserId(id string) {
+	adminUserIdMu.Lock()
+	defer adminUserIdMu.Unlock()
+	adminUserId = id
+}
 
 const TokenRedisPrefix = "USER:TOKEN:USERID"
 
@@ -38,8 +56,18 @@ const (
 	LoginTypePhone    = "PHONE"
 	LoginTypeWeChat   = "WECHAT"
 	LoginTypeQQ       = "QQ"
+	LoginTypeLdap     = "LDAP" // ldap / active directory 目录账户
 )
 
+var AllLoginTypes = []string{
+	LoginTypeIdPasswd,
+	LoginTypeEmail,
+	LoginTypePhone,
+	LoginTypeWeChat,
+	LoginTypeQQ,
+	LoginTypeLdap,
+}
+
 // 登录平台
 const (
 	LoginPlatformH5      = "H5" // h5 页面
@@ -52,17 +80,31 @@ const (
 const CollectionNameUser = "user"
 const CombineAccountBanReason = "合并账户，本账户停用"
 
+var IKUser = &dbandmq.IndexKey{
+	Collection: CollectionNameUser,
+	SingleKey:  []string{"tenantId", "createdBy"},
+}
+
 type User struct {
-	Id     string `json:"id" bson:"_id"`
-	Name   string `json:"name" bson:"name"` // 如果是 id 登录，就是 id，如果是email 登录，就是 email，如果是手机号，就是手机号，如果是微信/QQ就是暱称
-	Avatar string `json:"avatar" bson:"avatar"`
+	Id       string `json:"id" bson:"_id"`
+	TenantId string `json:"tenantId" bson:"tenantId"` // 所属租户
+	Name     string `json:"name" bson:"name"`         // 如果是 id 登录，就是 id，如果是email 登录，就是 email，如果是手机号，就是手机号，如果是微信/QQ就是暱称
+	Avatar   string `json:"avatar" bson:"avatar"`
 
 	// 封禁
 	Ban       bool   `json:"ban" bson:"ban"`
-	BanT      int64  `json:"banT" bson:"banT"` // 封禁到期时间
+	BanStartT int64  `json:"banStartT" bson:"banStartT"` // 封禁生效时间，为 0 或早于当前时间时立即生效，用于定时封禁
+	BanT      int64  `json:"banT" bson:"banT"`           // 封禁到期时间
 	BanReason string `json:"banReason" bson:"banReason"`
 
-	History []*ophistory.OperationHistory `json:"history" bson:"history"` // 操作历史记录
+	// 管理员定义的自定义属性，key 与类型见 AttrDef
+	Attributes map[string]interface{} `json:"attributes" bson:"attributes,omitempty"`
+
+	// 管理员创建账户时记录创建人，创建人可以管理该账户；自助注册和第三方登录创建的账户为空
+	CreatedBy string `json:"createdBy" bson:"createdBy,omitempty"`
+
+	// 用户信息版本号，每次修改后加 1，用于判断 token 中缓存的用户信息是否过期
+	Version int64 `json:"version" bson:"version"`
 
 	CreateT *util.CurTime `json:"-" bson:"createT"`
 	UpdateT *util.CurTime `json:"-" bson:"updateT"`
@@ -78,30 +120,33 @@ type User struct {
 	IdPasswd   *UserLoginIdPasswdAuth `json:"idPasswd" bson:"-"`
 	PhoneAuth  *PhoneAuth             `json:"phoneAuth" bson:"-"`
 	WeChatAuth *WeChatAuth            `json:"weChatAuth" bson:"-"`
+	LdapAuth   *LdapAuth              `json:"ldapAuth" bson:"-"`
+	EmailAuth  *EmailAuth             `json:"emailAuth" bson:"-"`
 
 	Ip string `json:"ip" bson:"-"`
 }
 
 // 账户密码登录方式
+// 各登录方式的 loginId / phone / openId / email 在租户内唯一，联合索引在启动时建立
 const CollectionNameIdPasswd = "idPasswdAuth"
 
 var IKIdPasswd = &dbandmq.IndexKey{
 	Collection: CollectionNameIdPasswd,
 	SingleKey:  []string{"userId", "selfReg"},
-	UniqueKey:  []string{"loginId"},
 }
 
 type UserLoginIdPasswdAuth struct {
-	Id      string        `json:"id" bson:"_id"`
-	UserId  string        `json:"userId" bson:"userId"`
-	LoginId string        `json:"loginId" bson:"loginId"`
-	Avatar  string        `json:"avatar" bson:"avatar"`
-	Salt    string        `json:"-" bson:"salt"`
-	Passwd  string        `json:"-" bson:"passwd"`
-	Init    bool          `json:"init" bson:"init"`       // 是否初始化，帮人创建的时候，是 true，修改密码后就是 false, 自主注册，是 false
-	SelfReg bool          `json:"selfReg" bson:"selfReg"` // 是否自己主动注册的，还是管理员后台创建的
-	CreateT *util.CurTime `json:"-" bson:"createT"`
-	UpdateT *util.CurTime `json:"-" bson:"updateT"`
+	Id       string        `json:"id" bson:"_id"`
+	UserId   string        `json:"userId" bson:"userId"`
+	TenantId string        `json:"tenantId" bson:"tenantId"`
+	LoginId  string        `json:"loginId" bson:"loginId"`
+	Avatar   string        `json:"avatar" bson:"avatar"`
+	Salt     string        `json:"-" bson:"salt"`
+	Passwd   string        `json:"-" bson:"passwd"`
+	Init     bool          `json:"init" bson:"init"`       // 是否初始化，帮人创建的时候，是 true，修改密码后就是 false, 自主注册，是 false
+	SelfReg  bool          `json:"selfReg" bson:"selfReg"` // 是否自己主动注册的，还是管理员后台创建的
+	CreateT  *util.CurTime `json:"-" bson:"createT"`
+	UpdateT  *util.CurTime `json:"-" bson:"updateT"`
 }
 
 // 手机验证码登录
@@ -110,18 +155,18 @@ const CollectionNamePhone = "phoneAuth"
 var IKPhone = &dbandmq.IndexKey{
 	Collection: CollectionNamePhone,
 	SingleKey:  []string{"userId", "selfReg"},
-	UniqueKey:  []string{"phone"},
 }
 
 type PhoneAuth struct {
-	Id      string        `json:"id" bson:"_id"`
-	UserId  string        `json:"userId" bson:"userId"`
-	Phone   string        `json:"phone" bson:"phone"`
-	Avatar  string        `json:"avatar" bson:"avatar"`
-	Init    bool          `json:"init" bson:"init"`       // 是否初始化，帮人创建的时候，是 true，自主注册，是 false
-	SelfReg bool          `json:"selfReg" bson:"selfReg"` // 是否自己主动注册的，还是管理员后台创建的
-	CreateT *util.CurTime `json:"-" bson:"createT"`
-	UpdateT *util.CurTime `json:"-" bson:"updateT"`
+	Id       string        `json:"id" bson:"_id"`
+	UserId   string        `json:"userId" bson:"userId"`
+	TenantId string        `json:"tenantId" bson:"tenantId"`
+	Phone    string        `json:"phone" bson:"phone"`
+	Avatar   string        `json:"avatar" bson:"avatar"`
+	Init     bool          `json:"init" bson:"init"`       // 是否初始化，帮人创建的时候，是 true，自主注册，是 false
+	SelfReg  bool          `json:"selfReg" bson:"selfReg"` // 是否自己主动注册的，还是管理员后台创建的
+	CreateT  *util.CurTime `json:"-" bson:"createT"`
+	UpdateT  *util.CurTime `json:"-" bson:"updateT"`
 }
 
 // 微信登录
@@ -130,17 +175,17 @@ const CollectionNameWeChat = "weChatAuth"
 var IKWeChat = &dbandmq.IndexKey{
 	Collection: CollectionNameWeChat,
 	SingleKey:  []string{"userId", "unionId"},
-	UniqueKey:  []string{"openId"},
 }
 
 type WeChatAuth struct {
-	Id     string `json:"id" bson:"_id"`
-	UserId string `json:"userId" bson:"userId"`
+	Id       string `json:"id" bson:"_id"`
+	UserId   string `json:"userId" bson:"userId"`
+	TenantId string `json:"tenantId" bson:"tenantId"`
 
 	Platform string `json:"platform" bson:"platform"` // 使用 app 还是 h5 还是 小程序 登录的
 
-	OpenId   string `json:"openId" bson:"openId"`
-	UnionId  string `json:"unionId" bson:"unionId"`
+	OpenId     string `json:"openId" bson:"openId"`
+	UnionId    string `json:"unionId" bson:"unionId"`
 	SessionKey string `json:"-" bson:"sessionKey"` // 仅小程序登录方式有值
 
 	Nickname string `json:"nickname" bson:"nickname"`
@@ -168,6 +213,47 @@ type WeChatOption struct {
 	AesKey string
 }
 
+// ldap 目录账户登录
+// 账户密码保存在目录中，这里只记录目录账户与 user 的对应关系
+const CollectionNameLdap = "ldapAuth"
+
+var IKLdap = &dbandmq.IndexKey{
+	Collection: CollectionNameLdap,
+	SingleKey:  []string{"userId", "dn"},
+}
+
+type LdapAuth struct {
+	Id       string        `json:"id" bson:"_id"`
+	UserId   string        `json:"userId" bson:"userId"`
+	TenantId string        `json:"tenantId" bson:"tenantId"`
+	LoginId  string        `json:"loginId" bson:"loginId"`
+	Dn       string        `json:"dn" bson:"dn"`
+	Name     string        `json:"name" bson:"name"`
+	Email    string        `json:"email" bson:"email"`
+	Groups   []string      `json:"groups" bson:"groups"` // 最近一次登录时目录返回的分组
+	CreateT  *util.CurTime `json:"-" bson:"createT"`
+	UpdateT  *util.CurTime `json:"-" bson:"updateT"`
+}
+
+// 邮箱，目前只用于注册时的验证和找回密码，暂不支持邮箱登录
+const CollectionNameEmail = "emailAuth"
+
+var IKEmail = &dbandmq.IndexKey{
+	Collection: CollectionNameEmail,
+	SingleKey:  []string{"userId"},
+}
+
+type EmailAuth struct {
+	Id       string        `json:"id" bson:"_id"`
+	UserId   string        `json:"userId" bson:"userId"`
+	TenantId string        `json:"tenantId" bson:"tenantId"`
+	Email    string        `json:"email" bson:"email"` // 统一保存为小写
+	Verified bool          `json:"verified" bson:"verified"`
+	SelfReg  bool          `json:"selfReg" bson:"selfReg"`
+	CreateT  *util.CurTime `json:"-" bson:"createT"`
+	UpdateT  *util.CurTime `json:"-" bson:"updateT"`
+}
+
 // 其他登录方式 todo
 
 func GetUserById(db *dbandmq.Ds, id string) (*User, error) {
@@ -180,16 +266,33 @@ func GetUserById(db *dbandmq.Ds, id string) (*User, error) {
 	return u, nil
 }
 
+// 读取指定创建人创建的所有用户 id
+func GetUserIdsByCreator(db *dbandmq.Ds, creatorId string) ([]string, error) {
+	var users []*User
+	err := db.C(CollectionNameUser).Find(bson.M{"createdBy": creatorId}).Select(bson.M{"_id": 1}).All(&users)
+	if err != nil {
+		Logger.Errorf("", "读取[%s]创建的用户失败, %s", creatorId, err.Error())
+		return nil, err
+	}
+
+	var ids []string
+	for _, u := range users {
+		ids = append(ids, u.Id)
+	}
+	return ids, nil
+}
+
 // 根据 loginId 查询登录信息
-func GetUserByLoginId(db *dbandmq.Ds, loginId string) (*User, error) {
+func GetUserByLoginId(db *dbandmq.Ds, tenantId, loginId string) (*User, error) {
 	f := bson.M{
-		"loginId": loginId,
+		"tenantId": tenantId,
+		"loginId":  loginId,
 	}
 
 	var ulpa *UserLoginIdPasswdAuth
 	err := db.C(CollectionNameIdPasswd).Find(f).One(&ulpa)
 	if err != nil && err != mgo.ErrNotFound {
-		Logger.Errorf("", "根据loginId[%s]查询登录信息失败, %s", err.Error())
+		Logger.Errorf("", "根据loginId[%s]查询登录信息失败, %s", loginId, err.Error())
 		return nil, err
 	}
 
@@ -233,15 +336,15 @@ func GetWeChatConfig(r *redis.Client, platform string, opt *WeChatOption) *wecha
 
 // 存储或更新微信登录
 // 返回 token 和 user 结构
-func SaveWeChatLogin(db *dbandmq.Ds, r *redis.Client, wxInfo *oauth.UserInfo) (*User, string, error) {
+func SaveWeChatLogin(db *dbandmq.Ds, r *redis.Client, tenantId string, wxInfo *oauth.UserInfo) (*User, string, error) {
 	openId := wxInfo.OpenID
-	user, err := GetUserByOpenId(db, openId)
+	user, err := GetUserByOpenId(db, tenantId, openId)
 	if err != nil {
 		return nil, "", err
 	}
 
 	if user == nil {
-		user, err = saveWeChatLogin(db, wxInfo)
+		user, err = saveWeChatLogin(db, tenantId, wxInfo)
 		if err != nil {
 			return nil, "", err
 		}
@@ -260,9 +363,10 @@ func SaveWeChatLogin(db *dbandmq.Ds, r *redis.Client, wxInfo *oauth.UserInfo) (*
 	return user, token, nil
 }
 
-func saveWeChatLogin(db *dbandmq.Ds, wxInfo *oauth.UserInfo) (*User, error) {
+func saveWeChatLogin(db *dbandmq.Ds, tenantId string, wxInfo *oauth.UserInfo) (*User, error) {
 	user := &User{
 		Id:        util.GenerateDataId(),
+		TenantId:  tenantId,
 		Name:      wxInfo.Nickname,
 		Avatar:    wxInfo.HeadImgURL,
 		Ban:       false,
@@ -275,6 +379,7 @@ func saveWeChatLogin(db *dbandmq.Ds, wxInfo *oauth.UserInfo) (*User, error) {
 	wxa := &WeChatAuth{
 		Id:       util.GenerateDataId(),
 		UserId:   user.Id,
+		TenantId: tenantId,
 		OpenId:   wxInfo.OpenID,
 		UnionId:  wxInfo.Unionid,
 		Nickname: wxInfo.Nickname,
@@ -303,12 +408,18 @@ func saveWeChatLogin(db *dbandmq.Ds, wxInfo *oauth.UserInfo) (*User, error) {
 	user.Avatar = wxa.Avatar
 	user.WeChatAuth = wxa
 
+	err = recordSelfCreate(db, user, wxa.Nickname)
+	if err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
-func GetUserByOpenId(db *dbandmq.Ds, openId string) (*User, error) {
+func GetUserByOpenId(db *dbandmq.Ds, tenantId, openId string) (*User, error) {
 	f := bson.M{
-		"openId": openId,
+		"tenantId": tenantId,
+		"openId":   openId,
 	}
 
 	var wx *WeChatAuth
@@ -336,14 +447,14 @@ func GetUserByOpenId(db *dbandmq.Ds, openId string) (*User, error) {
 }
 
 // 返回 token 和 user 结构
-func SavePhoneLogin(db *dbandmq.Ds, r *redis.Client, phone string) (*User, string, error) {
-	user, err := GetUserByPhone(db, phone)
+func SavePhoneLogin(db *dbandmq.Ds, r *redis.Client, tenantId, phone string) (*User, string, error) {
+	user, err := GetUserByPhone(db, tenantId, phone)
 	if err != nil {
 		return nil, "", err
 	}
 
 	if user == nil {
-		user, err = savePhoneLogin(db, phone, "", true)
+		user, err = savePhoneLogin(db, tenantId, phone, "", true, "")
 		if err != nil {
 			return nil, "", err
 		}
@@ -362,27 +473,30 @@ func SavePhoneLogin(db *dbandmq.Ds, r *redis.Client, phone string) (*User, strin
 	return user, token, nil
 }
 
-func savePhoneLogin(db *dbandmq.Ds, phone, avatar string, selfReg bool) (*User, error) {
+func savePhoneLogin(db *dbandmq.Ds, tenantId, phone, avatar string, selfReg bool, createdBy string) (*User, error) {
 	user := &User{
 		Id:        util.GenerateDataId(),
+		TenantId:  tenantId,
 		Name:      phone,
 		Avatar:    avatar,
 		Ban:       false,
 		BanT:      0,
 		BanReason: "",
+		CreatedBy: createdBy,
 		CreateT:   util.GetCurTime(),
 	}
 	user.UpdateT = user.CreateT
 
 	pa := &PhoneAuth{
-		Id:      util.GenerateDataId(),
-		UserId:  user.Id,
-		Phone:   phone,
-		Avatar:  avatar,
-		Init:    false,
-		SelfReg: selfReg,
-		CreateT: user.CreateT,
-		UpdateT: user.UpdateT,
+		Id:       util.GenerateDataId(),
+		UserId:   user.Id,
+		TenantId: tenantId,
+		Phone:    phone,
+		Avatar:   avatar,
+		Init:     false,
+		SelfReg:  selfReg,
+		CreateT:  user.CreateT,
+		UpdateT:  user.UpdateT,
 	}
 	if selfReg {
 		pa.Init = true
@@ -404,17 +518,26 @@ func savePhoneLogin(db *dbandmq.Ds, phone, avatar string, selfReg bool) (*User,
 	user.Name = phone
 	user.PhoneAuth = pa
 
+	// 管理员创建的账户由调用方记录
+	if selfReg {
+		err = recordSelfCreate(db, user, phone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return user, nil
 }
 
-// 管理员创建 phone 账户
-func InitPhoneAuth(db *dbandmq.Ds, phone, avatar string) (*User, error) {
-	return savePhoneLogin(db, phone, avatar, false)
+// 管理员创建 phone 账户，createdBy 是创建人
+func InitPhoneAuth(db *dbandmq.Ds, tenantId, phone, avatar, createdBy string) (*User, error) {
+	return savePhoneLogin(db, tenantId, phone, avatar, false, createdBy)
 }
 
-func GetUserByPhone(db *dbandmq.Ds, phone string) (*User, error) {
+func GetUserByPhone(db *dbandmq.Ds, tenantId, phone string) (*User, error) {
 	f := bson.M{
-		"phone": phone,
+		"tenantId": tenantId,
+		"phone":    phone,
 	}
 
 	var pa *PhoneAuth
@@ -440,6 +563,150 @@ func GetUserByPhone(db *dbandmq.Ds, phone string) (*User, error) {
 	return user, nil
 }
 
+// ldap 目录账户登录，首次登录时自动创建 user
+// 返回 token 和 user 结构
+func SaveLdapLogin(db *dbandmq.Ds, r *redis.Client, tenantId string, lu *ldapapp.LdapUser) (*User, string, error) {
+	user, err := GetUserByLdapLoginId(db, tenantId, lu.LoginId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if user == nil {
+		user, err = saveLdapLogin(db, tenantId, lu)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		// 同步目录中最新的信息
+		update := bson.M{
+			"$set": bson.M{
+				"dn":      lu.Dn,
+				"name":    lu.Name,
+				"email":   lu.Email,
+				"groups":  lu.Groups,
+				"updateT": util.GetCurTime(),
+			},
+		}
+		err = db.C(CollectionNameLdap).UpdateId(user.LdapAuth.Id, update)
+		if err != nil {
+			Logger.Errorf("", "ldap用户[%s]登录时，更新ldapAuth信息失败, %s", lu.LoginId, err.Error())
+			return nil, "", err
+		}
+		user.LdapAuth.Dn = lu.Dn
+		user.LdapAuth.Name = lu.Name
+		user.LdapAuth.Email = lu.Email
+		user.LdapAuth.Groups = lu.Groups
+
+		// 目录信息变化后，其他登录方式的 token 也需要刷新
+		if BumpUserVersion(db, user.Id) == nil {
+			user.Version++
+		}
+	}
+
+	// 生成 token
+	token, err := GenerateToken(user.Id, LoginTypeLdap)
+	if err != nil {
+		return nil, "", err
+	}
+	err = SaveToken(r, token, user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, token, nil
+}
+
+func saveLdapLogin(db *dbandmq.Ds, tenantId string, lu *ldapapp.LdapUser) (*User, error) {
+	user := &User{
+		Id:        util.GenerateDataId(),
+		TenantId:  tenantId,
+		Name:      lu.Name,
+		Ban:       false,
+		BanT:      0,
+		BanReason: "",
+		CreateT:   util.GetCurTime(),
+	}
+	user.UpdateT = user.CreateT
+
+	la := &LdapAuth{
+		Id:       util.GenerateDataId(),
+		UserId:   user.Id,
+		TenantId: tenantId,
+		LoginId:  lu.LoginId,
+		Dn:       lu.Dn,
+		Name:     lu.Name,
+		Email:    lu.Email,
+		Groups:   lu.Groups,
+		CreateT:  user.CreateT,
+		UpdateT:  user.UpdateT,
+	}
+
+	err := db.C(CollectionNameUser).Insert(user)
+	if err != nil {
+		Logger.Errorf("", "ldap用户[%s]首次登录时，创建user信息失败, %s", lu.LoginId, err.Error())
+		return nil, err
+	}
+
+	err = db.C(CollectionNameLdap).Insert(la)
+	if err != nil {
+		// 同一个账户同时首次登录时唯一索引冲突，删除刚创建的 user
+		Logger.Errorf("", "ldap用户[%s]首次登录时，保存ldapAuth信息失败, %s", lu.LoginId, err.Error())
+		_ = db.C(CollectionNameUser).RemoveId(user.Id)
+		return nil, err
+	}
+
+	user.LoginType = LoginTypeLdap
+	user.LdapAuth = la
+
+	err = recordSelfCreate(db, user, lu.LoginId)
+	if err != nil {
+		return nil, err
+	}
+
+	Logger.Infof("", "ldap用户[%s][%s]首次登录，创建user[%s]成功", lu.LoginId, lu.Dn, user.Id)
+	return user, nil
+}
+
+// 首次登录时自动创建的账户，操作人是用户自己
+func recordSelfCreate(db *dbandmq.Ds, user *User, account string) error {
+	opHis := ophistory.NewOpHistory(user.Id, user.Name, "")
+	opHis.TenantId = user.TenantId
+	opHis.SetParams(ophistory.Params{"account": account}).SetDiff(nil, user)
+	return ophistory.Record(db, opHis, ophistory.CodeUserCreate, ophistory.TargetUser, user.Id)
+}
+
+func GetUserByLdapLoginId(db *dbandmq.Ds, tenantId, loginId string) (*User, error) {
+	f := bson.M{
+		"tenantId": tenantId,
+		"loginId":  loginId,
+	}
+
+	var la *LdapAuth
+	err := db.C(CollectionNameLdap).Find(f).One(&la)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据ldap loginId[%s]读取登录信息失败, %s", loginId, err.Error())
+		return nil, err
+	}
+
+	if la == nil {
+		return nil, nil
+	}
+
+	user, err := GetUserById(db, la.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		Logger.Errorf("", "ldap loginId[%s]对应的user[%s]不存在", loginId, la.UserId)
+		return nil, nil
+	}
+
+	user.LoginType = LoginTypeLdap
+	user.LdapAuth = la
+
+	return user, nil
+}
+
 // 读取用户的所有可能的信息
 func GetUserFullInfoById(db *dbandmq.Ds, userId string) (*User, error) {
 	user, err := GetUserById(db, userId)
@@ -452,7 +719,7 @@ func GetUserFullInfoById(db *dbandmq.Ds, userId string) (*User, error) {
 	}
 
 	// id passwd 信息
-	idp, _ := getIdPasswdAuthByUserId(db, userId)
+	idp, _ := GetIdPasswdAuthByUserId(db, userId)
 	user.IdPasswd = idp
 
 	// phone
@@ -463,6 +730,14 @@ func GetUserFullInfoById(db *dbandmq.Ds, userId string) (*User, error) {
 	wca, _ := getWeChatAuthByUserId(db, userId)
 	user.WeChatAuth = wca
 
+	// ldap
+	la, _ := getLdapAuthByUserId(db, userId)
+	user.LdapAuth = la
+
+	// email
+	ea, _ := getEmailAuthByUserId(db, userId)
+	user.EmailAuth = ea
+
 	if user.Name == "" {
 		if idp != nil {
 			user.Name = idp.LoginId
@@ -470,13 +745,30 @@ func GetUserFullInfoById(db *dbandmq.Ds, userId string) (*User, error) {
 			user.Name = pa.Phone
 		} else if wca != nil {
 			user.Name = wca.Nickname
+		} else if la != nil {
+			user.Name = la.Name
 		}
 	}
 
 	return user, nil
 }
 
-func getIdPasswdAuthByUserId(db *dbandmq.Ds, userId string) (*UserLoginIdPasswdAuth, error) {
+func getEmailAuthByUserId(db *dbandmq.Ds, userId string) (*EmailAuth, error) {
+	f := bson.M{
+		"userId": userId,
+	}
+
+	var ea *EmailAuth
+	err := db.C(CollectionNameEmail).Find(f).One(&ea)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	return ea, nil
+}
+
+// 读取用户的账户密码登录方式，没有时返回 nil
+func GetIdPasswdAuthByUserId(db *dbandmq.Ds, userId string) (*UserLoginIdPasswdAuth, error) {
 	f := bson.M{
 		"userId": userId,
 	}
@@ -518,9 +810,24 @@ func getWeChatAuthByUserId(db *dbandmq.Ds, userId string) (*WeChatAuth, error) {
 	return wca, nil
 }
 
+func getLdapAuthByUserId(db *dbandmq.Ds, userId string) (*LdapAuth, error) {
+	f := bson.M{
+		"userId": userId,
+	}
+
+	var la *LdapAuth
+	err := db.C(CollectionNameLdap).Find(f).One(&la)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	return la, nil
+}
+
 // 搜索 loginid 模糊匹配信息
-func QueryLoginIdAuthByLoginId(db *dbandmq.Ds, lid string) ([]*UserLoginIdPasswdAuth, error) {
+func QueryLoginIdAuthByLoginId(db *dbandmq.Ds, tenantId, lid string) ([]*UserLoginIdPasswdAuth, error) {
 	f := bson.M{
+		"tenantId": tenantId,
 		"loginId": bson.M{
 			"$regex": lid,
 		},
@@ -536,8 +843,9 @@ func QueryLoginIdAuthByLoginId(db *dbandmq.Ds, lid string) ([]*UserLoginIdPasswd
 }
 
 // 搜索 phone 模糊匹配信息
-func QueryPhoneAuthByPhone(db *dbandmq.Ds, phone string) ([]*PhoneAuth, error) {
+func QueryPhoneAuthByPhone(db *dbandmq.Ds, tenantId, phone string) ([]*PhoneAuth, error) {
 	f := bson.M{
+		"tenantId": tenantId,
 		"phone": bson.M{
 			"$regex": phone,
 		},
@@ -553,8 +861,9 @@ func QueryPhoneAuthByPhone(db *dbandmq.Ds, phone string) ([]*PhoneAuth, error) {
 }
 
 // 搜索 wechat 模糊匹配信息
-func QueryWeChatAuthByNickname(db *dbandmq.Ds, nickname string) ([]*WeChatAuth, error) {
+func QueryWeChatAuthByNickname(db *dbandmq.Ds, tenantId, nickname string) ([]*WeChatAuth, error) {
 	f := bson.M{
+		"tenantId": tenantId,
 		"nickname": bson.M{
 			"$regex": nickname,
 		},
@@ -585,22 +894,3 @@ func IsValidPlatform(p string) bool {
 
 	return false
 }
-
-// 追加用户的变更历史记录
-func AppendOpHistoryToUser(db *dbandmq.Ds, id string, op *ophistory.OperationHistory) error {
-	update := bson.M{
-		"$set": bson.M{
-			"updateT": util.GetCurTime(),
-		},
-		"$push": bson.M{
-			"history": op,
-		},
-	}
-
-	err := db.C(CollectionNameUser).UpdateId(id, update)
-	if err != nil {
-		Logger.Errorf("", "更新用户[%s]操作历史[%s]失败", id, op.Action)
-		return err
-	}
-	return nil
-}
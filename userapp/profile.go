@@ -0,0 +1,150 @@
+package userapp
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"unicode/utf8"
+)
+
+// 可以修改的用户资料字段，值为 user 表中的字段名
+// attributes 表示所有自定义属性，也可以使用 attributes.<key> 指定单个属性
+const (
+	ProfileFieldName       = "name"
+	ProfileFieldAvatar     = "avatar"
+	ProfileFieldAttributes = "attributes"
+)
+
+var AllProfileFields = []string{
+	ProfileFieldName,
+	ProfileFieldAvatar,
+	ProfileFieldAttributes,
+}
+
+const attrFieldPrefix = ProfileFieldAttributes + "."
+
+const (
+	MaxNameLen   = 64
+	MaxAvatarLen = 1024
+)
+
+// 一个字段的修改内容
+// 自定义属性的 field 为 attributes.<key>，New 为 nil 时表示删除该属性
+type ProfileChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func IsProfileField(field string) bool {
+	if strings.HasPrefix(field, attrFieldPrefix) {
+		return len(field) > len(attrFieldPrefix)
+	}
+	for _, f := range AllProfileFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// 自定义属性在字段配置中的名字
+func AttrProfileField(key string) string {
+	return attrFieldPrefix + key
+}
+
+// 检查字段值是否合法，返回处理后的值
+func CheckProfileField(field, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch field {
+	case ProfileFieldName:
+		if value == "" {
+			return "", errors.New("name 不能为空")
+		}
+		if utf8.RuneCountInString(value) > MaxNameLen {
+			return "", fmt.Errorf("name 长度不能超过%d", MaxNameLen)
+		}
+	case ProfileFieldAvatar:
+		if len(value) > MaxAvatarLen {
+			return "", fmt.Errorf("avatar 长度不能超过%d", MaxAvatarLen)
+		}
+		if value != "" && !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+			return "", errors.New("avatar 必须是 http 或 https 地址")
+		}
+	default:
+		return "", fmt.Errorf("不支持修改字段[%s]", field)
+	}
+
+	return value, nil
+}
+
+// 读取字段当前值
+func (u *User) ProfileValue(field string) string {
+	switch field {
+	case ProfileFieldName:
+		return u.Name
+	case ProfileFieldAvatar:
+		return u.Avatar
+	}
+	return ""
+}
+
+// 修改用户资料，每个字段的修改都记录一条历史，包含修改前后的值
+func UpdateUserProfile(db *dbandmq.Ds, userId string, changes []*ProfileChange, opHis *ophistory.OperationHistory) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	setM := bson.M{
+		"updateT": util.GetCurTime(),
+	}
+	unsetM := bson.M{}
+	var hs []*ophistory.OperationHistory
+	for _, chg := range changes {
+		if chg.New == nil {
+			unsetM[chg.Field] = ""
+		} else {
+			setM[chg.Field] = chg.New
+		}
+		h := opHis.WithAction("")
+		h.Params = ophistory.Params{"field": chg.Field}
+		h.Changes = []*ophistory.Change{{Field: chg.Field, Old: chg.Old, New: chg.New}}
+		hs = append(hs, h)
+	}
+
+	update := bson.M{
+		"$set": setM,
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+	if len(unsetM) > 0 {
+		update["$unset"] = unsetM
+	}
+
+	err := db.C(CollectionNameUser).UpdateId(userId, update)
+	if err != nil {
+		if mgo.IsDup(err) {
+			return errors.New("属性值已被其他用户使用")
+		}
+		Logger.Errorf("", "修改用户[%s]资料失败, %s", userId, err.Error())
+		return err
+	}
+
+	// 资料已经修改，某个字段的审计日志写入失败时继续写入其他字段，返回第一个错误
+	var recordErr error
+	for _, h := range hs {
+		err = ophistory.Record(db, h, ophistory.CodeUserProfile, ophistory.TargetUser, userId)
+		if err != nil && recordErr == nil {
+			recordErr = err
+		}
+	}
+
+	return recordErr
+}
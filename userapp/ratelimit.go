@@ -0,0 +1,36 @@
+package userapp
+
+import (
+	"github.com/go-redis/redis"
+	. "github.com/leyle/ginbase/consolelog"
+	"time"
+)
+
+const RateLimitRedisPrefix = "USER:RATELIMIT:"
+
+// 计数和设置过期时间在一个脚本中执行，不会出现没有过期时间的计数
+// 没有过期时间的历史计数也会补上，避免一直被限制
+var rateLimitScript = redis.NewScript(`
+local cnt = redis.call('INCR', KEYS[1])
+if cnt == 1 or redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return cnt
+`)
+
+// 固定窗口限流，window 时间内同一个 key 最多允许 limit 次
+// limit <= 0 时不限制
+func AllowRequest(r *redis.Client, key string, limit int, window time.Duration) (bool, error) {
+	if limit <= 0 {
+		return true, nil
+	}
+
+	key = RateLimitRedisPrefix + key
+	cnt, err := rateLimitScript.Run(r, []string{key}, window.Nanoseconds()/int64(time.Millisecond)).Int64()
+	if err != nil {
+		Logger.Errorf("", "限流计数[%s]失败, %s", key, err.Error())
+		return false, err
+	}
+
+	return cnt <= int64(limit), nil
+}
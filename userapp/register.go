@@ -0,0 +1,319 @@
+package userapp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// 默认的 loginId 格式，字母开头，字母数字下划线，4-32 位
+const DefaultLoginIdPattern = `^[a-zA-Z][a-zA-Z0-9_]{3,31}$`
+
+// 密码策略
+type PasswdPolicy struct {
+	MinLen      int
+	NeedLetter  bool // 必须包含字母
+	NeedDigit   bool // 必须包含数字
+	NeedSpecial bool // 必须包含特殊字符
+}
+
+// 管理员创建账户和修改密码时使用的默认策略
+var DefaultPasswdPolicy = &PasswdPolicy{MinLen: 6}
+
+func (p *PasswdPolicy) Check(passwd string) error {
+	if len(passwd) < p.MinLen {
+		return fmt.Errorf("密码长度不能少于%d位", p.MinLen)
+	}
+
+	var hasLetter, hasDigit, hasSpecial bool
+	for _, c := range passwd {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsSpace(c):
+			return errors.New("密码不能包含空白字符")
+		default:
+			hasSpecial = true
+		}
+	}
+
+	if p.NeedLetter && !hasLetter {
+		return errors.New("密码必须包含字母")
+	}
+	if p.NeedDigit && !hasDigit {
+		return errors.New("密码必须包含数字")
+	}
+	if p.NeedSpecial && !hasSpecial {
+		return errors.New("密码必须包含特殊字符")
+	}
+
+	return nil
+}
+
+// 检查 loginId 格式，pattern 为空时使用默认格式
+func CheckLoginId(pattern *regexp.Regexp, loginId string) error {
+	if pattern == nil {
+		pattern = regexp.MustCompile(DefaultLoginIdPattern)
+	}
+	if !pattern.MatchString(loginId) {
+		return errors.New("loginId 格式错误")
+	}
+	return nil
+}
+
+// 新建账户密码登录方式的 user，并记录审计日志
+// 调用方需要先检查 loginId 是否已存在
+func CreateIdPasswdAccount(db *dbandmq.Ds, tenantId, loginId, passwd, avatar string, selfReg bool, opHis *ophistory.OperationHistory) (*User, error) {
+	createdBy := ""
+	if opHis != nil && !selfReg {
+		createdBy = opHis.UserId
+	}
+	user, err := NewIdPasswdAccount(db, tenantId, loginId, passwd, avatar, selfReg, createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// 登录方式保存成功后才记录，避免审计日志和 webhook 中出现不存在的用户
+	if opHis != nil {
+		err = RecordAccountCreate(db, opHis, loginId, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// 新建账户密码登录方式的 user，不记录审计日志
+// 用于后续还有其他步骤的场景，全部成功后由调用方调用 RecordAccountCreate
+func NewIdPasswdAccount(db *dbandmq.Ds, tenantId, loginId, passwd, avatar string, selfReg bool, createdBy string) (*User, error) {
+	user := &User{
+		Id:        util.GenerateDataId(),
+		TenantId:  tenantId,
+		Name:      loginId,
+		Avatar:    avatar,
+		CreatedBy: createdBy,
+		CreateT:   util.GetCurTime(),
+	}
+	user.UpdateT = user.CreateT
+
+	err := db.C(CollectionNameUser).Insert(user)
+	if err != nil {
+		Logger.Errorf("", "新建账户[%s]时，保存user信息失败, %s", loginId, err.Error())
+		return nil, err
+	}
+
+	// 管理员创建的账户，首次登录需要修改密码
+	ulpa, err := AddIdPasswdAuth(db, tenantId, user.Id, loginId, passwd, avatar, selfReg, !selfReg)
+	if err != nil {
+		_ = db.C(CollectionNameUser).RemoveId(user.Id)
+		return nil, err
+	}
+	user.IdPasswd = ulpa
+
+	return user, nil
+}
+
+// 记录新建账户的审计日志
+func RecordAccountCreate(db *dbandmq.Ds, opHis *ophistory.OperationHistory, loginId string, user *User) error {
+	opHis.SetParams(ophistory.Params{"account": loginId}).SetDiff(nil, user)
+	return ophistory.Record(db, opHis, ophistory.CodeUserCreate, ophistory.TargetUser, user.Id)
+}
+
+// 删除新建的账户，包括 user 和所有的账户密码登录方式
+// 用于新建账户后的步骤失败时回滚
+func RemoveIdPasswdAccount(db *dbandmq.Ds, userId string) error {
+	_, err := db.C(CollectionNameIdPasswd).RemoveAll(bson.M{"userId": userId})
+	if err != nil {
+		Logger.Errorf("", "回滚删除用户[%s]的登录方式失败, %s", userId, err.Error())
+		return err
+	}
+	err = db.C(CollectionNameUser).RemoveId(userId)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "回滚删除用户[%s]失败, %s", userId, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 给已有 user 添加一个账户密码登录方式
+func AddIdPasswdAuth(db *dbandmq.Ds, tenantId, userId, loginId, passwd, avatar string, selfReg, init bool) (*UserLoginIdPasswdAuth, error) {
+	salt := util.GenerateDataId()
+	ulpa := &UserLoginIdPasswdAuth{
+		Id:       util.GenerateDataId(),
+		UserId:   userId,
+		TenantId: tenantId,
+		LoginId:  loginId,
+		Avatar:   avatar,
+		Salt:     salt,
+		Passwd:   util.Sha256(passwd + salt),
+		Init:     init,
+		SelfReg:  selfReg,
+		CreateT:  util.GetCurTime(),
+	}
+	ulpa.UpdateT = ulpa.CreateT
+
+	err := db.C(CollectionNameIdPasswd).Insert(ulpa)
+	if err != nil {
+		Logger.Errorf("", "给用户[%s]添加loginId[%s]失败, %s", userId, loginId, err.Error())
+		return nil, err
+	}
+	_ = BumpUserVersion(db, userId)
+
+	return ulpa, nil
+}
+
+// 检查账户密码是否正确
+func CheckIdPasswd(ulpa *UserLoginIdPasswdAuth, passwd string) bool {
+	return ulpa != nil && util.Sha256(passwd+ulpa.Salt) == ulpa.Passwd
+}
+
+// 重置账户密码登录方式的密码，密码需要符合 policy
+// 用户所有登录方式的 token 都会失效，已泄露的 token 立即失效，init 时下次登录需要修改密码
+// 默认租户升级前的数据可能还没有 tenantId
+// code 区分管理员重置、自己修改和找回密码，opHis 中已有的 params 会保留
+func ResetIdPasswd(db *dbandmq.Ds, r *redis.Client, policy *PasswdPolicy, tenantId, loginId, passwd string, init bool, code string, opHis *ophistory.OperationHistory) (*UserLoginIdPasswdAuth, error) {
+	err := policy.Check(passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := util.GenerateDataId()
+	update := bson.M{
+		"$set": bson.M{
+			"salt":    salt,
+			"passwd":  util.Sha256(passwd + salt),
+			"init":    init,
+			"updateT": util.GetCurTime(),
+		},
+	}
+	f := bson.M{
+		"tenantId": tenantId,
+		"loginId":  loginId,
+	}
+	if tenantapp.IsDefault(tenantId) {
+		f["tenantId"] = bson.M{"$in": []interface{}{tenantapp.DefaultTenantId, nil}}
+	}
+
+	var ulpa *UserLoginIdPasswdAuth
+	_, err = db.C(CollectionNameIdPasswd).Find(f).Apply(mgo.Change{Update: update, ReturnNew: true}, &ulpa)
+	if err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("账户[%s]不存在", loginId)
+	}
+	if err != nil {
+		Logger.Errorf("", "重置账户[%s]的密码失败, %s", loginId, err.Error())
+		return nil, err
+	}
+
+	// 版本号变化，验证 token 时刷新缓存的用户信息
+	_ = BumpUserVersion(db, ulpa.UserId)
+
+	err = DeleteUserTokens(r, ulpa.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	userName := loginId
+	user, _ := GetUserById(db, ulpa.UserId)
+	if user != nil {
+		userName = user.Name
+	}
+	params := ophistory.Params{"userName": userName, "init": init}
+	for k, v := range opHis.Params {
+		params[k] = v
+	}
+	opHis.SetParams(params)
+	err = ophistory.Record(db, opHis, code, ophistory.TargetUser, ulpa.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	return ulpa, nil
+}
+
+// 给已有 user 添加一个 phone 登录方式
+func AddPhoneAuth(db *dbandmq.Ds, tenantId, userId, phone string, selfReg bool) (*PhoneAuth, error) {
+	pa := &PhoneAuth{
+		Id:       util.GenerateDataId(),
+		UserId:   userId,
+		TenantId: tenantId,
+		Phone:    phone,
+		SelfReg:  selfReg,
+		CreateT:  util.GetCurTime(),
+	}
+	pa.UpdateT = pa.CreateT
+
+	err := db.C(CollectionNamePhone).Insert(pa)
+	if err != nil {
+		Logger.Errorf("", "给用户[%s]添加phone[%s]失败, %s", userId, phone, err.Error())
+		return nil, err
+	}
+	_ = BumpUserVersion(db, userId)
+
+	return pa, nil
+}
+
+// 给已有 user 添加一个已验证的邮箱
+func AddEmailAuth(db *dbandmq.Ds, tenantId, userId, email string, selfReg bool) (*EmailAuth, error) {
+	ea := &EmailAuth{
+		Id:       util.GenerateDataId(),
+		UserId:   userId,
+		TenantId: tenantId,
+		Email:    strings.ToLower(strings.TrimSpace(email)),
+		Verified: true,
+		SelfReg:  selfReg,
+		CreateT:  util.GetCurTime(),
+	}
+	ea.UpdateT = ea.CreateT
+
+	err := db.C(CollectionNameEmail).Insert(ea)
+	if err != nil {
+		Logger.Errorf("", "给用户[%s]添加email[%s]失败, %s", userId, email, err.Error())
+		return nil, err
+	}
+	_ = BumpUserVersion(db, userId)
+
+	return ea, nil
+}
+
+func GetUserByEmail(db *dbandmq.Ds, tenantId, email string) (*User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	f := bson.M{
+		"tenantId": tenantId,
+		"email":    email,
+	}
+
+	var ea *EmailAuth
+	err := db.C(CollectionNameEmail).Find(f).One(&ea)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据email[%s]读取信息失败, %s", email, err.Error())
+		return nil, err
+	}
+
+	if ea == nil {
+		return nil, nil
+	}
+
+	user, err := GetUserById(db, ea.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil
+	}
+	user.EmailAuth = ea
+
+	return user, nil
+}
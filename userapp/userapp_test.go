@@ -84,4 +84,95 @@ func TestCheckToken(t *testing.T) {
 	t.Log(tk.T)
 	t.Log(tk.Token)
 	t.Log(tk.User)
-}
\ No newline at end of file
+}
+func TestPasswdPolicy(t *testing.T) {
+	p := &PasswdPolicy{MinLen: 8, NeedLetter: true, NeedDigit: true}
+
+	cases := map[string]bool{
+		"abc123":     false, // 过短
+		"abcdefgh":   false, // 无数字
+		"12345678":   false, // 无字母
+		"abcd 1234":  false, // 包含空白
+		"abcd1234":   true,
+		"abcd1234!@": true,
+	}
+	for passwd, valid := range cases {
+		err := p.Check(passwd)
+		if (err == nil) != valid {
+			t.Errorf("Check(%q) err = %v, want valid %v", passwd, err, valid)
+		}
+	}
+}
+
+func TestCheckLoginId(t *testing.T) {
+	cases := map[string]bool{
+		"abc":        false,
+		"1abcd":      false,
+		"abcd-e":     false,
+		"abcd_1234":  true,
+		"TestUser01": true,
+	}
+	for loginId, valid := range cases {
+		err := CheckLoginId(nil, loginId)
+		if (err == nil) != valid {
+			t.Errorf("CheckLoginId(%q) err = %v, want valid %v", loginId, err, valid)
+		}
+	}
+}
+
+func TestIsBannedAt(t *testing.T) {
+	now := int64(1600000000)
+
+	cases := []struct {
+		user   *User
+		banned bool
+	}{
+		{&User{Ban: false, BanT: now + 100}, false},
+		{&User{Ban: true, BanT: now + 100}, true},
+		{&User{Ban: true, BanT: now - 1}, false},                        // 已到期
+		{&User{Ban: true, BanStartT: now + 10, BanT: now + 100}, false}, // 定时封禁未生效
+		{&User{Ban: true, BanStartT: now - 10, BanT: now + 100}, true},
+		{&User{Ban: true}, true}, // 无到期时间
+	}
+
+	for i, tc := range cases {
+		if tc.user.IsBannedAt(now) != tc.banned {
+			t.Errorf("case %d: IsBannedAt = %v, want %v", i, !tc.banned, tc.banned)
+		}
+	}
+}
+
+func TestValidateAttributes(t *testing.T) {
+	defs := []*AttrDef{
+		{Key: "empNo", Type: AttrTypeString, Required: true, Visibility: AttrVisibilityPublic},
+		{Key: "level", Type: AttrTypeNumber, Visibility: AttrVisibilityPrivate},
+		{Key: "joinDate", Type: AttrTypeDate, Visibility: AttrVisibilityPrivate},
+	}
+
+	cases := []struct {
+		old   map[string]interface{}
+		attrs map[string]interface{}
+		valid bool
+	}{
+		{nil, map[string]interface{}{"empNo": "E001", "level": float64(3)}, true},
+		{nil, map[string]interface{}{"level": float64(3)}, false},                       // 缺少必填
+		{nil, map[string]interface{}{"empNo": "E001", "level": "3"}, false},             // 类型错误
+		{nil, map[string]interface{}{"empNo": "E001", "joinDate": "2020/01/01"}, false}, // 日期格式错误
+		{nil, map[string]interface{}{"empNo": "E001", "other": "x"}, false},             // 未定义
+		{map[string]interface{}{"empNo": "E001"}, map[string]interface{}{"level": float64(1)}, true},
+		{map[string]interface{}{"empNo": "E001"}, map[string]interface{}{"empNo": nil}, false}, // 删除必填
+	}
+
+	for i, tc := range cases {
+		_, err := ValidateAttributes(defs, tc.old, tc.attrs)
+		if (err == nil) != tc.valid {
+			t.Errorf("case %d: err = %v, want valid %v", i, err, tc.valid)
+		}
+	}
+
+	attrs := map[string]interface{}{"empNo": "E001", "level": float64(3), "removed": "x"}
+	pub := FilterAttributes(defs, attrs, AttrVisibilityPublic)
+	if len(pub) != 1 || pub["empNo"] != "E001" {
+		t.Errorf("FilterAttributes = %v, want only empNo", pub)
+	}
+}
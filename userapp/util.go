@@ -9,6 +9,7 @@ import (
 	. "github.com/leyle/ginbase/consolelog"
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/tenantapp"
 	"strconv"
 	"strings"
 	"time"
@@ -111,6 +112,23 @@ func DeleteToken(r *redis.Client, userId, loginType string) error {
 	return nil
 }
 
+// 删除用户所有登录方式的 token，用于重置密码、封禁等需要强制下线的场景
+func DeleteUserTokens(r *redis.Client, userId string) error {
+	var keys []string
+	for _, loginType := range AllLoginTypes {
+		keys = append(keys, generateTokenKey(userId, loginType))
+	}
+
+	_, err := r.Del(keys...).Result()
+	if err != nil && err != redis.Nil {
+		Logger.Errorf("", "移除用户[%s]所有token失败, %s", userId, err.Error())
+		return err
+	}
+
+	Logger.Infof("", "移除用户[%s]所有token成功", userId)
+	return nil
+}
+
 // 验证 token
 func CheckToken(r *redis.Client, token string) (*TokenVal, error) {
 	// 先解析 token
@@ -152,8 +170,9 @@ func generateTokenKey(userId, loginType string) string {
 }
 
 // 确保系统启动时包含了系统管理员账户
+// 系统管理员属于默认租户
 func InsureAdminAccount(db *dbandmq.Ds) (*User, error) {
-	user, err := GetUserByLoginId(db, AdminLoginId)
+	user, err := GetUserByLoginId(db, tenantapp.DefaultTenantId, AdminLoginId)
 	if err != nil {
 		return nil, err
 	}
@@ -168,11 +187,23 @@ func InsureAdminAccount(db *dbandmq.Ds) (*User, error) {
 
 	Logger.Infof("", "启动userapp，init admin 账户成功，userId[%s]", user.Id)
 
-	AdminUserId = user.Id
+	SetAdminUserId(user.Id)
 
 	return user, nil
 }
 
+// 重新读取系统管理员的 userId，其他实例修改了用户数据后调用
+func ReloadAdminUserId(db *dbandmq.Ds) error {
+	user, err := GetUserByLoginId(db, tenantapp.DefaultTenantId, AdminLoginId)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		SetAdminUserId(user.Id)
+	}
+	return nil
+}
+
 func initAdminAccount(db *dbandmq.Ds) (*User, error) {
 	salt := util.GenerateDataId()
 	p := AdminLoginPasswd + salt
@@ -180,6 +211,7 @@ func initAdminAccount(db *dbandmq.Ds) (*User, error) {
 
 	user := &User{
 		Id:        util.GenerateDataId(),
+		TenantId:  tenantapp.DefaultTenantId,
 		Name:      AdminLoginId,
 		CreateT:   util.GetCurTime(),
 	}
@@ -188,6 +220,7 @@ func initAdminAccount(db *dbandmq.Ds) (*User, error) {
 	ulpa := &UserLoginIdPasswdAuth{
 		Id:      util.GenerateDataId(),
 		UserId:  user.Id,
+		TenantId: tenantapp.DefaultTenantId,
 		LoginId: AdminLoginId,
 		Salt:    salt,
 		Passwd:  hashP,
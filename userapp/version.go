@@ -0,0 +1,78 @@
+package userapp
+
+import (
+	"errors"
+	"github.com/go-redis/redis"
+	jsoniter "github.com/json-iterator/go"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 用户信息版本号
+// 修改 user 表或者登录方式信息后，版本号加 1
+// token 中缓存的 user 版本号与数据库不一致时，验证 token 时会刷新缓存
+func BumpUserVersion(db *dbandmq.Ds, userId string) error {
+	update := bson.M{
+		"$set": bson.M{
+			"updateT": util.GetCurTime(),
+		},
+		"$inc": bson.M{
+			"version": 1,
+		},
+	}
+
+	err := db.C(CollectionNameUser).UpdateId(userId, update)
+	if err != nil {
+		Logger.Errorf("", "更新用户[%s]版本号失败, %s", userId, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+var errTokenReplaced = errors.New("token已被替换")
+
+// 使用最新的 user 信息刷新 token 中缓存的数据
+// 只在 redis 中仍是同一个 token 时才写入，避免覆盖新登录的 token 或恢复已退出的 token
+func RefreshTokenUser(r *redis.Client, tkVal *TokenVal, user *User) error {
+	key := generateTokenKey(user.Id, user.LoginType)
+
+	err := r.Watch(func(tx *redis.Tx) error {
+		data, err := tx.Get(key).Result()
+		if err != nil {
+			return err
+		}
+
+		var cur *TokenVal
+		err = jsoniter.UnmarshalFromString(data, &cur)
+		if err != nil {
+			return err
+		}
+		if cur.Token != tkVal.Token {
+			return errTokenReplaced
+		}
+
+		newVal := &TokenVal{
+			Token: tkVal.Token,
+			User:  user,
+			T:     tkVal.T,
+		}
+		dump, _ := jsoniter.Marshal(newVal)
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, dump, 0)
+			return nil
+		})
+		return err
+	}, key)
+
+	if err != nil {
+		Logger.Errorf("", "刷新用户[%s][%s]token中的用户信息失败, %s", user.Id, user.LoginType, err.Error())
+		return err
+	}
+
+	Logger.Debugf("", "刷新用户[%s][%s]token中的用户信息成功，版本[%d]", user.Id, user.LoginType, user.Version)
+	return nil
+}
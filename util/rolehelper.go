@@ -6,6 +6,7 @@ import (
 	"github.com/leyle/ginbase/dbandmq"
 	"github.com/leyle/ginbase/util"
 	"github.com/leyle/userandrole/roleapp"
+	"github.com/leyle/userandrole/tenantapp"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -37,6 +38,72 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 			Method: "GET",
 			Path:   uriPrefix + "/user/me",
 		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "用户修改自己的资料",
+			Method: "PUT",
+			Path:   uriPrefix + "/user/me",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "用户读取自己已绑定的登录方式",
+			Method: "GET",
+			Path:   uriPrefix + "/user/me/auths",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "用户绑定登录方式",
+			Method: "POST",
+			Path:   uriPrefix + "/user/me/link",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "用户解绑登录方式",
+			Method: "POST",
+			Path:   uriPrefix + "/user/me/unlink",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "用户申请role",
+			Method: "POST",
+			Path:   uriPrefix + "/user/me/accessrequest",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "用户读取自己的授权申请",
+			Method: "GET",
+			Path:   uriPrefix + "/user/me/accessrequests",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "通过授权申请",
+			Method: "POST",
+			Path:   uriPrefix + "/grantrequest/*/approve",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "拒绝授权申请",
+			Method: "POST",
+			Path:   uriPrefix + "/grantrequest/*/reject",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "撤回授权申请",
+			Method: "POST",
+			Path:   uriPrefix + "/grantrequest/*/cancel",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取授权申请明细",
+			Method: "GET",
+			Path:   uriPrefix + "/grantrequest/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取待自己审批的授权申请",
+			Method: "GET",
+			Path:   uriPrefix + "/grantrequests/todo",
+		},
 		&roleapp.Item{
 			Id:     util.GenerateDataId(),
 			Name:   "退出登录",
@@ -53,6 +120,7 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 
 	for _, tmp := range defaultRoleItems {
 		tmp.DataFrom = roleapp.DataFromSystem
+		tmp.TenantId = tenantapp.DefaultTenantId
 	}
 
 	roleItems := []*roleapp.Item{
@@ -174,6 +242,12 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 			Method: "POST",
 			Path:   uriPrefix + "/role/role/*/delchildrole",
 		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "设置role审批",
+			Method: "PUT",
+			Path:   uriPrefix + "/role/role/*/approval",
+		},
 		&roleapp.Item{
 			Id:     util.GenerateDataId(),
 			Name:   "查看role信息",
@@ -224,6 +298,36 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 			Method: "GET",
 			Path:   uriPrefix + "/user/user/*",
 		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "修改指定id的用户资料",
+			Method: "PUT",
+			Path:   uriPrefix + "/user/user/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "新建用户自定义属性",
+			Method: "POST",
+			Path:   uriPrefix + "/user/attrdef",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "修改用户自定义属性",
+			Method: "PUT",
+			Path:   uriPrefix + "/user/attrdef/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "删除用户自定义属性",
+			Method: "DELETE",
+			Path:   uriPrefix + "/user/attrdef/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取用户自定义属性列表",
+			Method: "GET",
+			Path:   uriPrefix + "/user/attrdefs",
+		},
 		&roleapp.Item{
 			Id:     util.GenerateDataId(),
 			Name:   "根据微信openid读取用户信息",
@@ -242,6 +346,36 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 			Method: "GET",
 			Path:   uriPrefix + "/user/users",
 		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "预览合并账户",
+			Method: "POST",
+			Path:   uriPrefix + "/user/merge/preview",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "合并账户",
+			Method: "POST",
+			Path:   uriPrefix + "/user/merge",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "撤销合并账户",
+			Method: "POST",
+			Path:   uriPrefix + "/user/merge/undo/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取合并记录明细",
+			Method: "GET",
+			Path:   uriPrefix + "/user/merge/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "搜索合并记录",
+			Method: "GET",
+			Path:   uriPrefix + "/user/merges",
+		},
 
 		///////////////////////////////////////////
 		&roleapp.Item{
@@ -268,9 +402,290 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 			Method: "GET",
 			Path:   uriPrefix + "/uwr/users",
 		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "指定由某用户管理的用户",
+			Method: "POST",
+			Path:   uriPrefix + "/uwr/addmanagedusers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "取消指定的管理关系",
+			Method: "POST",
+			Path:   uriPrefix + "/uwr/delmanagedusers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "搜索授权申请",
+			Method: "GET",
+			Path:   uriPrefix + "/grantrequests",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "搜索审计日志",
+			Method: "GET",
+			Path:   uriPrefix + "/auditlogs",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "校验审计日志",
+			Method: "GET",
+			Path:   uriPrefix + "/auditlogs/verify",
+		},
+
+		///////////////////////////////////////////
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "新建webhook",
+			Method: "POST",
+			Path:   uriPrefix + "/webhook",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "修改webhook",
+			Method: "PUT",
+			Path:   uriPrefix + "/webhook/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "重置webhook签名密钥",
+			Method: "POST",
+			Path:   uriPrefix + "/webhook/*/secret",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "删除webhook",
+			Method: "DELETE",
+			Path:   uriPrefix + "/webhook/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取webhook明细",
+			Method: "GET",
+			Path:   uriPrefix + "/webhook/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "搜索webhook",
+			Method: "GET",
+			Path:   uriPrefix + "/webhooks",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取webhook支持的事件",
+			Method: "GET",
+			Path:   uriPrefix + "/webhookevents",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取webhook投递记录明细",
+			Method: "GET",
+			Path:   uriPrefix + "/webhookdelivery/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "重新投递webhook",
+			Method: "POST",
+			Path:   uriPrefix + "/webhookdelivery/*/redeliver",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "搜索webhook投递日志",
+			Method: "GET",
+			Path:   uriPrefix + "/webhookdeliveries",
+		},
+
+		///////////////////////////////////////////
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "新建部门",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "修改部门名字",
+			Method: "PUT",
+			Path:   uriPrefix + "/org/unit/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "移动部门",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/move",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "删除部门",
+			Method: "DELETE",
+			Path:   uriPrefix + "/org/unit/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取部门明细",
+			Method: "GET",
+			Path:   uriPrefix + "/org/unit/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取下级部门列表",
+			Method: "GET",
+			Path:   uriPrefix + "/org/units",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "添加部门成员",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/addmembers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "移除部门成员",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/delmembers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "设置用户主部门",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/primary",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取部门成员",
+			Method: "GET",
+			Path:   uriPrefix + "/org/unit/*/members",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "给部门添加角色",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/addroles",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "取消部门角色",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/delroles",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "设置部门负责人",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/addmanagers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "取消部门负责人",
+			Method: "POST",
+			Path:   uriPrefix + "/org/unit/*/delmanagers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取用户所属部门",
+			Method: "GET",
+			Path:   uriPrefix + "/org/user/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "新建用户组",
+			Method: "POST",
+			Path:   uriPrefix + "/group",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "修改用户组信息",
+			Method: "PUT",
+			Path:   uriPrefix + "/group/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "删除用户组",
+			Method: "DELETE",
+			Path:   uriPrefix + "/group/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取用户组明细",
+			Method: "GET",
+			Path:   uriPrefix + "/group/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "添加用户组成员",
+			Method: "POST",
+			Path:   uriPrefix + "/group/*/addmembers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "移除用户组成员",
+			Method: "POST",
+			Path:   uriPrefix + "/group/*/delmembers",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "给用户组添加角色",
+			Method: "POST",
+			Path:   uriPrefix + "/group/*/addroles",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "取消用户组角色",
+			Method: "POST",
+			Path:   uriPrefix + "/group/*/delroles",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "搜索用户组",
+			Method: "GET",
+			Path:   uriPrefix + "/groups",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取用户所属用户组",
+			Method: "GET",
+			Path:   uriPrefix + "/groups/user/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "新建租户",
+			Method: "POST",
+			Path:   uriPrefix + "/tenant",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "修改租户信息",
+			Method: "PUT",
+			Path:   uriPrefix + "/tenant/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "暂停租户",
+			Method: "POST",
+			Path:   uriPrefix + "/tenant/*/suspend",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "恢复租户",
+			Method: "POST",
+			Path:   uriPrefix + "/tenant/*/resume",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "读取租户明细",
+			Method: "GET",
+			Path:   uriPrefix + "/tenant/*",
+		},
+		&roleapp.Item{
+			Id:     util.GenerateDataId(),
+			Name:   "搜索租户",
+			Method: "GET",
+			Path:   uriPrefix + "/tenants",
+		},
 	}
 	for _, tmp := range roleItems {
 		tmp.DataFrom = roleapp.DataFromSystem
+		tmp.TenantId = tenantapp.DefaultTenantId
 	}
 
 	// 1. 检查上面所有的 items 是否存在，不存在的就创建
@@ -305,6 +720,7 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 
 	defaultP := &roleapp.Permission{
 		Id:       util.GenerateDataId(),
+		TenantId: tenantapp.DefaultTenantId,
 		Name:     "注册用户默认权限",
 		ItemIds:  ditemIds,
 		DataFrom: roleapp.DataFromSystem,
@@ -325,6 +741,7 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 	allItemIds = append(allItemIds, ditemIds...)
 	apiP := &roleapp.Permission{
 		Id:       util.GenerateDataId(),
+		TenantId: tenantapp.DefaultTenantId,
 		Name:     "roleApi 管理权限",
 		ItemIds:  allItemIds,
 		DataFrom: roleapp.DataFromSystem,
@@ -339,7 +756,7 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 	}
 
 	// 4. 将 defautp 给 default role
-	defaultRole, err := roleapp.GetRoleById(db, roleapp.DefaultRoleId, false)
+	defaultRole, err := roleapp.GetRoleById(db, roleapp.DefaultRoleId(), false)
 	if err != nil {
 		return err
 	}
@@ -358,6 +775,7 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 	// 5. 将所有 p 给 api role
 	apiR := &roleapp.Role{
 		Id:            util.GenerateDataId(),
+		TenantId:      tenantapp.DefaultTenantId,
 		Name:          "api管理员",
 		PermissionIds: allItemIds,
 		DataFrom:      roleapp.DataFromSystem,
@@ -365,7 +783,7 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 		CreateT:       t,
 		UpdateT:       t,
 	}
-	apiRole, err := roleapp.GetRoleByName(db, apiR.Name, false)
+	apiRole, err := roleapp.GetRoleByName(db, tenantapp.DefaultTenantId, apiR.Name, false)
 	if err != nil {
 		return err
 	}
@@ -387,7 +805,7 @@ func RbacHelper(db *dbandmq.Ds, uriPrefix string) error {
 
 func insurenItem(db *dbandmq.Ds, item *roleapp.Item) (*roleapp.Item, error) {
 	// 按 name 查询，不存在就创建
-	dbitem, err := roleapp.GetItemByName(db, item.Name)
+	dbitem, err := roleapp.GetItemByName(db, tenantapp.DefaultTenantId, item.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -420,7 +838,7 @@ func updateItemSetDataFrom(ds *dbandmq.Ds, id string) {
 
 func insurePermission(db *dbandmq.Ds, p *roleapp.Permission) (*roleapp.Permission, error) {
 	Logger.Debugf("", "当前处理权限[%s]", p.Name)
-	dbp, err := roleapp.GetPermissionByName(db, p.Name, false)
+	dbp, err := roleapp.GetPermissionByName(db, tenantapp.DefaultTenantId, p.Name, false)
 	if err != nil {
 		return nil, err
 	}
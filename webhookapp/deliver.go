@@ -0,0 +1,209 @@
+package webhookapp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 投递请求头
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const (
+	MaxDeliveryAttempts   = 8                // 最多投递次数，用完后标记为失败
+	DeliveryTimeout       = 10 * time.Second // 单次请求超时时间
+	DeliveryCheckInterval = 5 * time.Second  // 后台检查待投递记录的间隔
+
+	deliveryBatchSize = 100
+	firstRetryBackoff = 30 * time.Second
+	maxRetryBackoff   = time.Hour
+
+	// 投递中的记录超过这个时间没有结果，认为投递的进程已退出，重新投递
+	sendingTimeout = 5 * time.Minute
+)
+
+var httpClient = newDeliveryClient()
+
+// 第 attempts 次投递失败后的重试间隔，从 30 秒开始每次翻倍，最长 1 小时
+func RetryBackoff(attempts int) time.Duration {
+	d := firstRetryBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+	return d
+}
+
+// 签名，hmac-sha256(secret, timestamp + "." + body)
+// 接收方使用相同的方法计算后与请求头 X-Webhook-Signature 对比
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 发送一次投递请求，返回 2xx 时成功
+func send(client *http.Client, reqUrl, secret string, d *Delivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderDelivery, d.Id)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, ts, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("返回状态码%d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// 投递到期的记录，返回处理的记录数
+// 每条记录先改为投递中再发送，多个进程同时运行时不会重复投递
+func DeliverPending(db *dbandmq.Ds) (int, error) {
+	now := time.Now()
+
+	// 超时的投递中记录重新投递
+	f := bson.M{
+		"status":          DeliveryStatusSending,
+		"updateT.seconds": bson.M{"$lt": now.Add(-sendingTimeout).Unix()},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":  DeliveryStatusPending,
+			"updateT": util.GetCurTime(),
+		},
+	}
+	_, err := db.C(CollectionNameDelivery).UpdateAll(f, update)
+	if err != nil {
+		Logger.Errorf("", "恢复超时的webhook投递记录失败, %s", err.Error())
+		return 0, err
+	}
+
+	cnt := 0
+	for cnt < deliveryBatchSize {
+		f = bson.M{
+			"status": DeliveryStatusPending,
+			"nextT":  bson.M{"$lte": now.Unix()},
+		}
+		change := mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{
+					"status":  DeliveryStatusSending,
+					"updateT": util.GetCurTime(),
+				},
+			},
+			ReturnNew: true,
+		}
+		var d *Delivery
+		_, err = db.C(CollectionNameDelivery).Find(f).Sort("nextT").Apply(change, &d)
+		if err == mgo.ErrNotFound {
+			break
+		}
+		if err != nil {
+			Logger.Errorf("", "读取待投递的webhook记录失败, %s", err.Error())
+			return cnt, err
+		}
+
+		err = deliverOne(db, httpClient, d)
+		if err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+
+	return cnt, nil
+}
+
+// 投递一条记录并保存结果
+func deliverOne(db *dbandmq.Ds, client *http.Client, d *Delivery) error {
+	w, err := GetWebhookById(db, d.WebhookId)
+	if err != nil {
+		return err
+	}
+
+	curT := util.GetCurTime()
+	set := bson.M{
+		"updateT": curT,
+	}
+	switch {
+	case w == nil:
+		set["status"] = DeliveryStatusFailed
+		set["lastError"] = ErrWebhookNotFound.Error()
+	case !w.Enable:
+		set["status"] = DeliveryStatusFailed
+		set["lastError"] = ErrWebhookDisabled.Error()
+	default:
+		code, err := send(client, w.Url, w.Secret, d)
+		d.Attempts++
+		set["url"] = w.Url
+		set["attempts"] = d.Attempts
+		set["lastStatusCode"] = code
+		if err == nil {
+			set["status"] = DeliveryStatusSuccess
+			set["lastError"] = ""
+			set["deliveredT"] = curT
+		} else {
+			set["lastError"] = err.Error()
+			if d.Attempts >= MaxDeliveryAttempts {
+				set["status"] = DeliveryStatusFailed
+			} else {
+				set["status"] = DeliveryStatusPending
+				set["nextT"] = time.Now().Add(RetryBackoff(d.Attempts)).Unix()
+			}
+			Logger.Warnf("", "投递[%s]到webhook[%s]失败，第%d次, %s", d.Id, d.WebhookId, d.Attempts, err.Error())
+		}
+	}
+
+	err = db.C(CollectionNameDelivery).UpdateId(d.Id, bson.M{"$set": set})
+	if err != nil {
+		Logger.Errorf("", "保存webhook投递[%s]结果失败, %s", d.Id, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 后台定时投递，程序启动时调用
+func StartDeliveryJob(ds *dbandmq.Ds) {
+	go func() {
+		ticker := time.NewTicker(DeliveryCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			db := ds.CopyDs()
+			_, _ = DeliverPending(db)
+			db.Close()
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package webhookapp
+
+import (
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/userandrole/ophistory"
+	"github.com/leyle/userandrole/tenantapp"
+)
+
+// 支持订阅的事件
+const (
+	EventUserCreated  = "user.created"
+	EventUserBanned   = "user.banned"
+	EventUserUnbanned = "user.unbanned"
+	EventUserLogin    = "user.login"
+	EventRoleUpdated  = "role.updated" // role 的新建、修改、删除
+	EventUwrChanged   = "uwr.changed"  // 用户拥有的 roles 或管理范围变化
+)
+
+var Events = []string{
+	EventUserCreated,
+	EventUserBanned,
+	EventUserUnbanned,
+	EventUserLogin,
+	EventRoleUpdated,
+	EventUwrChanged,
+}
+
+func IsValidEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// 审计日志操作类型对应的事件
+var codeEvents = map[string]string{
+	ophistory.CodeUserCreate:       EventUserCreated,
+	ophistory.CodeUserRegister:     EventUserCreated,
+	ophistory.CodeUserBan:          EventUserBanned,
+	ophistory.CodeUserBindPhoneBan: EventUserBanned,
+	ophistory.CodeUserUnBan:        EventUserUnbanned,
+	ophistory.CodeUserBanExpire:    EventUserUnbanned,
+
+	ophistory.CodeRoleCreate:       EventRoleUpdated,
+	ophistory.CodeRoleAddPs:        EventRoleUpdated,
+	ophistory.CodeRoleDelPs:        EventRoleUpdated,
+	ophistory.CodeRoleUpdate:       EventRoleUpdated,
+	ophistory.CodeRoleDelete:       EventRoleUpdated,
+	ophistory.CodeRoleAddChildRole: EventRoleUpdated,
+	ophistory.CodeRoleDelChildRole: EventRoleUpdated,
+	ophistory.CodeRoleApproval:     EventRoleUpdated,
+
+	ophistory.CodeUwrAddRoles:       EventUwrChanged,
+	ophistory.CodeUwrDelRoles:       EventUwrChanged,
+	ophistory.CodeUwrExpire:         EventUwrChanged,
+	ophistory.CodeUwrLdapSync:       EventUwrChanged,
+	ophistory.CodeUwrAddManageUsers: EventUwrChanged,
+	ophistory.CodeUwrDelManageUsers: EventUwrChanged,
+	ophistory.CodeUwrAddManageOrgs:  EventUwrChanged,
+	ophistory.CodeUwrDelManageOrgs:  EventUwrChanged,
+}
+
+// 数据变化事件的 data
+type ChangeData struct {
+	Code       string              `json:"code"` // 审计日志的操作类型
+	TargetType string              `json:"targetType"`
+	TargetId   string              `json:"targetId"`
+	ActorId    string              `json:"actorId"` // 操作人
+	ActorName  string              `json:"actorName"`
+	Params     ophistory.Params    `json:"params"`
+	Changes    []*ophistory.Change `json:"changes"`
+	AuditId    string              `json:"auditId"` // 审计日志 id
+}
+
+// 登录事件的 data
+type LoginData struct {
+	UserId    string `json:"userId"`
+	UserName  string `json:"userName"`
+	LoginType string `json:"loginType"`
+	Platform  string `json:"platform"`
+	Ip        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+}
+
+// 审计日志写入后的回调，通过 ophistory.AddRecordHook 注册
+func OnAuditRecord(db *dbandmq.Ds, log *ophistory.OperationHistory) {
+	event, ok := codeEvents[log.Code]
+	if !ok {
+		return
+	}
+
+	data := &ChangeData{
+		Code:       log.Code,
+		TargetType: log.TargetType,
+		TargetId:   log.TargetId,
+		ActorId:    log.UserId,
+		ActorName:  log.UserName,
+		Params:     log.Params,
+		Changes:    log.Changes,
+		AuditId:    log.Id,
+	}
+	_ = Publish(db, tenantapp.NormalizeId(log.TenantId), event, data)
+}
+
+// 登录记录写入后的回调，通过 ophistory.AddLoginHook 注册
+func OnLogin(db *dbandmq.Ds, lh *ophistory.LoginHistory) {
+	data := &LoginData{
+		UserId:    lh.UserId,
+		UserName:  lh.UserName,
+		LoginType: lh.LoginType,
+		Platform:  lh.Platform,
+		Ip:        lh.Ip,
+		UserAgent: lh.UserAgent,
+	}
+	_ = Publish(db, tenantapp.NormalizeId(lh.TenantId), EventUserLogin, data)
+}
@@ -0,0 +1,347 @@
+package webhookapp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/leyle/ginbase/consolelog"
+	"github.com/leyle/ginbase/dbandmq"
+	"github.com/leyle/ginbase/util"
+	"github.com/leyle/userandrole/ophistory"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/url"
+	"strings"
+)
+
+// webhook 订阅，用户和权限数据变化时通知下游系统
+// 事件先写入投递表（outbox），由后台任务投递，失败后按间隔重试
+const CollectionNameWebhook = "webhook"
+
+var IKWebhook = &dbandmq.IndexKey{
+	Collection:    CollectionNameWebhook,
+	SingleKey:     []string{"tenantId", "events", "enable"},
+	CompositeKeys: [][]string{{"tenantId", "events"}},
+}
+
+type Webhook struct {
+	Id          string   `json:"id" bson:"_id"`
+	TenantId    string   `json:"tenantId" bson:"tenantId"`
+	Url         string   `json:"url" bson:"url"`
+	Description string   `json:"description" bson:"description"`
+	Secret      string   `json:"-" bson:"secret"` // 签名密钥，只在新建和重置时返回
+	Events      []string `json:"events" bson:"events"`
+	Enable      bool     `json:"enable" bson:"enable"`
+
+	CreateT *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT *util.CurTime `json:"updateT" bson:"updateT"`
+}
+
+// 投递记录，同时作为待投递的队列和投递日志
+const CollectionNameDelivery = "webhookDelivery"
+
+var IKDelivery = &dbandmq.IndexKey{
+	Collection:    CollectionNameDelivery,
+	SingleKey:     []string{"tenantId", "webhookId", "eventId", "event", "status", "createT.seconds"},
+	CompositeKeys: [][]string{{"status", "nextT"}},
+}
+
+// 投递状态
+const (
+	DeliveryStatusPending = "PENDING" // 等待投递，包括等待重试
+	DeliveryStatusSending = "SENDING" // 投递中
+	DeliveryStatusSuccess = "SUCCESS"
+	DeliveryStatusFailed  = "FAILED" // 重试次数用完或者 webhook 已删除、停用
+)
+
+type Delivery struct {
+	Id        string `json:"id" bson:"_id"`
+	TenantId  string `json:"tenantId" bson:"tenantId"`
+	WebhookId string `json:"webhookId" bson:"webhookId"`
+	EventId   string `json:"eventId" bson:"eventId"` // 同一个事件投递到多个 webhook 时相同
+	Event     string `json:"event" bson:"event"`
+	Url       string `json:"url" bson:"url"`
+	Payload   string `json:"payload" bson:"payload"` // 请求 body
+
+	Status         string `json:"status" bson:"status"`
+	Attempts       int    `json:"attempts" bson:"attempts"`
+	NextT          int64  `json:"nextT" bson:"nextT"` // 下次投递的时间，unix 秒
+	LastStatusCode int    `json:"lastStatusCode" bson:"lastStatusCode"`
+	LastError      string `json:"lastError" bson:"lastError"`
+
+	RedeliverOf string `json:"redeliverOf,omitempty" bson:"redeliverOf,omitempty"` // 手动重新投递时原投递记录的 id
+
+	CreateT    *util.CurTime `json:"createT" bson:"createT"`
+	UpdateT    *util.CurTime `json:"updateT" bson:"updateT"`
+	DeliveredT *util.CurTime `json:"deliveredT,omitempty" bson:"deliveredT,omitempty"`
+}
+
+// 投递的请求 body
+type Payload struct {
+	Id       string      `json:"id"` // 事件 id
+	Event    string      `json:"event"`
+	TenantId string      `json:"tenantId"`
+	T        int64       `json:"t"`
+	Data     interface{} `json:"data"`
+}
+
+var (
+	ErrWebhookNotFound  = errors.New("无指定id的webhook")
+	ErrDeliveryNotFound = errors.New("无指定id的投递记录")
+	ErrWebhookDisabled  = errors.New("webhook已停用")
+)
+
+func checkUrl(u string) (string, error) {
+	u = strings.TrimSpace(u)
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return "", fmt.Errorf("url[%s]格式错误，需要是 http 或 https 地址", u)
+	}
+	if err = checkTarget(pu.Hostname()); err != nil {
+		return "", err
+	}
+	return u, nil
+}
+
+func checkEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return nil, errors.New("events不能为空")
+	}
+	for _, e := range events {
+		if !IsValidEvent(e) {
+			return nil, fmt.Errorf("不支持的事件[%s]", e)
+		}
+	}
+	return util.UniqueStringArray(events), nil
+}
+
+// 生成签名密钥
+func GenerateSecret() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func GetWebhookById(db *dbandmq.Ds, id string) (*Webhook, error) {
+	var w *Webhook
+	err := db.C(CollectionNameWebhook).FindId(id).One(&w)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取webhook失败, %s", id, err.Error())
+		return nil, err
+	}
+	return w, nil
+}
+
+// 新建 webhook，secret 为空时自动生成
+func CreateWebhook(db *dbandmq.Ds, tenantId, u, description, secret string, events []string, opHis *ophistory.OperationHistory) (*Webhook, error) {
+	u, err := checkUrl(u)
+	if err != nil {
+		return nil, err
+	}
+	events, err = checkEvents(events)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		secret = GenerateSecret()
+	}
+
+	w := &Webhook{
+		Id:          util.GenerateDataId(),
+		TenantId:    tenantId,
+		Url:         u,
+		Description: description,
+		Secret:      secret,
+		Events:      events,
+		Enable:      true,
+		CreateT:     util.GetCurTime(),
+	}
+	w.UpdateT = w.CreateT
+
+	err = db.C(CollectionNameWebhook).Insert(w)
+	if err != nil {
+		Logger.Errorf("", "新建webhook[%s]失败, %s", u, err.Error())
+		return nil, err
+	}
+	if opHis != nil {
+		err = ophistory.Record(db, opHis, ophistory.CodeWebhookCreate, ophistory.TargetWebhook, w.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// 修改 webhook 地址、描述、订阅的事件和是否启用
+func UpdateWebhook(db *dbandmq.Ds, w *Webhook, u, description string, events []string, enable bool, opHis *ophistory.OperationHistory) error {
+	u, err := checkUrl(u)
+	if err != nil {
+		return err
+	}
+	events, err = checkEvents(events)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"url":         u,
+			"description": description,
+			"events":      events,
+			"enable":      enable,
+			"updateT":     util.GetCurTime(),
+		},
+	}
+	err = db.C(CollectionNameWebhook).UpdateId(w.Id, update)
+	if err != nil {
+		Logger.Errorf("", "修改webhook[%s]失败, %s", w.Id, err.Error())
+		return err
+	}
+	if opHis != nil {
+		err = ophistory.Record(db, opHis, ophistory.CodeWebhookUpdate, ophistory.TargetWebhook, w.Id)
+	}
+
+	w.Url = u
+	w.Description = description
+	w.Events = events
+	w.Enable = enable
+	return err
+}
+
+// 重置签名密钥
+func ResetWebhookSecret(db *dbandmq.Ds, w *Webhook, opHis *ophistory.OperationHistory) error {
+	secret := GenerateSecret()
+	update := bson.M{
+		"$set": bson.M{
+			"secret":  secret,
+			"updateT": util.GetCurTime(),
+		},
+	}
+	err := db.C(CollectionNameWebhook).UpdateId(w.Id, update)
+	if err != nil {
+		Logger.Errorf("", "重置webhook[%s]密钥失败, %s", w.Id, err.Error())
+		return err
+	}
+	if opHis != nil {
+		err = ophistory.Record(db, opHis, ophistory.CodeWebhookSecret, ophistory.TargetWebhook, w.Id)
+	}
+
+	w.Secret = secret
+	return err
+}
+
+// 删除 webhook，还未投递的记录在投递时标记为失败，投递日志保留
+func DeleteWebhook(db *dbandmq.Ds, w *Webhook, opHis *ophistory.OperationHistory) error {
+	err := db.C(CollectionNameWebhook).RemoveId(w.Id)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "删除webhook[%s]失败, %s", w.Id, err.Error())
+		return err
+	}
+	if opHis != nil {
+		return ophistory.Record(db, opHis, ophistory.CodeWebhookDelete, ophistory.TargetWebhook, w.Id)
+	}
+	return nil
+}
+
+func GetDeliveryById(db *dbandmq.Ds, id string) (*Delivery, error) {
+	var d *Delivery
+	err := db.C(CollectionNameDelivery).FindId(id).One(&d)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Errorf("", "根据id[%s]读取webhook投递记录失败, %s", id, err.Error())
+		return nil, err
+	}
+	return d, nil
+}
+
+// 把事件写入订阅了该事件的 webhook 的投递队列
+func Publish(db *dbandmq.Ds, tenantId, event string, data interface{}) error {
+	f := bson.M{
+		"tenantId": tenantId,
+		"events":   event,
+		"enable":   true,
+	}
+	var ws []*Webhook
+	err := db.C(CollectionNameWebhook).Find(f).All(&ws)
+	if err != nil {
+		Logger.Errorf("", "读取订阅了事件[%s]的webhook失败, %s", event, err.Error())
+		return err
+	}
+	if len(ws) == 0 {
+		return nil
+	}
+
+	curT := util.GetCurTime()
+	payload := &Payload{
+		Id:       util.GenerateDataId(),
+		Event:    event,
+		TenantId: tenantId,
+		T:        curT.Seconds,
+		Data:     data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		Logger.Errorf("", "生成事件[%s]的webhook数据失败, %s", event, err.Error())
+		return err
+	}
+
+	for _, w := range ws {
+		d := &Delivery{
+			Id:        util.GenerateDataId(),
+			TenantId:  tenantId,
+			WebhookId: w.Id,
+			EventId:   payload.Id,
+			Event:     event,
+			Url:       w.Url,
+			Payload:   string(body),
+			Status:    DeliveryStatusPending,
+			NextT:     curT.Seconds,
+			CreateT:   curT,
+			UpdateT:   curT,
+		}
+		err = db.C(CollectionNameDelivery).Insert(d)
+		if err != nil {
+			Logger.Errorf("", "保存事件[%s]到webhook[%s]的投递记录失败, %s", event, w.Id, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// 手动重新投递，复制原记录的内容生成新的投递记录，原记录保留
+func Redeliver(db *dbandmq.Ds, d *Delivery) (*Delivery, error) {
+	w, err := GetWebhookById(db, d.WebhookId)
+	if err != nil {
+		return nil, err
+	}
+	if w == nil {
+		return nil, ErrWebhookNotFound
+	}
+	if !w.Enable {
+		return nil, ErrWebhookDisabled
+	}
+
+	curT := util.GetCurTime()
+	nd := &Delivery{
+		Id:          util.GenerateDataId(),
+		TenantId:    d.TenantId,
+		WebhookId:   d.WebhookId,
+		EventId:     d.EventId,
+		Event:       d.Event,
+		Url:         w.Url,
+		Payload:     d.Payload,
+		Status:      DeliveryStatusPending,
+		NextT:       curT.Seconds,
+		RedeliverOf: d.Id,
+		CreateT:     curT,
+		UpdateT:     curT,
+	}
+	err = db.C(CollectionNameDelivery).Insert(nd)
+	if err != nil {
+		Logger.Errorf("", "重新投递[%s]失败, %s", d.Id, err.Error())
+		return nil, err
+	}
+	return nd, nil
+}
@@ -0,0 +1,154 @@
+package webhookapp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 租户管理员可以配置 webhook，投递时由服务端发起请求
+// 不限制地址时可以用来探测内网的服务，比如 mongodb、redis、云主机的元数据接口
+// 默认拒绝本机、内网、链路本地等地址，需要投递到内网时在配置文件的 webhook.allowtargets 中指定
+var blockedNets = parseCIDRs(
+	"0.0.0.0/8",      // 本网络
+	"10.0.0.0/8",     // 内网
+	"100.64.0.0/10",  // 运营商级 NAT
+	"127.0.0.0/8",    // 本机
+	"169.254.0.0/16", // 链路本地，包括云主机元数据接口
+	"172.16.0.0/12",  // 内网
+	"192.0.0.0/24",   // 保留
+	"192.168.0.0/16", // 内网
+	"198.18.0.0/15",  // 性能测试
+	"224.0.0.0/4",    // 组播
+	"240.0.0.0/4",    // 保留和广播
+	"::/128",         // 未指定
+	"::1/128",        // 本机
+	"fc00::/7",       // 内网
+	"fe80::/10",      // 链路本地
+	"ff00::/8",       // 组播
+)
+
+// 允许的内网地址，ip 网段或者域名
+var (
+	allowNets  []*net.IPNet
+	allowHosts = make(map[string]bool)
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var ret []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// 设置允许投递的内网地址，启动时调用
+// 每一项可以是 ip、ip 网段（比如 10.0.1.0/24）或者域名
+func SetAllowTargets(targets []string) error {
+	nets := []*net.IPNet{}
+	hosts := make(map[string]bool)
+	for _, t := range targets {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if strings.Contains(t, "/") {
+			_, n, err := net.ParseCIDR(t)
+			if err != nil {
+				return fmt.Errorf("webhook.allowtargets 中的网段[%s]错误", t)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		if ip := net.ParseIP(t); ip != nil {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		hosts[t] = true
+	}
+	allowNets = nets
+	allowHosts = hosts
+	return nil
+}
+
+func isBlockedIP(ip net.IP) bool {
+	for _, n := range allowNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查 webhook 地址的域名解析到的所有 ip，任意一个是内网地址都拒绝
+func checkTarget(host string) error {
+	host = strings.ToLower(host)
+	if allowHosts[host] {
+		return nil
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return fmt.Errorf("无法解析域名[%s]", host)
+		}
+	}
+	for _, ip := range ips {
+		if isBlockedIP(ip) {
+			return fmt.Errorf("不能投递到内网地址[%s]", host)
+		}
+	}
+	return nil
+}
+
+// 投递时在建立连接前检查实际连接的 ip，避免保存后域名解析改为内网地址
+// 不使用环境变量中的代理，否则只能检查代理的地址
+func newDeliveryClient() *http.Client {
+	dialer := &net.Dialer{Timeout: DeliveryTimeout}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if allowHosts[strings.ToLower(host)] {
+				return dialer.DialContext(ctx, network, addr)
+			}
+
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				if isBlockedIP(ip.IP) {
+					return nil, fmt.Errorf("不能投递到内网地址[%s]", host)
+				}
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+		},
+		TLSHandshakeTimeout:   DeliveryTimeout,
+		ResponseHeaderTimeout: DeliveryTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	// 重定向的地址也经过上面的检查
+	return &http.Client{
+		Timeout:   DeliveryTimeout,
+		Transport: transport,
+	}
+}
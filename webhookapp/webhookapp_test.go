@@ -0,0 +1,127 @@
+package webhookapp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	secret := "s3cret"
+	var gotBody []byte
+	var gotHeader http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = ioutil.ReadAll(r.Body)
+		gotHeader = r.Header
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d := &Delivery{
+		Id:      "d1",
+		Event:   EventUserBanned,
+		Payload: `{"id":"e1","event":"user.banned"}`,
+	}
+
+	code, err := send(srv.Client(), srv.URL+"/ok", secret, d)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("send = %d, %v, want 204", code, err)
+	}
+	if string(gotBody) != d.Payload {
+		t.Errorf("body = %s, want %s", gotBody, d.Payload)
+	}
+	if gotHeader.Get(HeaderEvent) != EventUserBanned || gotHeader.Get(HeaderDelivery) != "d1" {
+		t.Errorf("headers = %v", gotHeader)
+	}
+
+	// 接收方校验签名
+	ts, err := strconv.ParseInt(gotHeader.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotHeader.Get(HeaderSignature) != Sign(secret, ts, gotBody) {
+		t.Errorf("signature mismatch")
+	}
+	if gotHeader.Get(HeaderSignature) == Sign("other", ts, gotBody) {
+		t.Errorf("signature matched with wrong secret")
+	}
+
+	code, err = send(srv.Client(), srv.URL+"/fail", secret, d)
+	if err == nil || code != http.StatusInternalServerError {
+		t.Errorf("send to /fail = %d, %v, want 500 and error", code, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tc := range cases {
+		if got := RetryBackoff(tc.attempts); got != tc.backoff {
+			t.Errorf("RetryBackoff(%d) = %v, want %v", tc.attempts, got, tc.backoff)
+		}
+	}
+}
+
+func TestCheckEvents(t *testing.T) {
+	events, err := checkEvents([]string{EventUserLogin, EventUserLogin})
+	if err != nil || len(events) != 1 {
+		t.Errorf("checkEvents = %v, %v", events, err)
+	}
+	if _, err = checkEvents([]string{"user.deleted"}); err == nil {
+		t.Errorf("checkEvents accepted unknown event")
+	}
+	if _, err = checkEvents(nil); err == nil {
+		t.Errorf("checkEvents accepted empty events")
+	}
+	if _, err = checkUrl("ftp://example.com"); err == nil {
+		t.Errorf("checkUrl accepted ftp url")
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	defer SetAllowTargets(nil)
+
+	for _, host := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "::1", "fd00::1", "localhost"} {
+		if err := checkTarget(host); err == nil {
+			t.Errorf("checkTarget(%s) = nil, want error", host)
+		}
+	}
+	if err := checkTarget("8.8.8.8"); err != nil {
+		t.Errorf("checkTarget(8.8.8.8) = %v", err)
+	}
+	if _, err := checkUrl("http://127.0.0.1:27017/"); err == nil {
+		t.Error("checkUrl allows loopback")
+	}
+
+	if err := SetAllowTargets([]string{"10.1.0.0/16", "hooks.internal"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTarget("10.1.2.3"); err != nil {
+		t.Errorf("checkTarget(10.1.2.3) = %v", err)
+	}
+	if err := checkTarget("hooks.internal"); err != nil {
+		t.Errorf("checkTarget(hooks.internal) = %v", err)
+	}
+	if err := checkTarget("10.2.0.1"); err == nil {
+		t.Error("checkTarget(10.2.0.1) = nil, want error")
+	}
+	if err := SetAllowTargets([]string{"10.0.0.0/99"}); err == nil {
+		t.Error("SetAllowTargets accepts invalid cidr")
+	}
+}